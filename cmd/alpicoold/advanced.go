@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+// Custom HomeKit types for the keypad-only settings. Apps like Eve and
+// Controller for HomeKit show and edit characteristics they don't know.
+const (
+	TypeFridgeAdvanced = "A1C00000-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeHysteresis     = "A1C000E3-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeSoftStartDelay = "A1C000E4-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeTempCompHigh   = "A1C000E6-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeTempCompMid    = "A1C000E7-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeTempCompLow    = "A1C000E8-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeTempCompOff    = "A1C000E9-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeVoltageCutoff  = "A1C000C0-4B25-4C0D-9E6F-0A1C00D0E500"
+)
+
+// advancedField is one keypad setting. Temperature offsets are in the
+// fridge's unit, so their range depends on E5.
+type advancedField struct {
+	typ         string
+	description string
+	field       func(*k25.Settings) *int8
+	minC, maxC  int
+	minF, maxF  int
+}
+
+var advancedFields = []advancedField{
+	{TypeHysteresis, "E3 hysteresis", func(s *k25.Settings) *int8 { return &s.HysteresisMenuE3 }, 1, 10, 1, 18},
+	{TypeSoftStartDelay, "E4 soft start delay (min)", func(s *k25.Settings) *int8 { return &s.SoftStartDelayMinMenuE4 }, 0, 10, 0, 10},
+	{TypeTempCompHigh, "E6 temp comp. >= -6C", func(s *k25.Settings) *int8 { return &s.TempCompGTEMinus6DegCelsiusMenuE6 }, -10, 10, -18, 18},
+	{TypeTempCompMid, "E7 temp comp. -12C to -6C", func(s *k25.Settings) *int8 { return &s.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7 }, -10, 10, -18, 18},
+	{TypeTempCompLow, "E8 temp comp. < -12C", func(s *k25.Settings) *int8 { return &s.TempCompLTMinus12DegCelsiusMenuE8 }, -10, 10, -18, 18},
+	{TypeTempCompOff, "E9 shutdown temp comp.", func(s *k25.Settings) *int8 { return &s.TempCompShutdownMenuE9 }, -10, 10, -18, 18},
+	{TypeVoltageCutoff, "Battery cutoff (0=H 1=M 2=L)", func(s *k25.Settings) *int8 { return &s.HLvl }, 0, 2, 0, 2},
+}
+
+// bounds is the field's range for the fridge's current unit
+func (a advancedField) bounds(s k25.Settings) (int, int) {
+	if s.CelsiusFahrenheitModeMenuE5 {
+		return a.minF, a.maxF
+	}
+	return a.minC, a.maxC
+}
+
+// apply sets the field to v if it's in range
+func (a advancedField) apply(s k25.Settings, v int) (k25.Settings, error) {
+	min, max := a.bounds(s)
+	if v < min || v > max {
+		return s, fmt.Errorf("%s must be %d..%d, got %d", a.description, min, max, v)
+	}
+	*a.field(&s) = int8(v)
+	return s, nil
+}
+
+// hkAdvanced is the "Fridge Advanced" service
+type hkAdvanced struct {
+	*service.Service
+	values []*characteristic.Int
+	unitF  *bool // unit the bounds were last set for
+}
+
+// newHKAdvanced makes the service, writes go through the shared settings path
+// and are held until the fridge reports them
+func newHKAdvanced(fridge *Fridge, holds *hkHolds) *hkAdvanced {
+	a := &hkAdvanced{Service: service.New(TypeFridgeAdvanced)}
+
+	n := characteristic.NewName()
+	n.SetValue("Fridge Advanced")
+	a.AddCharacteristic(n.Characteristic)
+
+	for _, field := range advancedFields {
+		field := field
+		c := characteristic.NewInt(field.typ)
+		c.Format = characteristic.FormatInt32
+		c.Perms = characteristic.PermsAll()
+		c.Description = field.description
+		c.SetMinValue(field.minC)
+		c.SetMaxValue(field.maxC)
+		c.SetStepValue(1)
+		c.SetValue(field.minC)
+		c.OnValueRemoteUpdate(func(v int) {
+			holds.Hold(field.typ, v)
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			defer cancel()
+			var applyErr error
+			_, err := fridge.UpdateSettings(ctx, Command{Source: sourceHomeKit}, func(s *k25.Settings) {
+				var next k25.Settings
+				if next, applyErr = field.apply(*s, v); applyErr == nil {
+					*s = next
+				}
+			})
+			if applyErr != nil {
+				err = applyErr
+			}
+			if err != nil {
+				holds.Reject(field.typ)
+				log.WithFields(log.Fields{
+					"client":  "HKClient",
+					"setting": field.description,
+					"value":   v,
+					"err":     err,
+				}).Warn("Rejected advanced setting")
+			}
+		})
+		a.AddCharacteristic(c.Characteristic)
+		a.values = append(a.values, c)
+	}
+	return a
+}
+
+// set shows the fridge's settings, adjusting ranges when E5 changes
+func (a *hkAdvanced) set(s k25.Settings, p *hkPusher) {
+	unitF := s.CelsiusFahrenheitModeMenuE5
+	resize := a.unitF == nil || *a.unitF != unitF
+	for i, field := range advancedFields {
+		c := a.values[i]
+		if resize {
+			min, max := field.bounds(s)
+			c.SetMinValue(min)
+			c.SetMaxValue(max)
+		}
+		p.Int(field.typ, int(*field.field(&s)), c)
+	}
+	a.unitF = &unitF
+}
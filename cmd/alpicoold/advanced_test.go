@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdvancedFields(t *testing.T) {
+	f := testStatusReport.Settings
+	hysteresis := advancedFields[0]
+	if min, max := hysteresis.bounds(f); min != 1 || max != 18 {
+		t.Fatalf("Bad fahrenheit bounds %d..%d", min, max)
+	}
+	s, err := hysteresis.apply(f, 6)
+	if err != nil || s.HysteresisMenuE3 != 6 {
+		t.Fatalf("Bad apply %+v %v", s, err)
+	}
+	if _, err := hysteresis.apply(f, 0); err == nil {
+		t.Fatal("Expected 0 hysteresis to be rejected")
+	}
+
+	c, _ := convertSettingsUnit(f, false)
+	if _, err := hysteresis.apply(c, 12); err == nil {
+		t.Fatal("Expected 12C hysteresis to be rejected")
+	}
+	cutoff := advancedFields[len(advancedFields)-1]
+	if _, err := cutoff.apply(f, 3); err == nil {
+		t.Fatal("Expected cutoff 3 to be rejected")
+	}
+}
+
+func TestHKAdvanced(t *testing.T) {
+	fridge := newTestFridge(testStatusReport)
+	holds := newHKHolds()
+	push := newHKPusher(holds)
+	a := newHKAdvanced(fridge, holds)
+	a.set(testStatusReport.Settings, push)
+	hysteresis := a.values[0]
+	if hysteresis.GetValue() != 4 || hysteresis.GetMaxValue() != 18 {
+		t.Fatalf("Bad hysteresis %v max %v", hysteresis.GetValue(), hysteresis.GetMaxValue())
+	}
+
+	// A write from a controller goes out as a settings command
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	go hysteresis.UpdateValueFromConnection(7, conn)
+
+	// The write is held before it goes out, so a report in the meantime
+	// doesn't bounce it back
+	deadline := time.Now().Add(5 * time.Second)
+	for _, ok := holds.next(); !ok; _, ok = holds.next() {
+		if time.Now().After(deadline) {
+			t.Fatal("Write was never held")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a.set(testStatusReport.Settings, push)
+	if hysteresis.GetValue() != 7 {
+		t.Fatalf("Held value bounced back to %v", hysteresis.GetValue())
+	}
+	select {
+	case s := <-fridge.settingsC:
+		if s.HysteresisMenuE3 != 7 || s.TempSet != testStatusReport.TempSet {
+			t.Fatalf("Bad settings sent %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No settings command")
+	}
+
+	// Until the fridge reports it
+	acked := testStatusReport.Settings
+	acked.HysteresisMenuE3 = 7
+	a.set(acked, push)
+	if _, ok := holds.next(); ok {
+		t.Fatal("Hold survived the acknowledgement")
+	}
+
+	// Switching to celsius narrows the offsets
+	c, _ := convertSettingsUnit(acked, false)
+	a.set(c, push)
+	if hysteresis.GetValue() != 4 || hysteresis.GetMaxValue() != 10 {
+		t.Fatalf("Bad celsius hysteresis %v max %v", hysteresis.GetValue(), hysteresis.GetMaxValue())
+	}
+}
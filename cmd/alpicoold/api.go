@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	_ "embed" // openapi.json
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed openapi.json
+var openAPIDoc []byte
+
+// commandTimeout bounds how long a request waits for the bluetooth writer
+var commandTimeout = 5 * time.Second
+
+// apiError is the body of every non 2xx API response
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.WithFields(log.Fields{"client": "JSONClient"}).Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeTypeJSON)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	log.WithFields(log.Fields{
+		"client": "JSONClient",
+		"status": status,
+	}).Debug(err)
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// writeCommandError maps command path failures to status codes
+func writeCommandError(w http.ResponseWriter, err error) {
+	var conflict *ConflictError
+	switch {
+	case errors.Is(err, errQueued):
+		writeJSON(w, http.StatusAccepted, apiError{Error: err.Error()})
+	case errors.As(err, &conflict):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errNoStatus):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, errors.New("Timed out waiting for the bluetooth writer, is the fridge connected?"))
+	case errors.Is(err, context.Canceled):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusUnprocessableEntity, err)
+	}
+}
+
+// methods rejects anything but the allowed methods
+func methods(h http.HandlerFunc, allowed ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range allowed {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+	}
+}
+
+// decodeBody strictly decodes a JSON request body
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("Bad request body: %s", err)
+	}
+	if d.More() {
+		return errors.New("Bad request body: trailing data after JSON object")
+	}
+	return nil
+}
+
+// requireStatus writes a 503 and returns false until the fridge has reported in
+func requireStatus(w http.ResponseWriter, f *Fridge) (k25.StatusReport, bool) {
+	s := f.GetStatusReport()
+	if s.Settings == initialFridgeSettings {
+		writeError(w, http.StatusServiceUnavailable, errNoStatus)
+		return s, false
+	}
+	return s, true
+}
+
+// applySettingsPatch overlays a partial JSON object of Settings fields
+func applySettingsPatch(current k25.Settings, patch map[string]json.RawMessage) (k25.Settings, error) {
+	if len(patch) == 0 {
+		return current, errors.New("Empty settings patch")
+	}
+	b, err := json.Marshal(current)
+	if err != nil {
+		return current, err
+	}
+	merged := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &merged); err != nil {
+		return current, err
+	}
+	for k, v := range patch {
+		if _, ok := merged[k]; !ok {
+			return current, fmt.Errorf("Unknown setting %q", k)
+		}
+		merged[k] = v
+	}
+	b, err = json.Marshal(merged)
+	if err != nil {
+		return current, err
+	}
+	var next k25.Settings
+	if err := json.Unmarshal(b, &next); err != nil {
+		return current, fmt.Errorf("Bad settings value: %s", err)
+	}
+	return next, nil
+}
+
+func handleSettings(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := requireStatus(w, f)
+		if !ok {
+			return
+		}
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, s.Settings)
+			return
+		}
+
+		cmd, err := httpCommand(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		patch := map[string]json.RawMessage{}
+		if err := decodeBody(w, r, &patch); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		next, err := applySettingsPatch(s.Settings, patch)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+		defer cancel()
+		sent, err := f.UpdateSettings(ctx, cmd, func(s *k25.Settings) { *s = next })
+		if err != nil {
+			writeCommandError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, sent)
+	}
+}
+
+// temperatureRequest is a setpoint with an explicit unit, C or F
+type temperatureRequest struct {
+	Value *float64 `json:"value"`
+	Unit  string   `json:"unit"`
+}
+
+// temperatureResponse echoes the setpoint as it'll be sent to the fridge
+type temperatureResponse struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// errTempRange means a setpoint is outside the fridge's E1..E2 limits
+var errTempRange = errors.New("Temperature out of range")
+
+// resolveTemp converts a setpoint in unit, C or F, to the fridge's units and
+// checks it against the limits. It returns the rounded value in fridge units
+// and the celsius value the bluetooth writer wants.
+func resolveTemp(s k25.Settings, value float64, unit string) (float64, float64, error) {
+	unit = strings.ToUpper(unit)
+	if unit != "C" && unit != "F" {
+		return 0, 0, errors.New(`Unit must be "C" or "F"`)
+	}
+	fridgeU := fridgeUnit(s)
+	v := value
+	if unit != fridgeU {
+		if fridgeU == "F" {
+			v = CtoF(v)
+		} else {
+			v = FtoC(v)
+		}
+	}
+	v = math.Round(v)
+	if v < float64(s.LowestTempSettingMenuE1) || v > float64(s.HighestTempSettingMenuE2) {
+		return 0, 0, fmt.Errorf("%w: %v%s is outside %d..%d%s", errTempRange,
+			value, unit, s.LowestTempSettingMenuE1, s.HighestTempSettingMenuE2, fridgeU)
+	}
+	celsius := v
+	if fridgeU == "F" {
+		celsius = FtoC(v)
+	}
+	return v, celsius, nil
+}
+
+func handleTemperature(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := requireStatus(w, f)
+		if !ok {
+			return
+		}
+		cmd, err := httpCommand(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var req temperatureRequest
+		if err := decodeBody(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Value == nil {
+			writeError(w, http.StatusBadRequest, errors.New("Missing value"))
+			return
+		}
+		v, celsius, err := resolveTemp(s.Settings, *req.Value, req.Unit)
+		if errors.Is(err, errTempRange) {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+		defer cancel()
+		if err := f.SendTemp(ctx, cmd, celsius); err != nil {
+			writeCommandError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, temperatureResponse{Value: v, Unit: fridgeUnit(s.Settings)})
+	}
+}
+
+// toggleRequest turns something on or off
+type toggleRequest struct {
+	Value *bool `json:"value"`
+}
+
+// handleToggle sets one boolean setting
+func handleToggle(f *Fridge, set func(*k25.Settings, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cmd, err := httpCommand(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var req toggleRequest
+		if err := decodeBody(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Value == nil {
+			writeError(w, http.StatusBadRequest, errors.New("Missing value"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+		defer cancel()
+		s, err := f.UpdateSettings(ctx, cmd, func(s *k25.Settings) { set(s, *req.Value) })
+		if err != nil {
+			writeCommandError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, s)
+	}
+}
+
+// sensorsResponse is the read only side of the status report
+type sensorsResponse struct {
+	k25.Sensors
+	InputVoltage float64         `json:"InputVoltage"`
+	Unit         string          `json:"Unit"`
+	Compressor   CompressorState `json:"Compressor"`
+	Lid          *LidState       `json:"Lid,omitempty"` // nil with lid detection off
+	Freshness
+}
+
+func handleSensors(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := requireStatus(w, f)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, sensorsResponse{
+			Sensors:      s.Sensors,
+			InputVoltage: inputVoltage(s.Sensors),
+			Unit:         fridgeUnit(s.Settings),
+			Compressor:   f.compressor.State(false),
+			Lid:          f.lid.State(),
+			Freshness:    f.Freshness(),
+		})
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(contentType, mimeTypeJSON)
+	w.Write(openAPIDoc)
+}
+
+// registerAPI adds the REST resources to mux
+func registerAPI(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/settings", methods(handleSettings(f), http.MethodGet, http.MethodPatch))
+	mux.HandleFunc("/temperature", methods(handleTemperature(f), http.MethodPut))
+	mux.HandleFunc("/power", methods(handleToggle(f, func(s *k25.Settings, v bool) { s.On = v }), http.MethodPost))
+	mux.HandleFunc("/eco", methods(handleToggle(f, func(s *k25.Settings, v bool) { s.EcoMode = v }), http.MethodPost))
+	mux.HandleFunc("/lock", methods(handleToggle(f, func(s *k25.Settings, v bool) { s.Locked = v }), http.MethodPost))
+	mux.HandleFunc("/sensors", methods(handleSensors(f), http.MethodGet))
+	mux.HandleFunc("/openapi.json", methods(handleOpenAPI, http.MethodGet))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+func newTestAPI(f *Fridge) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleGet(f))
+	registerAPI(mux, f)
+	return httptest.NewServer(mux)
+}
+
+func doRequest(t *testing.T, method, url, body string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	out := map[string]interface{}{}
+	json.NewDecoder(res.Body).Decode(&out)
+	return res, out
+}
+
+func TestAPI(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	srv := newTestAPI(f)
+	defer srv.Close()
+	setCommandTimeout(t, 200*time.Millisecond)
+
+	sent := standInWriter(t, f, false)
+
+	t.Run("GET /sensors", func(t *testing.T) {
+		res, body := doRequest(t, http.MethodGet, srv.URL+"/sensors", "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Bad status %d", res.StatusCode)
+		}
+		if body["InputVoltage"] != 12.8 || body["Temp"] != float64(39) {
+			t.Fatalf("Bad body %v", body)
+		}
+	})
+
+	t.Run("PATCH /settings", func(t *testing.T) {
+		res, body := doRequest(t, http.MethodPatch, srv.URL+"/settings", `{"EcoMode": false, "TempSet": 40}`)
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("Bad status %d %v", res.StatusCode, body)
+		}
+		s := <-sent
+		if s.EcoMode || s.TempSet != 40 || !s.On {
+			t.Fatalf("Bad settings sent %+v", s)
+		}
+	})
+
+	t.Run("PATCH /settings unit", func(t *testing.T) {
+		// Temperatures move with E5 unless the patch sets them in the new unit
+		for body, set := range map[string]int8{
+			`{"CelsiusFahrenheitModeMenuE5": false}`:               3,
+			`{"CelsiusFahrenheitModeMenuE5": false, "TempSet": 5}`: 5,
+		} {
+			res, out := doRequest(t, http.MethodPatch, srv.URL+"/settings", body)
+			if res.StatusCode != http.StatusAccepted {
+				t.Fatalf("%s: bad status %d %v", body, res.StatusCode, out)
+			}
+			s := <-sent
+			if s.CelsiusFahrenheitModeMenuE5 || s.TempSet != set || s.LowestTempSettingMenuE1 != -20 || s.HighestTempSettingMenuE2 != 20 || s.HysteresisMenuE3 != 2 {
+				t.Fatalf("%s: expected celsius settings, got %+v", body, s)
+			}
+		}
+	})
+
+	t.Run("PATCH /settings validation", func(t *testing.T) {
+		for body, status := range map[string]int{
+			`{"Defrost": true}`:   http.StatusBadRequest,
+			`{"TempSet": "cold"}`: http.StatusBadRequest,
+			`{}`:                  http.StatusBadRequest,
+			`{"TempSet": 99}`:     http.StatusUnprocessableEntity,
+			`{"HLvl": 3}`:         http.StatusUnprocessableEntity,
+			`not json`:            http.StatusBadRequest,
+			`{"TempSet": 40} {}`:  http.StatusBadRequest,
+			`{"TempSet": 41}`:     http.StatusAccepted,
+		} {
+			res, out := doRequest(t, http.MethodPatch, srv.URL+"/settings", body)
+			if res.StatusCode != status {
+				t.Fatalf("%s: expected %d, got %d %v", body, status, res.StatusCode, out)
+			}
+			if status == http.StatusAccepted {
+				<-sent
+			} else if out["error"] == "" {
+				t.Fatalf("%s: missing error message", body)
+			}
+		}
+	})
+
+	t.Run("PUT /temperature", func(t *testing.T) {
+		res, body := doRequest(t, http.MethodPut, srv.URL+"/temperature", `{"value": 4, "unit": "C"}`)
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("Bad status %d %v", res.StatusCode, body)
+		}
+		// 4C is 39.2F, rounded to the fridge's whole degrees
+		if body["value"] != float64(39) || body["unit"] != "F" {
+			t.Fatalf("Bad body %v", body)
+		}
+		if s := <-sent; s.TempSet != 39 {
+			t.Fatalf("Bad setting %+v", s)
+		}
+
+		for body, status := range map[string]int{
+			`{"value": 40}`:              http.StatusBadRequest,
+			`{"unit": "F"}`:              http.StatusBadRequest,
+			`{"value": 40, "unit": "K"}`: http.StatusBadRequest,
+			`{"value": 90, "unit": "F"}`: http.StatusUnprocessableEntity,
+		} {
+			res, out := doRequest(t, http.MethodPut, srv.URL+"/temperature", body)
+			if res.StatusCode != status {
+				t.Fatalf("%s: expected %d, got %d %v", body, status, res.StatusCode, out)
+			}
+		}
+	})
+
+	t.Run("POST /lock", func(t *testing.T) {
+		res, _ := doRequest(t, http.MethodPost, srv.URL+"/lock", `{"value": true}`)
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("Bad status %d", res.StatusCode)
+		}
+		if s := <-sent; !s.Locked {
+			t.Fatal("Expected lock")
+		}
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		res, _ := doRequest(t, http.MethodDelete, srv.URL+"/power", "")
+		if res.StatusCode != http.StatusMethodNotAllowed || res.Header.Get("Allow") != "POST" {
+			t.Fatalf("Bad status %d %q", res.StatusCode, res.Header.Get("Allow"))
+		}
+	})
+
+	t.Run("openapi", func(t *testing.T) {
+		res, body := doRequest(t, http.MethodGet, srv.URL+"/openapi.json", "")
+		if res.StatusCode != http.StatusOK || body["openapi"] == nil {
+			t.Fatalf("Bad openapi doc %d", res.StatusCode)
+		}
+	})
+}
+
+func TestAPIWithoutFridge(t *testing.T) {
+	setCommandTimeout(t, 50*time.Millisecond)
+
+	t.Run("no status yet", func(t *testing.T) {
+		srv := newTestAPI(newTestFridge(k25.StatusReport{}))
+		defer srv.Close()
+		res, _ := doRequest(t, http.MethodPost, srv.URL+"/power", `{"value": true}`)
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Bad status %d", res.StatusCode)
+		}
+	})
+
+	t.Run("writer not listening", func(t *testing.T) {
+		srv := newTestAPI(newTestFridge(testStatusReport))
+		defer srv.Close()
+		res, _ := doRequest(t, http.MethodPost, srv.URL+"/power", `{"value": false}`)
+		if res.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("Bad status %d", res.StatusCode)
+		}
+	})
+}
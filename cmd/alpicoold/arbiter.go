@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+// CommandPriority orders sources when they want different settings
+type CommandPriority int
+
+// Priorities, each beats the ones before it
+const (
+	priorityKeepAlive CommandPriority = iota // CycleCompressor keeping power banks awake
+	prioritySchedule                         // Rules and timers
+	priorityManual                           // People, through HomeKit, HTTP, gRPC or MQTT
+	prioritySafety                           // Protecting the food or the battery
+)
+
+func (p CommandPriority) String() string {
+	switch p {
+	case priorityKeepAlive:
+		return "keep-alive"
+	case prioritySchedule:
+		return "schedule"
+	case priorityManual:
+		return "manual"
+	case prioritySafety:
+		return "safety"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// MarshalText lets priorities show by name in JSON
+func (p CommandPriority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText reads priorities by name
+func (p *CommandPriority) UnmarshalText(b []byte) error {
+	parsed, err := parsePriority(string(b))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+func parsePriority(s string) (CommandPriority, error) {
+	for p := priorityKeepAlive; p <= prioritySafety; p++ {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown priority %q, want safety, manual, schedule or keep-alive", s)
+}
+
+// Source says who asked for a change
+type Source struct {
+	Name     string          `json:"name"`
+	Priority CommandPriority `json:"priority"`
+}
+
+var (
+	sourceHomeKit   = Source{Name: "homekit", Priority: priorityManual}
+	sourceHTTP      = Source{Name: "http", Priority: priorityManual}
+	sourceGRPC      = Source{Name: "grpc", Priority: priorityManual}
+	sourceMQTT      = Source{Name: "mqtt", Priority: priorityManual}
+	sourceKeepAlive = Source{Name: "cycle-compressor", Priority: priorityKeepAlive}
+)
+
+// noHold asks for a change that doesn't keep lower priorities off afterwards
+const noHold = time.Duration(-1)
+
+// Command tags a settings change with where it came from
+type Command struct {
+	Source Source
+	User   string        // who within the source, e.g. a login or client address
+	Hold   time.Duration // how long lower priorities are kept off, 0 uses the priority's default
+	Queue  bool          // wait out conflicting holds instead of failing
+}
+
+func (c Command) String() string {
+	return c.Source.Name + " (" + c.Source.Priority.String() + ")"
+}
+
+var (
+	// arbiterQueueTTL drops queued commands nobody has been able to apply
+	arbiterQueueTTL = 6 * time.Hour
+
+	errQueued = errors.New("Queued until a higher priority hold ends")
+)
+
+// ConflictError says a held setting turned a command away
+type ConflictError struct {
+	Field string
+	Owner SettingOwner
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s is held by %s (%s) until %s", e.Field, e.Owner.Source.Name, e.Owner.Source.Priority, e.Owner.Until.Format(time.RFC3339))
+}
+
+// SettingOwner is the source that last changed a setting
+type SettingOwner struct {
+	Source Source    `json:"source"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"` // lower priorities are turned away until then
+}
+
+// holds reports whether o still keeps lower priorities off at now
+func (o SettingOwner) holds(now time.Time) bool {
+	return now.Before(o.Until)
+}
+
+// queuedCommand waits for a hold to end
+type queuedCommand struct {
+	cmd    Command
+	fields []string
+	at     time.Time
+	run    func(ctx context.Context) error
+}
+
+// QueuedCommand describes a waiting command for the API
+type QueuedCommand struct {
+	Source Source    `json:"source"`
+	Fields []string  `json:"fields"`
+	Queued time.Time `json:"queued"`
+}
+
+// Arbiter decides which source gets to change each setting. A nil Arbiter
+// lets everything through.
+type Arbiter struct {
+	mu     sync.Mutex
+	holds  map[CommandPriority]time.Duration // default hold per priority
+	owners map[string]SettingOwner
+	queue  []*queuedCommand
+	wake   chan struct{}
+	now    func() time.Time
+}
+
+func newArbiter(holds map[CommandPriority]time.Duration) *Arbiter {
+	return &Arbiter{
+		holds:  holds,
+		owners: map[string]SettingOwner{},
+		wake:   make(chan struct{}, 1),
+		now:    time.Now,
+	}
+}
+
+// changedSettings names the Settings fields that differ
+func changedSettings(before, after k25.Settings) []string {
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	out := []string{}
+	for i := 0; i < b.NumField(); i++ {
+		if b.Field(i).Interface() != a.Field(i).Interface() {
+			out = append(out, b.Type().Field(i).Name)
+		}
+	}
+	return out
+}
+
+// conflict finds a field held by a higher priority than cmd
+func (a *Arbiter) conflict(cmd Command, fields []string, now time.Time) error {
+	for _, field := range fields {
+		owner, ok := a.owners[field]
+		if ok && owner.holds(now) && owner.Source.Priority > cmd.Source.Priority {
+			return &ConflictError{Field: field, Owner: owner}
+		}
+	}
+	return nil
+}
+
+// Check says whether cmd could change fields right now, without claiming them
+func (a *Arbiter) Check(cmd Command, fields []string) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conflict(cmd, fields, a.now())
+}
+
+// admit claims fields for cmd, or queues retry when cmd asks to wait. The
+// returned release undoes the claim if the command never reaches the fridge.
+func (a *Arbiter) admit(cmd Command, fields []string, retry func(ctx context.Context) error) (func(), error) {
+	if a == nil || len(fields) == 0 {
+		return func() {}, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if err := a.conflict(cmd, fields, now); err != nil {
+		if !cmd.Queue {
+			return nil, err
+		}
+		// The newest request from a source replaces its older one
+		for i, q := range a.queue {
+			if q.cmd.Source == cmd.Source {
+				a.queue = append(a.queue[:i], a.queue[i+1:]...)
+				break
+			}
+		}
+		cmd.Queue = false
+		a.queue = append(a.queue, &queuedCommand{cmd: cmd, fields: fields, at: now, run: retry})
+		a.poke()
+		return nil, fmt.Errorf("%w: %s", errQueued, err)
+	}
+
+	hold := cmd.Hold
+	if hold == 0 {
+		hold = a.holds[cmd.Source.Priority]
+	}
+	if hold < 0 {
+		hold = 0
+	}
+	prev := map[string]SettingOwner{}
+	for _, field := range fields {
+		if owner, ok := a.owners[field]; ok {
+			prev[field] = owner
+		}
+		a.owners[field] = SettingOwner{Source: cmd.Source, Since: now, Until: now.Add(hold)}
+	}
+	a.poke()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for _, field := range fields {
+			if owner, ok := prev[field]; ok {
+				a.owners[field] = owner
+			} else {
+				delete(a.owners, field)
+			}
+		}
+	}, nil
+}
+
+func (a *Arbiter) poke() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Release ends holds at or below upTo early, on fields or every setting if
+// none are given. A person can hand control back without lifting safety holds.
+func (a *Arbiter) Release(upTo CommandPriority, fields ...string) []string {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	released := []string{}
+	for field, owner := range a.owners {
+		if len(fields) > 0 && !containsString(fields, field) {
+			continue
+		}
+		if owner.holds(now) && owner.Source.Priority <= upTo {
+			owner.Until = now
+			a.owners[field] = owner
+			released = append(released, field)
+		}
+	}
+	sort.Strings(released)
+	a.poke()
+	return released
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ArbiterState is who owns each setting and what's waiting
+type ArbiterState struct {
+	Owners map[string]SettingOwner `json:"owners"`
+	Held   map[string]bool         `json:"held"`
+	Queued []QueuedCommand         `json:"queued"`
+}
+
+// State reports which source owns each setting
+func (a *Arbiter) State() ArbiterState {
+	out := ArbiterState{Owners: map[string]SettingOwner{}, Held: map[string]bool{}, Queued: []QueuedCommand{}}
+	if a == nil {
+		return out
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for field, owner := range a.owners {
+		out.Owners[field] = owner
+		out.Held[field] = owner.holds(now)
+	}
+	for _, q := range a.queue {
+		out.Queued = append(out.Queued, QueuedCommand{Source: q.cmd.Source, Fields: q.fields, Queued: q.at})
+	}
+	return out
+}
+
+// next is when the soonest hold blocking a queued command ends
+func (a *Arbiter) next() (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	var soonest time.Time
+	for _, q := range a.queue {
+		for _, field := range q.fields {
+			owner, ok := a.owners[field]
+			if ok && owner.holds(now) && (soonest.IsZero() || owner.Until.Before(soonest)) {
+				soonest = owner.Until
+			}
+		}
+	}
+	return soonest, len(a.queue) > 0
+}
+
+// ready takes the queued commands nothing blocks any more, highest priority first
+func (a *Arbiter) ready() []*queuedCommand {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	out := []*queuedCommand{}
+	keep := a.queue[:0]
+	for _, q := range a.queue {
+		switch {
+		case now.Sub(q.at) > arbiterQueueTTL:
+			log.WithFields(log.Fields{"client": "Arbiter", "source": q.cmd.Source.Name}).Info("Dropping stale queued command")
+		case a.conflict(q.cmd, q.fields, now) == nil:
+			out = append(out, q)
+		default:
+			keep = append(keep, q)
+		}
+	}
+	a.queue = keep
+	sort.SliceStable(out, func(i, j int) bool { return out[i].cmd.Source.Priority > out[j].cmd.Source.Priority })
+	return out
+}
+
+// Run applies queued commands as the holds in their way end
+func (a *Arbiter) Run(ctx context.Context) {
+	for {
+		wait := time.Hour
+		if until, ok := a.next(); ok {
+			wait = time.Until(until)
+			if until.IsZero() {
+				wait = 0
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-a.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+		for _, q := range a.ready() {
+			cctx, cancel := context.WithTimeout(ctx, commandTimeout)
+			err := q.run(cctx)
+			cancel()
+			log := log.WithFields(log.Fields{"client": "Arbiter", "source": q.cmd.Source.Name, "fields": q.fields})
+			if err != nil {
+				log.WithField("err", err).Warn("Queued command failed")
+			} else {
+				log.Info("Queued command applied")
+			}
+		}
+	}
+}
+
+// commandHold reads ?hold=2h from write requests, 0 means no hold
+func commandHold(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("hold")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("hold must be a duration like 30m or 2h")
+	}
+	if d == 0 {
+		return noHold, nil
+	}
+	return d, nil
+}
+
+// httpCommand tags an API request with the login or client address,
+// ?queue=true waits out conflicting holds
+func httpCommand(r *http.Request) (Command, error) {
+	hold, err := commandHold(r)
+	if err != nil {
+		return Command{}, err
+	}
+	user, _, ok := r.BasicAuth()
+	if !ok {
+		user = clientHost(r)
+	}
+	return Command{Source: sourceHTTP, User: user, Hold: hold, Queue: r.URL.Query().Get("queue") == "true"}, nil
+}
+
+func handleArbiter(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, f.arbiter.State())
+		case http.MethodDelete:
+			// Hand control back, ?fields=TempSet,On for some settings only
+			released := f.arbiter.Release(priorityManual, splitParam(r, "fields")...)
+			writeJSON(w, http.StatusOK, map[string][]string{"released": released})
+		}
+	}
+}
+
+// registerArbiter adds the ownership endpoints to mux
+func registerArbiter(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/arbiter", methods(handleArbiter(f), http.MethodGet, http.MethodDelete))
+}
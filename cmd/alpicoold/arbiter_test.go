@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+var sourceTestSafety = Source{Name: "test-safety", Priority: prioritySafety}
+
+func newTestArbiter(now *time.Time) *Arbiter {
+	a := newArbiter(map[CommandPriority]time.Duration{priorityManual: 2 * time.Hour, prioritySafety: 10 * time.Minute})
+	a.now = func() time.Time { return *now }
+	return a
+}
+
+func TestArbiter(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	a := newTestArbiter(&now)
+	noop := func(context.Context) error { return nil }
+
+	if _, err := a.admit(Command{Source: sourceHTTP}, []string{"TempSet"}, noop); err != nil {
+		t.Fatal(err)
+	}
+	if owner := a.State().Owners["TempSet"]; owner.Source != sourceHTTP || !owner.Until.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("Manual changes should hold for 2h, got %+v", owner)
+	}
+
+	// Lower priorities are turned away from held settings only
+	var conflict *ConflictError
+	_, err := a.admit(Command{Source: sourceKeepAlive}, []string{"On", "TempSet"}, noop)
+	if !errors.As(err, &conflict) || conflict.Field != "TempSet" || conflict.Owner.Source != sourceHTTP {
+		t.Fatalf("Expected a TempSet conflict, got %v", err)
+	}
+	if err := a.Check(Command{Source: sourceKeepAlive}, []string{"On"}); err != nil {
+		t.Fatal(err)
+	}
+	// Equal and higher priorities take over
+	if _, err := a.admit(Command{Source: sourceMQTT, Hold: noHold}, []string{"TempSet"}, noop); err != nil {
+		t.Fatal(err)
+	}
+	if a.State().Held["TempSet"] {
+		t.Fatal("A zero hold shouldn't hold")
+	}
+	release, err := a.admit(Command{Source: sourceTestSafety}, []string{"TempSet", "EcoMode"}, noop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if owner := a.State().Owners["TempSet"]; owner.Source != sourceMQTT {
+		t.Fatalf("Release should restore the previous owner, got %+v", owner)
+	}
+	if _, ok := a.State().Owners["EcoMode"]; ok {
+		t.Fatal("Release should forget new owners")
+	}
+
+	// Holds end on their own, or when a person hands control back
+	a.admit(Command{Source: sourceTestSafety}, []string{"EcoMode"}, noop)
+	a.admit(Command{Source: sourceHTTP}, []string{"On"}, noop)
+	if released := a.Release(priorityManual); len(released) != 1 || released[0] != "On" {
+		t.Fatalf("Only the manual hold should be released, got %v", released)
+	}
+	if err := a.Check(Command{Source: sourceHTTP}, []string{"EcoMode"}); err == nil {
+		t.Fatal("Safety should still hold EcoMode")
+	}
+	now = now.Add(10 * time.Minute)
+	if err := a.Check(Command{Source: sourceKeepAlive}, []string{"EcoMode", "On"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArbiterQueue(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	a := newTestArbiter(&now)
+	noop := func(context.Context) error { return nil }
+	a.admit(Command{Source: sourceHTTP}, []string{"TempSet"}, noop)
+
+	ran := 0
+	_, err := a.admit(Command{Source: sourceKeepAlive, Queue: true}, []string{"TempSet"}, func(context.Context) error { ran++; return nil })
+	if !errors.Is(err, errQueued) {
+		t.Fatalf("Expected the command to queue, got %v", err)
+	}
+	// A newer request from the same source replaces the queued one
+	a.admit(Command{Source: sourceKeepAlive, Queue: true}, []string{"TempSet"}, func(context.Context) error { ran += 10; return nil })
+	if q := a.State().Queued; len(q) != 1 || q[0].Source != sourceKeepAlive {
+		t.Fatalf("Bad queue %+v", q)
+	}
+	if until, ok := a.next(); !ok || !until.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("Queue should wake when the hold ends, got %v", until)
+	}
+	if len(a.ready()) != 0 {
+		t.Fatal("Nothing should be ready during the hold")
+	}
+
+	now = now.Add(2 * time.Hour)
+	ready := a.ready()
+	if len(ready) != 1 || len(a.State().Queued) != 0 {
+		t.Fatalf("Expected the command to be ready, got %d", len(ready))
+	}
+	ready[0].run(context.Background())
+	if ran != 10 {
+		t.Fatalf("The newest queued command should run, got %d", ran)
+	}
+
+	// Commands nobody could apply for too long are dropped
+	a.admit(Command{Source: sourceHTTP}, []string{"On"}, noop)
+	a.admit(Command{Source: sourceKeepAlive, Queue: true}, []string{"On"}, noop)
+	now = now.Add(arbiterQueueTTL + time.Minute)
+	if len(a.ready()) != 0 || len(a.State().Queued) != 0 {
+		t.Fatal("Stale queued command should be dropped")
+	}
+}
+
+func TestArbiterHTTP(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	f.arbiter = newArbiter(map[CommandPriority]time.Duration{priorityManual: 2 * time.Hour, prioritySafety: 10 * time.Minute})
+	mux := http.NewServeMux()
+	registerAPI(mux, f)
+	registerArbiter(mux, f)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	setCommandTimeout(t, 200*time.Millisecond)
+
+	standInWriter(t, f, false)
+
+	res, body := doRequest(t, http.MethodPatch, srv.URL+"/settings?hold=1h", `{"Locked": true}`)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Bad status %d %v", res.StatusCode, body)
+	}
+	if _, err := f.UpdateSettings(context.Background(), Command{Source: sourceTestSafety}, func(s *k25.Settings) { s.TempSet = 35 }); err != nil {
+		t.Fatal(err)
+	}
+
+	res, body = doRequest(t, http.MethodPatch, srv.URL+"/settings", `{"TempSet": 40}`)
+	if res.StatusCode != http.StatusConflict || !strings.Contains(body["error"].(string), "test-safety") {
+		t.Fatalf("Expected 409, got %d %v", res.StatusCode, body)
+	}
+	res, body = doRequest(t, http.MethodPatch, srv.URL+"/settings?queue=true", `{"TempSet": 40}`)
+	if res.StatusCode != http.StatusAccepted || !strings.Contains(body["error"].(string), "Queued") {
+		t.Fatalf("Expected the change to queue, got %d %v", res.StatusCode, body)
+	}
+	if res, _ := doRequest(t, http.MethodPatch, srv.URL+"/settings?hold=soon", `{"TempSet": 40}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad hold, got %d", res.StatusCode)
+	}
+
+	res, body = doRequest(t, http.MethodGet, srv.URL+"/arbiter", "")
+	owners := body["owners"].(map[string]interface{})
+	locked := owners["Locked"].(map[string]interface{})["source"].(map[string]interface{})
+	if res.StatusCode != http.StatusOK || locked["name"] != "http" || locked["priority"] != "manual" {
+		t.Fatalf("Bad arbiter state %v", body)
+	}
+	if q := body["queued"].([]interface{}); len(q) != 1 {
+		t.Fatalf("Expected one queued command, got %v", q)
+	}
+
+	res, body = doRequest(t, http.MethodDelete, srv.URL+"/arbiter", "")
+	if released := body["released"].([]interface{}); res.StatusCode != http.StatusOK || len(released) != 1 || released[0] != "Locked" {
+		t.Fatalf("Only Locked should be released, got %v", body)
+	}
+}
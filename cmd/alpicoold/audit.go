@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+// Audit entry kinds
+const (
+	auditSetState = "set-state" // SetStateCommand written
+	auditSetTemp  = "set-temp"  // SetTempCommand written
+	auditKeypad   = "keypad"    // settings changed with no command to explain it
+	auditAck      = "ack"       // the fridge did or didn't report a command back
+)
+
+// Audit results
+const (
+	auditWritten     = "written"
+	auditWriteFailed = "write failed"
+	auditConfirmed   = "confirmed"
+	auditUnconfirmed = "unconfirmed"
+	auditObserved    = "observed"
+)
+
+var (
+	// auditAckWindow is how long the fridge gets to report a command back
+	auditAckWindow = 15 * time.Second
+
+	// sourceKeypad is someone pressing buttons on the fridge
+	sourceKeypad = Source{Name: "local keypad", Priority: priorityManual}
+	// sourceFridge is the fridge reporting a command back
+	sourceFridge = Source{Name: "fridge", Priority: priorityManual}
+
+	auditQueryLimit = 1000
+)
+
+// AuditChange is one setting going from one value to another
+type AuditChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// settingsDiff lists the Settings fields that differ, in struct order
+func settingsDiff(before, after k25.Settings) []AuditChange {
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	out := []AuditChange{}
+	for _, field := range changedSettings(before, after) {
+		out = append(out, AuditChange{
+			Field: field,
+			From:  b.FieldByName(field).Interface(),
+			To:    a.FieldByName(field).Interface(),
+		})
+	}
+	return out
+}
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Seq     uint64        `json:"seq"`
+	Time    time.Time     `json:"time"`
+	Kind    string        `json:"kind"`
+	Source  Source        `json:"source"`
+	User    string        `json:"user,omitempty"`
+	Changes []AuditChange `json:"changes,omitempty"`
+	Raw     string        `json:"raw,omitempty"` // command bytes in hex
+	Result  string        `json:"result"`
+	Error   string        `json:"error,omitempty"`
+	Ref     uint64        `json:"ref,omitempty"` // the command an ack is about
+	Ack     string        `json:"ack,omitempty"` // folded in from the ack line by queries
+}
+
+// writtenCommand is a recent command the fridge should report back
+type writtenCommand struct {
+	seq    uint64
+	at     time.Time
+	after  k25.Settings
+	fields []string
+	acked  bool
+}
+
+// reported says whether cur shows every setting the command changed
+func (w *writtenCommand) reported(cur k25.Settings) bool {
+	for _, field := range changedSettings(w.after, cur) {
+		if containsString(w.fields, field) {
+			return false
+		}
+	}
+	return true
+}
+
+// AuditSettings avoids lots of args to openAuditLog
+type AuditSettings struct {
+	path      string
+	maxBytes  int64         // rotate when the log would grow past this
+	keep      int           // rotated logs to keep, as path.1 to path.keep
+	ackWindow time.Duration // how long the fridge gets to report a command back
+}
+
+// AuditLog is an append-only record of every command written to the fridge
+// and every settings change made on its keypad. A nil AuditLog records
+// nothing.
+type AuditLog struct {
+	mu       sync.Mutex
+	settings AuditSettings
+	file     *os.File
+	size     int64
+	seq      uint64
+	written  []*writtenCommand
+	now      func() time.Time
+}
+
+func openAuditLog(settings AuditSettings) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(settings.path), 0755); err != nil {
+		return nil, err
+	}
+	a := &AuditLog{settings: settings, now: time.Now}
+	// Carry on numbering from the newest entry on disk
+	for _, path := range a.files() {
+		entries, err := readAuditFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Seq > a.seq {
+				a.seq = e.Seq
+			}
+		}
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.settings.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// Close stops writing the log
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// files lists the log and its rotations, oldest first
+func (a *AuditLog) files() []string {
+	out := []string{}
+	for i := a.settings.keep; i >= 1; i-- {
+		out = append(out, a.settings.path+"."+strconv.Itoa(i))
+	}
+	return append(out, a.settings.path)
+}
+
+// rotate shifts path to path.1, path.1 to path.2 and so on, dropping the oldest
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	files := a.files()
+	for i := 1; i < len(files); i++ {
+		if err := os.Rename(files[i], files[i-1]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.settings.keep == 0 {
+		if err := os.Remove(a.settings.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// append numbers e and writes it out, synced so it survives the crash a
+// failed write is about to cause
+func (a *AuditLog) append(e AuditEntry) uint64 {
+	a.seq++
+	e.Seq = a.seq
+	if e.Time.IsZero() {
+		e.Time = a.now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, '\n')
+	log := log.WithFields(log.Fields{"client": "AuditLog", "seq": e.Seq, "kind": e.Kind})
+	if a.settings.maxBytes > 0 && a.size > 0 && a.size+int64(len(b)) > a.settings.maxBytes {
+		if err := a.rotate(); err != nil {
+			log.WithField("err", err).Error("Audit log rotation failed")
+			return e.Seq
+		}
+	}
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		log.WithField("err", err).Error("Audit log write failed")
+	}
+	return e.Seq
+}
+
+// Command records a command the bluetooth writer wrote, or failed to
+func (a *AuditLog) Command(kind string, cmd Command, before, after k25.Settings, raw []byte, writeErr error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := AuditEntry{
+		Kind:    kind,
+		Source:  cmd.Source,
+		User:    cmd.User,
+		Changes: settingsDiff(before, after),
+		Raw:     hex.EncodeToString(raw),
+		Result:  auditWritten,
+	}
+	if writeErr != nil {
+		e.Result, e.Error = auditWriteFailed, writeErr.Error()
+	}
+	seq := a.append(e)
+	if writeErr == nil && len(e.Changes) > 0 {
+		a.written = append(a.written, &writtenCommand{
+			seq:    seq,
+			at:     a.now(),
+			after:  after,
+			fields: changedSettings(before, after),
+		})
+	}
+}
+
+// explained says whether a recent command asked for change
+func (a *AuditLog) explained(change AuditChange) bool {
+	for _, w := range a.written {
+		if containsString(w.fields, change.Field) && reflect.ValueOf(w.after).FieldByName(change.Field).Interface() == change.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe checks a status report against recent commands. Commands the
+// fridge reports back are acked, and changes no command explains are
+// logged as keypad changes.
+func (a *AuditLog) Observe(prev, cur k25.Settings) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+
+	if prev != initialFridgeSettings && prev != cur {
+		unexplained := []AuditChange{}
+		for _, change := range settingsDiff(prev, cur) {
+			if !a.explained(change) {
+				unexplained = append(unexplained, change)
+			}
+		}
+		if len(unexplained) > 0 {
+			a.append(AuditEntry{Kind: auditKeypad, Source: sourceKeypad, Changes: unexplained, Result: auditObserved})
+		}
+	}
+
+	keep := a.written[:0]
+	for _, w := range a.written {
+		if !w.acked && w.reported(cur) {
+			w.acked = true
+			a.append(AuditEntry{Kind: auditAck, Source: sourceFridge, Ref: w.seq, Result: auditConfirmed})
+		}
+		if now.Sub(w.at) <= a.settings.ackWindow {
+			keep = append(keep, w)
+			continue
+		}
+		if !w.acked {
+			a.append(AuditEntry{Kind: auditAck, Source: sourceFridge, Ref: w.seq, Result: auditUnconfirmed})
+		}
+	}
+	a.written = keep
+}
+
+// readAuditFile reads the entries in one log file, skipping a torn last line
+func readAuditFile(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, scanner.Err()
+}
+
+// AuditQuery narrows down audit entries, zero values match everything
+type AuditQuery struct {
+	Since  time.Time
+	Until  time.Time
+	Source string
+	Kind   string
+	Field  string
+	Limit  int
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) || !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if q.Source != "" && e.Source.Name != q.Source || q.Kind != "" && e.Kind != q.Kind {
+		return false
+	}
+	if q.Field == "" {
+		return true
+	}
+	for _, c := range e.Changes {
+		if c.Field == q.Field {
+			return true
+		}
+	}
+	return false
+}
+
+// readAll reads every entry still on disk, oldest first
+func (a *AuditLog) readAll() ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	all := []AuditEntry{}
+	for _, path := range a.files() {
+		entries, err := readAuditFile(path)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	return all, nil
+}
+
+// Query returns matching entries newest first, with each command's ack
+// folded in
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	out := []AuditEntry{}
+	if a == nil {
+		return out, nil
+	}
+	all, err := a.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	acks := map[uint64]string{}
+	for _, e := range all {
+		if e.Kind == auditAck {
+			acks[e.Ref] = e.Result
+		}
+	}
+	for i := len(all) - 1; i >= 0 && (q.Limit <= 0 || len(out) < q.Limit); i-- {
+		e := all[i]
+		if e.Kind == auditAck || !q.matches(e) {
+			continue
+		}
+		e.Ack = acks[e.Seq]
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+var errBadAuditQuery = errors.New("since and until must be RFC 3339 times, limit a positive number")
+
+// auditQuery reads ?since=&until=&source=&kind=&field=&limit= from r
+func auditQuery(r *http.Request) (AuditQuery, error) {
+	v := r.URL.Query()
+	q := AuditQuery{Source: v.Get("source"), Kind: v.Get("kind"), Field: v.Get("field"), Limit: 100}
+	var err error
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errBadAuditQuery
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, errBadAuditQuery
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, errBadAuditQuery
+		}
+	}
+	if q.Limit > auditQueryLimit {
+		q.Limit = auditQueryLimit
+	}
+	return q, nil
+}
+
+func handleAudit(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.audit == nil {
+			writeError(w, http.StatusNotFound, errors.New("Audit log is off"))
+			return
+		}
+		q, err := auditQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		entries, err := f.audit.Query(q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("Reading audit log: %w", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+// registerAudit adds the audit log endpoint to mux
+func registerAudit(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/audit", methods(handleAudit(f), http.MethodGet))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestAuditLog(t *testing.T, settings AuditSettings, now *time.Time) *AuditLog {
+	t.Helper()
+	a, err := openAuditLog(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return *now }
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestAuditLog(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	settings := AuditSettings{path: filepath.Join(t.TempDir(), "audit.log"), maxBytes: 1 << 20, keep: 2, ackWindow: 15 * time.Second}
+	a := newTestAuditLog(t, settings, &now)
+	before := testStatusReport.Settings
+
+	// A command the fridge reports back is confirmed, not a keypad change
+	after := before
+	after.EcoMode = false
+	a.Command(auditSetState, Command{Source: sourceHTTP, User: "alice"}, before, after, []byte{0xfe, 0xfe}, nil)
+	now = now.Add(time.Second)
+	a.Observe(before, after)
+
+	// Buttons pressed on the fridge
+	keypad := after
+	keypad.Locked = true
+	a.Observe(after, keypad)
+
+	// Nothing reported back in time
+	temp := keypad
+	temp.TempSet = 40
+	a.Command(auditSetTemp, Command{Source: sourceMQTT}, keypad, temp, []byte{0x05}, nil)
+	now = now.Add(20 * time.Second)
+	a.Observe(keypad, keypad)
+
+	a.Command(auditSetState, Command{Source: sourceKeepAlive}, keypad, before, nil, errors.New("Not connected"))
+
+	entries, err := a.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries without acks, got %+v", entries)
+	}
+	failed, set, pressed, eco := entries[0], entries[1], entries[2], entries[3]
+	if eco.Source != sourceHTTP || eco.User != "alice" || eco.Raw != "fefe" || eco.Ack != auditConfirmed {
+		t.Fatalf("Bad set state entry %+v", eco)
+	}
+	if len(eco.Changes) != 1 || eco.Changes[0] != (AuditChange{Field: "EcoMode", From: true, To: false}) {
+		t.Fatalf("Bad changes %+v", eco.Changes)
+	}
+	if pressed.Kind != auditKeypad || pressed.Source != sourceKeypad || len(pressed.Changes) != 1 || pressed.Changes[0].Field != "Locked" {
+		t.Fatalf("Bad keypad entry %+v", pressed)
+	}
+	if set.Kind != auditSetTemp || set.Ack != auditUnconfirmed {
+		t.Fatalf("Expected an unconfirmed set temp, got %+v", set)
+	}
+	if failed.Result != auditWriteFailed || failed.Error != "Not connected" || failed.Ack != "" {
+		t.Fatalf("Bad failed write %+v", failed)
+	}
+
+	// Queries
+	for q, want := range map[*AuditQuery]int{
+		{Kind: auditKeypad}:                 1,
+		{Source: "mqtt"}:                    1,
+		{Field: "EcoMode"}:                  2,
+		{Since: now.Add(-time.Second)}:      1,
+		{Until: now.Add(-10 * time.Second)}: 3,
+		{Limit: 3}:                          3,
+	} {
+		if got, _ := a.Query(*q); len(got) != want {
+			t.Fatalf("Query %+v expected %d entries, got %d", *q, want, len(got))
+		}
+	}
+
+	// Numbering carries on after a restart
+	a.Close()
+	a = newTestAuditLog(t, settings, &now)
+	a.Observe(keypad, before)
+	if got, _ := a.Query(AuditQuery{Limit: 1}); got[0].Seq != 7 {
+		t.Fatalf("Expected seq 7 after reopening, got %+v", got)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a := newTestAuditLog(t, AuditSettings{path: path, maxBytes: 400, keep: 2}, &now)
+
+	prev := testStatusReport.Settings
+	for i := 0; i < 20; i++ {
+		cur := prev
+		cur.Locked = !prev.Locked
+		a.Observe(prev, cur)
+		prev = cur
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		if info, err := os.Stat(p); err != nil || info.Size() > 400 {
+			t.Fatalf("Expected %s under 400 bytes, got %v %v", p, info, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("Only 2 rotated logs should be kept")
+	}
+	entries, _ := a.Query(AuditQuery{Limit: 1000})
+	if len(entries) == 0 || len(entries) >= 20 || entries[0].Seq != 20 {
+		t.Fatalf("Expected the newest entries, got %d ending at %d", len(entries), entries[0].Seq)
+	}
+}
+
+func TestAuditHTTP(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	mux := http.NewServeMux()
+	registerAudit(mux, f)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/audit", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without an audit log, got %d", rec.Code)
+	}
+
+	now := time.Now()
+	f.audit = newTestAuditLog(t, AuditSettings{path: filepath.Join(t.TempDir(), "audit.log"), ackWindow: time.Minute}, &now)
+	locked := testStatusReport.Settings
+	locked.Locked = true
+	f.audit.Observe(testStatusReport.Settings, locked)
+
+	for _, url := range []string{"/audit?since=yesterday", "/audit?limit=0"} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", url, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/audit?kind=keypad", nil))
+	var entries []AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Source.Name != "local keypad" {
+		t.Fatalf("Bad audit entries %s %v", rec.Body, err)
+	}
+}
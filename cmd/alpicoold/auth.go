@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Role is what a caller is allowed to do
+type Role int
+
+// Roles, each includes the ones before it
+const (
+	roleNone Role = iota
+	roleRead
+	roleControl
+)
+
+func (r Role) String() string {
+	switch r {
+	case roleRead:
+		return "read"
+	case roleControl:
+		return "control"
+	}
+	return "none"
+}
+
+func parseRole(s string) (Role, error) {
+	switch strings.ToLower(s) {
+	case "read":
+		return roleRead, nil
+	case "control":
+		return roleControl, nil
+	}
+	return roleNone, fmt.Errorf("Unknown role %q, want read or control", s)
+}
+
+// basicUser is a basic auth login
+type basicUser struct {
+	password string
+	role     Role
+}
+
+// Auth decides who can do what on the HTTP server
+type Auth struct {
+	tokens        map[string]Role
+	users         map[string]basicUser
+	anonymousRead bool
+}
+
+// newAuth builds auth from comma separated tokens and user:password:role logins
+func newAuth(readTokens, controlTokens, users string, anonymousRead bool) (*Auth, error) {
+	a := &Auth{
+		tokens:        map[string]Role{},
+		users:         map[string]basicUser{},
+		anonymousRead: anonymousRead,
+	}
+	for _, t := range strings.Split(readTokens, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			a.tokens[t] = roleRead
+		}
+	}
+	for _, t := range strings.Split(controlTokens, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			a.tokens[t] = roleControl
+		}
+	}
+	for _, u := range strings.Split(users, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		parts := strings.SplitN(u, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Bad basic auth user %q, want name:password:role", parts[0])
+		}
+		role, err := parseRole(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		a.users[parts[0]] = basicUser{password: parts[1], role: role}
+	}
+	return a, nil
+}
+
+// Enabled is false when no credentials are configured, which leaves everyone
+// read-only
+func (a *Auth) Enabled() bool {
+	return a != nil && (len(a.tokens) > 0 || len(a.users) > 0)
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// roleFor works out the caller's role from bearer token, basic auth or an
+// access_token query parameter, which is there for EventSource and WebSocket
+// clients that can't set headers
+func (a *Auth) roleFor(r *http.Request) Role {
+	if !a.Enabled() {
+		return roleRead
+	}
+
+	token := ""
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	} else if q := r.URL.Query().Get("access_token"); q != "" && r.Method == http.MethodGet {
+		token = q
+	}
+	if token != "" {
+		best := roleNone
+		for t, role := range a.tokens {
+			if secureEqual(t, token) && role > best {
+				best = role
+			}
+		}
+		return best
+	}
+
+	if name, password, ok := r.BasicAuth(); ok {
+		u, found := a.users[name]
+		if !found {
+			// Burn the same time as a real comparison
+			secureEqual(password, password)
+			return roleNone
+		}
+		if secureEqual(u.password, password) {
+			return u.role
+		}
+		return roleNone
+	}
+
+	if a.anonymousRead {
+		return roleRead
+	}
+	return roleNone
+}
+
+// publicPaths are probes that systemd and load balancers hit without credentials
+var publicPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// readOnlyPosts take a body but change nothing
+var readOnlyPosts = map[string]bool{
+	"/rules/dry-run": true,
+}
+
+// requiredRole is read for safe methods and control for everything else
+func requiredRole(r *http.Request) Role {
+	if publicPaths[r.URL.Path] {
+		return roleNone
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return roleRead
+	case http.MethodPost:
+		if readOnlyPosts[r.URL.Path] {
+			return roleRead
+		}
+	}
+	return roleControl
+}
+
+// Middleware rejects requests the caller's role doesn't cover
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		have, need := a.roleFor(r), requiredRole(r)
+		if have >= need {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if have == roleNone {
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="alpicoold", charset="UTF-8"`)
+			}
+			writeError(w, http.StatusUnauthorized, errors.New("Authentication required"))
+			return
+		}
+		if !a.Enabled() {
+			writeError(w, http.StatusForbidden, errors.New("Read-only until control credentials are set with HTTP_CONTROL_TOKENS or HTTP_USERS"))
+			return
+		}
+		writeError(w, http.StatusForbidden, fmt.Errorf("The %s role can't %s %s", have, r.Method, r.URL.Path))
+	})
+}
+
+// requireJSON turns away writes that aren't JSON, so a browser can't be
+// tricked into sending one from another site as a form or text/plain
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			if requiredRole(r) < roleControl {
+				break
+			}
+			if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter is a token bucket per client address
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    perSecond,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// allow takes a token for key, or says how long until one is available
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	// Forget idle clients now and then so the map doesn't grow forever
+	if len(l.buckets) > 1000 {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > time.Hour {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Middleware rate limits write requests, reads are left alone
+func (l *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l == nil || l.rate <= 0 || requiredRole(r) < roleControl {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := l.allow(clientHost(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, errors.New("Too many write requests, slow down"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientHost is the address limits are counted against
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// selfSignedCert loads the cert in dir, creating one on first run
+func selfSignedCert(dir string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		return cert, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return tls.Certificate{}, err
+	}
+
+	log.WithFields(log.Fields{"client": "JSONClient"}).Infof("Generating self-signed certificate in %s", dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "alpicoold"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if host, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, host, host+".local")
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
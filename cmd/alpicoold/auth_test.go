@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	a, err := newAuth("reader", "controller", "alice:pw:control,bob:pw:read", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, c := range []struct {
+		name   string
+		method string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{"anonymous read", http.MethodGet, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"read token read", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader") }, http.StatusNoContent},
+		{"read token write", http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader") }, http.StatusForbidden},
+		{"control token write", http.MethodPatch, func(r *http.Request) { r.Header.Set("Authorization", "Bearer controller") }, http.StatusNoContent},
+		{"bad token", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"basic control", http.MethodPost, func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, http.StatusNoContent},
+		{"basic read write", http.MethodPost, func(r *http.Request) { r.SetBasicAuth("bob", "pw") }, http.StatusForbidden},
+		{"basic bad password", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("alice", "nope") }, http.StatusUnauthorized},
+		{"query token read", http.MethodGet, func(r *http.Request) { r.URL.RawQuery = "access_token=reader" }, http.StatusNoContent},
+		{"query token write", http.MethodPost, func(r *http.Request) { r.URL.RawQuery = "access_token=controller" }, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(c.method, "/settings", nil)
+		c.setup(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s: expected %d, got %d", c.name, c.status, w.Code)
+		}
+	}
+
+	t.Run("no credentials is read-only", func(t *testing.T) {
+		open, _ := newAuth("", "", "", false)
+		if open.Enabled() || open.roleFor(httptest.NewRequest(http.MethodPost, "/", nil)) != roleRead {
+			t.Fatal("Expected read-only access")
+		}
+		w := httptest.NewRecorder()
+		open.Middleware(h).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/power", nil))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "HTTP_CONTROL_TOKENS") {
+			t.Fatalf("Expected writes turned away, got %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("dry run is a read", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/rules/dry-run", nil)
+		r.Header.Set("Authorization", "Bearer reader")
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected a reader to dry-run rules, got %d", w.Code)
+		}
+	})
+
+	t.Run("anonymous read", func(t *testing.T) {
+		a, _ := newAuth("", "c", "", true)
+		if a.roleFor(httptest.NewRequest(http.MethodGet, "/", nil)) != roleRead {
+			t.Fatal("Expected anonymous read")
+		}
+	})
+
+	t.Run("bad users", func(t *testing.T) {
+		for _, u := range []string{"alice", "alice:pw", "alice:pw:admin", ":pw:read"} {
+			if _, err := newAuth("", "", u, false); err == nil {
+				t.Fatalf("Expected error for %q", u)
+			}
+		}
+	})
+}
+
+func TestRequireJSON(t *testing.T) {
+	h := requireJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, c := range []struct {
+		method, path, contentType string
+		status                    int
+	}{
+		{http.MethodPost, "/power", "application/json", http.StatusNoContent},
+		{http.MethodPatch, "/settings", "application/json; charset=utf-8", http.StatusNoContent},
+		{http.MethodPost, "/power", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "/temperature", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/power", "", http.StatusUnsupportedMediaType},
+		{http.MethodGet, "/settings", "", http.StatusNoContent},
+		{http.MethodDelete, "/arbiter", "", http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(`{"value": false}`))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s %s as %q: expected %d, got %d", c.method, c.path, c.contentType, c.status, w.Code)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newRateLimiter(1, 2)
+	l.now = func() time.Time { return now }
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	do := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/power", nil))
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do(http.MethodPost); w.Code != http.StatusNoContent {
+			t.Fatalf("Burst request %d limited", i)
+		}
+	}
+	w := do(http.MethodPost)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := do(http.MethodGet); w.Code != http.StatusNoContent {
+		t.Fatal("Reads shouldn't be limited")
+	}
+	now = now.Add(time.Second)
+	if w := do(http.MethodPost); w.Code != http.StatusNoContent {
+		t.Fatal("Bucket should refill")
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	first, err := selfSignedCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := selfSignedCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := x509.ParseCertificate(first.Certificate[0])
+	b, _ := x509.ParseCertificate(second.Certificate[0])
+	if a.SerialNumber.Cmp(b.SerialNumber) != 0 {
+		t.Fatal("Second run should reuse the generated certificate")
+	}
+	if err := a.VerifyHostname("localhost"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// TypeVoltage is Eve's voltage characteristic, which Eve and Controller for
+// HomeKit show and let automations use
+const TypeVoltage = "E863F10A-079E-48FF-8F27-9C2605A29F52"
+
+// batteryPoint is one step on a resting voltage to state of charge curve
+type batteryPoint struct {
+	Volts   float64
+	Percent float64
+}
+
+// BatteryCurve maps 12V battery voltage to percent, sorted by voltage
+type BatteryCurve []batteryPoint
+
+// batteryCurves are typical resting voltages for 12V batteries
+var batteryCurves = map[string]BatteryCurve{
+	"lead-acid": {
+		{10.5, 0}, {11.31, 10}, {11.58, 20}, {11.75, 30}, {11.9, 40}, {12.06, 50},
+		{12.2, 60}, {12.32, 70}, {12.42, 80}, {12.5, 90}, {12.7, 100},
+	},
+	"lifepo4": {
+		{10.0, 0}, {12.0, 9}, {12.5, 14}, {12.8, 17}, {12.9, 20}, {13.0, 30},
+		{13.1, 40}, {13.2, 70}, {13.3, 90}, {13.4, 99}, {13.6, 100},
+	},
+}
+
+// parseBatteryCurve takes a chemistry name or volts:percent pairs, e.g. 11.8:0,12.7:100
+func parseBatteryCurve(s string) (BatteryCurve, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := batteryCurves[s]; ok {
+		return c, nil
+	}
+	if !strings.Contains(s, ":") {
+		return nil, fmt.Errorf("Unknown battery curve %q, want lead-acid, lifepo4 or volts:percent pairs", s)
+	}
+	c := BatteryCurve{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad battery curve point %q, want volts:percent", pair)
+		}
+		v, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad battery curve volts %q", parts[0])
+		}
+		p, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("Bad battery curve percent %q", parts[1])
+		}
+		c = append(c, batteryPoint{v, p})
+	}
+	if len(c) < 2 {
+		return nil, fmt.Errorf("Battery curve needs at least two points")
+	}
+	sort.Slice(c, func(i, j int) bool { return c[i].Volts < c[j].Volts })
+	return c, nil
+}
+
+// Percent interpolates the state of charge at volts
+func (c BatteryCurve) Percent(volts float64) float64 {
+	if len(c) == 0 {
+		return 0
+	}
+	if volts <= c[0].Volts {
+		return c[0].Percent
+	}
+	for i := 1; i < len(c); i++ {
+		if volts <= c[i].Volts {
+			lo, hi := c[i-1], c[i]
+			return lo.Percent + (volts-lo.Volts)/(hi.Volts-lo.Volts)*(hi.Percent-lo.Percent)
+		}
+	}
+	return c[len(c)-1].Percent
+}
+
+// BatterySettings says how to turn fridge readings into battery levels
+type BatterySettings struct {
+	curve      BatteryCurve // input voltage to percent, nil disables the input battery
+	lowPercent int          // StatusLowBattery at or below this
+	ub17       bool         // the fridge has a built in battery reported in UB17
+}
+
+// batteryLevel is what HomeKit's battery service shows
+type batteryLevel struct {
+	Percent int
+	Low     bool
+}
+
+func (s BatterySettings) level(percent float64) batteryLevel {
+	p := int(math.Round(math.Max(0, math.Min(100, percent))))
+	return batteryLevel{Percent: p, Low: p <= s.lowPercent}
+}
+
+// inputLevel is the supply battery's level from the fridge's input voltage
+func (s BatterySettings) inputLevel(r k25.Sensors) batteryLevel {
+	return s.level(s.curve.Percent(inputVoltage(r)))
+}
+
+// ub17Level is the built in battery's level, UB17 is already a percentage
+func (s BatterySettings) ub17Level(r k25.Sensors) batteryLevel {
+	return s.level(float64(r.UB17))
+}
+
+// inputVoltage combines the whole and tenths voltage bytes
+func inputVoltage(r k25.Sensors) float64 {
+	return float64(r.InputV1) + float64(r.InputV2)/10
+}
+
+// hkBattery is a HomeKit battery service with a voltage reading
+type hkBattery struct {
+	*service.BatteryService
+	Voltage *characteristic.Float
+}
+
+// newHKBattery makes a non-chargeable battery service called name
+func newHKBattery(name string) *hkBattery {
+	b := &hkBattery{BatteryService: service.NewBatteryService()}
+	b.ChargingState.SetValue(characteristic.ChargingStateNotChargeable)
+
+	n := characteristic.NewName()
+	n.SetValue(name)
+	b.AddCharacteristic(n.Characteristic)
+
+	b.Voltage = characteristic.NewFloat(TypeVoltage)
+	b.Voltage.Format = characteristic.FormatFloat
+	b.Voltage.Perms = characteristic.PermsRead()
+	b.Voltage.Description = "Voltage"
+	b.Voltage.SetMinValue(0)
+	b.Voltage.SetMaxValue(30)
+	b.Voltage.SetStepValue(0.1)
+	b.Voltage.SetValue(0)
+	b.AddCharacteristic(b.Voltage.Characteristic)
+	return b
+}
+
+// set updates the service, volts < 0 leaves the voltage alone
+func (b *hkBattery) set(l batteryLevel, volts float64) {
+	b.BatteryLevel.SetValue(l.Percent)
+	if l.Low {
+		b.StatusLowBattery.SetValue(characteristic.StatusLowBatteryBatteryLevelLow)
+	} else {
+		b.StatusLowBattery.SetValue(characteristic.StatusLowBatteryBatteryLevelNormal)
+	}
+	if volts >= 0 {
+		b.Voltage.SetValue(volts)
+	}
+}
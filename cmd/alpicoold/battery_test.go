@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+func TestBatteryCurve(t *testing.T) {
+	lead := batteryCurves["lead-acid"]
+	for _, c := range []struct {
+		volts   float64
+		percent float64
+	}{
+		{9, 0},
+		{10.5, 0},
+		{12.06, 50},
+		{12.13, 55},
+		{12.7, 100},
+		{14.4, 100},
+	} {
+		if p := lead.Percent(c.volts); math.Abs(p-c.percent) > 0.01 {
+			t.Fatalf("lead-acid %vV: expected %v%%, got %v", c.volts, c.percent, p)
+		}
+	}
+	if p := batteryCurves["lifepo4"].Percent(13.15); math.Abs(p-55) > 0.01 {
+		t.Fatalf("lifepo4 13.15V: expected 55%%, got %v", p)
+	}
+
+	custom, err := parseBatteryCurve("12.8:100, 11.8:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := custom.Percent(12.3); math.Abs(p-50) > 0.01 {
+		t.Fatalf("Custom curve should be sorted and interpolate, got %v", p)
+	}
+	if c, err := parseBatteryCurve("LiFePO4"); err != nil || len(c) == 0 {
+		t.Fatalf("Named curves should be case insensitive: %v", err)
+	}
+	for _, bad := range []string{"nickel", "12:50", "12:x,13:100", "12:50,13:101", "a:1,13:100"} {
+		if _, err := parseBatteryCurve(bad); err == nil {
+			t.Fatalf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestBatteryLevels(t *testing.T) {
+	s := BatterySettings{curve: batteryCurves["lead-acid"], lowPercent: 20, ub17: true}
+	if l := s.inputLevel(k25.Sensors{InputV1: 12, InputV2: 8}); l.Percent != 100 || l.Low {
+		t.Fatalf("12.8V should be full, got %+v", l)
+	}
+	if l := s.inputLevel(k25.Sensors{InputV1: 11, InputV2: 5}); !l.Low {
+		t.Fatalf("11.5V should be low, got %+v", l)
+	}
+	if l := s.ub17Level(k25.Sensors{UB17: 120}); l.Percent != 100 {
+		t.Fatalf("UB17 should be clamped, got %+v", l)
+	}
+
+	b := newHKBattery("Input battery")
+	b.set(s.inputLevel(k25.Sensors{InputV1: 11, InputV2: 5}), 11.5)
+	if b.StatusLowBattery.GetValue() != characteristic.StatusLowBatteryBatteryLevelLow ||
+		b.Voltage.GetValue() != 11.5 || b.BatteryLevel.GetValue() > 20 {
+		t.Fatal("HomeKit battery not updated")
+	}
+	if b.ChargingState.GetValue() != characteristic.ChargingStateNotChargeable {
+		t.Fatal("Battery should be not chargeable")
+	}
+}
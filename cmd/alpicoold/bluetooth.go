@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +26,9 @@ var (
 	writeableFridgeUUID = "00001235-0000-1000-8000-00805f9b34fb" // Writable
 	readeableFridgeUUID = "00001236-0000-1000-8000-00805f9b34fb" // Read Notify
 	descriptorUUID      = "00002902-0000-1000-8000-00805f9b34fb"
+
+	// devicePropsInterval is how often RSSI is refreshed for diagnostics
+	devicePropsInterval = 30 * time.Second
 )
 
 // Client is the main bluetooth client that looks at the fridge
@@ -42,6 +44,8 @@ func Client(ctx context.Context, wg *sync.WaitGroup, fridge *Fridge, adapterID,
 
 	// clean up connection on exit
 	defer func() {
+		fridge.SetConnected(false)
+		fridge.diag.SetPhase(phaseDisconnected)
 		api.Exit()
 		log.Trace("Api exit done")
 	}()
@@ -52,6 +56,15 @@ func Client(ctx context.Context, wg *sync.WaitGroup, fridge *Fridge, adapterID,
 	if err != nil {
 		return err
 	}
+	if props, err := a.GetProperties(); err == nil {
+		fridge.diag.SetAdapter(AdapterInfo{
+			ID:          adapterID,
+			Address:     props.Address,
+			Alias:       props.Alias,
+			Powered:     props.Powered,
+			Discovering: props.Discovering,
+		})
+	}
 
 	//Connect DBus System bus
 	conn, err := dbus.SystemBus()
@@ -68,6 +81,7 @@ func Client(ctx context.Context, wg *sync.WaitGroup, fridge *Fridge, adapterID,
 		return fmt.Errorf("SimpleAgent: %s", err)
 	}
 
+	fridge.diag.SetPhase(phaseDiscovering)
 	findContext, cancelFindDevice := context.WithCancel(ctx)
 	defer cancelFindDevice()
 	dev, err := findDevice(findContext, a, hwaddr)
@@ -76,39 +90,69 @@ func Client(ctx context.Context, wg *sync.WaitGroup, fridge *Fridge, adapterID,
 	}
 
 	// Connect to the device
+	fridge.diag.SetPhase(phaseConnecting)
 	err = connect(dev, ag, adapterID)
 	if err != nil {
 		return err
 	}
+	recordDevice(fridge, dev)
 
 	// Kick off listening for commands
 
 	// Kick off listening for state notifications
+	fridge.diag.SetPhase(phaseSubscribing)
 	watchStateCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	err = WatchState(watchStateCtx, fridge, a, dev)
 	if err != nil {
 		return err
 	}
+	fridge.SetConnected(true)
+	fridge.diag.SetPhase(phaseConnected)
+
+	// Keep RSSI and friends fresh for /debug/state
+	deviceTicker := time.NewTicker(devicePropsInterval)
+	defer deviceTicker.Stop()
 
 	log.Trace("Client blocking and waiting")
 	// Wait for quit signal
-	select {
-	case <-ctx.Done():
-		log.Tracef("Cancel: bluetooth client: %v", ctx.Err())
-		// wait for cycling to be done
-		log.Trace("await compressor cycle")
-		fridge.cycleCompressorWg.Wait()
-		log.Trace("compressor cycle done, disconnecting bluetooth")
-		err := dev.Disconnect()
-		if err != nil {
-			log.Error(err)
-			return err
+	for {
+		select {
+		case <-deviceTicker.C:
+			recordDevice(fridge, dev)
+		case <-ctx.Done():
+			log.Tracef("Cancel: bluetooth client: %v", ctx.Err())
+			// wait for cycling to be done
+			log.Trace("await compressor cycle")
+			fridge.cycleCompressorWg.Wait()
+			log.Trace("compressor cycle done, disconnecting bluetooth")
+			err := dev.Disconnect()
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			log.Trace("Disconnected from bluetooth")
+
+			return nil
 		}
-		log.Trace("Disconnected from bluetooth")
+	}
+}
 
-		return nil
+// recordDevice snapshots the fridge's bluetooth properties for diagnostics
+func recordDevice(fridge *Fridge, dev *device.Device1) {
+	props, err := dev.GetProperties()
+	if err != nil {
+		fridge.diag.Error("bluetooth", fmt.Errorf("device properties: %s", err))
+		return
 	}
+	fridge.diag.SetDevice(DeviceInfo{
+		Address:          props.Address,
+		Name:             props.Name,
+		RSSI:             props.RSSI,
+		TxPower:          props.TxPower,
+		Connected:        props.Connected,
+		ServicesResolved: props.ServicesResolved,
+	})
 }
 
 func findDevice(ctx context.Context, a *adapter.Adapter1, hwaddr string) (*device.Device1, error) {
@@ -270,56 +314,43 @@ func WatchState(ctx context.Context, fridge *Fridge, a *adapter.Adapter1, dev *d
 		defer ticker.Stop()
 
 		for {
+			fridge.diag.Beat("bluetooth writer")
 			select {
 			case settings := <-fridge.settingsC:
-				log.Tracef("Got settings payload %v", settings)
-				c, err := k25.NewSetStateCommand(settings)
+				log.Tracef("Got settings payload %v", settings.Settings)
+				c, err := k25.NewSetStateCommand(settings.Settings)
 				if err != nil {
 					panic(err)
 				}
 				log.WithFields(log.Fields{
 					"client":  "BluetoothClient",
 					"payload": fmt.Sprintf("% x", c),
+					"source":  settings.cmd.Source.Name,
 				}).Infof("Writing set state payload")
+				before := fridge.GetStatusReport().Settings
 				err = char.WriteValue(c, nil)
+				fridge.audit.Command(auditSetState, settings.cmd, before, settings.Settings, c, err)
 				if err != nil {
 					panic(err)
 				}
-			case temp := <-fridge.tempSettingsC:
+			case tc := <-fridge.tempSettingsC:
 				log.WithFields(log.Fields{
-					"temp":   temp,
+					"temp":   tc.celsius,
 					"client": "BluetoothClient",
 				}).Info("Got celsius temp setting!")
+				// Clamped to E1 and E2 in the fridge's own unit
 				sr := fridge.GetStatusReport()
-				maxTemp := float64(sr.HighestTempSettingMenuE2)
-				log.Trace("max temp", maxTemp)
-				minTemp := float64(sr.LowestTempSettingMenuE1)
-				log.Trace("min temp", minTemp)
-
-				// Use current units
-				isF := sr.CelsiusFahrenheitModeMenuE5
-				if isF {
-					temp = CtoF(temp)
-				}
-				log.Debug("converted temp", temp)
-				// Sanitize hk possible high input
-				temp = math.Min(maxTemp, temp)
-				log.Debug("capped temp", temp)
-
-				temp = math.Max(minTemp, temp)
-				log.Debug("upped temp", temp)
-				// Move result back to C if we're in C mode
-				if !isF {
-					temp = FtoC(temp)
-				}
+				after := tc.settings(sr)
+				log.Debug("converted temp", after.TempSet)
 
 				// Form command bytes
-				c, err := k25.NewSetTempCommand(int8(temp))
+				c, err := k25.NewSetTempCommand(after.TempSet)
 				if err != nil {
 					panic(err)
 				}
 				log.Info("Writing set temp payload", c)
 				err = char.WriteValue(c, nil)
+				fridge.audit.Command(auditSetTemp, tc.cmd, sr.Settings, after, c, err)
 				if err != nil {
 					panic(err)
 				}
@@ -357,6 +388,7 @@ func WatchState(ctx context.Context, fridge *Fridge, a *adapter.Adapter1, dev *d
 				err = f.UnmarshalBinary(value)
 				if err != nil {
 					log.Error("Other frame UnmarshalBinary", err)
+					fridge.diag.Error("bluetooth notify", err)
 					break
 				}
 				// Send status to rest of app
@@ -370,6 +402,32 @@ func WatchState(ctx context.Context, fridge *Fridge, a *adapter.Adapter1, dev *d
 		return err
 	}
 
+	// Kick the fridge when reports go stale
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-fridge.resubscribeC:
+				log.WithFields(log.Fields{
+					"client": "BluetoothClient",
+				}).Warn("Re-pinging and re-subscribing to status reports")
+				fridge.diag.SetPhase(phaseSubscribing)
+				if err := char.WriteValue(k25.PingCommand, nil); err != nil {
+					fridge.diag.Error("bluetooth resubscribe", err)
+				}
+				if err := notifChar.StopNotify(); err != nil {
+					log.Debugf("StopNotify: %s", err)
+				}
+				if err := notifChar.StartNotify(); err != nil {
+					fridge.diag.Error("bluetooth resubscribe", err)
+					continue
+				}
+				fridge.diag.SetPhase(phaseConnected)
+			}
+		}
+	}()
+
 	log.Trace("watchState returning now")
 	return nil
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/rtp"
+	"github.com/brutella/hc/service"
+	"github.com/brutella/hc/tlv8"
+	"github.com/brutella/hkcam"
+	"github.com/brutella/hkcam/ffmpeg"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// cameraCheckInterval is how often the camera's ffmpeg and device are rechecked
+	cameraCheckInterval = time.Minute
+	// lookPath finds binaries, swapped out in tests
+	lookPath = exec.LookPath
+	// watchSnapshots starts hkcam's snapshot directory watcher, swapped out in
+	// tests since it exits the process once the directory is removed
+	watchSnapshots = (*hkcam.CameraControl).SetupWithDir
+
+	errCameraUnavailable = errors.New("Camera unavailable")
+)
+
+// CameraSettings avoids lots of args to newCamera
+type CameraSettings struct {
+	snapshotDir     string
+	minVideoBitrate int
+	multiStream     bool
+	// Platform dependent flags
+	inputDevice      string
+	inputFilename    string
+	loopbackFilename string
+	h264Decoder      string
+	h264Encoder      string
+}
+
+// CameraState is the camera's health for /debug/state
+type CameraState struct {
+	Enabled   bool      `json:"enabled"`
+	Available bool      `json:"available"`
+	Reason    string    `json:"reason,omitempty"`
+	Checked   time.Time `json:"checked"`
+}
+
+// checkCamera finds reasons the camera can't stream
+func checkCamera(s CameraSettings) error {
+	if _, err := lookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("ffmpeg not found: %w", err)
+	}
+	if s.inputDevice == "v4l2" {
+		if _, err := os.Stat(s.inputFilename); err != nil {
+			return fmt.Errorf("camera device: %w", err)
+		}
+	}
+	return nil
+}
+
+// Camera is the optional HomeKit camera. It's watched on its own, so a
+// missing device or ffmpeg only marks it unavailable and the bridge keeps going.
+type Camera struct {
+	*accessory.Camera
+	settings CameraSettings
+	ff       ffmpeg.FFMPEG
+	diag     *Diagnostics
+
+	mu    sync.RWMutex
+	state CameraState
+}
+
+// newCamera builds the camera accessory, hkcam panics become errors
+func newCamera(info accessory.Info, settings CameraSettings, diag *Diagnostics) (c *Camera, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c, err = nil, fmt.Errorf("camera setup: %v", r)
+		}
+	}()
+
+	if log.GetLevel() == log.TraceLevel {
+		// TODO get something like this log.Debug.Enable()
+		ffmpeg.EnableVerboseLogging()
+	}
+
+	c = &Camera{
+		Camera:   accessory.NewCamera(info),
+		settings: settings,
+		diag:     diag,
+		state:    CameraState{Enabled: true},
+	}
+	c.ff = hkcam.SetupFFMPEGStreaming(c.Camera, ffmpeg.Config{
+		InputDevice:      settings.inputDevice,
+		InputFilename:    settings.inputFilename,
+		LoopbackFilename: settings.loopbackFilename,
+		H264Decoder:      settings.h264Decoder,
+		H264Encoder:      settings.h264Encoder,
+		MinVideoBitrate:  settings.minVideoBitrate,
+		MultiStream:      settings.multiStream,
+	})
+
+	// Add a custom camera control service to record snapshots. Its watcher
+	// exits the process if the directory is missing, so make sure it's there.
+	if err := os.MkdirAll(settings.snapshotDir, 0700); err != nil {
+		return nil, err
+	}
+	cc := hkcam.NewCameraControl()
+	c.Control.AddCharacteristic(cc.Assets.Characteristic)
+	c.Control.AddCharacteristic(cc.GetAsset.Characteristic)
+	c.Control.AddCharacteristic(cc.DeleteAssets.Characteristic)
+	c.Control.AddCharacteristic(cc.TakeSnapshot.Characteristic)
+	watchSnapshots(cc, settings.snapshotDir)
+	cc.CameraSnapshotReq = c.Snapshot
+
+	c.check()
+	return c, nil
+}
+
+// Snapshot takes a picture if the camera is available
+func (c *Camera) Snapshot(width, height uint) (img *image.Image, err error) {
+	if !c.State().Available {
+		return nil, errCameraUnavailable
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			img, err = nil, fmt.Errorf("snapshot: %v", r)
+		}
+	}()
+	img, err = c.ff.Snapshot(width, height)
+	if err != nil {
+		c.diag.Error("camera", err)
+	}
+	return img, err
+}
+
+// State is the camera's last health check
+func (c *Camera) State() CameraState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+// check looks for ffmpeg and the device and tells HomeKit and diagnostics
+func (c *Camera) check() {
+	err := checkCamera(c.settings)
+	state := CameraState{Enabled: true, Available: err == nil, Checked: time.Now()}
+	if err != nil {
+		state.Reason = err.Error()
+	}
+
+	c.mu.Lock()
+	prev := c.state
+	c.state = state
+	c.mu.Unlock()
+	c.diag.SetCamera(state)
+
+	if prev.Available != state.Available || prev.Checked.IsZero() {
+		log := log.WithFields(log.Fields{"client": "Camera"})
+		if err != nil {
+			log.WithField("err", err).Warn("Camera unavailable, the bridge carries on without it")
+			c.diag.Error("camera", err)
+		} else {
+			log.Info("Camera available")
+		}
+	}
+
+	status := rtp.StreamingStatusAvailable
+	if err != nil {
+		status = rtp.StreamingStatusUnavailable
+	}
+	setStreamingStatus(c.StreamManagement1, status)
+	setStreamingStatus(c.StreamManagement2, status)
+}
+
+func setStreamingStatus(m *service.CameraRTPStreamManagement, status byte) {
+	if b, err := tlv8.Marshal(rtp.StreamingStatus{Status: status}); err == nil {
+		m.StreamingStatus.SetValue(b)
+	}
+}
+
+// Supervise rechecks the camera every cameraCheckInterval until ctx is done
+func (c *Camera) Supervise(ctx context.Context) {
+	ticker := time.NewTicker(cameraCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.check()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hkcam"
+)
+
+func TestCamera(t *testing.T) {
+	// hkcam's watcher would exit the test binary once the directory is cleaned up
+	watchSnapshots = func(*hkcam.CameraControl, string) {}
+	defer func() { watchSnapshots = (*hkcam.CameraControl).SetupWithDir }()
+	snapshots := t.TempDir()
+	device := filepath.Join(t.TempDir(), "video0")
+	lookPath = func(string) (string, error) { return "/usr/bin/ffmpeg", nil }
+	defer func() { lookPath = exec.LookPath }()
+
+	settings := CameraSettings{
+		snapshotDir:   snapshots,
+		inputDevice:   "v4l2",
+		inputFilename: device,
+	}
+	diag := newDiagnostics()
+	cam, err := newCamera(accessory.Info{Name: "Camera"}, settings, diag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No device yet
+	if cam.State().Available {
+		t.Fatal("Camera available without a device")
+	}
+	if _, err := cam.Snapshot(640, 480); err != errCameraUnavailable {
+		t.Fatalf("Expected errCameraUnavailable, got %v", err)
+	}
+	f := newTestFridge(testStatusReport)
+	f.diag = diag
+	if s := debugState(f); s.Camera == nil || s.Camera.Available || s.Camera.Reason == "" {
+		t.Fatalf("Bad camera debug state %+v", s.Camera)
+	}
+	if len(diag.Stalled()) != 0 {
+		t.Fatal("Camera trouble should not make the daemon unhealthy")
+	}
+
+	// Device plugged in
+	if err := os.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cam.check()
+	if !cam.State().Available {
+		t.Fatalf("Camera unavailable with a device: %s", cam.State().Reason)
+	}
+
+	// ffmpeg uninstalled
+	lookPath = func(string) (string, error) { return "", errors.New("not found") }
+	cam.check()
+	if cam.State().Available {
+		t.Fatal("Camera available without ffmpeg")
+	}
+}
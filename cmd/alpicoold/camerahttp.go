@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// cameraDefaultWidth and cameraDefaultHeight are used without ?width and ?height
+	cameraDefaultWidth, cameraDefaultHeight uint = 640, 360
+	// cameraMaxWidth and cameraMaxHeight keep ffmpeg from upscaling on a Pi
+	cameraMaxWidth, cameraMaxHeight uint = 1920, 1080
+	// mjpegDefaultFPS and mjpegMaxFPS bound how often a stream asks ffmpeg for a frame
+	mjpegDefaultFPS, mjpegMaxFPS = 1.0, 5.0
+	// cameraJPEGQuality is the quality of frames served over HTTP
+	cameraJPEGQuality = 80
+
+	errNoCamera = errors.New("Camera is off, enable it with CAM_ENABLED")
+)
+
+// queryUint reads a positive whole number parameter up to max, or def when missing
+func queryUint(r *http.Request, name string, def, max uint) (uint, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || n == 0 || uint(n) > max {
+		return 0, fmt.Errorf("%s must be a whole number from 1 to %d", name, max)
+	}
+	return uint(n), nil
+}
+
+// frameSize reads ?width=640&height=360
+func frameSize(r *http.Request) (uint, uint, error) {
+	width, err := queryUint(r, "width", cameraDefaultWidth, cameraMaxWidth)
+	if err != nil {
+		return 0, 0, err
+	}
+	height, err := queryUint(r, "height", cameraDefaultHeight, cameraMaxHeight)
+	if err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
+
+// frameJPEG takes a picture and encodes it for HTTP
+func frameJPEG(src FrameSource, width, height uint) ([]byte, error) {
+	img, err := src.Snapshot(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil || *img == nil {
+		return nil, errors.New("Camera returned no frame")
+	}
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, *img, &jpeg.Options{Quality: cameraJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// clientLimit caps how many requests each client has open at once
+type clientLimit struct {
+	mu     sync.Mutex
+	max    int // 0 is unlimited
+	active map[string]int
+}
+
+func newClientLimit(max int) *clientLimit {
+	return &clientLimit{max: max, active: map[string]int{}}
+}
+
+// acquire takes a slot for key, false when key has max open already
+func (l *clientLimit) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.active[key] >= l.max {
+		return false
+	}
+	l.active[key]++
+	return true
+}
+
+func (l *clientLimit) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key]--; l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+}
+
+// handleCameraSnapshot serves one JPEG frame
+func handleCameraSnapshot(f *Fridge, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.camera == nil {
+			writeError(w, http.StatusNotFound, errNoCamera)
+			return
+		}
+		width, height, err := frameSize(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if limiter.rate > 0 {
+			if ok, wait := limiter.allow(clientHost(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, errors.New("Too many camera snapshots, slow down"))
+				return
+			}
+		}
+		frame, err := frameJPEG(f.camera, width, height)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		w.Header().Set(contentType, "image/jpeg")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", strconv.Itoa(len(frame)))
+		w.Write(frame)
+	}
+}
+
+// handleCameraStream serves frames as multipart/x-mixed-replace MJPEG,
+// which browsers show in a plain <img> tag
+func handleCameraStream(f *Fridge, streams *clientLimit) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.WithFields(log.Fields{
+			"client": "JSONClient",
+			"stream": "mjpeg",
+			"remote": r.RemoteAddr,
+		})
+		if f.camera == nil {
+			writeError(w, http.StatusNotFound, errNoCamera)
+			return
+		}
+		width, height, err := frameSize(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		fps := mjpegDefaultFPS
+		if v := r.URL.Query().Get("fps"); v != "" {
+			fps, err = strconv.ParseFloat(v, 64)
+			if err != nil || fps <= 0 || fps > mjpegMaxFPS {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("fps must be above 0 and at most %g", mjpegMaxFPS))
+				return
+			}
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming unsupported"))
+			return
+		}
+
+		host := clientHost(r)
+		if !streams.acquire(host) {
+			writeError(w, http.StatusTooManyRequests, errors.New("Too many camera streams open from this client"))
+			return
+		}
+		defer streams.release(host)
+
+		// Fail plainly if there's no picture to start with
+		frame, err := frameJPEG(f.camera, width, height)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		mw := multipart.NewWriter(w)
+		w.Header().Set(contentType, "multipart/x-mixed-replace; boundary="+mw.Boundary())
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		log.Debug("stream open")
+
+		write := func(frame []byte) error {
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":   {"image/jpeg"},
+				"Content-Length": {strconv.Itoa(len(frame))},
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := part.Write(frame); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / fps))
+		defer ticker.Stop()
+		for {
+			if err := write(frame); err != nil {
+				log.Debugf("stream write: %s", err)
+				return
+			}
+			for {
+				select {
+				case <-r.Context().Done():
+					log.Debug("stream closed by client")
+					return
+				case <-ticker.C:
+				}
+				// A missed frame keeps the last one on screen, the camera may come back
+				if frame, err = frameJPEG(f.camera, width, height); err == nil {
+					break
+				}
+				log.Debugf("stream frame: %s", err)
+			}
+		}
+	}
+}
+
+// registerCamera adds the live camera endpoints to mux
+func registerCamera(mux *http.ServeMux, settings HTTPSettings, f *Fridge) {
+	limiter := newRateLimiter(settings.camSnapshotRate, settings.camSnapshotBurst)
+	streams := newClientLimit(settings.camStreamsPerClient)
+	mux.HandleFunc("/camera/snapshot.jpg", methods(handleCameraSnapshot(f, limiter), http.MethodGet))
+	mux.HandleFunc("/camera/stream", methods(handleCameraStream(f, streams), http.MethodGet))
+}
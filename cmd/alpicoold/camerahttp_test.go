@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestCameraServer(t *testing.T, settings HTTPSettings, frames FrameSource) *httptest.Server {
+	t.Helper()
+	f := newTestFridge(testStatusReport)
+	f.camera = frames
+	mux := http.NewServeMux()
+	registerCamera(mux, settings, f)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCameraSnapshotHTTP(t *testing.T) {
+	frames := &fakeFrames{}
+	srv := newTestCameraServer(t, HTTPSettings{camSnapshotRate: 1.0 / 60, camSnapshotBurst: 2}, frames)
+
+	res, err := http.Get(srv.URL + "/camera/snapshot.jpg?width=320&height=240")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Bad snapshot %d %s", res.StatusCode, b)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 320 || size.Y != 240 {
+		t.Fatalf("Expected 320x240, got %v", size)
+	}
+
+	for _, c := range []struct {
+		path string
+		want int
+	}{
+		{"/camera/snapshot.jpg?width=0", http.StatusBadRequest},
+		{"/camera/snapshot.jpg?height=5000", http.StatusBadRequest},
+		{"/camera/snapshot.jpg", http.StatusOK},
+		// Burst used up
+		{"/camera/snapshot.jpg", http.StatusTooManyRequests},
+	} {
+		path, want := c.path, c.want
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Fatalf("%s: expected %d, got %d", path, want, res.StatusCode)
+		}
+		if want == http.StatusTooManyRequests && res.Header.Get("Retry-After") == "" {
+			t.Fatal("No Retry-After")
+		}
+	}
+
+	// Camera trouble and no camera at all
+	frames.err = errors.New("no device")
+	srv = newTestCameraServer(t, HTTPSettings{}, frames)
+	if res, _ := http.Get(srv.URL + "/camera/snapshot.jpg"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d", res.StatusCode)
+	}
+	srv = newTestCameraServer(t, HTTPSettings{}, nil)
+	for _, path := range []string{"/camera/snapshot.jpg", "/camera/stream"} {
+		if res, _ := http.Get(srv.URL + path); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected 404 without a camera, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestCameraStreamHTTP(t *testing.T) {
+	frames := &fakeFrames{}
+	srv := newTestCameraServer(t, HTTPSettings{camStreamsPerClient: 1}, frames)
+
+	res, err := http.Get(srv.URL + "/camera/stream?fps=5&width=160&height=90")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("Bad stream type %q %v", res.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("Bad part %v", part.Header)
+		}
+		if _, err := jpeg.Decode(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One stream per client
+	second, err := http.Get(srv.URL + "/camera/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Body.Close()
+	if second.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected the second stream refused, got %d", second.StatusCode)
+	}
+
+	if res, _ := http.Get(srv.URL + "/camera/stream?fps=60"); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected fps over the cap refused, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// Eve's power characteristics, which Eve shows for outlets and lets
+// automations use
+const (
+	TypeEveWatts     = "E863F10D-079E-48FF-8F27-9C2605A29F52"
+	TypeEveTotalKWh  = "E863F10C-079E-48FF-8F27-9C2605A29F52"
+	compressorWindow = 24 * time.Hour
+)
+
+var (
+	// compressorSlopeWindow is how far back the temperature slope is fitted
+	compressorSlopeWindow = 5 * time.Minute
+	// compressorSlopeC is the slope in degrees C an hour that counts as
+	// cooling or warming, halved in eco mode where the compressor runs slower
+	compressorSlopeC = 2.0
+	// compressorSagVolts is how far the input voltage drops under compressor load
+	compressorSagVolts = 0.2
+	// compressorMaxGap is the longest silence treated as more of the same,
+	// longer gaps aren't counted towards duty cycle or energy
+	compressorMaxGap = 2 * time.Minute
+)
+
+// PowerProfile is what the fridge draws from its input in each mode
+type PowerProfile struct {
+	Max  float64 `json:"max"`  // watts with the compressor running flat out
+	Eco  float64 `json:"eco"`  // watts with the compressor running in eco mode
+	Idle float64 `json:"idle"` // watts with the fridge on and the compressor resting
+}
+
+// parsePowerProfile reads mode:watts pairs, e.g. max:45,eco:30,idle:1.5
+func parsePowerProfile(s string) (PowerProfile, error) {
+	p := PowerProfile{}
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return p, fmt.Errorf("Bad power profile %q, want mode:watts", pair)
+		}
+		w, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || w < 0 {
+			return p, fmt.Errorf("Bad power profile watts %q", parts[1])
+		}
+		switch mode := strings.ToLower(parts[0]); mode {
+		case "max":
+			p.Max = w
+		case "eco":
+			p.Eco = w
+		case "idle":
+			p.Idle = w
+		default:
+			return p, fmt.Errorf("Unknown power profile mode %q, want max, eco or idle", parts[0])
+		}
+		seen[strings.ToLower(parts[0])] = true
+	}
+	if !seen["max"] || !seen["eco"] || !seen["idle"] {
+		return p, fmt.Errorf("Power profile needs max, eco and idle watts")
+	}
+	return p, nil
+}
+
+// watts is the draw for a fridge state
+func (p PowerProfile) watts(on, running, eco bool) float64 {
+	switch {
+	case !on:
+		return 0
+	case !running:
+		return p.Idle
+	case eco:
+		return p.Eco
+	}
+	return p.Max
+}
+
+// compressorReading is one status report, kept for the slope fit
+type compressorReading struct {
+	at   time.Time
+	temp float64
+}
+
+// compressorSegment is a stretch of time with the same power draw
+type compressorSegment struct {
+	start, end time.Time
+	on         bool
+	running    bool
+	eco        bool
+	watts      float64
+}
+
+// CompressorPeriod is a stretch of time the compressor ran
+type CompressorPeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Eco   bool      `json:"eco"`
+}
+
+// CompressorState is the analyzer's view of the compressor and its energy use
+type CompressorState struct {
+	Running      bool               `json:"running"`
+	Since        *time.Time         `json:"since,omitempty"` // when it last started or stopped
+	Reasons      []string           `json:"reasons"`         // the evidence for the last decision
+	TempSlope    float64            `json:"tempSlope"`       // degrees an hour in the fridge's unit
+	VoltageSag   float64            `json:"voltageSag"`      // volts below the resting input voltage
+	Watts        float64            `json:"watts"`
+	DutyCycle1h  float64            `json:"dutyCycle1h"` // share of the time the fridge was on
+	DutyCycle24h float64            `json:"dutyCycle24h"`
+	Cycles24h    int                `json:"cycles24h"`
+	WattHours1h  float64            `json:"wattHours1h"`
+	WattHours24h float64            `json:"wattHours24h"`
+	WattHours    float64            `json:"wattHoursTotal"` // since the daemon started
+	Profile      PowerProfile       `json:"profile"`
+	Periods      []CompressorPeriod `json:"periods,omitempty"` // runs in the last 24h, oldest first
+}
+
+// Compressor infers when the compressor runs, which the fridge doesn't
+// report, from the temperature slope, the hysteresis band (E3), sag in the
+// input voltage and eco mode, and integrates a power profile over it. A nil
+// Compressor infers nothing.
+type Compressor struct {
+	mu        sync.Mutex
+	profile   PowerProfile
+	readings  []compressorReading
+	segments  []compressorSegment
+	baseline  float64 // resting input voltage, learned while the compressor is off
+	running   bool
+	since     time.Time
+	reasons   []string
+	slope     float64
+	sag       float64
+	wattHours float64
+	last      time.Time
+}
+
+func newCompressor(profile PowerProfile) *Compressor {
+	return &Compressor{profile: profile, reasons: []string{}}
+}
+
+// fitSlope is the least squares slope of the readings in degrees an hour
+func fitSlope(readings []compressorReading) float64 {
+	if len(readings) < 2 || readings[len(readings)-1].at.Sub(readings[0].at) < time.Minute {
+		return 0
+	}
+	t0 := readings[0].at
+	var sx, sy, sxx, sxy float64
+	for _, r := range readings {
+		x := r.at.Sub(t0).Hours()
+		sx += x
+		sy += r.temp
+		sxx += x * x
+		sxy += x * r.temp
+	}
+	n := float64(len(readings))
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
+
+// evidence scores how much r looks like the compressor running, positive
+// for running and negative for resting
+func (c *Compressor) evidence(r k25.StatusReport) (int, []string) {
+	score, reasons := 0, []string{}
+	if c.baseline > 0 {
+		switch {
+		case c.sag >= compressorSagVolts:
+			score += 2
+			reasons = append(reasons, fmt.Sprintf("input sagged %.1fV", c.sag))
+		case c.sag <= -compressorSagVolts:
+			score -= 2
+			reasons = append(reasons, fmt.Sprintf("input recovered %.1fV", -c.sag))
+		case c.sag < compressorSagVolts/2 && c.running:
+			score -= 2
+			reasons = append(reasons, "input sag gone")
+		case c.sag < compressorSagVolts/2:
+			score--
+			reasons = append(reasons, "no input sag")
+		}
+	}
+
+	threshold := compressorSlopeC
+	if r.CelsiusFahrenheitModeMenuE5 {
+		threshold *= 1.8
+	}
+	if r.EcoMode {
+		threshold /= 2
+	}
+	switch {
+	case c.slope <= -threshold:
+		score++
+		reasons = append(reasons, fmt.Sprintf("cooling %.1f°/h", -c.slope))
+	case c.slope >= threshold:
+		score--
+		reasons = append(reasons, fmt.Sprintf("warming %.1f°/h", c.slope))
+	}
+
+	// The thermostat starts the compressor above the band and stops it at the setpoint
+	switch {
+	case int(r.Temp) >= int(r.TempSet)+int(r.HysteresisMenuE3):
+		score++
+		reasons = append(reasons, "above the hysteresis band")
+	case r.Temp < r.TempSet:
+		score--
+		reasons = append(reasons, "below the setpoint")
+	}
+	return score, reasons
+}
+
+// Observe feeds the analyzer a status report
+func (c *Compressor) Observe(r k25.StatusReport, at time.Time) {
+	if c == nil || r.Settings == initialFridgeSettings {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	volts := inputVoltage(r.Sensors)
+
+	c.readings = append(c.readings, compressorReading{at: at, temp: float64(r.Temp)})
+	cut := 0
+	for cut < len(c.readings) && at.Sub(c.readings[cut].at) > compressorSlopeWindow {
+		cut++
+	}
+	c.readings = c.readings[cut:]
+	c.slope = fitSlope(c.readings)
+	c.sag = 0
+	if c.baseline > 0 {
+		c.sag = c.baseline - volts
+	}
+
+	running := c.running
+	if !r.On {
+		running, c.reasons = false, []string{"fridge is off"}
+	} else {
+		score, reasons := c.evidence(r)
+		c.reasons = reasons
+		switch {
+		case score >= 2:
+			running = true
+		case score <= -1:
+			running = false
+		}
+	}
+	if running != c.running || c.since.IsZero() {
+		c.since = at
+	}
+	c.running = running
+
+	// Learn the resting voltage, jumping to it when it rises past the old one
+	if !running {
+		switch {
+		case c.baseline == 0 || volts-c.baseline >= compressorSagVolts:
+			c.baseline = volts
+		default:
+			c.baseline += (volts - c.baseline) * 0.2
+		}
+	}
+
+	c.record(r, at)
+}
+
+// record extends the current segment to at, or starts a new one
+func (c *Compressor) record(r k25.StatusReport, at time.Time) {
+	seg := compressorSegment{start: at, end: at, on: r.On, running: c.running, eco: r.EcoMode}
+	seg.watts = c.profile.watts(seg.on, seg.running, seg.eco)
+	n := len(c.segments)
+	gap := c.last.IsZero() || at.Sub(c.last) > compressorMaxGap
+	if !gap && n > 0 {
+		cur := &c.segments[n-1]
+		c.wattHours += cur.watts * at.Sub(cur.end).Hours()
+		cur.end = at
+		if cur.on == seg.on && cur.running == seg.running && cur.eco == seg.eco {
+			c.last = at
+			return
+		}
+	}
+	c.segments = append(c.segments, seg)
+	c.last = at
+
+	cut := 0
+	for cut < len(c.segments)-1 && at.Sub(c.segments[cut].end) > compressorWindow {
+		cut++
+	}
+	c.segments = c.segments[cut:]
+}
+
+// window sums running time, on time, energy and starts since t
+func (c *Compressor) window(t time.Time) (duty, wattHours float64, starts int) {
+	var running, on time.Duration
+	for i, s := range c.segments {
+		start, end := s.start, s.end
+		if end.Before(t) {
+			continue
+		}
+		if start.Before(t) {
+			start = t
+		}
+		d := end.Sub(start)
+		if s.on {
+			on += d
+		}
+		if s.running {
+			running += d
+			if !s.start.Before(t) && (i == 0 || !c.segments[i-1].running) {
+				starts++
+			}
+		}
+		wattHours += s.watts * d.Hours()
+	}
+	if on > 0 {
+		duty = running.Seconds() / on.Seconds()
+	}
+	return duty, wattHours, starts
+}
+
+// State reports the compressor, duty cycle and energy as of the last report
+func (c *Compressor) State(periods bool) CompressorState {
+	if c == nil {
+		return CompressorState{Reasons: []string{}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CompressorState{
+		Running:    c.running,
+		Reasons:    append([]string{}, c.reasons...),
+		TempSlope:  round2(c.slope),
+		VoltageSag: round2(c.sag),
+		WattHours:  round2(c.wattHours),
+		Profile:    c.profile,
+	}
+	if !c.since.IsZero() {
+		since := c.since
+		s.Since = &since
+	}
+	if n := len(c.segments); n > 0 {
+		s.Watts = c.segments[n-1].watts
+	}
+	var wh1, wh24 float64
+	s.DutyCycle1h, wh1, _ = c.window(c.last.Add(-time.Hour))
+	s.DutyCycle24h, wh24, s.Cycles24h = c.window(c.last.Add(-compressorWindow))
+	s.DutyCycle1h, s.DutyCycle24h = round2(s.DutyCycle1h), round2(s.DutyCycle24h)
+	s.WattHours1h, s.WattHours24h = round2(wh1), round2(wh24)
+
+	if periods {
+		for _, seg := range c.segments {
+			n := len(s.Periods)
+			switch {
+			case !seg.running:
+			case n > 0 && s.Periods[n-1].End.Equal(seg.start):
+				// Eco toggled mid run
+				s.Periods[n-1].End = seg.end
+			default:
+				s.Periods = append(s.Periods, CompressorPeriod{Start: seg.start, End: seg.end, Eco: seg.eco})
+			}
+		}
+	}
+	return s
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// hkEnergy is Eve's power and energy readings, shown on the thermostat
+type hkEnergy struct {
+	Watts    *characteristic.Float
+	TotalKWh *characteristic.Float
+}
+
+func newHKEnergy() *hkEnergy {
+	reading := func(typ, description string, max float64) *characteristic.Float {
+		c := characteristic.NewFloat(typ)
+		c.Format = characteristic.FormatFloat
+		c.Perms = characteristic.PermsRead()
+		c.Description = description
+		c.SetMinValue(0)
+		c.SetMaxValue(max)
+		c.SetStepValue(0.01)
+		c.SetValue(0)
+		return c
+	}
+	return &hkEnergy{
+		Watts:    reading(TypeEveWatts, "Consumption", 1000),
+		TotalKWh: reading(TypeEveTotalKWh, "Total Consumption", 1000000),
+	}
+}
+
+func handleCompressor(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireStatus(w, f); !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, f.compressor.State(true))
+	}
+}
+
+// registerCompressor adds the compressor endpoint to mux
+func registerCompressor(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/compressor", methods(handleCompressor(f), http.MethodGet))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParsePowerProfile(t *testing.T) {
+	p, err := parsePowerProfile("max:45, eco:30,IDLE:1.5")
+	if err != nil || p != (PowerProfile{Max: 45, Eco: 30, Idle: 1.5}) {
+		t.Fatalf("Bad profile %+v %v", p, err)
+	}
+	for _, bad := range []string{"", "max:45,eco:30", "max:45,eco:30,idle:x", "max:45,eco:30,idle:-1", "max:45,eco:30,idle:1,turbo:60", "max=45"} {
+		if _, err := parsePowerProfile(bad); err == nil {
+			t.Fatalf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestCompressorInference(t *testing.T) {
+	c := newCompressor(PowerProfile{Max: 40, Eco: 20, Idle: 2})
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	r := testStatusReport // F, set 37, E3 4
+	r.EcoMode = false
+	at := start
+	run := func(minutes int, temp func(m float64) float64, volts float64) {
+		r.InputV1, r.InputV2 = int8(volts), int8(math.Round((volts-math.Floor(volts))*10))
+		for s := 0; s < minutes*60; s += 10 {
+			r.Temp = int8(math.Round(temp(float64(s) / 60)))
+			c.Observe(r, at)
+			at = at.Add(10 * time.Second)
+		}
+	}
+
+	// Resting and warming up to the top of the band
+	run(10, func(m float64) float64 { return 38 + m*0.3 }, 12.8)
+	if s := c.State(false); s.Running || s.Watts != 2 {
+		t.Fatalf("Expected the compressor resting, got %+v", s)
+	}
+	// Running, the input sags and the temperature falls
+	run(20, func(m float64) float64 { return 41 - m*0.2 }, 12.4)
+	s := c.State(false)
+	if !s.Running || s.Watts != 40 || s.VoltageSag < 0.3 || s.TempSlope >= 0 {
+		t.Fatalf("Expected the compressor running, got %+v", s)
+	}
+	// Stopped at the setpoint, the input recovers
+	run(30, func(m float64) float64 { return 37 + m*0.07 }, 12.8)
+	s = c.State(true)
+	if s.Running || s.Since == nil || s.Since.Sub(start) < 30*time.Minute {
+		t.Fatalf("Expected the compressor stopped at 30m, got %+v", s)
+	}
+
+	if math.Abs(s.DutyCycle1h-1.0/3) > 0.03 || s.Cycles24h != 1 {
+		t.Fatalf("Expected a third duty cycle over one run, got %v %d", s.DutyCycle1h, s.Cycles24h)
+	}
+	if want := 40*20.0/60 + 2*40.0/60; math.Abs(s.WattHours1h-want) > 0.5 || math.Abs(s.WattHours-s.WattHours24h) > 0.01 {
+		t.Fatalf("Expected about %.1fWh, got %v %v", want, s.WattHours1h, s.WattHours)
+	}
+	if len(s.Periods) != 1 || s.Periods[0].Start.Sub(start) < 10*time.Minute || s.Periods[0].Start.Sub(start) > 11*time.Minute {
+		t.Fatalf("Bad periods %+v", s.Periods)
+	}
+
+	// Off draws nothing, and silence isn't counted
+	r.On = false
+	at = at.Add(time.Hour)
+	c.Observe(r, at)
+	c.Observe(r, at.Add(time.Minute))
+	s = c.State(false)
+	if s.Running || s.Watts != 0 || s.Reasons[0] != "fridge is off" || s.DutyCycle1h != 0 {
+		t.Fatalf("Expected the fridge off, got %+v", s)
+	}
+}
+
+func TestCompressorHTTP(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	f.compressor = newCompressor(PowerProfile{Max: 40, Eco: 20, Idle: 2})
+	f.compressor.Observe(testStatusReport, time.Now())
+	mux := http.NewServeMux()
+	registerCompressor(mux, f)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/compressor", nil))
+	var s CompressorState
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil || rec.Code != http.StatusOK || s.Profile.Max != 40 || s.Watts != 2 {
+		t.Fatalf("Bad compressor state %d %s %v", rec.Code, rec.Body, err)
+	}
+}
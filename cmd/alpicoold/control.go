@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+// Control modes and actuators
+const (
+	controlOff      = "off"
+	controlPID      = "pid"
+	controlBangBang = "bang-bang"
+
+	actuateSetpoint = "setpoint" // move TempSet so the fridge's thermostat starts or stops
+	actuatePower    = "power"    // turn the fridge on to cool and off to rest
+)
+
+var (
+	// controlInterval is how often the controller decides
+	controlInterval = 30 * time.Second
+	// controlMinPulse is the shortest run or rest a PID period is split into
+	controlMinPulse = time.Minute
+	// controlResend is how long to wait for the fridge to report a change
+	// before sending it again
+	controlResend = time.Minute
+
+	sourceControl = Source{Name: "control", Priority: prioritySchedule}
+
+	errControlOff = errors.New("Thermostat control is off")
+)
+
+// ControlSettings avoids lots of args to newController
+type ControlSettings struct {
+	mode        string
+	target      float64 // degrees C, fractional
+	band        float64 // bang-bang, degrees C either side of the target
+	kp, ki, kd  float64 // PID gains per degree C, per degree C minute and per degree C a minute
+	period      time.Duration
+	minOff      time.Duration
+	actuator    string
+	probeMaxAge time.Duration
+}
+
+// Validate checks the settings make sense
+func (s ControlSettings) Validate() error {
+	switch s.mode {
+	case controlOff, controlPID, controlBangBang:
+	default:
+		return fmt.Errorf("Unknown control mode %q, want off, pid or bang-bang", s.mode)
+	}
+	switch s.actuator {
+	case actuateSetpoint, actuatePower:
+	default:
+		return fmt.Errorf("Unknown control actuator %q, want setpoint or power", s.actuator)
+	}
+	if s.band <= 0 || s.kp < 0 || s.ki < 0 || s.kd < 0 {
+		return errors.New("Control band must be positive and gains can't be negative")
+	}
+	if s.period < 2*controlMinPulse || s.minOff < 0 {
+		return fmt.Errorf("Control period must be at least %s", 2*controlMinPulse)
+	}
+	return nil
+}
+
+// parseTemperature reads a temperature with its unit, e.g. 4.5C or 40.1F, as
+// degrees C. A delta is a difference, so 0.9F is 0.5C.
+func parseTemperature(s string, delta bool) (float64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	bad := fmt.Errorf("Bad temperature %q, want a number and unit like 4.5C or 40.1F", s)
+	if len(s) < 2 {
+		return 0, bad
+	}
+	v, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, bad
+	}
+	switch s[len(s)-1] {
+	case 'C':
+		return v, nil
+	case 'F':
+		if delta {
+			return v / 1.8, nil
+		}
+		return FtoC(v), nil
+	}
+	return 0, bad
+}
+
+// parseControlGains reads PID gains as kp:0.5,ki:0.02,kd:0 pairs into settings
+func parseControlGains(s string, settings *ControlSettings) error {
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Bad control gain %q, want term:gain", pair)
+		}
+		g, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || g < 0 {
+			return fmt.Errorf("Bad control gain %q", parts[1])
+		}
+		switch term := strings.ToLower(parts[0]); term {
+		case "kp":
+			settings.kp = g
+		case "ki":
+			settings.ki = g
+		case "kd":
+			settings.kd = g
+		default:
+			return fmt.Errorf("Unknown control gain %q, want kp, ki or kd", parts[0])
+		}
+		seen[strings.ToLower(parts[0])] = true
+	}
+	if !seen["kp"] || !seen["ki"] || !seen["kd"] {
+		return fmt.Errorf("Control gains need kp, ki and kd")
+	}
+	return nil
+}
+
+// ControlState is what the controller is doing
+type ControlState struct {
+	Mode          string     `json:"mode"`
+	Target        float64    `json:"target"` // degrees C
+	Band          float64    `json:"band"`
+	Kp            float64    `json:"kp"`
+	Ki            float64    `json:"ki"`
+	Kd            float64    `json:"kd"`
+	PeriodSeconds float64    `json:"periodSeconds"`
+	MinOffSeconds float64    `json:"minOffSeconds"`
+	Actuator      string     `json:"actuator"`
+	Feedback      string     `json:"feedback,omitempty"` // probe or fridge
+	Temp          *float64   `json:"temp,omitempty"`     // the feedback, degrees C
+	Probe         *float64   `json:"probe,omitempty"`    // last probe reading, degrees C
+	ProbeAt       *time.Time `json:"probeAt,omitempty"`
+	Cooling       bool       `json:"cooling"`
+	Since         *time.Time `json:"since,omitempty"` // when it last switched
+	Output        float64    `json:"output"`          // PID duty, 0 to 1
+	Integral      float64    `json:"integral"`        // degree C minutes
+	Held          string     `json:"held,omitempty"`  // why the controller isn't acting right now
+	Error         string     `json:"error,omitempty"` // the last command that failed
+}
+
+// Controller holds a fractional setpoint the fridge's whole degree
+// thermostat can't, by starting and stopping the compressor itself. It
+// moves TempSet past the fridge's temperature, or turns the fridge on and
+// off. A nil Controller controls nothing.
+type Controller struct {
+	mu       sync.Mutex
+	settings ControlSettings
+	wake     chan struct{}
+
+	probe      float64
+	probeAt    time.Time
+	probeStale bool
+
+	cooling   bool
+	since     time.Time
+	window    time.Time // start of the PID period
+	integral  float64
+	lastErr   float64
+	lastAt    time.Time
+	output    float64
+	temp      *float64
+	feedback  string
+	saved     *k25.Settings // the user's settings from before control started
+	sent      k25.Settings
+	sentAt    time.Time
+	held, err string
+}
+
+func newController(settings ControlSettings) *Controller {
+	return &Controller{settings: settings, wake: make(chan struct{}, 1)}
+}
+
+// Probe records an external temperature reading in degrees C
+func (c *Controller) Probe(celsius float64, at time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.probe, c.probeAt = celsius, at
+	c.mu.Unlock()
+}
+
+// Configure swaps the settings, starting afresh when the mode changes
+func (c *Controller) Configure(s ControlSettings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if s.mode != c.settings.mode {
+		c.cooling, c.since, c.window, c.integral, c.lastAt, c.output = false, time.Time{}, time.Time{}, 0, time.Time{}, 0
+		c.held, c.err = "", ""
+	}
+	c.settings = s
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Settings are the current settings
+func (c *Controller) Settings() ControlSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings
+}
+
+// State is what the controller is doing
+func (c *Controller) State() ControlState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.settings
+	st := ControlState{
+		Mode:          s.mode,
+		Target:        round2(s.target),
+		Band:          s.band,
+		Kp:            s.kp,
+		Ki:            s.ki,
+		Kd:            s.kd,
+		PeriodSeconds: s.period.Seconds(),
+		MinOffSeconds: s.minOff.Seconds(),
+		Actuator:      s.actuator,
+		Cooling:       c.cooling,
+		Output:        round2(c.output),
+		Integral:      round2(c.integral),
+		Held:          c.held,
+		Error:         c.err,
+	}
+	if s.mode == controlOff {
+		return st
+	}
+	st.Feedback, st.Temp = c.feedback, c.temp
+	if !c.probeAt.IsZero() {
+		probe, at := c.probe, c.probeAt
+		st.Probe, st.ProbeAt = &probe, &at
+	}
+	if !c.since.IsZero() {
+		since := c.since
+		st.Since = &since
+	}
+	return st
+}
+
+// decide works out whether the compressor should run, with c.mu held.
+// offSince is when the compressor last stopped, as far as anyone knows.
+func (c *Controller) decide(temp float64, offSince time.Time, now time.Time) bool {
+	s := c.settings
+	e := temp - s.target
+	want := c.cooling
+	switch s.mode {
+	case controlBangBang:
+		if e >= s.band {
+			want = true
+		} else if e <= -s.band {
+			want = false
+		}
+	case controlPID:
+		dt, deriv := 0.0, 0.0
+		if !c.lastAt.IsZero() {
+			dt = now.Sub(c.lastAt).Minutes()
+		}
+		if dt > 0 {
+			deriv = (e - c.lastErr) / dt
+		}
+		u := s.kp*e + s.ki*c.integral + s.kd*deriv
+		// Anti-windup: stop integrating while saturated the same way
+		if !(u >= 1 && e > 0) && !(u <= 0 && e < 0) {
+			c.integral += e * dt
+			u = s.kp*e + s.ki*c.integral + s.kd*deriv
+		}
+		c.output = math.Max(0, math.Min(1, u))
+		c.lastErr, c.lastAt = e, now
+
+		// Run for the output's share of each period
+		if c.window.IsZero() || now.Sub(c.window) >= s.period {
+			c.window = now
+		}
+		on := time.Duration(c.output * float64(s.period))
+		switch {
+		case on < controlMinPulse:
+			on = 0
+		case s.period-on < controlMinPulse:
+			on = s.period
+		}
+		want = now.Sub(c.window) < on
+	}
+
+	c.held = ""
+	if want && !c.cooling {
+		if c.since.After(offSince) {
+			offSince = c.since
+		}
+		if !offSince.IsZero() && now.Sub(offSince) < s.minOff {
+			c.held = fmt.Sprintf("minimum compressor off-time until %s", offSince.Add(s.minOff).Format(time.Kitchen))
+			want = false
+		}
+	}
+	if want != c.cooling {
+		c.cooling, c.since = want, now
+	}
+	return want
+}
+
+// controlWant works out the fridge settings that make it run or rest. Running
+// puts TempSet at least E3 under the temperature, below the target, and
+// resting puts it at or over both, so the fridge's thermostat agrees.
+func controlWant(r k25.StatusReport, s ControlSettings, cool bool) k25.Settings {
+	want := r.Settings
+	target := s.target
+	if r.CelsiusFahrenheitModeMenuE5 {
+		target = CtoF(target)
+	}
+	temp := float64(r.Temp)
+	if cool {
+		set := math.Min(math.Floor(target)-1, temp-float64(r.HysteresisMenuE3))
+		want.TempSet = int8(math.Max(set, float64(r.LowestTempSettingMenuE1)))
+		want.On = true
+		return want
+	}
+	if s.actuator == actuatePower {
+		want.On = false
+		return want
+	}
+	set := math.Ceil(math.Max(temp, target))
+	want.TempSet = int8(math.Min(set, float64(r.HighestTempSettingMenuE2)))
+	return want
+}
+
+// controlCommand changes settings as the controller, without holding them
+var controlCommand = Command{Source: sourceControl, Hold: noHold}
+
+// applyControl sends the settings the fridge should have, by SetTempCommand when
+// only TempSet changes
+func (f *Fridge) applyControl(ctx context.Context, r k25.StatusReport, want k25.Settings) error {
+	if want == r.Settings {
+		return nil
+	}
+	if want.On == r.On {
+		return f.SendTempSet(ctx, controlCommand, want.TempSet)
+	}
+	_, err := f.UpdateSettings(ctx, controlCommand, func(s *k25.Settings) {
+		s.On, s.TempSet = want.On, want.TempSet
+	})
+	return err
+}
+
+// controlStep decides once and acts on it
+func (f *Fridge) controlStep(ctx context.Context, now time.Time) {
+	c := f.control
+	r := f.GetStatusReport()
+	if r.Settings == initialFridgeSettings {
+		return
+	}
+	c.mu.Lock()
+	s := c.settings
+
+	if s.mode == controlOff {
+		saved := c.saved
+		c.saved = nil
+		c.mu.Unlock()
+		if saved != nil {
+			f.restoreControl(ctx, *saved)
+		}
+		return
+	}
+	if f.Stale() {
+		// Leave it to the fridge's thermostat until reports come back
+		c.held = "status reports are stale"
+		c.mu.Unlock()
+		return
+	}
+	if c.saved == nil {
+		saved := r.Settings
+		c.saved = &saved
+	}
+
+	// Feedback from the probe while it's fresh, otherwise the fridge
+	temp, _ := reportCelsius(r)
+	c.feedback = "fridge"
+	stale := false
+	if !c.probeAt.IsZero() {
+		if now.Sub(c.probeAt) <= s.probeMaxAge {
+			temp, c.feedback = c.probe, "probe"
+		} else {
+			stale = true
+		}
+	}
+	alert := stale != c.probeStale
+	c.probeStale = stale
+	t := round2(temp)
+	c.temp = &t
+
+	var offSince time.Time
+	if comp := f.compressor.State(false); !comp.Running && comp.Since != nil {
+		offSince = *comp.Since
+	}
+	cool := c.decide(temp, offSince, now)
+	want := controlWant(r, s, cool)
+	resend := want != c.sent || now.Sub(c.sentAt) >= controlResend
+	if want != r.Settings && resend {
+		c.sent, c.sentAt = want, now
+	}
+	c.mu.Unlock()
+
+	if alert && stale {
+		f.Alert("warn", "control", "Probe reading is stale, controlling from the fridge's sensor")
+	} else if alert {
+		f.Alert("info", "control", "Probe readings resumed")
+	}
+	if want == r.Settings || !resend {
+		return
+	}
+	err := f.applyControl(ctx, r, want)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var conflict *ConflictError
+	switch {
+	case errors.As(err, &conflict) || errors.Is(err, errQueued):
+		// Someone took over by hand, wait for their hold to end
+		c.held, c.err = err.Error(), ""
+		c.sentAt = time.Time{}
+	case err != nil:
+		c.err = err.Error()
+	default:
+		c.err = ""
+	}
+}
+
+// restoreControl puts back the user's setpoint and power from before control
+// started, unless someone has since taken them over
+func (f *Fridge) restoreControl(ctx context.Context, saved k25.Settings) {
+	_, err := f.UpdateSettings(ctx, controlCommand, func(s *k25.Settings) {
+		s.On, s.TempSet = saved.On, saved.TempSet
+	})
+	var conflict *ConflictError
+	if err != nil && !errors.As(err, &conflict) {
+		log.WithFields(log.Fields{"client": "ControlClient", "err": err}).Error("Failed to restore settings after control")
+	}
+}
+
+// ControlClient runs the controller until ctx is done, then tries to hand the
+// fridge back with the settings it had before control started
+func ControlClient(ctx context.Context, wg *sync.WaitGroup, f *Fridge, c *Controller) {
+	wg.Add(1)
+	defer func() {
+		log.WithFields(log.Fields{
+			"client": "ControlClient",
+		}).Trace("Calling done on main wait group")
+		wg.Done()
+	}()
+	ticker := time.NewTicker(controlInterval)
+	defer ticker.Stop()
+	step := func() {
+		ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+		defer cancel()
+		f.controlStep(ctx, time.Now())
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			saved := c.saved
+			c.mu.Unlock()
+			if saved != nil {
+				// Best effort, bluetooth may already be gone
+				ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+				f.restoreControl(ctx, *saved)
+				cancel()
+			}
+			return
+		case <-ticker.C:
+			step()
+		case <-c.wake:
+			step()
+		}
+	}
+}
+
+// controlPatch changes some control settings
+type controlPatch struct {
+	Mode     *string  `json:"mode"`
+	Target   *float64 `json:"target"`
+	Unit     string   `json:"unit"` // of the target and band, C by default
+	Band     *float64 `json:"band"`
+	Kp       *float64 `json:"kp"`
+	Ki       *float64 `json:"ki"`
+	Kd       *float64 `json:"kd"`
+	Actuator *string  `json:"actuator"`
+}
+
+// apply overlays the patch on s
+func (p controlPatch) apply(s ControlSettings) (ControlSettings, error) {
+	unit := strings.ToUpper(p.Unit)
+	if unit == "" {
+		unit = "C"
+	}
+	if unit != "C" && unit != "F" {
+		return s, errors.New(`Unit must be "C" or "F"`)
+	}
+	if p.Mode != nil {
+		s.mode = *p.Mode
+	}
+	if p.Target != nil {
+		s.target = *p.Target
+		if unit == "F" {
+			s.target = FtoC(s.target)
+		}
+	}
+	if p.Band != nil {
+		s.band = *p.Band
+		if unit == "F" {
+			s.band /= 1.8
+		}
+	}
+	for _, g := range []struct {
+		v  *float64
+		to *float64
+	}{{p.Kp, &s.kp}, {p.Ki, &s.ki}, {p.Kd, &s.kd}} {
+		if g.v != nil {
+			*g.to = *g.v
+		}
+	}
+	if p.Actuator != nil {
+		s.actuator = *p.Actuator
+	}
+	return s, s.Validate()
+}
+
+func handleControl(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.control == nil {
+			writeError(w, http.StatusNotFound, errControlOff)
+			return
+		}
+		switch r.Method {
+		case http.MethodPatch:
+			var p controlPatch
+			if err := decodeBody(w, r, &p); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			s, err := p.apply(f.control.Settings())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			f.control.Configure(s)
+		case http.MethodDelete:
+			// Bypass, the fridge's own thermostat takes over again
+			s := f.control.Settings()
+			s.mode = controlOff
+			f.control.Configure(s)
+		}
+		writeJSON(w, http.StatusOK, f.control.State())
+	}
+}
+
+func handleControlProbe(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.control == nil {
+			writeError(w, http.StatusNotFound, errControlOff)
+			return
+		}
+		var req temperatureRequest
+		if err := decodeBody(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Value == nil {
+			writeError(w, http.StatusBadRequest, errors.New("Missing value"))
+			return
+		}
+		celsius := *req.Value
+		switch strings.ToUpper(req.Unit) {
+		case "C":
+		case "F":
+			celsius = FtoC(celsius)
+		default:
+			writeError(w, http.StatusBadRequest, errors.New(`Unit must be "C" or "F"`))
+			return
+		}
+		f.control.Probe(celsius, time.Now())
+		writeJSON(w, http.StatusOK, f.control.State())
+	}
+}
+
+// registerControl adds the thermostat control endpoints to mux
+func registerControl(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/control", methods(handleControl(f), http.MethodGet, http.MethodPatch, http.MethodDelete))
+	mux.HandleFunc("/control/probe", methods(handleControlProbe(f), http.MethodPut))
+}
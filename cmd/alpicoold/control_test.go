@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// controlSim is a fridge whose firmware runs the compressor from TempSet and
+// E3, warming 0.05°C and cooling 0.3°C a minute
+type controlSim struct {
+	f       *Fridge
+	temp    float64 // the real temperature in degrees C, the fridge reports it rounded in its unit
+	running bool
+	at      time.Time
+	applied <-chan k25.Settings
+	offAt   time.Time
+	minRest time.Duration // shortest rest between runs
+}
+
+func newControlSim(t *testing.T, settings ControlSettings, fahrenheit bool) *controlSim {
+	r := testStatusReport // F, E1 -4, E2 68, E3 4
+	if !fahrenheit {
+		r.CelsiusFahrenheitModeMenuE5 = false
+		r.TempSet, r.LowestTempSettingMenuE1, r.HighestTempSettingMenuE2, r.HysteresisMenuE3 = 4, -20, 20, 2
+	}
+	s := &controlSim{
+		f:       newTestFridge(r),
+		temp:    4.5,
+		at:      time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC),
+		minRest: 24 * time.Hour,
+	}
+	s.f.control = newController(settings)
+	s.report()
+	setCommandTimeout(t, 200*time.Millisecond)
+
+	s.applied = standInWriter(t, s.f, true)
+	return s
+}
+
+// fridgeTemp is the temperature as the fridge shows it
+func (s *controlSim) fridgeTemp() int8 {
+	if s.f.GetStatusReport().CelsiusFahrenheitModeMenuE5 {
+		return int8(math.Round(CtoF(s.temp)))
+	}
+	return int8(math.Round(s.temp))
+}
+
+func (s *controlSim) report() {
+	temp := s.fridgeTemp()
+	s.f.mu.Lock()
+	s.f.status.Temp = temp
+	s.f.mu.Unlock()
+}
+
+// run steps the controller every 30 seconds for d, calling check each step
+func (s *controlSim) run(d time.Duration, probe bool, check func()) {
+	for end := s.at.Add(d); s.at.Before(end); s.at = s.at.Add(controlInterval) {
+		if probe {
+			s.f.control.Probe(s.temp, s.at)
+		}
+		s.f.controlStep(context.Background(), s.at)
+		if s.f.control.sentAt.Equal(s.at) && s.f.control.err == "" {
+			<-s.applied
+		}
+
+		r := s.f.GetStatusReport()
+		switch temp := s.fridgeTemp(); {
+		case !r.On || s.running && temp <= r.TempSet:
+			if s.running {
+				s.offAt = s.at
+			}
+			s.running = false
+		case !s.running && temp >= r.TempSet+r.HysteresisMenuE3:
+			if !s.offAt.IsZero() && s.at.Sub(s.offAt) < s.minRest {
+				s.minRest = s.at.Sub(s.offAt)
+			}
+			s.running = true
+		}
+		if s.running {
+			s.temp -= 0.3 * controlInterval.Minutes()
+		} else {
+			s.temp += 0.05 * controlInterval.Minutes()
+		}
+		s.report()
+		if check != nil {
+			check()
+		}
+	}
+}
+
+var testControlSettings = ControlSettings{
+	mode:        controlBangBang,
+	target:      4.5,
+	band:        0.5,
+	kp:          0.5,
+	ki:          0.02,
+	period:      10 * time.Minute,
+	minOff:      5 * time.Minute,
+	actuator:    actuateSetpoint,
+	probeMaxAge: 2 * time.Minute,
+}
+
+func TestParseControl(t *testing.T) {
+	for in, want := range map[string]float64{"4.5C": 4.5, " 40.1f": 4.5, "-2C": -2} {
+		if got, err := parseTemperature(in, false); err != nil || math.Abs(got-want) > 0.01 {
+			t.Fatalf("%q: got %g %v, want %g", in, got, err, want)
+		}
+	}
+	if got, err := parseTemperature("0.9F", true); err != nil || math.Abs(got-0.5) > 0.01 {
+		t.Fatalf("Expected a 0.9F band to be 0.5C, got %g %v", got, err)
+	}
+	for _, bad := range []string{"4.5", "4.5K", "C", "warmC"} {
+		if _, err := parseTemperature(bad, false); err == nil {
+			t.Fatalf("Expected an error for %q", bad)
+		}
+	}
+
+	s := testControlSettings
+	if err := parseControlGains("kp:1, ki:0.1,KD:2", &s); err != nil || s.kp != 1 || s.ki != 0.1 || s.kd != 2 {
+		t.Fatalf("Bad gains %+v %v", s, err)
+	}
+	for _, bad := range []string{"kp:1,ki:0.1", "kp:1,ki:0.1,kd:-1", "kp:1,ki:0.1,kd:0,kx:1", "kp"} {
+		if err := parseControlGains(bad, &s); err == nil {
+			t.Fatalf("Expected an error for %q", bad)
+		}
+	}
+
+	s = testControlSettings
+	s.mode = "fuzzy"
+	if err := s.Validate(); err == nil {
+		t.Fatal("Expected an error for an unknown mode")
+	}
+	s = testControlSettings
+	s.period = time.Minute
+	if err := s.Validate(); err == nil {
+		t.Fatal("Expected an error for a period shorter than two pulses")
+	}
+}
+
+func TestControlHoldsTarget(t *testing.T) {
+	for _, test := range []struct {
+		mode       string
+		actuator   string
+		fahrenheit bool
+		deviation  float64 // furthest from the target once settled
+	}{
+		{controlBangBang, actuateSetpoint, false, 0.75},
+		{controlBangBang, actuateSetpoint, true, 0.75},
+		{controlBangBang, actuatePower, false, 0.75},
+		{controlPID, actuateSetpoint, false, 0.6},
+		{controlPID, actuateSetpoint, true, 0.6},
+	} {
+		settings := testControlSettings
+		settings.mode, settings.actuator = test.mode, test.actuator
+		s := newControlSim(t, settings, test.fahrenheit)
+		s.run(2*time.Hour, true, nil)
+
+		var sum, n, worst float64
+		s.run(6*time.Hour, true, func() {
+			sum += s.temp
+			n++
+			worst = math.Max(worst, math.Abs(s.temp-settings.target))
+			if s.f.control.err != "" {
+				t.Fatalf("%s: %s", test.mode, s.f.control.err)
+			}
+			// Never a setpoint that would freeze the load if the daemon died
+			if _, set := reportCelsius(s.f.GetStatusReport()); math.Abs(set-settings.target) > 3 {
+				t.Fatalf("%s by %s, F %v: setpoint %.1f°C is far from the target", test.mode, test.actuator, test.fahrenheit, set)
+			}
+		})
+		if mean := sum / n; math.Abs(mean-settings.target) > 0.25 || worst > test.deviation {
+			t.Fatalf("%s by %s, F %v: expected to hold %g°C, mean %.2f worst %.2f off", test.mode, test.actuator, test.fahrenheit, settings.target, mean, worst)
+		}
+		if s.minRest < settings.minOff {
+			t.Fatalf("%s by %s, F %v: compressor rested only %s", test.mode, test.actuator, test.fahrenheit, s.minRest)
+		}
+		if test.actuator == actuateSetpoint && !s.f.GetStatusReport().On {
+			t.Fatalf("%s: the setpoint actuator shouldn't switch the fridge off", test.mode)
+		}
+	}
+}
+
+func TestControlMinOff(t *testing.T) {
+	for _, mode := range []string{controlBangBang, controlPID} {
+		settings := testControlSettings
+		settings.mode, settings.kp = mode, 2
+		c := newController(settings)
+		now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+		c.mu.Lock()
+		if !c.decide(6, time.Time{}, now) {
+			t.Fatalf("%s: expected to cool well over the target", mode)
+		}
+		if c.decide(3, time.Time{}, now.Add(time.Minute)) {
+			t.Fatalf("%s: expected to rest well under the target", mode)
+		}
+		// Warm again straight away, but the compressor needs its rest
+		c.window = time.Time{}
+		if c.decide(6, time.Time{}, now.Add(3*time.Minute)) || !strings.Contains(c.held, "off-time") {
+			t.Fatalf("%s: expected the minimum off-time to hold, got %q", mode, c.held)
+		}
+		c.window = time.Time{}
+		if !c.decide(6, time.Time{}, now.Add(6*time.Minute)) || c.held != "" {
+			t.Fatalf("%s: expected to cool once the off-time passed, got %q", mode, c.held)
+		}
+		// The fridge's own thermostat stopping the compressor counts too
+		c.cooling, c.since, c.window = false, time.Time{}, time.Time{}
+		if c.decide(6, now.Add(5*time.Minute), now.Add(7*time.Minute)) {
+			t.Fatalf("%s: expected to wait out an inferred stop", mode)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestControlAntiWindup(t *testing.T) {
+	settings := testControlSettings
+	settings.mode = controlPID
+	c := newController(settings)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// An hour far too warm, e.g. while the lid was open, saturates the output
+	for i := 0; i <= 120; i++ {
+		c.decide(14.5, time.Time{}, now.Add(time.Duration(i)*controlInterval))
+	}
+	if c.output != 1 || c.integral > 10 {
+		t.Fatalf("Expected a saturated output without a wound up integral, got %g and %g", c.output, c.integral)
+	}
+	// So it backs off as soon as the target is passed
+	c.decide(4, time.Time{}, now.Add(61*time.Minute))
+	if c.output >= 0.5 {
+		t.Fatalf("Expected the output to drop under the target, got %g", c.output)
+	}
+}
+
+func TestControlProbeFallback(t *testing.T) {
+	s := newControlSim(t, testControlSettings, false)
+	sub := s.f.hub.Subscribe(10)
+	defer sub.Close()
+	s.run(time.Minute, true, nil)
+	if st := s.f.control.State(); st.Feedback != "probe" || st.Probe == nil {
+		t.Fatalf("Expected probe feedback, got %+v", st)
+	}
+	s.run(5*time.Minute, false, nil)
+	if st := s.f.control.State(); st.Feedback != "fridge" {
+		t.Fatalf("Expected to fall back to the fridge once the probe went stale, got %+v", st)
+	}
+	select {
+	case e := <-sub.C:
+		if e.Kind != eventAlert || !strings.Contains(e.Data.(Alert).Message, "stale") {
+			t.Fatalf("Expected a stale probe alert, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a stale probe alert")
+	}
+}
+
+func TestControlHTTP(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	mux := http.NewServeMux()
+	registerControl(mux, f)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	if res, _ := doRequest(t, http.MethodGet, srv.URL+"/control", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 without a controller, got %d", res.StatusCode)
+	}
+
+	settings := testControlSettings
+	settings.mode = controlOff
+	f.control = newController(settings)
+	setCommandTimeout(t, 200*time.Millisecond)
+	sent := standInWriter(t, f, true)
+
+	res, body := doRequest(t, http.MethodPatch, srv.URL+"/control", `{"mode": "pid", "target": 40.1, "unit": "F", "kp": 1}`)
+	if res.StatusCode != http.StatusOK || body["mode"] != "pid" || body["target"] != 4.5 || body["kp"] != 1.0 {
+		t.Fatalf("Bad patch %d %v", res.StatusCode, body)
+	}
+	if res, _ := doRequest(t, http.MethodPatch, srv.URL+"/control", `{"mode": "fuzzy"}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad mode, got %d", res.StatusCode)
+	}
+	if res, _ := doRequest(t, http.MethodPut, srv.URL+"/control/probe", `{"value": 5.5, "unit": "C"}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("Bad probe %d", res.StatusCode)
+	}
+
+	// 5.5°C is a degree over, so it cools from a setpoint under the target
+	f.controlStep(context.Background(), time.Now())
+	got := <-sent
+	if got.TempSet >= 37 || !got.On {
+		t.Fatalf("Expected a lower setpoint to start the compressor, got %+v", got)
+	}
+	if st := f.control.State(); !st.Cooling || st.Feedback != "probe" || st.Output != 1 {
+		t.Fatalf("Bad control state %+v", st)
+	}
+
+	// Bypass hands back the user's 37°F
+	res, body = doRequest(t, http.MethodDelete, srv.URL+"/control", "")
+	if res.StatusCode != http.StatusOK || body["mode"] != "off" {
+		t.Fatalf("Bad bypass %d %v", res.StatusCode, body)
+	}
+	f.controlStep(context.Background(), time.Now())
+	if got := <-sent; got.TempSet != 37 || !got.On {
+		t.Fatalf("Expected the user's settings back, got %+v", got)
+	}
+}
+
+func TestControlYieldsToManual(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	f.arbiter = newArbiter(map[CommandPriority]time.Duration{priorityManual: 2 * time.Hour, prioritySafety: 10 * time.Minute})
+	f.control = newController(testControlSettings)
+	setCommandTimeout(t, 200*time.Millisecond)
+	standInWriter(t, f, false)
+
+	// Someone sets the temperature by hand, which holds it for two hours
+	if err := f.SendTemp(context.Background(), Command{Source: sourceHTTP}, 2); err != nil {
+		t.Fatal(err)
+	}
+	f.control.Probe(8, time.Now())
+	f.controlStep(context.Background(), time.Now())
+	if st := f.control.State(); !strings.Contains(st.Held, "http") || st.Error != "" {
+		t.Fatalf("Expected control held off by the manual change, got %+v", st)
+	}
+}
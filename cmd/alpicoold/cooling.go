@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// coolingMinRun is the shortest compressor run worth learning from
+	coolingMinRun = 5 * time.Minute
+	// coolingLearnRuns is how many runs a baseline needs before it's trusted
+	coolingLearnRuns = 3
+	// coolingSlowFactor is the share of the baseline rate below which a run is slow
+	coolingSlowFactor = 0.5
+	// coolingSlowRuns is how many slow runs in a row flag degraded cooling
+	coolingSlowRuns = 2
+	// coolingKeepReports is how many periodic reports are kept for /cooling
+	coolingKeepReports = 48
+	// coolingKeepRuns is how many recent runs reports show
+	coolingKeepRuns = 20
+)
+
+// coolingAmbient classes how warm it is around the fridge from how fast it
+// warms up while the compressor rests, in degrees C a minute. The fridge has
+// no ambient sensor, but a warmer room leaks heat in faster.
+var coolingAmbient = []struct {
+	name string
+	leak float64 // warming slower than this
+}{
+	{"cool", 0.05},
+	{"mild", 0.15},
+	{"warm", math.Inf(1)},
+}
+
+// CoolingSettings avoids lots of args to newCooling
+type CoolingSettings struct {
+	path     string        // learned baselines, empty keeps them in memory
+	stall    time.Duration // how long cooling can be flat or rising while needed
+	interval time.Duration // between periodic reports
+}
+
+// Validate checks the settings make sense
+func (s CoolingSettings) Validate() error {
+	if s.stall <= 0 || s.interval <= 0 {
+		return errors.New("COOLING_STALL_SEC and COOLING_REPORT_SEC must be positive")
+	}
+	return nil
+}
+
+// CoolingBaseline is the learned pull-down rate for one setpoint band and ambient
+type CoolingBaseline struct {
+	Bucket  string    `json:"bucket"`
+	Rate    float64   `json:"rate"` // degrees C a minute while cooling
+	Runs    int       `json:"runs"`
+	Learned bool      `json:"learned"`
+	Updated time.Time `json:"updated"`
+}
+
+// CoolingRun is one compressor run and how fast it pulled the temperature down
+type CoolingRun struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Bucket   string    `json:"bucket"`
+	Rate     float64   `json:"rate"`               // degrees C a minute
+	Baseline float64   `json:"baseline,omitempty"` // the learned rate it was compared to
+	Slow     bool      `json:"slow"`
+}
+
+// CoolingReport is a snapshot of cooling health
+type CoolingReport struct {
+	Time         time.Time         `json:"time"`
+	Status       string            `json:"status"` // ok, degraded, learning or off
+	Issues       []string          `json:"issues"`
+	Bucket       string            `json:"bucket,omitempty"` // the conditions right now
+	StalledFor   float64           `json:"stalledForSeconds,omitempty"`
+	DutyCycle24h float64           `json:"dutyCycle24h"`
+	Cycles24h    int               `json:"cycles24h"`
+	Runs         []CoolingRun      `json:"runs"`      // newest first
+	Baselines    []CoolingBaseline `json:"baselines"` // by bucket
+}
+
+// Cooling learns how quickly the fridge normally pulls its temperature
+// down and flags when it stops managing: a run much slower than usual, or
+// the temperature flat or rising for too long while cooling is needed. A nil
+// Cooling watches nothing.
+type Cooling struct {
+	mu        sync.Mutex
+	settings  CoolingSettings
+	baselines map[string]*CoolingBaseline
+	runs      []CoolingRun
+	reports   []CoolingReport
+
+	on        bool
+	running   bool
+	set       float64 // setpoint in degrees C
+	leak      float64 // warming rate over the last rest, 0 until one is seen
+	restStart celsiusSample
+	runStart  celsiusSample
+	disturbed bool // lid or setpoint changed during the run
+
+	demand   bool      // above the top of the hysteresis band, until back at the setpoint
+	low      float64   // lowest temperature since demand started
+	lowAt    time.Time // when it was last lower
+	slow     int       // slow runs in a row
+	stalled  bool
+	degraded bool
+	issues   []string
+}
+
+func newCooling(settings CoolingSettings) (*Cooling, error) {
+	c := &Cooling{settings: settings, baselines: map[string]*CoolingBaseline{}, issues: []string{}}
+	if settings.path == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(settings.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	var saved []CoolingBaseline
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return c, fmt.Errorf("Bad cooling baselines in %s: %w", settings.path, err)
+	}
+	for i := range saved {
+		c.baselines[saved[i].Bucket] = &saved[i]
+	}
+	return c, nil
+}
+
+// bucket names the conditions a pull-down rate is learned for
+func (c *Cooling) bucket() string {
+	ambient := "unknown"
+	if c.leak > 0 {
+		for _, a := range coolingAmbient {
+			if c.leak < a.leak {
+				ambient = a.name
+				break
+			}
+		}
+	}
+	band := math.Floor(c.set/5) * 5
+	return fmt.Sprintf("%g to %g°C, %s", band, band+5, ambient)
+}
+
+// Observe takes a status report, whether the compressor is running and
+// whether the lid looks open, and returns the cooling issues and whether
+// they just changed
+func (c *Cooling) Observe(r k25.StatusReport, running, lidOpen bool, at time.Time) ([]string, bool) {
+	if c == nil || r.Settings == initialFridgeSettings {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	temp, set := reportCelsius(r)
+	band := float64(r.HysteresisMenuE3)
+	if r.CelsiusFahrenheitModeMenuE5 {
+		band /= 1.8
+	}
+	sample := celsiusSample{at: at, temp: temp}
+	setChanged := c.on && set != c.set
+	c.set = set
+
+	switch {
+	case !r.On:
+		c.running, c.demand = false, false
+	case running && (!c.running || !c.on):
+		// A run starts, and the rest before it says how warm it is outside
+		if c.on && !c.restStart.at.IsZero() && at.Sub(c.restStart.at) >= coolingMinRun {
+			c.leak = math.Max(0, (temp-c.restStart.temp)/at.Sub(c.restStart.at).Minutes())
+		}
+		c.runStart, c.disturbed = sample, false
+	case !running && c.running:
+		c.finishRun(sample)
+		c.restStart = sample
+	case !running && !c.on:
+		c.restStart = sample
+	}
+	if running && (setChanged || lidOpen) {
+		c.disturbed = true
+	}
+	c.on, c.running = r.On, running && r.On
+
+	// Needed cooling that isn't happening
+	switch {
+	case !r.On || lidOpen || temp <= set:
+		c.demand = false
+	case !c.demand && temp >= set+band:
+		c.demand, c.low, c.lowAt = true, temp, at
+	case c.demand && temp < c.low:
+		c.low, c.lowAt = temp, at
+	}
+
+	// Only the kinds of issue count as a change, not their numbers
+	stalled, degraded := c.demand && at.Sub(c.lowAt) >= c.settings.stall, c.slow >= coolingSlowRuns
+	c.issues = []string{}
+	if stalled {
+		c.issues = append(c.issues, fmt.Sprintf("no cooling for %s while %.1f°C over the setpoint", at.Sub(c.lowAt).Round(time.Minute), temp-set))
+	}
+	if degraded {
+		c.issues = append(c.issues, fmt.Sprintf("last %d runs pulled down under %.0f%% of the usual rate", c.slow, coolingSlowFactor*100))
+	}
+	changed := stalled != c.stalled || degraded != c.degraded
+	c.stalled, c.degraded = stalled, degraded
+	return append([]string{}, c.issues...), changed
+}
+
+// finishRun scores a run against its baseline and learns from it, with c.mu held
+func (c *Cooling) finishRun(end celsiusSample) {
+	d := end.at.Sub(c.runStart.at)
+	if c.runStart.at.IsZero() || d < coolingMinRun || c.disturbed {
+		return
+	}
+	run := CoolingRun{Start: c.runStart.at, End: end.at, Bucket: c.bucket(), Rate: (c.runStart.temp - end.temp) / d.Minutes()}
+	b, ok := c.baselines[run.Bucket]
+	if !ok {
+		b = &CoolingBaseline{Bucket: run.Bucket}
+		c.baselines[run.Bucket] = b
+	}
+	if b.Learned {
+		run.Baseline = round2(b.Rate)
+		run.Slow = run.Rate < b.Rate*coolingSlowFactor
+	}
+	if run.Slow {
+		c.slow++
+	} else {
+		// Slow runs aren't learned, or a failing compressor becomes the new normal
+		c.slow = 0
+		switch b.Runs {
+		case 0:
+			b.Rate = run.Rate
+		default:
+			b.Rate += (run.Rate - b.Rate) * 0.25
+		}
+		b.Runs++
+		b.Learned = b.Runs >= coolingLearnRuns
+		b.Updated = end.at
+		c.save()
+	}
+	run.Rate = round2(run.Rate)
+	c.runs = append([]CoolingRun{run}, c.runs...)
+	if len(c.runs) > coolingKeepRuns {
+		c.runs = c.runs[:coolingKeepRuns]
+	}
+}
+
+// save writes the baselines, with c.mu held
+func (c *Cooling) save() {
+	if c.settings.path == "" {
+		return
+	}
+	b, err := json.MarshalIndent(c.sortedBaselines(), "", "  ")
+	if err == nil {
+		tmp := c.settings.path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, c.settings.path)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"client": "Cooling", "err": err}).Error("Failed to save cooling baselines")
+	}
+}
+
+// sortedBaselines copies the baselines in bucket order, with c.mu held
+func (c *Cooling) sortedBaselines() []CoolingBaseline {
+	out := make([]CoolingBaseline, 0, len(c.baselines))
+	for _, b := range c.baselines {
+		b := *b
+		b.Rate = round2(b.Rate)
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Bucket < out[j].Bucket })
+	return out
+}
+
+// Report sums up cooling health as of at
+func (c *Cooling) Report(comp CompressorState, at time.Time) CoolingReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := CoolingReport{
+		Time:         at,
+		Issues:       append([]string{}, c.issues...),
+		DutyCycle24h: comp.DutyCycle24h,
+		Cycles24h:    comp.Cycles24h,
+		Runs:         append([]CoolingRun{}, c.runs...),
+		Baselines:    c.sortedBaselines(),
+	}
+	if c.demand && at.Sub(c.lowAt) > 0 {
+		r.StalledFor = at.Sub(c.lowAt).Round(time.Second).Seconds()
+	}
+	switch {
+	case len(r.Issues) > 0:
+		r.Status = "degraded"
+	case !c.on:
+		r.Status = "off"
+	default:
+		r.Bucket = c.bucket()
+		r.Status = "learning"
+		if b, ok := c.baselines[r.Bucket]; ok && b.Learned {
+			r.Status = "ok"
+		}
+	}
+	return r
+}
+
+// record keeps a periodic report
+func (c *Cooling) record(r CoolingReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reports = append([]CoolingReport{r}, c.reports...)
+	if len(c.reports) > coolingKeepReports {
+		c.reports = c.reports[:coolingKeepReports]
+	}
+}
+
+// Reports are the periodic reports, newest first
+func (c *Cooling) Reports() []CoolingReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CoolingReport{}, c.reports...)
+}
+
+// coolingChanged tells everyone cooling got worse or recovered
+func (f *Fridge) coolingChanged(issues []string) {
+	if len(issues) > 0 {
+		f.Alert("warn", "cooling", "Cooling degraded: "+strings.Join(issues, ", "))
+		return
+	}
+	f.Alert("info", "cooling", "Cooling recovered")
+}
+
+// WatchCooling writes a cooling health report every interval
+func (f *Fridge) WatchCooling(ctx context.Context) {
+	if f.cooling == nil {
+		return
+	}
+	ticker := time.NewTicker(f.cooling.settings.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if f.LastUpdate().IsZero() {
+				continue
+			}
+			r := f.cooling.Report(f.compressor.State(false), now)
+			f.cooling.record(r)
+			log.WithFields(log.Fields{
+				"client":  "Cooling",
+				"status":  r.Status,
+				"issues":  strings.Join(r.Issues, ", "),
+				"bucket":  r.Bucket,
+				"duty24h": r.DutyCycle24h,
+			}).Info("Cooling health")
+		}
+	}
+}
+
+// coolingResponse is the body of /cooling
+type coolingResponse struct {
+	Current CoolingReport   `json:"current"`
+	Reports []CoolingReport `json:"reports"` // periodic, newest first
+}
+
+func handleCooling(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.cooling == nil {
+			writeError(w, http.StatusNotFound, errors.New("Cooling health is off"))
+			return
+		}
+		if _, ok := requireStatus(w, f); !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, coolingResponse{
+			Current: f.cooling.Report(f.compressor.State(false), time.Now()),
+			Reports: f.cooling.Reports(),
+		})
+	}
+}
+
+// registerCooling adds the cooling health endpoint to mux
+func registerCooling(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/cooling", methods(handleCooling(f), http.MethodGet))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// coolingSim drives a Cooling with a fridge that rests and runs on cue
+type coolingSim struct {
+	c       *Cooling
+	at      time.Time
+	temp    float64 // degrees F
+	changes [][]string
+}
+
+// step holds the compressor state for minutes while the temperature moves
+// perMinute degrees F
+func (s *coolingSim) step(minutes int, running bool, perMinute float64) {
+	r := testStatusReport // F, set 37, E3 4
+	for i := 0; i < minutes*3; i++ {
+		r.Temp = int8(math.Round(s.temp))
+		if issues, changed := s.c.Observe(r, running, false, s.at); changed {
+			s.changes = append(s.changes, issues)
+		}
+		s.at = s.at.Add(20 * time.Second)
+		s.temp += perMinute / 3
+	}
+}
+
+// cycle rests up to the top of the band, runs back down at perMinute, and
+// rests a minute so the run is over
+func (s *coolingSim) cycle(perMinute float64) {
+	s.step(int(math.Ceil((41-s.temp)/0.2)), false, 0.2)
+	s.step(int(math.Ceil((s.temp-37)/perMinute)), true, -perMinute)
+	s.step(1, false, 0)
+}
+
+func newCoolingSim(t *testing.T, path string) *coolingSim {
+	c, err := newCooling(CoolingSettings{path: path, stall: 20 * time.Minute, interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &coolingSim{c: c, at: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), temp: 37}
+}
+
+func TestCoolingBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cooling.json")
+	s := newCoolingSim(t, path)
+	for i := 0; i < 4; i++ {
+		s.cycle(0.4)
+	}
+	r := s.c.Report(CompressorState{}, s.at)
+	if r.Status != "ok" || len(r.Issues) != 0 || len(s.changes) != 0 {
+		t.Fatalf("Expected healthy cooling, got %+v %v", r, s.changes)
+	}
+	if len(r.Baselines) != 1 || r.Bucket != "0 to 5°C, mild" || len(r.Runs) != 4 {
+		t.Fatalf("Bad baselines %+v runs %+v", r.Baselines, r.Runs)
+	}
+	learned := r.Baselines[0]
+	if !learned.Learned || learned.Runs != 4 || math.Abs(learned.Rate-0.4/1.8) > 0.03 {
+		t.Fatalf("Expected about %.2f°C a minute learned, got %+v", 0.4/1.8, learned)
+	}
+
+	// A blocked vent slows every run down
+	s.cycle(0.1)
+	if len(s.changes) != 0 || !s.c.Report(CompressorState{}, s.at).Runs[0].Slow {
+		t.Fatal("One slow run should be noted without an alert")
+	}
+	s.cycle(0.1)
+	r = s.c.Report(CompressorState{}, s.at)
+	if r.Status != "degraded" || len(s.changes) != 1 || !strings.Contains(s.changes[0][0], "2 runs") {
+		t.Fatalf("Expected degraded cooling, got %+v %v", r, s.changes)
+	}
+	if b := r.Baselines[0]; b.Runs != 4 {
+		t.Fatalf("Slow runs shouldn't be learned, got %+v", b)
+	}
+	s.cycle(0.4)
+	if len(s.changes) != 2 || len(s.changes[1]) != 0 {
+		t.Fatalf("Expected cooling to recover, got %v", s.changes)
+	}
+
+	// Baselines outlive a restart
+	again := newCoolingSim(t, path)
+	if b := again.c.Report(CompressorState{}, again.at).Baselines; len(b) != 1 || !b[0].Learned {
+		t.Fatalf("Expected saved baselines, got %+v", b)
+	}
+}
+
+func TestCoolingStall(t *testing.T) {
+	s := newCoolingSim(t, "")
+	s.temp = 42
+	// Running but getting nowhere
+	s.step(19, true, 0)
+	if len(s.changes) != 0 {
+		t.Fatalf("Too early to call a stall, got %v", s.changes)
+	}
+	s.step(5, true, 0.05)
+	r := s.c.Report(CompressorState{}, s.at)
+	if len(s.changes) != 1 || r.Status != "degraded" || r.StalledFor < 20*60 || !strings.Contains(r.Issues[0], "no cooling") {
+		t.Fatalf("Expected a stall, got %+v %v", r, s.changes)
+	}
+	// Once it cools again it's fine
+	s.step(20, true, -0.4)
+	if len(s.changes) != 2 || s.c.Report(CompressorState{}, s.at).StalledFor != 0 {
+		t.Fatalf("Expected the stall to clear, got %v", s.changes)
+	}
+
+	// An open lid explains it
+	s.temp = 45
+	r2 := testStatusReport
+	r2.Temp = 45
+	for i := 0; i < 30; i++ {
+		s.c.Observe(r2, true, true, s.at)
+		s.at = s.at.Add(time.Minute)
+	}
+	if issues, _ := s.c.Observe(r2, true, true, s.at); len(issues) != 0 {
+		t.Fatalf("An open lid shouldn't count as a stall, got %v", issues)
+	}
+}
+
+func TestCoolingSettingsValidate(t *testing.T) {
+	for _, s := range []CoolingSettings{
+		{stall: time.Minute},
+		{stall: time.Minute, interval: -time.Second},
+		{interval: time.Hour},
+	} {
+		if s.Validate() == nil {
+			t.Fatalf("Expected %+v rejected", s)
+		}
+	}
+	if err := (CoolingSettings{stall: 20 * time.Minute, interval: time.Hour}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoolingHTTP(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	mux := http.NewServeMux()
+	registerCooling(mux, f)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cooling", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without cooling health, got %d", rec.Code)
+	}
+
+	s := newCoolingSim(t, "")
+	s.cycle(0.4)
+	f.cooling = s.c
+	f.cooling.record(f.cooling.Report(CompressorState{DutyCycle24h: 0.4}, s.at))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cooling", nil))
+	var body coolingResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Bad cooling response %d %s %v", rec.Code, rec.Body, err)
+	}
+	if body.Current.Status != "learning" || len(body.Reports) != 1 || body.Reports[0].DutyCycle24h != 0.4 || len(body.Current.Runs) != 1 {
+		t.Fatalf("Bad cooling report %+v", body)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// connectionResponse is the bluetooth side of the daemon's health
+type connectionResponse struct {
+	Connected bool `json:"connected"`
+	Freshness
+}
+
+func handleConnection(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, connectionResponse{Connected: f.Connected(), Freshness: f.Freshness()})
+	}
+}
+
+// registerDashboard serves the embedded web UI under /dashboard/
+func registerDashboard(mux *http.ServeMux, f *Fridge) {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/history", methods(handleHistory(f), http.MethodGet))
+	mux.HandleFunc("/connection", methods(handleConnection(f), http.MethodGet))
+}
@@ -0,0 +1,309 @@
+// Alpicoold dashboard, talks to the daemon's JSON API
+(function () {
+  'use strict';
+
+  var state = { report: null, connected: false, stale: false };
+
+  var menu = [
+    { field: 'LowestTempSettingMenuE1', label: 'E1 lowest setpoint', temp: true },
+    { field: 'HighestTempSettingMenuE2', label: 'E2 highest setpoint', temp: true },
+    { field: 'HysteresisMenuE3', label: 'E3 hysteresis', temp: true },
+    { field: 'SoftStartDelayMinMenuE4', label: 'E4 soft start (min)', min: 0 },
+    { field: 'CelsiusFahrenheitModeMenuE5', label: 'E5 units', options: [[false, '°C'], [true, '°F']] },
+    { field: 'TempCompGTEMinus6DegCelsiusMenuE6', label: 'E6 comp. ≥ -6°C', temp: true },
+    { field: 'TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7', label: 'E7 comp. -12..-6°C', temp: true },
+    { field: 'TempCompLTMinus12DegCelsiusMenuE8', label: 'E8 comp. < -12°C', temp: true },
+    { field: 'TempCompShutdownMenuE9', label: 'E9 shutdown comp.', temp: true },
+    { field: 'HLvl', label: 'Battery cutoff', options: [[0, 'H'], [1, 'M'], [2, 'L']] }
+  ];
+
+  function $(id) { return document.getElementById(id); }
+
+  function message(text, isError) {
+    var m = $('message');
+    m.textContent = text || '';
+    m.className = 'message' + (isError ? ' error' : '');
+  }
+
+  function unit() {
+    return state.report && state.report.CelsiusFahrenheitModeMenuE5 ? '°F' : '°C';
+  }
+
+  function request(method, path, body) {
+    return fetch(path, {
+      method: method,
+      headers: body ? { 'Content-Type': 'application/json' } : {},
+      body: body ? JSON.stringify(body) : undefined,
+      credentials: 'same-origin'
+    }).then(function (res) {
+      return res.json().catch(function () { return {}; }).then(function (data) {
+        if (!res.ok) {
+          throw new Error(data.error || res.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function command(method, path, body, done) {
+    message('Sending…');
+    request(method, path, body).then(function () {
+      message('Sent, waiting for the fridge');
+      if (done) done();
+    }).catch(function (err) {
+      message(err.message, true);
+    });
+  }
+
+  // Rendering
+
+  function renderConnection() {
+    var c = $('connection');
+    if (state.connected && state.stale) {
+      c.textContent = 'stale';
+      c.className = 'pill stale';
+      return;
+    }
+    c.textContent = state.connected ? 'connected' : 'disconnected';
+    c.className = 'pill ' + (state.connected ? 'up' : 'down');
+  }
+
+  // inputVoltage matches the daemon's: whole volts and tenths in two bytes
+  function inputVoltage(r) {
+    return r.InputV1 + r.InputV2 / 10;
+  }
+
+  function renderReport() {
+    var r = state.report;
+    if (!r) return;
+    $('temp').textContent = r.Temp;
+    $('tempSet').textContent = r.TempSet;
+    $('voltage').textContent = inputVoltage(r).toFixed(1);
+    Array.prototype.forEach.call(document.querySelectorAll('.unit'), function (el) {
+      el.textContent = unit();
+    });
+    $('flags').innerHTML = '';
+    [['On', 'on', 'off'], ['EcoMode', 'eco', 'max'], ['Locked', 'locked', 'unlocked']].forEach(function (f) {
+      var span = document.createElement('span');
+      span.textContent = r[f[0]] ? f[1] : f[2];
+      $('flags').appendChild(span);
+    });
+    Array.prototype.forEach.call(document.querySelectorAll('[data-toggle]'), function (b) {
+      b.className = r[b.dataset.field] ? 'on' : '';
+    });
+    var sp = $('setpointValue');
+    if (document.activeElement !== sp) {
+      sp.value = r.TempSet;
+      sp.min = r.LowestTempSettingMenuE1;
+      sp.max = r.HighestTempSettingMenuE2;
+    }
+    if (!$('menu').contains(document.activeElement)) {
+      renderMenu();
+    }
+  }
+
+  function renderMenu() {
+    var r = state.report;
+    var ul = $('menuFields');
+    ul.innerHTML = '';
+    menu.forEach(function (m) {
+      var li = document.createElement('li');
+      var label = document.createElement('label');
+      label.textContent = m.label + (m.temp ? ' (' + unit() + ')' : '');
+      var input;
+      if (m.options) {
+        input = document.createElement('select');
+        m.options.forEach(function (o) {
+          var opt = document.createElement('option');
+          opt.value = JSON.stringify(o[0]);
+          opt.textContent = o[1];
+          opt.selected = r[m.field] === o[0];
+          input.appendChild(opt);
+        });
+      } else {
+        input = document.createElement('input');
+        input.type = 'number';
+        input.step = 1;
+        input.min = m.min !== undefined ? m.min : -128;
+        input.max = 127;
+        input.value = r[m.field];
+      }
+      input.name = m.field;
+      label.htmlFor = input.id = 'menu-' + m.field;
+      li.appendChild(label);
+      li.appendChild(input);
+      ul.appendChild(li);
+    });
+  }
+
+  function renderChart(samples) {
+    var svg = $('chart');
+    var w = 600, h = 200;
+    svg.innerHTML = '';
+    if (samples.length < 2) return;
+    var t0 = new Date(samples[0].time).getTime();
+    var t1 = new Date(samples[samples.length - 1].time).getTime();
+
+    function range(vals) {
+      var lo = Math.min.apply(null, vals), hi = Math.max.apply(null, vals);
+      return hi === lo ? [lo - 1, hi + 1] : [lo, hi];
+    }
+    function line(cls, get, r) {
+      var pts = samples.map(function (s) {
+        var x = (new Date(s.time).getTime() - t0) / Math.max(t1 - t0, 1) * w;
+        var y = h - (get(s) - r[0]) / (r[1] - r[0]) * (h - 20) - 10;
+        return x.toFixed(1) + ',' + y.toFixed(1);
+      });
+      var pl = document.createElementNS('http://www.w3.org/2000/svg', 'polyline');
+      pl.setAttribute('class', cls);
+      pl.setAttribute('points', pts.join(' '));
+      svg.appendChild(pl);
+    }
+
+    // Temperatures share a scale so the setpoint line means something
+    var temp = function (s) { return s.temp; };
+    var set = function (s) { return s.tempSet; };
+    var volt = function (s) { return s.inputVoltage; };
+    var temps = range(samples.map(temp).concat(samples.map(set)));
+    line('temp', temp, temps);
+    line('set', set, temps);
+    line('volt', volt, range(samples.map(volt)));
+  }
+
+  function loadHistory() {
+    request('GET', '/history?minutes=' + $('range').value).then(renderChart).catch(function () {});
+  }
+
+  // Validation mirrors the daemon's, the daemon has the final word
+
+  function readMenu() {
+    var patch = {};
+    var errors = [];
+    menu.forEach(function (m) {
+      var input = $('menu-' + m.field);
+      input.parentNode.className = '';
+      var v = m.options ? JSON.parse(input.value) : Number(input.value);
+      if (!m.options && (!Number.isInteger(v) || v < Number(input.min) || v > Number(input.max))) {
+        errors.push(m.label + ' must be a whole number from ' + input.min + ' to ' + input.max);
+        input.parentNode.className = 'invalid';
+      }
+      if (v !== state.report[m.field]) {
+        patch[m.field] = v;
+      }
+    });
+    var merged = Object.assign({}, state.report, patch);
+    if (merged.LowestTempSettingMenuE1 > merged.HighestTempSettingMenuE2) {
+      errors.push('E1 must not be above E2');
+    }
+    if (merged.TempSet < merged.LowestTempSettingMenuE1 || merged.TempSet > merged.HighestTempSettingMenuE2) {
+      errors.push('Setpoint ' + merged.TempSet + ' would fall outside E1..E2');
+    }
+    return { patch: patch, errors: errors };
+  }
+
+  // Wiring
+
+  $('setpoint').addEventListener('click', function (e) {
+    var step = e.target.dataset && e.target.dataset.step;
+    if (step) {
+      var sp = $('setpointValue');
+      sp.value = Number(sp.value) + Number(step);
+    }
+  });
+
+  $('setpoint').addEventListener('submit', function (e) {
+    e.preventDefault();
+    var v = Number($('setpointValue').value);
+    var r = state.report;
+    if (r && (v < r.LowestTempSettingMenuE1 || v > r.HighestTempSettingMenuE2)) {
+      message('Setpoint must be from ' + r.LowestTempSettingMenuE1 + ' to ' + r.HighestTempSettingMenuE2 + unit(), true);
+      return;
+    }
+    command('PUT', '/temperature', { value: v, unit: unit().slice(1) });
+  });
+
+  Array.prototype.forEach.call(document.querySelectorAll('[data-toggle]'), function (b) {
+    b.addEventListener('click', function () {
+      if (!state.report) return;
+      command('POST', '/' + b.dataset.toggle, { value: !state.report[b.dataset.field] });
+    });
+  });
+
+  $('menu').addEventListener('submit', function (e) {
+    e.preventDefault();
+    var m = readMenu();
+    if (m.errors.length) {
+      message(m.errors.join('. '), true);
+      return;
+    }
+    if (!Object.keys(m.patch).length) {
+      message('Nothing changed');
+      return;
+    }
+    command('PATCH', '/settings', m.patch, function () { document.activeElement.blur(); });
+  });
+
+  $('range').addEventListener('change', loadHistory);
+
+  // Camera, hidden unless the daemon has one
+  var camera = { live: false };
+  function loadCamera() {
+    if (camera.live) return;
+    $('cameraImage').src = '/camera/snapshot.jpg?width=640&height=360&t=' + Date.now();
+  }
+  $('cameraImage').addEventListener('load', function () { $('camera').hidden = false; });
+  $('cameraImage').addEventListener('error', function () {
+    if (camera.live) {
+      camera.live = false;
+      $('cameraLive').className = '';
+      loadCamera();
+    }
+  });
+  $('cameraLive').addEventListener('click', function () {
+    camera.live = !camera.live;
+    $('cameraLive').className = camera.live ? 'on' : '';
+    if (camera.live) {
+      $('cameraImage').src = '/camera/stream?width=640&height=360&fps=2';
+    } else {
+      loadCamera();
+    }
+  });
+
+  request('GET', '/').then(function (r) {
+    if (r.Preamble) {
+      state.report = r;
+      renderReport();
+    }
+  }).catch(function (err) { message(err.message, true); });
+  request('GET', '/connection').then(function (c) {
+    state.connected = c.connected;
+    state.stale = c.stale;
+    renderConnection();
+  }).catch(function () {});
+  loadHistory();
+  setInterval(loadHistory, 60 * 1000);
+  loadCamera();
+  setInterval(loadCamera, 60 * 1000);
+
+  var events = new EventSource('/events?kinds=status,connection,stale,alert');
+  events.addEventListener('status', function (e) {
+    state.report = JSON.parse(e.data).data;
+    renderReport();
+  });
+  events.addEventListener('connection', function (e) {
+    state.connected = JSON.parse(e.data).data.connected;
+    renderConnection();
+  });
+  events.addEventListener('stale', function (e) {
+    state.stale = JSON.parse(e.data).data.stale;
+    renderConnection();
+  });
+  events.addEventListener('alert', function (e) {
+    var a = JSON.parse(e.data).data;
+    message(a.source + ': ' + a.message, a.level !== 'info');
+  });
+  events.onerror = function () {
+    state.connected = false;
+    renderConnection();
+  };
+})();
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3, time.Minute)
+	start := time.Unix(1600000000, 0)
+	for i := 0; i < 5; i++ {
+		r := testStatusReport
+		r.Temp = int8(i)
+		h.Record(r, true, start.Add(time.Duration(i)*time.Minute))
+		// Too soon after the last one
+		h.Record(r, true, start.Add(time.Duration(i)*time.Minute+time.Second))
+	}
+	samples := h.Since(time.Time{})
+	if len(samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(samples))
+	}
+	for i, s := range samples {
+		if s.Temp != int8(i+2) {
+			t.Fatalf("Samples out of order %v", samples)
+		}
+	}
+	if recent := h.Since(start.Add(3 * time.Minute)); len(recent) != 1 || recent[0].Temp != 4 {
+		t.Fatalf("Bad recent samples %v", recent)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	mux := http.NewServeMux()
+	registerDashboard(mux, f)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for path, want := range map[string]string{
+		"/dashboard/":       "<title>",
+		"/dashboard/app.js": "EventSource",
+		"/connection":       `{"connected":false,`,
+		"/history":          "[]",
+	} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || !strings.Contains(string(b), want) {
+			t.Fatalf("%s: %d %q", path, res.StatusCode, b)
+		}
+	}
+}
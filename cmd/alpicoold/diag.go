@@ -0,0 +1,308 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Bluetooth client phases, in the order a healthy start goes through them
+const (
+	phaseStarting     = "starting"
+	phaseDiscovering  = "discovering"
+	phaseConnecting   = "connecting"
+	phaseSubscribing  = "subscribing"
+	phaseConnected    = "connected"
+	phaseDisconnected = "disconnected"
+)
+
+var (
+	// readyMaxAge is how old the last status report can be and still be ready
+	readyMaxAge = 30 * time.Second
+	// healthStall is how long a worker can go quiet before the daemon is unhealthy
+	healthStall = 2 * time.Minute
+	// diagKeep is how many transitions and errors /debug/state remembers
+	diagKeep = 20
+)
+
+// Transition is one step of the bluetooth client's state machine
+type Transition struct {
+	Time  time.Time `json:"time"`
+	Phase string    `json:"phase"`
+}
+
+// DiagError is a recent error from one of the daemon's workers
+type DiagError struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Error  string    `json:"error"`
+}
+
+// AdapterInfo is the useful part of the bluetooth adapter's properties
+type AdapterInfo struct {
+	ID          string `json:"id"`
+	Address     string `json:"address"`
+	Alias       string `json:"alias"`
+	Powered     bool   `json:"powered"`
+	Discovering bool   `json:"discovering"`
+}
+
+// DeviceInfo is the useful part of the fridge's bluetooth properties
+type DeviceInfo struct {
+	Address          string    `json:"address"`
+	Name             string    `json:"name"`
+	RSSI             int16     `json:"rssi"`
+	TxPower          int16     `json:"txPower"`
+	Connected        bool      `json:"connected"`
+	ServicesResolved bool      `json:"servicesResolved"`
+	Updated          time.Time `json:"updated"`
+}
+
+// Diagnostics collects what the bluetooth client and workers are up to.
+// A nil Diagnostics ignores everything.
+type Diagnostics struct {
+	mu          sync.RWMutex
+	started     time.Time
+	phase       string
+	transitions []Transition
+	errors      []DiagError
+	beats       map[string]time.Time
+	adapter     *AdapterInfo
+	device      *DeviceInfo
+	camera      *CameraState
+	now         func() time.Time
+}
+
+func newDiagnostics() *Diagnostics {
+	return &Diagnostics{
+		started: time.Now(),
+		phase:   phaseStarting,
+		beats:   map[string]time.Time{},
+		now:     time.Now,
+	}
+}
+
+// SetPhase records a bluetooth state machine transition
+func (d *Diagnostics) SetPhase(phase string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if phase == d.phase {
+		return
+	}
+	d.phase = phase
+	d.transitions = append(d.transitions, Transition{Time: d.now(), Phase: phase})
+	if len(d.transitions) > diagKeep {
+		d.transitions = d.transitions[len(d.transitions)-diagKeep:]
+	}
+}
+
+// Error remembers err from source, nil errors are ignored
+func (d *Diagnostics) Error(source string, err error) {
+	if d == nil || err == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors = append(d.errors, DiagError{Time: d.now(), Source: source, Error: err.Error()})
+	if len(d.errors) > diagKeep {
+		d.errors = d.errors[len(d.errors)-diagKeep:]
+	}
+}
+
+// Beat says the named worker is still running
+func (d *Diagnostics) Beat(worker string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.beats[worker] = d.now()
+}
+
+// Forget stops watching a worker that exited on purpose
+func (d *Diagnostics) Forget(worker string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.beats, worker)
+}
+
+// SetAdapter records the adapter's properties
+func (d *Diagnostics) SetAdapter(a AdapterInfo) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.adapter = &a
+}
+
+// SetDevice records the fridge's bluetooth properties
+func (d *Diagnostics) SetDevice(dev DeviceInfo) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev.Updated = d.now()
+	d.device = &dev
+}
+
+// SetCamera records the camera's health, which never fails /healthz since
+// the bridge runs fine without it
+func (d *Diagnostics) SetCamera(c CameraState) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.camera = &c
+}
+
+// Phase is the bluetooth client's current state
+func (d *Diagnostics) Phase() string {
+	if d == nil {
+		return ""
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.phase
+}
+
+// Stalled lists workers that haven't beaten within healthStall
+func (d *Diagnostics) Stalled() []string {
+	out := []string{}
+	if d == nil {
+		return out
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := d.now()
+	for w, t := range d.beats {
+		if now.Sub(t) > healthStall {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// WorkerState is how recently a worker checked in
+type WorkerState struct {
+	LastBeat time.Time `json:"lastBeat"`
+	Age      string    `json:"age"`
+	Stalled  bool      `json:"stalled"`
+}
+
+// DebugState is the body of /debug/state
+type DebugState struct {
+	Uptime          string                 `json:"uptime"`
+	Phase           string                 `json:"phase"`
+	Connected       bool                   `json:"connected"`
+	Transitions     []Transition           `json:"transitions"`
+	LastReport      *time.Time             `json:"lastReport"`
+	LastReportAge   string                 `json:"lastReportAge,omitempty"`
+	Stale           bool                   `json:"stale"`
+	PendingCommands int                    `json:"pendingCommands"`
+	Goroutines      int                    `json:"goroutines"`
+	Workers         map[string]WorkerState `json:"workers"`
+	Adapter         *AdapterInfo           `json:"adapter"`
+	Device          *DeviceInfo            `json:"device"`
+	Camera          *CameraState           `json:"camera"`
+	Errors          []DiagError            `json:"errors"`
+}
+
+// debugState snapshots everything we know about the daemon's health
+func debugState(f *Fridge) DebugState {
+	d := f.diag
+	s := DebugState{
+		Connected:       f.Connected(),
+		Stale:           f.Stale(),
+		PendingCommands: f.PendingCommands(),
+		Goroutines:      runtime.NumGoroutine(),
+		Transitions:     []Transition{},
+		Workers:         map[string]WorkerState{},
+		Errors:          []DiagError{},
+	}
+	now := time.Now()
+	if d != nil {
+		d.mu.RLock()
+		now = d.now()
+		s.Uptime = now.Sub(d.started).Round(time.Second).String()
+		s.Phase = d.phase
+		s.Transitions = append(s.Transitions, d.transitions...)
+		s.Errors = append(s.Errors, d.errors...)
+		for w, t := range d.beats {
+			s.Workers[w] = WorkerState{LastBeat: t, Age: now.Sub(t).Round(time.Millisecond).String(), Stalled: now.Sub(t) > healthStall}
+		}
+		s.Adapter = d.adapter
+		s.Device = d.device
+		s.Camera = d.camera
+		d.mu.RUnlock()
+	}
+	if t := f.LastUpdate(); !t.IsZero() {
+		s.LastReport = &t
+		s.LastReportAge = now.Sub(t).Round(time.Millisecond).String()
+	}
+	return s
+}
+
+// probeResponse is the body of /healthz and /readyz
+type probeResponse struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// handleHealthz fails when a worker has stalled, so systemd can restart us
+func handleHealthz(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stalled := f.diag.Stalled()
+		if len(stalled) > 0 {
+			reasons := []string{}
+			for _, s := range stalled {
+				reasons = append(reasons, s+" stalled")
+			}
+			writeJSON(w, http.StatusServiceUnavailable, probeResponse{Status: "unhealthy", Reasons: reasons})
+			return
+		}
+		writeJSON(w, http.StatusOK, probeResponse{Status: "ok"})
+	}
+}
+
+// handleReadyz is ready when the fridge is connected and reporting
+func handleReadyz(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reasons := []string{}
+		if !f.Connected() {
+			reasons = append(reasons, "bluetooth "+f.diag.Phase())
+		}
+		if last := f.LastUpdate(); last.IsZero() {
+			reasons = append(reasons, "no status report yet")
+		} else if age := time.Since(last); age > readyMaxAge {
+			reasons = append(reasons, "last status report "+age.Round(time.Second).String()+" ago")
+		}
+		if len(reasons) > 0 {
+			writeJSON(w, http.StatusServiceUnavailable, probeResponse{Status: "not ready", Reasons: reasons})
+			return
+		}
+		writeJSON(w, http.StatusOK, probeResponse{Status: "ready"})
+	}
+}
+
+func handleDebugState(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, debugState(f))
+	}
+}
+
+// registerDiagnostics adds the probe and debug endpoints to mux
+func registerDiagnostics(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/healthz", methods(handleHealthz(f), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/readyz", methods(handleReadyz(f), http.MethodGet, http.MethodHead))
+	mux.HandleFunc("/debug/state", methods(handleDebugState(f), http.MethodGet))
+}
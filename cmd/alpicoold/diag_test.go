@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDiagnostics(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	d := newDiagnostics()
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < diagKeep+5; i++ {
+		d.SetPhase(phaseConnecting)
+		d.SetPhase(phaseConnected)
+		d.Error("bluetooth", errors.New("boom"))
+	}
+	d.Error("bluetooth", nil)
+	if len(d.transitions) != diagKeep || len(d.errors) != diagKeep {
+		t.Fatalf("Expected %d kept, got %d transitions %d errors", diagKeep, len(d.transitions), len(d.errors))
+	}
+
+	d.Beat("writer")
+	if len(d.Stalled()) != 0 {
+		t.Fatal("Fresh worker shouldn't be stalled")
+	}
+	now = now.Add(healthStall + time.Second)
+	if s := d.Stalled(); len(s) != 1 || s[0] != "writer" {
+		t.Fatalf("Expected writer stalled, got %v", s)
+	}
+	d.Forget("writer")
+	if len(d.Stalled()) != 0 {
+		t.Fatal("Forgotten worker shouldn't be stalled")
+	}
+
+	var nilDiag *Diagnostics
+	nilDiag.SetPhase(phaseConnected)
+	nilDiag.Beat("writer")
+	if nilDiag.Phase() != "" || len(nilDiag.Stalled()) != 0 {
+		t.Fatal("nil Diagnostics should be empty")
+	}
+}
+
+func TestProbes(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	auth, _ := newAuth("", "secret", "", false)
+	h := newMux(HTTPSettings{auth: auth}, f)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz should pass without credentials, got %d", w.Code)
+	}
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Disconnected fridge shouldn't be ready, got %d", w.Code)
+	}
+
+	f.SetConnected(true)
+	f.mu.Lock()
+	f.updated = time.Now()
+	f.mu.Unlock()
+	if w := get("/readyz"); w.Code != http.StatusOK {
+		t.Fatalf("Expected ready, got %d %s", w.Code, w.Body)
+	}
+
+	f.mu.Lock()
+	f.updated = time.Now().Add(-readyMaxAge - time.Second)
+	f.mu.Unlock()
+	w := get("/readyz")
+	var probe probeResponse
+	json.Unmarshal(w.Body.Bytes(), &probe)
+	if w.Code != http.StatusServiceUnavailable || len(probe.Reasons) != 1 {
+		t.Fatalf("Stale report shouldn't be ready, got %d %v", w.Code, probe)
+	}
+
+	f.diag.now = func() time.Time { return time.Now().Add(-healthStall - time.Second) }
+	f.diag.Beat("bluetooth writer")
+	f.diag.now = time.Now
+	if w := get("/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Stalled writer should be unhealthy, got %d", w.Code)
+	}
+
+	if w := get("/debug/state"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("debug state needs credentials, got %d", w.Code)
+	}
+	f.diag.SetPhase(phaseConnected)
+	f.diag.SetDevice(DeviceInfo{Address: "AA:BB", RSSI: -70})
+	r := httptest.NewRequest(http.MethodGet, "/debug/state", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var state DebugState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Phase != phaseConnected || !state.Connected || state.Device.RSSI != -70 ||
+		!state.Workers["bluetooth writer"].Stalled || state.LastReport == nil {
+		t.Fatalf("Bad debug state %s", w.Body)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// Event kinds
+const (
+	eventStatus     = "status"     // Every status report from the fridge
+	eventSettings   = "settings"   // Settings differ from the previous report
+	eventConnection = "connection" // Bluetooth connection up or down
+	eventAlert      = "alert"      // Something needs a human
+	eventStale      = "stale"      // Status reports stopped or resumed
+	eventLid        = "lid"        // The lid looks opened or closed
+)
+
+// Event is one thing that happened to the fridge
+type Event struct {
+	ID   uint64      `json:"id"`
+	Kind string      `json:"kind"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// SettingsChange is the payload of a settings event
+type SettingsChange struct {
+	Before k25.Settings `json:"before"`
+	After  k25.Settings `json:"after"`
+}
+
+// ConnectionChange is the payload of a connection event
+type ConnectionChange struct {
+	Connected bool `json:"connected"`
+}
+
+// Alert is the payload of an alert event
+type Alert struct {
+	Level   string `json:"level"` // info, warn or error
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// Hub fans fridge events out to any number of subscribers. Publishing never
+// blocks, a subscriber that can't keep up loses its oldest events instead.
+type Hub struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*Subscription]struct{}
+}
+
+// Subscription is one listener's buffered view of the hub
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	hub     *Hub
+	mu      sync.Mutex
+	dropped int
+	closed  bool
+}
+
+func newHub() *Hub {
+	return &Hub{subs: map[*Subscription]struct{}{}}
+}
+
+// Subscribe starts listening with room for buffer events
+func (h *Hub) Subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, hub: h}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Close stops the subscription and closes its channel
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	delete(s.hub.subs, s)
+	s.hub.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.c)
+	}
+}
+
+// Dropped counts events lost because the subscriber was too slow
+func (s *Subscription) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// deliver hands e to the subscriber, dropping its oldest event when full
+func (s *Subscription) deliver(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for {
+		select {
+		case s.c <- e:
+			return
+		default:
+		}
+		select {
+		case <-s.c:
+			s.dropped++
+		default:
+		}
+	}
+}
+
+// Publish sends an event of kind to every subscriber. A nil hub is a no-op so
+// partially built Fridges in tests don't need one.
+func (h *Hub) Publish(kind string, data interface{}) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.seq++
+	e := Event{ID: h.seq, Kind: kind, Time: time.Now(), Data: data}
+	subs := make([]*Subscription, 0, len(h.subs))
+	for s := range h.subs {
+		subs = append(subs, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range subs {
+		s.deliver(e)
+	}
+}
+
+// eventFilter limits a stream to some event kinds and status fields
+type eventFilter struct {
+	kinds  map[string]bool
+	fields map[string]bool
+}
+
+func newEventFilter(kinds, fields []string) eventFilter {
+	f := eventFilter{}
+	if len(kinds) > 0 {
+		f.kinds = map[string]bool{}
+		for _, k := range kinds {
+			f.kinds[k] = true
+		}
+	}
+	if len(fields) > 0 {
+		f.fields = map[string]bool{}
+		for _, k := range fields {
+			f.fields[k] = true
+		}
+	}
+	return f
+}
+
+// apply returns the event as it should be sent, or false to skip it
+func (f eventFilter) apply(e Event) (Event, bool) {
+	if f.kinds != nil && !f.kinds[e.Kind] {
+		return e, false
+	}
+	if f.fields == nil || e.Kind != eventStatus {
+		return e, true
+	}
+
+	b, err := json.Marshal(e.Data)
+	if err != nil {
+		return e, false
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return e, false
+	}
+	some := map[string]json.RawMessage{}
+	for k, v := range all {
+		if f.fields[k] {
+			some[k] = v
+		}
+	}
+	e.Data = some
+	return e, true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestHub(t *testing.T) {
+	h := newHub()
+	fast := h.Subscribe(10)
+	slow := h.Subscribe(2)
+	defer fast.Close()
+
+	for i := 0; i < 5; i++ {
+		h.Publish(eventStatus, i)
+	}
+
+	if len(fast.C) != 5 || fast.Dropped() != 0 {
+		t.Fatalf("Fast subscriber should have everything, has %d", len(fast.C))
+	}
+	if slow.Dropped() != 3 {
+		t.Fatalf("Expected 3 dropped, got %d", slow.Dropped())
+	}
+	// Slow subscriber keeps the newest events
+	if e := <-slow.C; e.Data != 3 {
+		t.Fatalf("Expected oldest kept event to be 3, got %v", e.Data)
+	}
+
+	slow.Close()
+	h.Publish(eventStatus, 5)
+	for e := range slow.C {
+		if e.Data != 4 {
+			t.Fatalf("Closed subscription got %v", e.Data)
+		}
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	f := newEventFilter([]string{eventStatus}, []string{"Temp", "TempSet"})
+	if _, ok := f.apply(Event{Kind: eventAlert}); ok {
+		t.Fatal("Alert should be filtered out")
+	}
+	e, ok := f.apply(Event{Kind: eventStatus, Data: testStatusReport})
+	if !ok {
+		t.Fatal("Status should pass")
+	}
+	b, _ := json.Marshal(e.Data)
+	if string(b) != `{"Temp":39,"TempSet":37}` {
+		t.Fatalf("Bad filtered data %s", b)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	mux := http.NewServeMux()
+	registerStreams(mux, f)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Publish until the stream has subscribed and sees one
+	publishUntil := func(done <-chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				f.hub.Publish(eventStatus, testStatusReport)
+				f.Alert("warn", "test", "lid open")
+			}
+		}
+	}
+
+	t.Run("sse", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/events?kinds=alert")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Bad content type %q", ct)
+		}
+
+		done := make(chan struct{})
+		defer close(done)
+		go publishUntil(done)
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") && line != "event: alert" {
+				t.Fatalf("Filtered kind came through: %s", line)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				var e Event
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					t.Fatal(err)
+				}
+				if e.Kind != eventAlert {
+					t.Fatalf("Bad event %v", e)
+				}
+				return
+			}
+		}
+		t.Fatal("Stream ended without an event")
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		ws, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/ws?fields=Temp", "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+
+		done := make(chan struct{})
+		defer close(done)
+		go publishUntil(done)
+
+		for i := 0; i < 10; i++ {
+			var e struct {
+				Kind string                 `json:"kind"`
+				Data map[string]interface{} `json:"data"`
+			}
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := websocket.JSON.Receive(ws, &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Kind != eventStatus {
+				continue
+			}
+			if len(e.Data) != 1 || e.Data["Temp"] != float64(39) {
+				t.Fatalf("Bad filtered status %v", e.Data)
+			}
+			return
+		}
+		t.Fatal("No status event")
+	})
+
+	t.Run("websocket from another site", func(t *testing.T) {
+		if _, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/ws", "", "http://evil.example"); err == nil {
+			t.Fatal("Expected a foreign origin turned away")
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/export"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+// Export formats
+const (
+	exportInflux   = "influx"
+	exportGraphite = "graphite"
+)
+
+// ExporterSettings avoids lots of args to ExporterClient
+type ExporterSettings struct {
+	format         string // influx or graphite
+	url            string // http(s)://, udp:// or tcp://
+	token          string // InfluxDB API token
+	prefix         string // Graphite metric prefix
+	node           string // Tag identifying this fridge
+	spoolDir       string
+	spoolMax       int
+	sampleInterval time.Duration
+	flushInterval  time.Duration
+	batchSize      int
+}
+
+// Validate checks the settings make sense
+func (s ExporterSettings) Validate() error {
+	if s.sampleInterval <= 0 || s.flushInterval <= 0 {
+		return errors.New("EXPORT_INTERVAL_SEC and EXPORT_FLUSH_INTERVAL_SEC must be positive")
+	}
+	if s.batchSize <= 0 {
+		return errors.New("EXPORT_BATCH_SIZE must be positive")
+	}
+	return nil
+}
+
+// fridgePoint turns a status report and the compressor's inferred state into
+// a telemetry sample
+func fridgePoint(node string, r k25.StatusReport, connected bool, fresh Freshness, comp CompressorState, at time.Time) export.Point {
+	return export.Point{
+		Measurement: "fridge",
+		Tags: map[string]string{
+			"node": node,
+			"unit": fridgeUnit(r.Settings),
+		},
+		Fields: map[string]interface{}{
+			"temp":          r.Temp,
+			"temp_set":      r.TempSet,
+			"on":            r.On,
+			"eco":           r.EcoMode,
+			"locked":        r.Locked,
+			"input_voltage": inputVoltage(r.Sensors),
+			"ub17":          r.UB17,
+			"hlvl":          r.HLvl,
+			"connected":     connected,
+			"stale":         fresh.Stale,
+			"age_seconds":   fresh.AgeSeconds,
+			"compressor":    comp.Running,
+			"duty_cycle_1h": comp.DutyCycle1h,
+			"watts":         comp.Watts,
+			"watt_hours":    comp.WattHours,
+		},
+		Time: at,
+	}
+}
+
+// formatPoint renders a point in the exporter's wire format
+func (s ExporterSettings) formatPoint(p export.Point) ([]string, error) {
+	switch s.format {
+	case exportInflux:
+		line, err := export.LineProtocol(p)
+		if err != nil {
+			return nil, err
+		}
+		return []string{line}, nil
+	case exportGraphite:
+		return export.Graphite(s.prefix, p), nil
+	}
+	return nil, fmt.Errorf("Unknown export format %q", s.format)
+}
+
+// flushSpool sends batches until the spool is empty or a send fails. Batches
+// the far end rejects outright are dropped so they don't block newer lines.
+func flushSpool(spool *export.Spool, sender export.Sender, batchSize int) (int, error) {
+	sent := 0
+	for {
+		batch := spool.Pending(batchSize)
+		if len(batch) == 0 {
+			return sent, nil
+		}
+		lines := make([]string, len(batch))
+		for i, e := range batch {
+			lines[i] = e.Line
+		}
+		if err := sender.Send(lines); errors.Is(err, export.ErrRejected) {
+			log.WithFields(log.Fields{
+				"client": "ExporterClient",
+				"lines":  len(batch),
+			}).Errorf("Dropping rejected batch: %s", err)
+		} else if err != nil {
+			return sent, err
+		} else {
+			sent += len(batch)
+		}
+		if err := spool.Ack(batch[len(batch)-1].Seq); err != nil {
+			return sent, err
+		}
+	}
+}
+
+// ExporterClient pushes fridge telemetry to InfluxDB or Graphite, spooling to
+// disk while the far end is unreachable and replaying when it's back
+func ExporterClient(ctx context.Context, wg *sync.WaitGroup, fridge *Fridge, settings ExporterSettings) {
+	log := log.WithFields(log.Fields{
+		"client": "ExporterClient",
+		"format": settings.format,
+	})
+	wg.Add(1)
+	defer func() {
+		wg.Done()
+		log.Trace("Calling done on main wait group")
+	}()
+
+	spool, err := export.OpenSpool(filepath.Join(settings.spoolDir, settings.format), settings.spoolMax)
+	if err != nil {
+		log.Errorf("Failed to open spool: %s", err)
+		return
+	}
+	sender, err := export.NewSender(settings.url, settings.token, 10*time.Second)
+	if err != nil {
+		log.Errorf("Failed to set up sender: %s", err)
+		return
+	}
+	defer sender.Close()
+	if n := spool.Len(); n > 0 {
+		log.Infof("Replaying %d spooled lines", n)
+	}
+
+	sampleTicker := time.NewTicker(settings.sampleInterval)
+	defer sampleTicker.Stop()
+	flushTicker := time.NewTicker(settings.flushInterval)
+	defer flushTicker.Stop()
+	online := true
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Trace("ExporterClient ctx canceled")
+			return
+		case now := <-sampleTicker.C:
+			r := fridge.GetStatusReport()
+			if r.Settings == initialFridgeSettings {
+				continue
+			}
+			lines, err := settings.formatPoint(fridgePoint(settings.node, r, fridge.Connected(), fridge.Freshness(), fridge.compressor.State(false), now))
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if err := spool.Append(lines...); err != nil {
+				log.Errorf("Spool append: %s", err)
+			}
+		case <-flushTicker.C:
+			sent, err := flushSpool(spool, sender, settings.batchSize)
+			if err != nil {
+				if online {
+					log.Warnf("Export failed, spooling %d lines: %s", spool.Len(), err)
+				}
+				online = false
+				continue
+			}
+			if !online {
+				log.Infof("Export back online, sent %d lines", sent)
+			}
+			online = true
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/export"
+)
+
+// testSender rejects batches containing bad lines and records the rest
+type testSender struct {
+	sent []string
+}
+
+func (s *testSender) Send(lines []string) error {
+	for _, l := range lines {
+		if l == "bad" {
+			return fmt.Errorf("%w: field type conflict", export.ErrRejected)
+		}
+	}
+	s.sent = append(s.sent, lines...)
+	return nil
+}
+
+func (s *testSender) Close() error { return nil }
+
+func TestFlushSpoolDropsRejected(t *testing.T) {
+	spool, err := export.OpenSpool(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append("bad", "a 1", "b 2"); err != nil {
+		t.Fatal(err)
+	}
+	s := &testSender{}
+	sent, err := flushSpool(spool, s, 1)
+	if err != nil || sent != 2 || spool.Len() != 0 {
+		t.Fatalf("Expected the rejected line dropped and the rest sent, got %d %v with %d left", sent, err, spool.Len())
+	}
+	if len(s.sent) != 2 || s.sent[0] != "a 1" {
+		t.Fatalf("Bad lines sent %v", s.sent)
+	}
+}
+
+func TestExporterSettingsValidate(t *testing.T) {
+	ok := ExporterSettings{sampleInterval: 10 * time.Second, flushInterval: time.Minute, batchSize: 500}
+	if err := ok.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []func(*ExporterSettings){
+		func(s *ExporterSettings) { s.sampleInterval = 0 },
+		func(s *ExporterSettings) { s.flushInterval = -time.Second },
+		func(s *ExporterSettings) { s.batchSize = 0 },
+	} {
+		s := ok
+		bad(&s)
+		if s.Validate() == nil {
+			t.Fatalf("Expected %+v rejected", s)
+		}
+	}
+}
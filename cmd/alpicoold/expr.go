@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprType is what an expression evaluates to, checked when a rule loads
+type exprType int
+
+const (
+	exprNumber exprType = iota
+	exprBool
+)
+
+func (t exprType) String() string {
+	if t == exprBool {
+		return "bool"
+	}
+	return "number"
+}
+
+// exprValue is a number or a bool, depending on the expression's type
+type exprValue struct {
+	num float64
+	b   bool
+}
+
+func (v exprValue) format(t exprType) string {
+	if t == exprBool {
+		return strconv.FormatBool(v.b)
+	}
+	return strconv.FormatFloat(v.num, 'f', -1, 64)
+}
+
+// exprVars are the values a condition can read, by name
+type exprVars map[string]exprValue
+
+// exprNode is one piece of a parsed expression
+type exprNode struct {
+	op          string // literal, var, !, neg, or a binary operator
+	typ         exprType
+	val         exprValue // literal
+	name        string    // var
+	left, right *exprNode
+}
+
+// Expr is a compiled rule condition like `inputV < 12.2 && on`
+type Expr struct {
+	src  string
+	root *exprNode
+}
+
+// binary operators by precedence, loosest first
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+// exprParser is a recursive descent parser over a token list
+type exprParser struct {
+	tokens []string
+	pos    int
+	types  map[string]exprType
+}
+
+// tokenizeExpr splits src into numbers, names, operators and parentheses
+func tokenizeExpr(src string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("<>!+-*/()", c) {
+				return nil, fmt.Errorf("Unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// compileExpr parses src and checks it against the variable types
+func compileExpr(src string, types map[string]exprType) (*Expr, error) {
+	tokens, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Empty expression")
+	}
+	p := &exprParser{tokens: tokens, types: types}
+	root, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %q", p.tokens[p.pos])
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) binary(level int) (*exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		found := false
+		for _, o := range exprPrecedence[level] {
+			found = found || o == op
+		}
+		if !found {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		n := &exprNode{op: op, left: left, right: right}
+		switch op {
+		case "||", "&&":
+			if left.typ != exprBool || right.typ != exprBool {
+				return nil, fmt.Errorf("%s needs bools on both sides", op)
+			}
+			n.typ = exprBool
+		case "==", "!=":
+			if left.typ != right.typ {
+				return nil, fmt.Errorf("Can't compare %s with %s", left.typ, right.typ)
+			}
+			n.typ = exprBool
+		case "<", "<=", ">", ">=":
+			if left.typ != exprNumber || right.typ != exprNumber {
+				return nil, fmt.Errorf("%s needs numbers on both sides", op)
+			}
+			n.typ = exprBool
+		default:
+			if left.typ != exprNumber || right.typ != exprNumber {
+				return nil, fmt.Errorf("%s needs numbers on both sides", op)
+			}
+			n.typ = exprNumber
+		}
+		left = n
+	}
+}
+
+func (p *exprParser) unary() (*exprNode, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, fmt.Errorf("Expression ends early")
+	}
+	p.pos++
+	switch {
+	case tok == "!" || tok == "-":
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if tok == "!" {
+			if operand.typ != exprBool {
+				return nil, fmt.Errorf("! needs a bool")
+			}
+			return &exprNode{op: "!", typ: exprBool, left: operand}, nil
+		}
+		if operand.typ != exprNumber {
+			return nil, fmt.Errorf("- needs a number")
+		}
+		return &exprNode{op: "neg", typ: exprNumber, left: operand}, nil
+	case tok == "(":
+		n, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("Missing )")
+		}
+		p.pos++
+		return n, nil
+	case tok == "true" || tok == "false":
+		return &exprNode{op: "literal", typ: exprBool, val: exprValue{b: tok == "true"}}, nil
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad number %q", tok)
+		}
+		return &exprNode{op: "literal", typ: exprNumber, val: exprValue{num: f}}, nil
+	case unicode.IsLetter(rune(tok[0])) || tok[0] == '_':
+		t, ok := p.types[tok]
+		if !ok {
+			return nil, fmt.Errorf("Unknown variable %q", tok)
+		}
+		return &exprNode{op: "var", typ: t, name: tok}, nil
+	}
+	return nil, fmt.Errorf("Unexpected %q", tok)
+}
+
+func (n *exprNode) eval(vars exprVars) exprValue {
+	switch n.op {
+	case "literal":
+		return n.val
+	case "var":
+		return vars[n.name]
+	case "!":
+		return exprValue{b: !n.left.eval(vars).b}
+	case "neg":
+		return exprValue{num: -n.left.eval(vars).num}
+	case "&&":
+		return exprValue{b: n.left.eval(vars).b && n.right.eval(vars).b}
+	case "||":
+		return exprValue{b: n.left.eval(vars).b || n.right.eval(vars).b}
+	}
+	l, r := n.left.eval(vars), n.right.eval(vars)
+	switch n.op {
+	case "==":
+		return exprValue{b: l == r}
+	case "!=":
+		return exprValue{b: l != r}
+	case "<":
+		return exprValue{b: l.num < r.num}
+	case "<=":
+		return exprValue{b: l.num <= r.num}
+	case ">":
+		return exprValue{b: l.num > r.num}
+	case ">=":
+		return exprValue{b: l.num >= r.num}
+	case "+":
+		return exprValue{num: l.num + r.num}
+	case "-":
+		return exprValue{num: l.num - r.num}
+	case "*":
+		return exprValue{num: l.num * r.num}
+	case "/":
+		if r.num == 0 {
+			return exprValue{}
+		}
+		return exprValue{num: l.num / r.num}
+	}
+	return exprValue{}
+}
+
+// explain writes the expression with each variable's current value filled in
+func (n *exprNode) explain(vars exprVars, b *strings.Builder) {
+	switch n.op {
+	case "literal":
+		b.WriteString(n.val.format(n.typ))
+	case "var":
+		fmt.Fprintf(b, "%s(%s)", n.name, vars[n.name].format(n.typ))
+	case "!":
+		b.WriteString("!")
+		n.left.explain(vars, b)
+	case "neg":
+		b.WriteString("-")
+		n.left.explain(vars, b)
+	default:
+		b.WriteString("(")
+		n.left.explain(vars, b)
+		fmt.Fprintf(b, " %s ", n.op)
+		n.right.explain(vars, b)
+		b.WriteString(")")
+	}
+}
+
+// Eval runs a bool expression
+func (e *Expr) Eval(vars exprVars) bool {
+	return e.root.eval(vars).b
+}
+
+// Explain shows how e came out against vars
+func (e *Expr) Explain(vars exprVars) string {
+	b := strings.Builder{}
+	e.root.explain(vars, &b)
+	fmt.Fprintf(&b, " = %s", e.root.eval(vars).format(e.root.typ))
+	return b.String()
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	types := map[string]exprType{"inputV": exprNumber, "on": exprBool, "temp": exprNumber}
+	vars := exprVars{"inputV": {num: 12.1}, "on": {b: true}, "temp": {num: 4}}
+
+	for src, want := range map[string]bool{
+		"inputV < 12.2 && on":             true,
+		"inputV < 12.2 && !on":            false,
+		"inputV >= 12.2 || temp == 4":     true,
+		"(temp + 2) * 2 > 11":             true,
+		"temp - 10 == -6":                 true,
+		"temp / 0 == 0":                   true,
+		"on == true && false != on":       true,
+		"1 + 2 * 3 == 7":                  true,
+		"!(inputV < 12.2) || temp <= 3.5": false,
+	} {
+		e, err := compileExpr(src, types)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if got := e.Eval(vars); got != want {
+			t.Fatalf("%s: expected %v, got %v", src, want, got)
+		}
+	}
+
+	for _, src := range []string{
+		"",
+		"inputV <",
+		"inputV && on",
+		"on < 3",
+		"on == 1",
+		"-on",
+		"voltage > 1",
+		"(on",
+		"on)",
+		"temp $ 3",
+		"1.2.3 > 1",
+	} {
+		if _, err := compileExpr(src, types); err == nil {
+			t.Fatalf("%q should not compile", src)
+		}
+	}
+
+	e, _ := compileExpr("inputV < 12.2 && on", types)
+	if got := e.Explain(vars); !strings.Contains(got, "inputV(12.1) < 12.2") || !strings.HasSuffix(got, "= true") {
+		t.Fatalf("Bad explanation %q", got)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/johnelliott/alpicoold/pkg/fridgepb"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCSettings avoids lots of args to GRPCClient
+type GRPCSettings struct {
+	addr       string // TCP host:port, empty disables TCP
+	socket     string // unix socket path, empty disables the socket
+	fridgeID   string
+	fridgeAddr string      // bluetooth address, for ListFridges
+	auth       *Auth       // checked on TCP, the socket is guarded by file permissions
+	tls        *tls.Config // for TCP, nil is plaintext
+}
+
+// grpcReadOnly are the methods the read role can call
+var grpcReadOnly = map[string]bool{
+	fridgepb.Fridge_ListFridges_FullMethodName: true,
+	fridgepb.Fridge_GetStatus_FullMethodName:   true,
+	fridgepb.Fridge_WatchStatus_FullMethodName: true,
+}
+
+// grpcRole works out the caller's role from "authorization: Bearer" metadata.
+// Unix socket callers already got past the socket's file permissions.
+func grpcRole(ctx context.Context, a *Auth) Role {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil && p.Addr.Network() == "unix" {
+		return roleControl
+	}
+	if !a.Enabled() {
+		return roleRead
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, h := range md.Get("authorization") {
+		if !strings.HasPrefix(h, "Bearer ") {
+			continue
+		}
+		token := strings.TrimPrefix(h, "Bearer ")
+		best := roleNone
+		for t, role := range a.tokens {
+			if secureEqual(t, token) && role > best {
+				best = role
+			}
+		}
+		return best
+	}
+	if a.anonymousRead {
+		return roleRead
+	}
+	return roleNone
+}
+
+func grpcAuthorize(ctx context.Context, a *Auth, method string) error {
+	need := roleControl
+	if grpcReadOnly[method] {
+		need = roleRead
+	}
+	have := grpcRole(ctx, a)
+	if have >= need {
+		return nil
+	}
+	if have == roleNone {
+		return status.Error(codes.Unauthenticated, "Authentication required")
+	}
+	return status.Errorf(codes.PermissionDenied, "The %s role can't call %s", have, method)
+}
+
+// grpcCommandError maps command path failures to status codes
+func grpcCommandError(err error) error {
+	switch {
+	case errors.Is(err, errNoStatus):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "Timed out waiting for the bluetooth writer, is the fridge connected?")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, errTempRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.As(err, new(*ConflictError)):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+func settingsToPB(s k25.Settings) *fridgepb.Settings {
+	return &fridgepb.Settings{
+		Locked:                            s.Locked,
+		On:                                s.On,
+		EcoMode:                           s.EcoMode,
+		HLvl:                              int32(s.HLvl),
+		TempSet:                           int32(s.TempSet),
+		HighestTempSettingMenuE2:          int32(s.HighestTempSettingMenuE2),
+		LowestTempSettingMenuE1:           int32(s.LowestTempSettingMenuE1),
+		HysteresisMenuE3:                  int32(s.HysteresisMenuE3),
+		SoftStartDelayMinMenuE4:           int32(s.SoftStartDelayMinMenuE4),
+		CelsiusFahrenheitModeMenuE5:       s.CelsiusFahrenheitModeMenuE5,
+		TempCompGteMinus6DegCelsiusMenuE6: int32(s.TempCompGTEMinus6DegCelsiusMenuE6),
+		TempCompGteMinus12DegCelsiusLtMinus6DegCelsiusMenuE7: int32(s.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7),
+		TempCompLtMinus12DegCelsiusMenuE8:                    int32(s.TempCompLTMinus12DegCelsiusMenuE8),
+		TempCompShutdownMenuE9:                               int32(s.TempCompShutdownMenuE9),
+	}
+}
+
+// settingsFromPB converts back, rejecting values that don't fit the fridge's bytes
+func settingsFromPB(p *fridgepb.Settings) (k25.Settings, error) {
+	var err error
+	i8 := func(name string, v int32) int8 {
+		if v < math.MinInt8 || v > math.MaxInt8 {
+			err = fmt.Errorf("%s %d doesn't fit in a byte", name, v)
+		}
+		return int8(v)
+	}
+	s := k25.Settings{
+		Locked:                            p.GetLocked(),
+		On:                                p.GetOn(),
+		EcoMode:                           p.GetEcoMode(),
+		HLvl:                              i8("h_lvl", p.GetHLvl()),
+		TempSet:                           i8("temp_set", p.GetTempSet()),
+		HighestTempSettingMenuE2:          i8("highest_temp_setting_menu_e2", p.GetHighestTempSettingMenuE2()),
+		LowestTempSettingMenuE1:           i8("lowest_temp_setting_menu_e1", p.GetLowestTempSettingMenuE1()),
+		HysteresisMenuE3:                  i8("hysteresis_menu_e3", p.GetHysteresisMenuE3()),
+		SoftStartDelayMinMenuE4:           i8("soft_start_delay_min_menu_e4", p.GetSoftStartDelayMinMenuE4()),
+		CelsiusFahrenheitModeMenuE5:       p.GetCelsiusFahrenheitModeMenuE5(),
+		TempCompGTEMinus6DegCelsiusMenuE6: i8("temp_comp_gte_minus6_deg_celsius_menu_e6", p.GetTempCompGteMinus6DegCelsiusMenuE6()),
+		TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7: i8("temp_comp_gte_minus12_deg_celsius_lt_minus6_deg_celsius_menu_e7", p.GetTempCompGteMinus12DegCelsiusLtMinus6DegCelsiusMenuE7()),
+		TempCompLTMinus12DegCelsiusMenuE8:                    i8("temp_comp_lt_minus12_deg_celsius_menu_e8", p.GetTempCompLtMinus12DegCelsiusMenuE8()),
+		TempCompShutdownMenuE9:                               i8("temp_comp_shutdown_menu_e9", p.GetTempCompShutdownMenuE9()),
+	}
+	return s, err
+}
+
+func unitToPB(s k25.Settings) fridgepb.TemperatureUnit {
+	if fridgeUnit(s) == "F" {
+		return fridgepb.TemperatureUnit_TEMPERATURE_UNIT_FAHRENHEIT
+	}
+	return fridgepb.TemperatureUnit_TEMPERATURE_UNIT_CELSIUS
+}
+
+// applyFieldMask copies the masked fields of patch over current
+func applyFieldMask(current k25.Settings, patch *fridgepb.Settings, paths []string) (k25.Settings, error) {
+	if len(paths) == 0 {
+		return current, errors.New("update_mask must name at least one field")
+	}
+	if patch == nil {
+		patch = &fridgepb.Settings{}
+	}
+	merged := settingsToPB(current)
+	dst, src := merged.ProtoReflect(), patch.ProtoReflect()
+	for _, p := range paths {
+		fd := dst.Descriptor().Fields().ByName(protoreflect.Name(p))
+		if fd == nil {
+			return current, fmt.Errorf("Unknown settings field %q", p)
+		}
+		dst.Set(fd, src.Get(fd))
+	}
+	return settingsFromPB(merged)
+}
+
+// grpcServer implements fridgepb.FridgeServer for the daemon's one fridge
+type grpcServer struct {
+	fridgepb.UnimplementedFridgeServer
+	f        *Fridge
+	settings GRPCSettings
+}
+
+func (g *grpcServer) checkID(id string) error {
+	if id != "" && id != g.settings.fridgeID {
+		return status.Errorf(codes.NotFound, "No fridge %q", id)
+	}
+	return nil
+}
+
+func (g *grpcServer) status() *fridgepb.Status {
+	r := g.f.GetStatusReport()
+	fresh := g.f.Freshness()
+	s := &fridgepb.Status{
+		FridgeId:  g.settings.fridgeID,
+		Connected: g.f.Connected(),
+		Stale:     fresh.Stale,
+		Unit:      unitToPB(r.Settings),
+		Settings:  settingsToPB(r.Settings),
+		Sensors: &fridgepb.Sensors{
+			Temp:         int32(r.Temp),
+			Ub17:         int32(r.UB17),
+			InputV1:      int32(r.InputV1),
+			InputV2:      int32(r.InputV2),
+			InputVoltage: inputVoltage(r.Sensors),
+		},
+	}
+	if fresh.LastUpdate != nil {
+		s.LastUpdate = timestamppb.New(*fresh.LastUpdate)
+	}
+	return s
+}
+
+func (g *grpcServer) ListFridges(ctx context.Context, req *fridgepb.ListFridgesRequest) (*fridgepb.ListFridgesResponse, error) {
+	return &fridgepb.ListFridgesResponse{Fridges: []*fridgepb.FridgeInfo{{
+		FridgeId:  g.settings.fridgeID,
+		Address:   g.settings.fridgeAddr,
+		Connected: g.f.Connected(),
+	}}}, nil
+}
+
+func (g *grpcServer) GetStatus(ctx context.Context, req *fridgepb.GetStatusRequest) (*fridgepb.Status, error) {
+	if err := g.checkID(req.GetFridgeId()); err != nil {
+		return nil, err
+	}
+	if g.f.GetStatusReport().Settings == initialFridgeSettings {
+		return nil, grpcCommandError(errNoStatus)
+	}
+	return g.status(), nil
+}
+
+func (g *grpcServer) WatchStatus(req *fridgepb.WatchStatusRequest, stream fridgepb.Fridge_WatchStatusServer) error {
+	if err := g.checkID(req.GetFridgeId()); err != nil {
+		return err
+	}
+	sub := g.f.hub.Subscribe(streamBuffer)
+	defer sub.Close()
+
+	// Only send what changed, status reports mostly repeat themselves
+	var last *fridgepb.Status
+	send := func() error {
+		if g.f.GetStatusReport().Settings == initialFridgeSettings {
+			return nil
+		}
+		s := g.status()
+		// Every report moves last_update, so leave it out of the comparison
+		cmp := proto.Clone(s).(*fridgepb.Status)
+		cmp.LastUpdate = nil
+		if proto.Equal(cmp, last) {
+			return nil
+		}
+		last = cmp
+		return stream.Send(s)
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			if e.Kind != eventStatus && e.Kind != eventConnection && e.Kind != eventStale {
+				continue
+			}
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (g *grpcServer) UpdateSettings(ctx context.Context, req *fridgepb.UpdateSettingsRequest) (*fridgepb.Settings, error) {
+	if err := g.checkID(req.GetFridgeId()); err != nil {
+		return nil, err
+	}
+	current := g.f.GetStatusReport().Settings
+	if current == initialFridgeSettings {
+		return nil, grpcCommandError(errNoStatus)
+	}
+	next, err := applyFieldMask(current, req.GetSettings(), req.GetUpdateMask().GetPaths())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	sent, err := g.f.UpdateSettings(ctx, Command{Source: sourceGRPC}, func(s *k25.Settings) { *s = next })
+	if err != nil {
+		return nil, grpcCommandError(err)
+	}
+	return settingsToPB(sent), nil
+}
+
+func (g *grpcServer) SetTemperature(ctx context.Context, req *fridgepb.SetTemperatureRequest) (*fridgepb.SetTemperatureResponse, error) {
+	if err := g.checkID(req.GetFridgeId()); err != nil {
+		return nil, err
+	}
+	s := g.f.GetStatusReport().Settings
+	if s == initialFridgeSettings {
+		return nil, grpcCommandError(errNoStatus)
+	}
+	unit := ""
+	switch req.GetUnit() {
+	case fridgepb.TemperatureUnit_TEMPERATURE_UNIT_CELSIUS:
+		unit = "C"
+	case fridgepb.TemperatureUnit_TEMPERATURE_UNIT_FAHRENHEIT:
+		unit = "F"
+	default:
+		return nil, status.Error(codes.InvalidArgument, "unit is required")
+	}
+	v, celsius, err := resolveTemp(s, req.GetValue(), unit)
+	if err != nil {
+		return nil, grpcCommandError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	if err := g.f.SendTemp(ctx, Command{Source: sourceGRPC}, celsius); err != nil {
+		return nil, grpcCommandError(err)
+	}
+	return &fridgepb.SetTemperatureResponse{Value: v, Unit: unitToPB(s)}, nil
+}
+
+// newGRPCServer builds the server with auth checks on every call
+func newGRPCServer(settings GRPCSettings, f *Fridge, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthorize(ctx, settings.auth, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthorize(ss.Context(), settings.auth, info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	s := grpc.NewServer(opts...)
+	fridgepb.RegisterFridgeServer(s, &grpcServer{f: f, settings: settings})
+	return s
+}
+
+// listenUnix replaces a stale socket and lets only the owner and group in
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// GRPCClient serves the gRPC API on TCP and/or a unix socket
+func GRPCClient(ctx context.Context, wg *sync.WaitGroup, f *Fridge, settings GRPCSettings) {
+	wg.Add(1)
+	defer func() {
+		log.WithFields(log.Fields{
+			"client": "GRPCClient",
+		}).Trace("Calling done on main wait group")
+		wg.Done()
+	}()
+	log := log.WithFields(log.Fields{"client": "GRPCClient"})
+
+	if settings.addr != "" && !settings.auth.Enabled() {
+		log.Warn("No HTTP credentials configured, gRPC over TCP is read-only and only the unix socket can control the fridge")
+	}
+
+	servers := []*grpc.Server{}
+	serve := func(s *grpc.Server, l net.Listener) {
+		servers = append(servers, s)
+		log.Debugf("server starting on %s %s", l.Addr().Network(), l.Addr())
+		go func() {
+			if err := s.Serve(l); err != nil {
+				log.WithField("err", err).Error("gRPC server stopped")
+			}
+		}()
+	}
+
+	if settings.addr != "" {
+		l, err := net.Listen("tcp", settings.addr)
+		if err != nil {
+			log.WithField("err", err).Error("Failed to listen")
+			return
+		}
+		opts := []grpc.ServerOption{}
+		if settings.tls != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(settings.tls)))
+		}
+		serve(newGRPCServer(settings, f, opts...), l)
+	}
+	if settings.socket != "" {
+		l, err := listenUnix(settings.socket)
+		if err != nil {
+			log.WithField("err", err).Error("Failed to listen")
+		} else {
+			defer os.Remove(settings.socket)
+			serve(newGRPCServer(settings, f), l)
+		}
+	}
+
+	<-ctx.Done()
+	log.Trace("client shutting down")
+	for _, s := range servers {
+		// Watchers never finish on their own, so don't wait on them
+		s.Stop()
+	}
+	log.Debug("done")
+}
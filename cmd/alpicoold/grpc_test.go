@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/fridgepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// dialTestGRPC serves f on l and returns a client for it
+func dialTestGRPC(t *testing.T, settings GRPCSettings, f *Fridge, l net.Listener, target string) fridgepb.FridgeClient {
+	t.Helper()
+	s := newGRPCServer(settings, f)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return fridgepb.NewFridgeClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	setCommandTimeout(t, 200*time.Millisecond)
+	auth, _ := newAuth("reader", "controller", "", false)
+	settings := GRPCSettings{fridgeID: "aabb", fridgeAddr: "AA:BB", auth: auth}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dialTestGRPC(t, settings, f, l, l.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	sent := standInWriter(t, f, false)
+
+	t.Run("auth", func(t *testing.T) {
+		if _, err := client.GetStatus(ctx, &fridgepb.GetStatusRequest{}); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("Expected Unauthenticated, got %v", err)
+		}
+		_, err := client.SetTemperature(as("reader"), &fridgepb.SetTemperatureRequest{Value: 3, Unit: fridgepb.TemperatureUnit_TEMPERATURE_UNIT_CELSIUS})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("Expected PermissionDenied, got %v", err)
+		}
+	})
+
+	t.Run("ListFridges", func(t *testing.T) {
+		res, err := client.ListFridges(as("reader"), &fridgepb.ListFridgesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Fridges) != 1 || res.Fridges[0].FridgeId != "aabb" || res.Fridges[0].Address != "AA:BB" {
+			t.Fatalf("Bad fridges %v", res.Fridges)
+		}
+	})
+
+	t.Run("GetStatus", func(t *testing.T) {
+		s, err := client.GetStatus(as("reader"), &fridgepb.GetStatusRequest{FridgeId: "aabb"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Settings.TempSet != 37 || s.Sensors.Temp != 39 || s.Sensors.InputVoltage != 12.8 ||
+			s.Unit != fridgepb.TemperatureUnit_TEMPERATURE_UNIT_FAHRENHEIT {
+			t.Fatalf("Bad status %v", s)
+		}
+		if _, err := client.GetStatus(as("reader"), &fridgepb.GetStatusRequest{FridgeId: "nope"}); status.Code(err) != codes.NotFound {
+			t.Fatalf("Expected NotFound, got %v", err)
+		}
+	})
+
+	t.Run("UpdateSettings", func(t *testing.T) {
+		res, err := client.UpdateSettings(as("controller"), &fridgepb.UpdateSettingsRequest{
+			Settings:   &fridgepb.Settings{Locked: true, TempSet: 99, On: false},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"locked"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := <-sent
+		if !s.Locked || !s.On || s.TempSet != 37 || !res.Locked {
+			t.Fatalf("Only locked should change, got %+v", s)
+		}
+
+		for _, c := range []struct {
+			name  string
+			paths []string
+			code  codes.Code
+		}{
+			{"empty mask", nil, codes.InvalidArgument},
+			{"unknown field", []string{"nope"}, codes.InvalidArgument},
+			{"out of range", []string{"temp_set"}, codes.InvalidArgument},
+		} {
+			_, err := client.UpdateSettings(as("controller"), &fridgepb.UpdateSettingsRequest{
+				Settings:   &fridgepb.Settings{TempSet: 99},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: c.paths},
+			})
+			if status.Code(err) != c.code {
+				t.Fatalf("%s: expected %s, got %v", c.name, c.code, err)
+			}
+		}
+	})
+
+	t.Run("SetTemperature", func(t *testing.T) {
+		res, err := client.SetTemperature(as("controller"), &fridgepb.SetTemperatureRequest{
+			Value: 3,
+			Unit:  fridgepb.TemperatureUnit_TEMPERATURE_UNIT_CELSIUS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := <-sent; s.TempSet != 37 || res.Value != 37 {
+			t.Fatalf("Expected 37F, got %v %+v", res.Value, s)
+		}
+		_, err = client.SetTemperature(as("controller"), &fridgepb.SetTemperatureRequest{
+			Value: 100,
+			Unit:  fridgepb.TemperatureUnit_TEMPERATURE_UNIT_FAHRENHEIT,
+		})
+		if status.Code(err) != codes.OutOfRange {
+			t.Fatalf("Expected OutOfRange, got %v", err)
+		}
+	})
+
+	t.Run("WatchStatus", func(t *testing.T) {
+		stream, err := client.WatchStatus(as("reader"), &fridgepb.WatchStatusRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Sensors.Temp != 39 {
+			t.Fatalf("Bad first status %v", first)
+		}
+
+		next := testStatusReport
+		next.Temp = 40
+		f.mu.Lock()
+		f.status = next
+		f.mu.Unlock()
+		f.hub.Publish(eventStatus, next)
+		second, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Sensors.Temp != 40 {
+			t.Fatalf("Expected the new temp, got %v", second)
+		}
+	})
+}
+
+func TestGRPCUnixSocket(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	auth, _ := newAuth("", "controller", "", false)
+	path := filepath.Join(t.TempDir(), "alpicoold.sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dialTestGRPC(t, GRPCSettings{fridgeID: "aabb", auth: auth}, f, l, "unix://"+path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// No token needed on the socket
+	if _, err := client.GetStatus(ctx, &fridgepb.GetStatusRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
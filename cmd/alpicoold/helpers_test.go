@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// testStatusReport is a fridge in Fahrenheit mode, on and in eco at 37°F
+var testStatusReport = k25.StatusReport{
+	Preamble:    k25.Preamble,
+	DataLen:     0x15,
+	CommandCode: 0x1,
+	Settings: k25.Settings{
+		On:                          true,
+		EcoMode:                     true,
+		HLvl:                        1,
+		TempSet:                     37,
+		LowestTempSettingMenuE1:     -4,
+		HighestTempSettingMenuE2:    68,
+		HysteresisMenuE3:            4,
+		CelsiusFahrenheitModeMenuE5: true,
+	},
+	Sensors: k25.Sensors{
+		Temp:    39,
+		InputV1: 12,
+		InputV2: 8,
+	},
+}
+
+// newTestFridge is a fridge reporting r with nothing reading its command channels
+func newTestFridge(r k25.StatusReport) *Fridge {
+	return &Fridge{
+		status:            r,
+		inlet:             make(statusReportC),
+		tempSettingsC:     make(tempSettingsC),
+		settingsC:         make(settingsC),
+		cycleCompressorWg: &sync.WaitGroup{},
+		hub:               newHub(),
+		diag:              newDiagnostics(),
+		resubscribeC:      make(chan struct{}, 1),
+	}
+}
+
+// setCommandTimeout changes commandTimeout until the test ends
+func setCommandTimeout(t *testing.T, d time.Duration) {
+	prev := commandTimeout
+	commandTimeout = d
+	t.Cleanup(func() { commandTimeout = prev })
+}
+
+// standInWriter stands in for the bluetooth writer until the test ends. It
+// passes on the settings each command would send, converting temperatures the
+// way the writer does, and with apply set the fridge takes them on.
+func standInWriter(t *testing.T, f *Fridge, apply bool) <-chan k25.Settings {
+	sent := make(chan k25.Settings, 16)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			var s k25.Settings
+			select {
+			case <-done:
+				return
+			case c := <-f.settingsC:
+				s = c.Settings
+			case c := <-f.tempSettingsC:
+				s = c.settings(f.GetStatusReport())
+			}
+			if apply {
+				f.mu.Lock()
+				f.status.Settings = s
+				f.mu.Unlock()
+			}
+			// Tests that don't look at what was sent don't hold up the writer
+			select {
+			case sent <- s:
+			default:
+			}
+		}
+	}()
+	return sent
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+var errBadMinutes = errors.New("minutes must be a positive integer")
+
+// Sample is a thinned out status report kept for charts
+type Sample struct {
+	Time         time.Time `json:"time"`
+	Temp         int8      `json:"temp"`
+	TempSet      int8      `json:"tempSet"`
+	Unit         string    `json:"unit"`
+	On           bool      `json:"on"`
+	EcoMode      bool      `json:"eco"`
+	InputVoltage float64   `json:"inputVoltage"`
+	Connected    bool      `json:"connected"`
+}
+
+// History is a fixed size ring of samples, at most one per interval
+type History struct {
+	mu       sync.RWMutex
+	interval time.Duration
+	samples  []Sample
+	next     int
+	full     bool
+	last     time.Time
+}
+
+func newHistory(size int, interval time.Duration) *History {
+	return &History{
+		interval: interval,
+		samples:  make([]Sample, size),
+	}
+}
+
+// Record keeps r if an interval has passed since the last sample. A nil
+// History records nothing.
+func (h *History) Record(r k25.StatusReport, connected bool, at time.Time) {
+	if h == nil || len(h.samples) == 0 || r.Settings == initialFridgeSettings {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.last.IsZero() && at.Sub(h.last) < h.interval {
+		return
+	}
+	h.last = at
+	h.samples[h.next] = Sample{
+		Time:         at,
+		Temp:         r.Temp,
+		TempSet:      r.TempSet,
+		Unit:         fridgeUnit(r.Settings),
+		On:           r.On,
+		EcoMode:      r.EcoMode,
+		InputVoltage: inputVoltage(r.Sensors),
+		Connected:    connected,
+	}
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Since returns samples newer than t, oldest first
+func (h *History) Since(t time.Time) []Sample {
+	out := []Sample{}
+	if h == nil {
+		return out
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ordered := h.samples[:h.next]
+	if h.full {
+		ordered = append(append([]Sample{}, h.samples[h.next:]...), h.samples[:h.next]...)
+	}
+	for _, s := range ordered {
+		if s.Time.After(t) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// handleHistory serves samples, ?minutes=N limits how far back
+func handleHistory(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := time.Time{}
+		if m := r.URL.Query().Get("minutes"); m != "" {
+			minutes, err := strconv.Atoi(m)
+			if err != nil || minutes <= 0 {
+				writeError(w, http.StatusBadRequest, errBadMinutes)
+				return
+			}
+			since = time.Now().Add(-time.Duration(minutes) * time.Minute)
+		}
+		writeJSON(w, http.StatusOK, f.history.Since(since))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/db"
+	"github.com/mdp/qrterminal/v3"
+)
+
+// hkDefaultPin is the PIN older releases hardcoded, kept so existing setups can re-pair
+const hkDefaultPin = "80000000"
+
+// Stable accessory ids so the Home app keeps rooms and automations across restarts
+const (
+	hkBridgeID uint64 = iota + 1
+	hkThermostatID
+	hkLockID
+	hkOnID
+	hkEcoID
+	hkCameraID
+	hkLidID
+)
+
+var setupIDPattern = regexp.MustCompile(`^[0-9A-Z]{4}$`)
+
+// hkFiles are the names hc keeps in its storage directory, which it shares
+// with the tls, export and camera snapshot files
+var hkFiles = []string{"uuid", "version", "configHash"}
+
+// macHex is the fridge address as uppercase hex without separators
+func macHex(addr string) string {
+	s := strings.ToUpper(addr)
+	for _, sep := range []string{":", "-", "."} {
+		s = strings.ReplaceAll(s, sep, "")
+	}
+	return s
+}
+
+// macSuffix is the last four hex digits of the fridge address, enough to
+// tell two fridges apart on one network
+func macSuffix(addr string) string {
+	s := macHex(addr)
+	if len(s) < 4 {
+		return s
+	}
+	return s[len(s)-4:]
+}
+
+// validSetupID checks the 4 character setup id that goes in the X-HM:// URI
+func validSetupID(id string) error {
+	if !setupIDPattern.MatchString(id) {
+		return fmt.Errorf("HomeKit setup id %q must be 4 uppercase letters or digits", id)
+	}
+	return nil
+}
+
+// HKIdentity is how the bridge and its accessories introduce themselves
+type HKIdentity struct {
+	name         string // bridge name, accessory names build on it
+	manufacturer string
+	model        string
+	serial       string // base serial, each accessory adds a suffix
+}
+
+// newHKIdentity fills in blanks from the fridge address
+func newHKIdentity(addr, name, manufacturer, model string) HKIdentity {
+	suffix := macSuffix(addr)
+	if name == "" {
+		name = strings.TrimSpace("Alpicool " + suffix)
+	}
+	serial := macHex(addr)
+	if serial == "" {
+		serial = "0"
+	}
+	return HKIdentity{name: name, manufacturer: manufacturer, model: model, serial: serial}
+}
+
+// info describes one accessory, part names it and suffixes its serial
+func (i HKIdentity) info(id uint64, part string) accessory.Info {
+	name, serial := i.name, i.serial
+	if part != "" {
+		name = i.name + " " + part
+		serial = i.serial + "-" + strings.ToUpper(part)
+	}
+	return accessory.Info{
+		ID:           id,
+		Name:         name,
+		SerialNumber: serial,
+		Manufacturer: i.manufacturer,
+		Model:        i.model,
+	}
+}
+
+// hkPaired is true when a controller has paired with the bridge in dir. The
+// bridge's own key pair is one entity, every pairing adds another.
+func hkPaired(dir string) bool {
+	d, err := db.NewDatabase(dir)
+	if err != nil {
+		return false
+	}
+	es, err := d.Entities()
+	return err == nil && len(es) > 1
+}
+
+// resetHKPairing removes hc's identity and pairings from dir and leaves
+// everything else alone. The next start is a new, unpaired bridge.
+func resetHKPairing(dir string) ([]string, error) {
+	entities, err := filepath.Glob(filepath.Join(dir, "*.entity"))
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, name := range hkFiles {
+		entities = append(entities, filepath.Join(dir, name))
+	}
+	for _, path := range entities {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, filepath.Base(path))
+	}
+	return removed, nil
+}
+
+// printSetupCode shows the PIN and a QR code the Home app can scan
+func printSetupCode(w io.Writer, uri, pin string) {
+	fmt.Fprintf(w, "Scan to add to HomeKit, or enter %s\n", pin)
+	qrterminal.GenerateHalfBlock(uri, qrterminal.L, w)
+	fmt.Fprintln(w, uri)
+}
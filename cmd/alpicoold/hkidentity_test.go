@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHKIdentity(t *testing.T) {
+	if got := macSuffix("d8:17:d1:f1:b9:78"); got != "B978" {
+		t.Fatalf("Bad suffix %q", got)
+	}
+	if err := validSetupID(macSuffix("d8:17:d1:f1:b9:78")); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"", "abcd", "AB", "AB-C"} {
+		if validSetupID(bad) == nil {
+			t.Fatalf("Expected %q to be rejected", bad)
+		}
+	}
+
+	id := newHKIdentity("d8:17:d1:f1:b9:78", "", "johnelliott.org", "WT-0001 Bridge")
+	bridge := id.info(hkBridgeID, "")
+	if bridge.Name != "Alpicool B978" || bridge.SerialNumber != "D817D1F1B978" || bridge.ID != hkBridgeID {
+		t.Fatalf("Bad bridge info %+v", bridge)
+	}
+	lock := id.info(hkLockID, "Lock")
+	if lock.Name != "Alpicool B978 Lock" || lock.SerialNumber != "D817D1F1B978-LOCK" {
+		t.Fatalf("Bad lock info %+v", lock)
+	}
+
+	other := newHKIdentity("d8:17:d1:f1:00:01", "", "", "")
+	if other.info(hkLockID, "Lock").SerialNumber == lock.SerialNumber {
+		t.Fatal("Two fridges share a serial")
+	}
+	if named := newHKIdentity("d8:17:d1:f1:b9:78", "Van", "", ""); named.info(hkOnID, "Power").Name != "Van Power" {
+		t.Fatalf("Bad named identity %+v", named)
+	}
+}
+
+func TestResetHKPairing(t *testing.T) {
+	dir := t.TempDir()
+	keep := []string{"tls/cert.pem", "export/influx.spool", "snapshot.jpg"}
+	hcFiles := []string{"uuid", "version", "configHash", "3132.entity", "4142.entity"}
+	for _, name := range append(append([]string{}, keep...), hcFiles...) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := resetHKPairing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(removed)
+	sort.Strings(hcFiles)
+	if strings.Join(removed, ",") != strings.Join(hcFiles, ",") {
+		t.Fatalf("Removed %v, want %v", removed, hcFiles)
+	}
+	for _, name := range keep {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Reset removed %s: %v", name, err)
+		}
+	}
+
+	// A second reset has nothing left to do
+	if removed, err := resetHKPairing(dir); err != nil || len(removed) != 0 {
+		t.Fatalf("Second reset removed %v, %v", removed, err)
+	}
+	if hkPaired(dir) {
+		t.Fatal("Expected unpaired after reset")
+	}
+}
+
+func TestPrintSetupCode(t *testing.T) {
+	var b bytes.Buffer
+	printSetupCode(&b, "X-HM://0081YCYEPB978", "800-00-000")
+	out := b.String()
+	if !strings.Contains(out, "800-00-000") || !strings.Contains(out, "X-HM://0081YCYEPB978") {
+		t.Fatalf("Bad setup code output %q", out)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+)
+
+// hkHoldTimeout is how long HomeKit keeps showing a requested value the
+// fridge hasn't confirmed before going back to what the fridge reports
+var hkHoldTimeout = 10 * time.Second
+
+// hkHold is a value written from HomeKit and not yet seen in a status report
+type hkHold struct {
+	value interface{}
+	until time.Time
+}
+
+// hkHolds remembers HomeKit writes until the fridge acknowledges them
+type hkHolds struct {
+	mu     sync.Mutex
+	values map[string]hkHold
+	wake   chan struct{} // a hold was added, recheck expiry
+	now    func() time.Time
+}
+
+func newHKHolds() *hkHolds {
+	return &hkHolds{values: map[string]hkHold{}, wake: make(chan struct{}, 1), now: time.Now}
+}
+
+// Hold shows v for key until the fridge reports it or hkHoldTimeout passes
+func (h *hkHolds) Hold(key string, v interface{}) {
+	h.mu.Lock()
+	h.values[key] = hkHold{value: v, until: h.now().Add(hkHoldTimeout)}
+	h.mu.Unlock()
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Reject drops any hold on key and makes HomeKit show the fridge's value
+// again, for writes that never made it to the fridge
+func (h *hkHolds) Reject(key string) {
+	h.Hold(key, hkRejected{})
+}
+
+// hkRejected marks a hold that should resync rather than show a value
+type hkRejected struct{}
+
+// apply is the value HomeKit should show for key given what the fridge
+// reports, and whether to send it even if it looks unchanged
+func (h *hkHolds) apply(key string, actual interface{}) (interface{}, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hold, ok := h.values[key]
+	if !ok {
+		return actual, false
+	}
+	if _, rejected := hold.value.(hkRejected); rejected {
+		delete(h.values, key)
+		return actual, true
+	}
+	if sameValue(hold.value, actual) || !h.now().Before(hold.until) {
+		delete(h.values, key)
+		return actual, false
+	}
+	return hold.value, false
+}
+
+// next is when the earliest hold runs out
+func (h *hkHolds) next() (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var first time.Time
+	for _, hold := range h.values {
+		if first.IsZero() || hold.until.Before(first) {
+			first = hold.until
+		}
+	}
+	return first, !first.IsZero()
+}
+
+// sameValue compares characteristic values, floats only as far as HomeKit shows them
+func sameValue(a, b interface{}) bool {
+	af, aok := a.(float64)
+	bf, bok := b.(float64)
+	if aok && bok {
+		return math.Abs(af-bf) < 0.01
+	}
+	return a == b
+}
+
+// hkPusher sets characteristics only when the value to show changes, so
+// controllers get one event per change instead of one per status report
+type hkPusher struct {
+	holds *hkHolds
+	last  map[string]interface{}
+}
+
+func newHKPusher(holds *hkHolds) *hkPusher {
+	return &hkPusher{holds: holds, last: map[string]interface{}{}}
+}
+
+// changed records v for key and says whether it differs from last time
+func (p *hkPusher) changed(key string, actual interface{}) (interface{}, bool) {
+	v, force := p.holds.apply(key, actual)
+	if last, ok := p.last[key]; ok && !force && sameValue(last, v) {
+		return v, false
+	}
+	p.last[key] = v
+	return v, true
+}
+
+func (p *hkPusher) Bool(key string, actual bool, c *characteristic.Bool) {
+	if v, ok := p.changed(key, actual); ok {
+		c.SetValue(v.(bool))
+	}
+}
+
+func (p *hkPusher) Int(key string, actual int, c *characteristic.Int) {
+	if v, ok := p.changed(key, actual); ok {
+		c.SetValue(v.(int))
+	}
+}
+
+func (p *hkPusher) Float(key string, actual float64, c *characteristic.Float) {
+	if v, ok := p.changed(key, actual); ok {
+		c.SetValue(v.(float64))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+)
+
+func TestHKHolds(t *testing.T) {
+	now := time.Unix(1000, 0)
+	holds := newHKHolds()
+	holds.now = func() time.Time { return now }
+
+	if v, _ := holds.apply("target", 3.0); v != 3.0 {
+		t.Fatalf("No hold should show the fridge, got %v", v)
+	}
+
+	holds.Hold("target", 5.0)
+	if until, ok := holds.next(); !ok || !until.Equal(now.Add(hkHoldTimeout)) {
+		t.Fatalf("Bad expiry %v %v", until, ok)
+	}
+	if v, _ := holds.apply("target", 3.0); v != 5.0 {
+		t.Fatalf("Expected held 5, got %v", v)
+	}
+	// Acknowledged
+	if v, _ := holds.apply("target", 5.001); v != 5.001 {
+		t.Fatalf("Expected fridge value after ack, got %v", v)
+	}
+	if _, ok := holds.next(); ok {
+		t.Fatal("Hold survived the acknowledgement")
+	}
+
+	// Timed out
+	holds.Hold("on", true)
+	now = now.Add(hkHoldTimeout)
+	if v, _ := holds.apply("on", false); v != false {
+		t.Fatalf("Expected fridge value after timeout, got %v", v)
+	}
+
+	// Rejected writes resync even when the value looks the same
+	holds.Reject("units")
+	if v, force := holds.apply("units", 1); v != 1 || !force {
+		t.Fatalf("Expected forced resync, got %v %v", v, force)
+	}
+}
+
+func TestHKPusher(t *testing.T) {
+	holds := newHKHolds()
+	push := newHKPusher(holds)
+	c := characteristic.NewOn()
+	events := 0
+	c.OnValueUpdate(func(*characteristic.Characteristic, interface{}, interface{}) { events++ })
+
+	for i := 0; i < 3; i++ {
+		push.Bool("on", true, c.Bool)
+	}
+	if events != 1 || !c.GetValue() {
+		t.Fatalf("Expected one change, got %d", events)
+	}
+
+	// A controller turns it off, the fridge hasn't caught up yet
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	c.UpdateValueFromConnection(false, conn)
+	holds.Hold("on", false)
+	push.Bool("on", true, c.Bool)
+	if c.GetValue() {
+		t.Fatal("Stale report bounced the switch back on")
+	}
+
+	// The write failed, show the fridge's state again
+	holds.Reject("on")
+	push.Bool("on", true, c.Bool)
+	if !c.GetValue() {
+		t.Fatal("Rejected write never resynced")
+	}
+}
@@ -2,30 +2,26 @@ package main
 
 import (
 	"context"
-	"image"
-	"math"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/brutella/hc"
 	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
 	hclog "github.com/brutella/hc/log"
-	"github.com/brutella/hkcam"
-	"github.com/brutella/hkcam/ffmpeg"
+	"github.com/johnelliott/alpicoold/pkg/k25"
 	log "github.com/sirupsen/logrus"
 )
 
 // HKSettings avoids lots of args to HKClient
 type HKSettings struct {
-	storagePath     string
-	minVideoBitrate int
-	multiStream     bool
-	// Platform dependent flags
-	inputDevice      string
-	inputFilename    string
-	loopbackFilename string
-	h264Decoder      string
-	h264Encoder      string
+	storagePath string
+	camera      *Camera // nil runs the bridge without one
+	battery     BatterySettings
+	pin         string // 8 digit pairing code
+	setupID     string // 4 character id for the setup URI
+	identity    HKIdentity
 }
 
 // HKClient is an imaginary client for homekit preparation
@@ -42,165 +38,229 @@ func HKClient(ctx context.Context, wg *sync.WaitGroup, fridge *Fridge, settings
 	hclog.Debug.SetOutput(log.StandardLogger().WriterLevel(log.TraceLevel))
 	hclog.Info.SetOutput(log.StandardLogger().WriterLevel(log.DebugLevel))
 
-	// Set up Lock button
-	infoLockButton := accessory.Info{
-		Name:         "Lock K25",
-		SerialNumber: "1",
-		Manufacturer: "johnelliott.org",
-		Model:        "WT-0001 Bridge",
-		// FirmwareRevision: "0.0.1",
-		// ID:               1,
-	}
-	lockButton := accessory.NewSwitch(infoLockButton)
-	lockButton.Switch.On.OnValueRemoteUpdate(fridge.SetLocked)
-
-	// On button
-	infoOnButton := accessory.Info{
-		Name:         "On K25",
-		SerialNumber: "1",
-		Manufacturer: "johnelliott.org",
-		Model:        "WT-0001 Bridge",
-		// FirmwareRevision: "0.0.1",
-		// ID:               1,
-	}
-	onButton := accessory.NewSwitch(infoOnButton)
-	onButton.Switch.On.OnValueRemoteUpdate(fridge.SetOn)
-
-	// EcoMode button
-	infoEcoModeButton := accessory.Info{
-		Name:         "EcoMode K25",
-		SerialNumber: "1",
-		Manufacturer: "johnelliott.org",
-		Model:        "WT-0001 Bridge",
-		// FirmwareRevision: "0.0.1",
-		// ID:               1,
+	id := settings.identity
+	bridge := accessory.NewBridge(id.info(hkBridgeID, ""))
+	// Writes show in HomeKit straight away and stay until the fridge confirms them
+	holds := newHKHolds()
+	held := func(key string, set func(Command, bool) error) func(bool) {
+		return func(v bool) {
+			holds.Hold(key, v)
+			if err := set(Command{Source: sourceHomeKit}, v); err != nil {
+				holds.Reject(key)
+				log.WithFields(log.Fields{"client": "HKClient", "setting": key, "err": err}).Warn("Rejected switch")
+			}
+		}
 	}
-	ecoModeButton := accessory.NewSwitch(infoEcoModeButton)
-	ecoModeButton.Switch.On.OnValueRemoteUpdate(fridge.SetEcoMode)
+
+	lockButton := accessory.NewSwitch(id.info(hkLockID, "Lock"))
+	lockButton.Switch.On.OnValueRemoteUpdate(held("locked", fridge.SetLocked))
+
+	onButton := accessory.NewSwitch(id.info(hkOnID, "Power"))
+	onButton.Switch.On.OnValueRemoteUpdate(held("on", fridge.SetOn))
+
+	ecoModeButton := accessory.NewSwitch(id.info(hkEcoID, "Eco"))
+	ecoModeButton.Switch.On.OnValueRemoteUpdate(held("eco", fridge.SetEcoMode))
 
 	// Thermostat
-	infoThermo := accessory.Info{
-		Name: "Alpicool K25",
-		// SerialNumber:     "1",
-		Manufacturer: "johnelliott.org",
-		Model:        "WT-0001 Bridge",
-		// FirmwareRevision: "0.0.1",
-		// ID:               2,
-	}
-	// TODO see if I can set upper and lower bounds properly
-	th := accessory.NewThermostat(infoThermo, FtoC(40), FtoC(-10), FtoC(99), 1)
+	infoThermo := id.info(hkThermostatID, "Fridge")
+	// Bounds follow E1, E2 and E5 once the fridge reports
+	th := accessory.NewThermostat(infoThermo, FtoC(40), FtoC(-10), FtoC(99), 0.1)
 	th.Thermostat.CurrentHeatingCoolingState.SetValue(2)
 	th.Thermostat.TargetHeatingCoolingState.SetValue(0)
 	th.Thermostat.TemperatureDisplayUnits.SetValue(1) // 0=C, 1=F
+	// Flag old data rather than show a cheerful temperature from a dead fridge
+	statusActive := characteristic.NewStatusActive()
+	statusFault := characteristic.NewStatusFault()
+	th.Thermostat.AddCharacteristic(statusActive.Characteristic)
+	th.Thermostat.AddCharacteristic(statusFault.Characteristic)
+	// Inferred compressor draw for Eve
+	energy := newHKEnergy()
+	th.Thermostat.AddCharacteristic(energy.Watts.Characteristic)
+	th.Thermostat.AddCharacteristic(energy.TotalKWh.Characteristic)
+
+	// Batteries on the thermostat accessory so the Home app shows them with the fridge
+	var inputBattery, fridgeBattery *hkBattery
+	if settings.battery.curve != nil {
+		inputBattery = newHKBattery("Input battery")
+		th.AddService(inputBattery.Service)
+	}
+	if settings.battery.ub17 {
+		fridgeBattery = newHKBattery("Fridge battery")
+		th.AddService(fridgeBattery.Service)
+	}
+
+	// Keypad-only settings for apps that show custom characteristics
+	advanced := newHKAdvanced(fridge, holds)
+	th.AddService(advanced.Service)
+	predictions := newHKPredictions()
+	th.AddService(predictions.Service)
 
 	th.Thermostat.TargetTemperature.OnValueRemoteUpdate(func(newTempRawCelsius float64) {
-		// Round to something reasonable
-		newTemp := math.Round(newTempRawCelsius)
-		log.Tracef("New TargetTemperature: %v %v %v", newTempRawCelsius, newTemp, byte(newTemp))
-		fridge.tempSettingsC <- newTemp
-		// just set it for them for now, do this via commands later
-		// th.Thermostat.TargetTemperature.SetValue(newTemp)
+		// Round in the fridge's unit so a whole degree F stays one
+		_, celsius, err := resolveTemp(fridge.GetStatusReport().Settings, newTempRawCelsius, "C")
+		if err != nil {
+			holds.Reject("target")
+			log.WithFields(log.Fields{"client": "HKClient", "err": err}).Warn("Ignoring TargetTemperature")
+			return
+		}
+		log.Tracef("New TargetTemperature: %v %v", newTempRawCelsius, celsius)
+		holds.Hold("target", celsius)
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		if err := fridge.SendTemp(ctx, Command{Source: sourceHomeKit}, celsius); err != nil {
+			holds.Reject("target")
+			log.WithFields(log.Fields{"client": "HKClient", "err": err}).Warn("Rejected TargetTemperature")
+		}
+	})
+	th.Thermostat.TemperatureDisplayUnits.OnValueRemoteUpdate(func(units int) {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		if _, err := fridge.SetUnit(ctx, Command{Source: sourceHomeKit}, units == 1); err != nil {
+			holds.Reject("units")
+			log.WithFields(log.Fields{"client": "HKClient", "err": err}).Error("Failed to switch fridge units")
+			return
+		}
+		holds.Hold("units", units)
 	})
-	// Camera setup
+	accessories := []*accessory.Accessory{th.Accessory, lockButton.Accessory, ecoModeButton.Accessory, onButton.Accessory}
 
-	if log.GetLevel() == log.TraceLevel {
-		// TODO get something like this log.Debug.Enable()
-		ffmpeg.EnableVerboseLogging()
+	// Only with the detector on, so nobody trusts a sensor that can't trip
+	var lid *hkLid
+	if fridge.lid != nil {
+		lid = newHKLid(id.info(hkLidID, "Lid"))
+		accessories = append(accessories, lid.Accessory)
 	}
 
-	switchInfo := accessory.Info{Name: "Camera", FirmwareRevision: "0.0.9", Manufacturer: "Matthias Hochgatterer"}
-	cam := accessory.NewCamera(switchInfo)
-
-	cfg := ffmpeg.Config{
-		InputDevice:      settings.inputDevice,
-		InputFilename:    settings.inputFilename,
-		LoopbackFilename: settings.loopbackFilename,
-		H264Decoder:      settings.h264Decoder,
-		H264Encoder:      settings.h264Encoder,
-		MinVideoBitrate:  settings.minVideoBitrate,
-		MultiStream:      settings.multiStream,
+	// The camera is optional and never takes the bridge down with it
+	cam := settings.camera
+	if cam != nil {
+		accessories = append(accessories, cam.Accessory)
 	}
 
-	ffmpeg := hkcam.SetupFFMPEGStreaming(cam, cfg)
-
-	// Add a custom camera control service to record snapshots
-	cc := hkcam.NewCameraControl()
-	cam.Control.AddCharacteristic(cc.Assets.Characteristic)
-	cam.Control.AddCharacteristic(cc.GetAsset.Characteristic)
-	cam.Control.AddCharacteristic(cc.DeleteAssets.Characteristic)
-	cam.Control.AddCharacteristic(cc.TakeSnapshot.Characteristic)
-	// End Camera setup
-
-	// Start the hk brige ip transport
-	config := hc.Config{Pin: "80000000", StoragePath: settings.storagePath}
-	t, err := hc.NewIPTransport(config, th.Accessory, lockButton.Accessory, ecoModeButton.Accessory, onButton.Accessory, cam.Accessory)
+	// Start the hk bridge ip transport
+	paired := hkPaired(settings.storagePath)
+	config := hc.Config{Pin: settings.pin, SetupId: settings.setupID, StoragePath: settings.storagePath}
+	t, err := hc.NewIPTransport(config, bridge.Accessory, accessories...)
 	if err != nil {
-		log.Error(err)
+		log.WithFields(log.Fields{"client": "HKClient", "err": err}).Error("Failed to start HomeKit transport")
+		fridge.diag.Error("homekit", err)
+		return
+	}
+	if uri, err := t.XHMURI(); err != nil {
+		log.WithFields(log.Fields{"client": "HKClient", "err": err}).Error("Failed to make setup URI")
+	} else {
+		log.WithFields(log.Fields{
+			"client": "HKClient",
+			"name":   id.name,
+			"paired": paired,
+			"uri":    uri,
+		}).Info("HomeKit bridge ready")
+		if pin, err := hc.ValidatePin(settings.pin); err == nil && !paired {
+			printSetupCode(os.Stdout, uri, pin)
+		}
 	}
 
-	// Set up camera snapshots
-	t.CameraSnapshotReq = func(width, height uint) (*image.Image, error) {
-		return ffmpeg.Snapshot(width, height)
+	if cam != nil {
+		t.CameraSnapshotReq = cam.Snapshot
 	}
 
-	cc.SetupWithDir(settings.storagePath)
-	cc.CameraSnapshotReq = func(width, height uint) (*image.Image, error) {
-		return ffmpeg.Snapshot(width, height)
+	// Push what changed whenever the fridge reports, connects or goes stale
+	push := newHKPusher(holds)
+	var bounds k25.Settings
+	update := func() {
+		s := fridge.GetStatusReport()
+		temp, tempSetting := float64(s.Temp), float64(s.TempSet)
+		if s.CelsiusFahrenheitModeMenuE5 {
+			temp, tempSetting = FtoC(temp), FtoC(tempSetting)
+		}
+		log.WithFields(log.Fields{
+			"client":      "HKClient",
+			"temp":        temp,
+			"tempSetting": tempSetting,
+		}).Trace("settings to HK")
+
+		// switches/buttons
+		push.Bool("on", s.On, onButton.Switch.On.Bool)
+		push.Bool("eco", s.EcoMode, ecoModeButton.Switch.On.Bool)
+		push.Bool("locked", s.Locked, lockButton.Switch.On.Bool)
+		// Required
+		heatingCooling := 0
+		if s.On {
+			heatingCooling = 2
+		}
+		// Cooling only while the compressor runs
+		comp := fridge.compressor.State(false)
+		current := heatingCooling
+		if fridge.compressor != nil && !comp.Running {
+			current = 0
+		}
+		push.Int("current state", current, th.Thermostat.CurrentHeatingCoolingState.Int)
+		push.Int("target state", heatingCooling, th.Thermostat.TargetHeatingCoolingState.Int)
+		push.Float("watts", comp.Watts, energy.Watts)
+		push.Float("kwh", comp.WattHours/1000, energy.TotalKWh)
+
+		if s.Settings != initialFridgeSettings {
+			if s.Settings != bounds {
+				min, max, step := hkTempBounds(s.Settings)
+				th.Thermostat.TargetTemperature.SetMinValue(min)
+				th.Thermostat.TargetTemperature.SetMaxValue(max)
+				th.Thermostat.TargetTemperature.SetStepValue(step)
+				bounds = s.Settings
+			}
+			push.Int("units", hkDisplayUnits(s.Settings), th.Thermostat.TemperatureDisplayUnits.Int)
+			push.Float("current", temp, th.Thermostat.CurrentTemperature.Float)
+			push.Float("target", tempSetting, th.Thermostat.TargetTemperature.Float)
+
+			if inputBattery != nil {
+				inputBattery.set(settings.battery.inputLevel(s.Sensors), inputVoltage(s.Sensors))
+			}
+			if fridgeBattery != nil {
+				fridgeBattery.set(settings.battery.ub17Level(s.Sensors), -1)
+			}
+			advanced.set(s.Settings, push)
+		}
+		if lid != nil {
+			lid.set(fridge.lid.State(), push)
+		}
+		predictions.set(fridge.Predict(), push)
+
+		stale := fridge.Stale()
+		push.Bool("active", fridge.Connected() && !stale, statusActive.Bool)
+		fault := characteristic.StatusFaultNoFault
+		if stale {
+			fault = characteristic.StatusFaultGeneralFault
+		}
+		push.Int("fault", fault, statusFault.Int)
 	}
 
+	sub := fridge.hub.Subscribe(16)
 	go func() {
-		// Fridge state scanner
-		// TODO bring this value in from env/cli
-		hkUpdateInterval := time.Second
-		ticker := time.NewTicker(hkUpdateInterval)
-
+		defer sub.Close()
+		update()
 		log.Trace("HK client looping now")
 		for {
+			// Wake up when the earliest hold runs out so HomeKit reverts
+			var expired <-chan time.Time
+			if until, ok := holds.next(); ok {
+				expired = time.After(time.Until(until))
+			}
 			select {
 			case <-ctx.Done():
 				log.Trace("HKClient ctx canceled")
 				<-t.Stop()
 				log.Trace("HKClient stopped")
 				return
-			case <-ticker.C:
-				s := fridge.GetStatusReport()
-				var t float64
-				var tempSetting float64
-				if s.CelsiusFahrenheitModeMenuE5 {
-					t = FtoC(float64(s.Temp))
-					tempSetting = FtoC(float64(s.TempSet))
-				} else {
-					t = float64(s.Temp)
-					tempSetting = float64(s.TempSet)
+			case e, ok := <-sub.C:
+				if !ok {
+					return
 				}
-				log.WithFields(log.Fields{
-					"client":      "HKClient",
-					"temp":        t,
-					"tempSetting": tempSetting,
-				}).Trace("settings to HK")
-
-				// switches/buttons
-				onButton.Switch.On.SetValue(s.On)
-				ecoModeButton.Switch.On.SetValue(s.EcoMode)
-				lockButton.Switch.On.SetValue(s.Locked)
-				// Required
-				if s.On {
-					th.Thermostat.CurrentHeatingCoolingState.SetValue(2)
-					th.Thermostat.TargetHeatingCoolingState.SetValue(2)
-				} else {
-					th.Thermostat.CurrentHeatingCoolingState.SetValue(0)
-					th.Thermostat.TargetHeatingCoolingState.SetValue(0)
+				switch e.Kind {
+				case eventStatus, eventConnection, eventStale, eventLid:
+					update()
 				}
-				th.Thermostat.CurrentTemperature.SetValue(t)
-				th.Thermostat.TargetTemperature.SetValue(tempSetting)
-				th.Thermostat.TemperatureDisplayUnits.SetValue(1) // 0=C, 1=F
-
-				// TODO see if this is settable this often per the spec
-				// th.Thermostat.TemperatureDisplayUnits.SetValue(int(s.CelsiusFahrenheitModeMenuE5)) // 0=C, 1=F
-
-				// Optional
-				// th.Thermostat.CurrentHeatingCoolingState.SetMaxValue(int(s.LowestTempSettingMenuE1))
-				// th.Thermostat.CurrentHeatingCoolingState.SetMinValue(int(s.HighestTempSettingMenuE2))
+			case <-holds.wake:
+			case <-expired:
+				update()
 			}
 		}
 	}()
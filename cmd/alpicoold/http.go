@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
 	"mime"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -25,6 +26,7 @@ func handleGet(f *Fridge) http.HandlerFunc {
 				panic(err)
 			}
 			w.Header().Set(contentType, mimeTypeJSON)
+			setFreshnessHeaders(w, f)
 			w.Write(json)
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -36,8 +38,74 @@ func handleGet(f *Fridge) http.HandlerFunc {
 	}
 }
 
+// setFreshnessHeaders says how old the status report is, since its JSON is fixed
+func setFreshnessHeaders(w http.ResponseWriter, f *Fridge) {
+	fresh := f.Freshness()
+	if fresh.LastUpdate == nil {
+		return
+	}
+	w.Header().Set("Last-Modified", fresh.LastUpdate.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Fridge-Stale", strconv.FormatBool(fresh.Stale))
+}
+
+// HTTPSettings avoids lots of args to JSONClient
+type HTTPSettings struct {
+	addr       string // host:port to listen on
+	auth       *Auth
+	writeRate  float64 // write requests per second per client, 0 is unlimited
+	writeBurst int
+	tlsCert    string // PEM files, or
+	tlsKey     string
+	tlsSelf    bool   // generate a self-signed certificate on first run
+	tlsDir     string // where the self-signed certificate lives
+	// Camera limits, per client address
+	camSnapshotRate     float64 // snapshots per second, 0 is unlimited
+	camSnapshotBurst    int
+	camStreamsPerClient int // open MJPEG streams, 0 is unlimited
+}
+
+// tlsConfig loads the configured certificate, nil means plain http
+func (s HTTPSettings) tlsConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case s.tlsCert != "" || s.tlsKey != "":
+		cert, err = tls.LoadX509KeyPair(s.tlsCert, s.tlsKey)
+	case s.tlsSelf:
+		cert, err = selfSignedCert(s.tlsDir)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// newMux wires up every endpoint behind auth and rate limiting
+func newMux(settings HTTPSettings, f *Fridge) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleGet(f))
+	registerAPI(mux, f)
+	registerStreams(mux, f)
+	registerDashboard(mux, f)
+	registerDiagnostics(mux, f)
+	registerSnapshots(mux, f)
+	registerCamera(mux, settings, f)
+	registerRules(mux, f)
+	registerArbiter(mux, f)
+	registerAudit(mux, f)
+	registerCompressor(mux, f)
+	registerCooling(mux, f)
+	registerPredictions(mux, f)
+	registerControl(mux, f)
+
+	limiter := newRateLimiter(settings.writeRate, settings.writeBurst)
+	return settings.auth.Middleware(limiter.Middleware(requireJSON(mux)))
+}
+
 // JSONClient serves json
-func JSONClient(ctx context.Context, wg *sync.WaitGroup, port string, f *Fridge) {
+func JSONClient(ctx context.Context, wg *sync.WaitGroup, settings HTTPSettings, f *Fridge) {
 	wg.Add(1)
 	defer func() {
 		log.WithFields(log.Fields{
@@ -46,19 +114,32 @@ func JSONClient(ctx context.Context, wg *sync.WaitGroup, port string, f *Fridge)
 		wg.Done()
 	}()
 
-	if port == "" {
-		port = "80"
+	if settings.addr == "" {
+		settings.addr = ":80"
+	}
+	if !settings.auth.Enabled() {
+		log.WithFields(log.Fields{
+			"client": "JSONClient",
+		}).Warn("No HTTP credentials configured, the API is read-only until HTTP_CONTROL_TOKENS or HTTP_USERS are set")
+	}
+	tlsConfig, err := settings.tlsConfig()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client": "JSONClient",
+			"err":    err,
+		}).Fatal("Failed to load TLS certificate")
 	}
 
 	log.WithFields(log.Fields{
 		"client": "JSONClient",
-	}).Debugf("server starting on port %s", port)
+		"tls":    tlsConfig != nil,
+		"auth":   settings.auth.Enabled(),
+	}).Debugf("server starting on %s", settings.addr)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleGet(f))
 	server := &http.Server{
-		Addr:    fmt.Sprintf("0.0.0.0:%s", port),
-		Handler: mux,
+		Addr:      settings.addr,
+		Handler:   newMux(settings, f),
+		TLSConfig: tlsConfig,
 		BaseContext: func(_ net.Listener) context.Context {
 			return ctx
 		},
@@ -76,8 +157,17 @@ func JSONClient(ctx context.Context, wg *sync.WaitGroup, port string, f *Fridge)
 		server.Shutdown(ctx)
 	}()
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		panic(err)
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.WithFields(log.Fields{
+			"client": "JSONClient",
+			"addr":   settings.addr,
+			"err":    err,
+		}).Fatal("HTTP server failed")
 	}
 	log.WithFields(log.Fields{"client": "JSONClient"}).Debug("done")
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// lidLevels are the rises in degrees C within lidWindow that look like an
+// open lid at each sensitivity
+var lidLevels = map[string]float64{
+	"low":    4,
+	"medium": 2.5,
+	"high":   1.5,
+}
+
+var (
+	// lidWindow is how quickly the rise has to happen
+	lidWindow = 3 * time.Minute
+	// lidRunningFactor scales the rise while the compressor runs, when the
+	// temperature should be falling
+	lidRunningFactor = 0.7
+	// lidCloseDrop is how far in degrees C the temperature falls from its
+	// peak once the lid is shut and the compressor catches up
+	lidCloseDrop = 1.0
+)
+
+// LidSettings avoids lots of args to newLidDetector
+type LidSettings struct {
+	sensitivity string
+	rise        float64 // degrees C within lidWindow
+}
+
+// parseLidSensitivity reads low, medium, high or off. Off returns zero
+// settings, which disable the detector.
+func parseLidSensitivity(s string) (LidSettings, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "off" {
+		return LidSettings{}, nil
+	}
+	rise, ok := lidLevels[s]
+	if !ok {
+		return LidSettings{}, fmt.Errorf("Unknown lid sensitivity %q, want off, low, medium or high", s)
+	}
+	return LidSettings{sensitivity: s, rise: rise}, nil
+}
+
+// LidState is the payload of a lid event
+type LidState struct {
+	Open        bool       `json:"open"`
+	Since       *time.Time `json:"since,omitempty"` // when it last opened or closed
+	Rise        float64    `json:"rise"`            // degrees C within the window, when it opened
+	Reason      string     `json:"reason,omitempty"`
+	Sensitivity string     `json:"sensitivity"`
+}
+
+// celsiusSample is one temperature reading in degrees C
+type celsiusSample struct {
+	at   time.Time
+	temp float64
+}
+
+// LidDetector flags a lid left open from temperature rises the fridge can't
+// explain. Rises while the fridge is off, or on the way up to a raised
+// setpoint, don't count, and the compressor running makes a rise more
+// suspicious. A nil LidDetector detects nothing.
+type LidDetector struct {
+	mu       sync.Mutex
+	settings LidSettings
+	samples  []celsiusSample
+	prev     k25.Settings
+	raisedTo *float64 // a raised setpoint the temperature is still rising towards
+	peak     float64
+	state    LidState
+}
+
+func newLidDetector(settings LidSettings) *LidDetector {
+	if settings.rise <= 0 {
+		return nil
+	}
+	return &LidDetector{settings: settings, state: LidState{Sensitivity: settings.sensitivity}}
+}
+
+// reportCelsius is the report's temperature and setpoint in degrees C
+func reportCelsius(r k25.StatusReport) (temp, set float64) {
+	temp, set = float64(r.Temp), float64(r.TempSet)
+	if r.CelsiusFahrenheitModeMenuE5 {
+		temp, set = FtoC(temp), FtoC(set)
+	}
+	return temp, set
+}
+
+// Observe takes a status report and whether the compressor is running, and
+// returns the lid state and whether it just changed
+func (l *LidDetector) Observe(r k25.StatusReport, running bool, at time.Time) (LidState, bool) {
+	if l == nil || r.Settings == initialFridgeSettings {
+		return LidState{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	temp, set := reportCelsius(r)
+	prev := l.prev
+	l.prev = r.Settings
+
+	if !r.On {
+		l.samples = nil
+		l.raisedTo = nil
+		if l.state.Open {
+			return l.change(false, 0, "fridge is off", at), true
+		}
+		return l.state, false
+	}
+	// Warming up to a higher setpoint is expected, start afresh once there
+	if prev != initialFridgeSettings && prev.CelsiusFahrenheitModeMenuE5 == r.CelsiusFahrenheitModeMenuE5 && r.TempSet > prev.TempSet {
+		l.raisedTo = &set
+	}
+	if l.raisedTo != nil && temp >= *l.raisedTo {
+		l.raisedTo = nil
+		l.samples = nil
+	}
+	if n := len(l.samples); n > 0 && at.Sub(l.samples[n-1].at) > lidWindow {
+		l.samples = nil
+	}
+	l.samples = append(l.samples, celsiusSample{at: at, temp: temp})
+	cut := 0
+	for cut < len(l.samples) && at.Sub(l.samples[cut].at) > lidWindow {
+		cut++
+	}
+	l.samples = l.samples[cut:]
+
+	if l.state.Open {
+		l.peak = math.Max(l.peak, temp)
+		if l.peak-temp >= lidCloseDrop {
+			l.samples = []celsiusSample{{at: at, temp: temp}}
+			return l.change(false, 0, "temperature falling again", at), true
+		}
+		return l.state, false
+	}
+	if l.raisedTo != nil {
+		return l.state, false
+	}
+	low := l.samples[0]
+	for _, s := range l.samples {
+		if s.temp <= low.temp {
+			low = s
+		}
+	}
+	rise, threshold := temp-low.temp, l.settings.rise
+	if running {
+		threshold *= lidRunningFactor
+	}
+	if rise < threshold {
+		return l.state, false
+	}
+	l.peak = temp
+	reason := fmt.Sprintf("rose %.1f°C in %s", rise, at.Sub(low.at).Round(time.Second))
+	if running {
+		reason += " with the compressor running"
+	}
+	return l.change(true, rise, reason, at), true
+}
+
+// change records a new state, with l.mu held
+func (l *LidDetector) change(open bool, rise float64, reason string, at time.Time) LidState {
+	since := at
+	l.state = LidState{Open: open, Since: &since, Rise: round2(rise), Reason: reason, Sensitivity: l.settings.sensitivity}
+	return l.state
+}
+
+// State is the last lid state, nil without a detector
+func (l *LidDetector) State() *LidState {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.state
+	return &s
+}
+
+// lidChanged tells everyone the lid opened or closed
+func (f *Fridge) lidChanged(s LidState) {
+	if s.Open {
+		f.Alert("warn", "lid", "Lid looks open, temperature "+s.Reason)
+	} else {
+		f.Alert("info", "lid", "Lid looks closed, "+s.Reason)
+	}
+	f.hub.Publish(eventLid, s)
+}
+
+// hkLid is a contact sensor that shows the lid open or closed
+type hkLid struct {
+	*accessory.Accessory
+	Sensor *service.ContactSensor
+}
+
+func newHKLid(info accessory.Info) *hkLid {
+	l := &hkLid{Accessory: accessory.New(info, accessory.TypeSensor), Sensor: service.NewContactSensor()}
+	l.Sensor.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+	l.AddService(l.Sensor.Service)
+	return l
+}
+
+// set shows the lid state, closed means contact detected
+func (l *hkLid) set(s *LidState, push *hkPusher) {
+	state := characteristic.ContactSensorStateContactDetected
+	if s.Open {
+		state = characteristic.ContactSensorStateContactNotDetected
+	}
+	push.Int("lid", state, l.Sensor.ContactSensorState.Int)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// replayLid feeds a synthetic status stream, in the format of
+// /events?kinds=status, through the compressor and lid detector, returning
+// every lid change
+func replayLid(t *testing.T, name, sensitivity string) []LidState {
+	t.Helper()
+	file, err := os.Open(filepath.Join("testdata", "lid", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	settings, err := parseLidSensitivity(sensitivity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCompressor(PowerProfile{Max: 45, Eco: 30, Idle: 1.5})
+	l := newLidDetector(settings)
+
+	var changes []LidState
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e struct {
+			Time time.Time
+			Data k25.StatusReport
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Data.Valid(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		c.Observe(e.Data, e.Time)
+		if s, changed := l.Observe(e.Data, c.State(false).Running, e.Time); changed {
+			changes = append(changes, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestParseLidSensitivity(t *testing.T) {
+	if s, err := parseLidSensitivity(" High"); err != nil || s.rise != 1.5 {
+		t.Fatalf("Bad sensitivity %+v %v", s, err)
+	}
+	if s, err := parseLidSensitivity("off"); err != nil || newLidDetector(s) != nil {
+		t.Fatal("Off should disable the detector")
+	}
+	if _, err := parseLidSensitivity("paranoid"); err == nil {
+		t.Fatal("Expected an error for an unknown sensitivity")
+	}
+}
+
+func TestLidReplay(t *testing.T) {
+	start := time.Date(2026, 7, 18, 14, 2, 7, 0, time.UTC)
+	for _, test := range []struct {
+		file        string
+		sensitivity string
+		opened      []time.Duration // about when each opening is flagged
+	}{
+		{"lid-open.jsonl", "medium", []time.Duration{9 * time.Minute}},
+		{"lid-open.jsonl", "low", []time.Duration{9 * time.Minute}},
+		{"setpoint-raised.jsonl", "high", nil},
+		{"switched-off.jsonl", "high", nil},
+		{"compressor-cycles.jsonl", "high", nil},
+		{"cracked-open-celsius.jsonl", "high", []time.Duration{6 * time.Minute}},
+		{"cracked-open-celsius.jsonl", "medium", nil},
+	} {
+		changes := replayLid(t, test.file, test.sensitivity)
+		if len(changes) != 2*len(test.opened) {
+			t.Fatalf("%s at %s: expected %d openings and closings, got %+v", test.file, test.sensitivity, len(test.opened), changes)
+		}
+		for i, at := range test.opened {
+			open, closed := changes[2*i], changes[2*i+1]
+			if !open.Open || open.Since.Sub(start) < at-time.Minute || open.Since.Sub(start) > at+time.Minute || open.Rise < lidLevels["high"]*lidRunningFactor {
+				t.Fatalf("%s at %s: bad opening %+v", test.file, test.sensitivity, open)
+			}
+			if closed.Open || !closed.Since.After(*open.Since) || closed.Reason != "temperature falling again" {
+				t.Fatalf("%s at %s: bad closing %+v", test.file, test.sensitivity, closed)
+			}
+		}
+	}
+}
+
+func TestLidEvents(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	sub := f.hub.Subscribe(10)
+	defer sub.Close()
+	f.lid = newLidDetector(LidSettings{sensitivity: "medium", rise: 2.5})
+
+	now := time.Now()
+	r := testStatusReport // F, set 37
+	for i, temp := range []int8{38, 40, 43, 44} {
+		r.Temp = temp
+		if s, changed := f.lid.Observe(r, false, now.Add(time.Duration(i)*30*time.Second)); changed {
+			f.lidChanged(s)
+		}
+	}
+	var kinds []string
+	for len(kinds) < 2 {
+		select {
+		case e := <-sub.C:
+			kinds = append(kinds, e.Kind)
+			if e.Kind == eventLid && !e.Data.(LidState).Open {
+				t.Fatalf("Expected the lid open, got %+v", e.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected an alert and a lid event, got %v", kinds)
+		}
+	}
+	if kinds[0] != eventAlert || kinds[1] != eventLid {
+		t.Fatalf("Expected an alert and a lid event, got %v", kinds)
+	}
+
+	mux := http.NewServeMux()
+	registerAPI(mux, f)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sensors", nil))
+	var body sensorsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Lid == nil || !body.Lid.Open {
+		t.Fatalf("Expected the open lid in sensors, got %s %v", rec.Body, err)
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/brutella/hc"
 	"github.com/go-acme/lego/platform/config/env"
 	"github.com/johnelliott/alpicoold/pkg/k25"
 	log "github.com/sirupsen/logrus"
@@ -25,9 +30,77 @@ var (
 	compcyclerateF = flag.Duration("compcyclerate", 0, "interval to cycle compressor in seconds")
 
 	// HomeKit
-	storagePathF = flag.String("fridgestoragepath", "./var/local/homekitdb", "path for sqlite storage of homekit data")
+	storagePathF    = flag.String("fridgestoragepath", "./var/local/homekitdb", "path for sqlite storage of homekit data")
+	hkPinF          = flag.String("hk_pin", hkDefaultPin, "HomeKit pairing PIN, 8 digits")
+	hkSetupIDF      = flag.String("hk_setup_id", "", "HomeKit setup id for the QR code, 4 uppercase letters or digits, defaults to the end of the fridge address")
+	hkNameF         = flag.String("hk_name", "", "HomeKit bridge name, defaults to Alpicool and the end of the fridge address")
+	hkManufacturerF = flag.String("hk_manufacturer", "johnelliott.org", "HomeKit manufacturer shown for every accessory")
+	hkModelF        = flag.String("hk_model", "WT-0001 Bridge", "HomeKit model shown for every accessory")
+	hkResetPairingF = flag.Bool("hk_reset_pairing", false, "forget HomeKit pairings and identity in the storage path, then exit")
+
+	// HomeKit batteries
+	batteryCurveF      = flag.String("battery_curve", "lead-acid", "input battery voltage curve: lead-acid, lifepo4, none, or volts:percent pairs")
+	batteryLowPercentF = flag.Int("battery_low_percent", 20, "battery percent at or below which HomeKit shows low battery")
+	batteryUB17F       = flag.Bool("battery_ub17", false, "the fridge has a built in battery, expose UB17 as its level")
+
+	// Compressor and energy
+	powerProfileF  = flag.String("power_profile", "max:45,eco:30,idle:1.5", "watts drawn with the compressor running flat out, in eco mode and resting, as mode:watts pairs")
+	coolingStallF  = flag.Duration("cooling_stall", 20*time.Minute, "how long the temperature can stay flat or rising while cooling is needed before cooling counts as degraded")
+	coolingReportF = flag.Duration("cooling_report_interval", time.Hour, "interval between cooling health reports")
+	cutoffVoltsF   = flag.String("cutoff_volts", "h:11.3,m:10.1,l:9.6", "input volts the fridge cuts off at for each battery cutoff level, as level:volts pairs")
+
+	// Thermostat control
+	controlModeF        = flag.String("control_mode", "off", "daemon-side thermostat control: off, pid or bang-bang")
+	controlTargetF      = flag.String("control_target", "4C", "fractional temperature to hold, with its unit, e.g. 4.5C or 40.1F")
+	controlBandF        = flag.String("control_band", "0.5C", "bang-bang band either side of the target, with its unit")
+	controlGainsF       = flag.String("control_gains", "kp:0.5,ki:0.02,kd:0", "PID gains as term:gain pairs, output is the share of each period spent cooling")
+	controlPeriodF      = flag.Duration("control_period", 10*time.Minute, "PID time-proportioning period")
+	controlMinOffF      = flag.Duration("control_min_off", 5*time.Minute, "minimum compressor off-time before control starts it again")
+	controlActuatorF    = flag.String("control_actuator", "setpoint", "how control starts and stops the compressor: setpoint or power")
+	controlProbeMaxAgeF = flag.Duration("control_probe_max_age", 2*time.Minute, "age at which an external probe reading is ignored in favour of the fridge's sensor")
+
+	// Lid
+	lidSensitivityF = flag.String("lid_sensitivity", "medium", "how small a temperature rise looks like an open lid: low, medium, high or off")
+
+	// HTTP
+	httpAddrF          = flag.String("http_addr", ":80", "HTTP listen address, host:port")
+	httpReadTokensF    = flag.String("http_read_tokens", "", "comma separated bearer tokens allowed to read")
+	httpControlTokensF = flag.String("http_control_tokens", "", "comma separated bearer tokens allowed to read and control")
+	httpUsersF         = flag.String("http_users", "", "comma separated basic auth logins, name:password:role where role is read or control")
+	httpAnonymousReadF = flag.Bool("http_anonymous_read", false, "allow reads without credentials when credentials are configured")
+	httpWriteRateF     = flag.Int("http_write_rate_per_min", 60, "write requests per minute per client, 0 is unlimited")
+	httpWriteBurstF    = flag.Int("http_write_burst", 10, "write requests a client can make in a burst")
+	httpTLSCertF       = flag.String("http_tls_cert", "", "TLS certificate PEM file")
+	httpTLSKeyF        = flag.String("http_tls_key", "", "TLS key PEM file")
+	httpTLSSelfSignedF = flag.Bool("http_tls_self_signed", false, "serve HTTPS with a self-signed certificate generated on first run")
+	readyMaxAgeF       = flag.Duration("ready_max_age", 30*time.Second, "max status report age for /readyz to pass")
+	staleAfterF        = flag.Duration("stale_after", 30*time.Second, "status report age after which the fridge state is stale")
+
+	// gRPC
+	grpcAddrF   = flag.String("grpc_addr", "", "gRPC TCP listen address, host:port, empty disables")
+	grpcSocketF = flag.String("grpc_socket", "", "gRPC unix socket path, empty disables")
+
+	// MQTT
+	mqttBrokerF          = flag.String("mqtt_broker", "", "MQTT broker url e.g. tcp://localhost:1883, empty disables MQTT")
+	mqttClientIDF        = flag.String("mqtt_client_id", "alpicoold", "MQTT client id")
+	mqttUsernameF        = flag.String("mqtt_username", "", "MQTT username")
+	mqttPasswordF        = flag.String("mqtt_password", "", "MQTT password")
+	mqttTopicPrefixF     = flag.String("mqtt_topic_prefix", "alpicoold", "MQTT state and command topic prefix")
+	mqttDiscoveryPrefixF = flag.String("mqtt_discovery_prefix", "homeassistant", "Home Assistant discovery prefix, empty disables discovery")
+	mqttNodeIDF          = flag.String("mqtt_node_id", "", "MQTT node id, defaults to the fridge address")
+
+	// Push exporters
+	influxURLF           = flag.String("influx_url", "", "InfluxDB write url, http(s):// or udp://, empty disables")
+	influxTokenF         = flag.String("influx_token", "", "InfluxDB API token")
+	graphiteURLF         = flag.String("graphite_url", "", "Graphite plaintext url, tcp:// or udp://, empty disables")
+	graphitePrefixF      = flag.String("graphite_prefix", "alpicoold", "Graphite metric prefix")
+	exportIntervalF      = flag.Duration("export_interval", 10*time.Second, "telemetry sample interval for push exporters")
+	exportFlushIntervalF = flag.Duration("export_flush_interval", 30*time.Second, "how often push exporters send batches")
+	exportBatchSizeF     = flag.Int("export_batch_size", 500, "max lines per export batch")
+	exportSpoolMaxLinesF = flag.Int("export_spool_max_lines", 100000, "max unsent lines kept on disk per exporter")
 
 	// Camera
+	cameraF             = flag.Bool("camera", false, "expose a HomeKit camera, needs ffmpeg and a video device")
 	minVideoBitrateF    = flag.Int("min_video_bitrate", 0, "minimum video bit rate in kbps")
 	camRotationDegreesF = flag.Int("cam_rot_deg", 0, "raspi camera rotation in degrees")
 	multiStreamF        = flag.Bool("multi_stream", false, "Allow mutliple clients to view the stream simultaneously")
@@ -37,7 +110,33 @@ var (
 	h264DecoderF        = flag.String("h264_decoder", "", "h264 video decoder")
 	h264EncoderF        = flag.String("h264_encoder", "h264_omx", "h264 video encoder")
 
+	// Camera over HTTP
+	camHTTPSnapshotRateF  = flag.Int("cam_http_snapshots_per_min", 30, "HTTP camera snapshots per minute per client, 0 is unlimited")
+	camHTTPSnapshotBurstF = flag.Int("cam_http_snapshot_burst", 5, "HTTP camera snapshots a client can take in a burst")
+	camHTTPStreamsF       = flag.Int("cam_http_streams_per_client", 2, "open MJPEG streams per client, 0 is unlimited")
+
+	// Command arbitration
+	manualHoldF = flag.Duration("manual_hold", 2*time.Hour, "how long a manual change keeps schedules, rules and keep-alive off that setting")
+	safetyHoldF = flag.Duration("safety_hold", 10*time.Minute, "how long a safety change keeps every other source off that setting")
+
+	// Audit log
+	auditFileF     = flag.String("audit_file", "", "append-only log of commands sent to the fridge, defaults to audit.log under the storage path")
+	auditMaxBytesF = flag.Int("audit_max_bytes", 1<<20, "size at which the audit log is rotated")
+	auditKeepF     = flag.Int("audit_keep", 5, "rotated audit logs to keep")
+
+	// Rules
+	rulesFileF = flag.String("rules_file", "", "JSON rules file, defaults to rules.json under the storage path")
+
+	// Snapshots
+	snapshotTimelapseF  = flag.Duration("snapshot_timelapse", 15*time.Minute, "interval between timelapse frames, 0 disables")
+	snapshotKeepEventsF = flag.Int("snapshot_keep_events", 200, "event snapshots to keep")
+	snapshotKeepFramesF = flag.Int("snapshot_keep_frames", 672, "timelapse frames to keep")
+	snapshotMaxAgeF     = flag.Duration("snapshot_max_age", 7*24*time.Hour, "delete snapshots older than this, 0 keeps them")
+	snapshotAlarmDeltaF = flag.Int("snapshot_alarm_delta", 5, "degrees over the setpoint that count as a temperature alarm, 0 disables")
+
 	initialFridgeSettings = k25.Settings{}
+	historyInterval       = 30 * time.Second
+	historySize           = 24 * 60 * 2 // A day at historyInterval
 	cycleOnTime           = 8 * time.Second
 	shutDownWaitTime      = 20*time.Second + cycleOnTime
 
@@ -60,12 +159,40 @@ var (
 
 //var dataDir *string = flag.String("data_dir", "Camera", "Path to data directory")
 // var verbose *bool = flag.Bool("verbose", true, "Verbose logging")
-// var pin *string = flag.String("pin", "00102003", "PIN for HomeKit pairing")
 // var port *string = flag.String("port", "", "Port on which transport is reachable")
 
 type statusReportC chan k25.StatusReport
-type tempSettingsC chan float64
-type settingsC chan k25.Settings
+type tempSettingsC chan tempCommand
+type settingsC chan settingsCommand
+
+// settingsCommand is settings on their way to the bluetooth writer
+type settingsCommand struct {
+	k25.Settings
+	cmd Command
+}
+
+// tempCommand is a celsius setpoint on its way to the bluetooth writer
+type tempCommand struct {
+	celsius float64
+	tempSet *int8 // a setpoint already in the fridge's unit, used instead of celsius
+	cmd     Command
+}
+
+// settings are sr's settings with the setpoint converted to the fridge's
+// unit, rounded and kept within E1 and E2
+func (tc tempCommand) settings(sr k25.StatusReport) k25.Settings {
+	temp := tc.celsius
+	if tc.tempSet != nil {
+		temp = float64(*tc.tempSet)
+	} else if sr.CelsiusFahrenheitModeMenuE5 {
+		temp = CtoF(temp)
+	}
+	temp = math.Min(float64(sr.HighestTempSettingMenuE2), temp)
+	temp = math.Max(float64(sr.LowestTempSettingMenuE1), temp)
+	after := sr.Settings
+	after.TempSet = int8(math.Round(temp))
+	return after
+}
 
 // Fridge represents a full fridge state
 type Fridge struct {
@@ -75,6 +202,25 @@ type Fridge struct {
 	tempSettingsC     tempSettingsC
 	settingsC         settingsC
 	cycleCompressorWg *sync.WaitGroup
+	connected         bool          // Bluetooth connection is up and notifying
+	connectedAt       time.Time     // When the connection last came up
+	updated           time.Time     // When the last status report arrived
+	stale             bool          // Reports stopped for longer than staleAfter
+	resubscribeC      chan struct{} // Asks the bluetooth client to re-subscribe
+	pending           int32         // Commands waiting on the bluetooth writer
+	hub               *Hub          // Fans status, settings, connection and alert events out
+	history           *History      // Thinned out status reports for charts
+	diag              *Diagnostics  // What the bluetooth client is up to, for /debug/state
+	snapshots         *Snapshotter  // Stored camera pictures, nil without a camera
+	camera            FrameSource   // Live camera pictures, nil without a camera
+	rules             *RuleEngine   // User-defined automations, nil without a rules file
+	arbiter           *Arbiter      // Decides which source gets to change each setting
+	audit             *AuditLog     // Every command written and keypad change seen, nil disables
+	compressor        *Compressor   // Inferred compressor runs, duty cycle and energy
+	lid               *LidDetector  // Flags a lid left open, nil disables
+	cooling           *Cooling      // Learned pull-down rates and degraded cooling
+	predictor         *Predictor    // Time to target and battery runtime
+	control           *Controller   // Daemon-side fractional setpoint thermostat
 }
 
 // MonitorMu routine, mutex based
@@ -85,19 +231,38 @@ func (f *Fridge) MonitorMu() {
 		f.mu.Lock()
 		prev := f.status
 		f.status = r
+		f.updated = time.Now()
 		f.mu.Unlock()
+		f.markFresh()
+		f.audit.Observe(prev.Settings, r.Settings)
 		// Log if on state changed
 		sr := f.GetStatusReport()
 		if prev.On != sr.On {
 			f.Log().Warn("on state changed")
 		}
+		f.hub.Publish(eventStatus, sr)
+		f.history.Record(sr, f.Connected(), time.Now())
+		f.compressor.Observe(sr, time.Now())
+		comp := f.compressor.State(false)
+		running := comp.Running
+		f.predictor.Observe(sr, comp, time.Now())
+		if s, changed := f.lid.Observe(sr, running, time.Now()); changed {
+			f.lidChanged(s)
+		}
+		lid := f.lid.State()
+		if issues, changed := f.cooling.Observe(sr, running, lid != nil && lid.Open, time.Now()); changed {
+			f.coolingChanged(issues)
+		}
+		if prev.Settings != sr.Settings {
+			f.hub.Publish(eventSettings, SettingsChange{Before: prev.Settings, After: sr.Settings})
+		}
 	}
 }
 
 // VoltageStr formats voltage bytes for humans
 func (f *Fridge) VoltageStr() string {
 	sens := f.GetStatusReport().Sensors
-	return fmt.Sprintf("%d.%dv", sens.InputV1, sens.InputV2)
+	return fmt.Sprintf("%.1fv", inputVoltage(sens))
 }
 
 // Log some basic stats to the console
@@ -114,36 +279,120 @@ func (f *Fridge) Log() *log.Entry {
 	})
 }
 
-// SetOn Sends the fridge state to the fridge
-func (f *Fridge) SetOn(turnOn bool) {
-	log.Warnf("SetOn: %v", turnOn)
-	s := f.GetStatusReport().Settings
-	if s.On != turnOn {
-		s.On = turnOn
-		f.settingsC <- s
+// errNoStatus means the fridge hasn't reported its settings yet
+var errNoStatus = errors.New("No status report from fridge yet")
+
+// sendSettings hands settings to the bluetooth writer, giving up when ctx is done
+func (f *Fridge) sendSettings(ctx context.Context, cmd Command, s k25.Settings) error {
+	atomic.AddInt32(&f.pending, 1)
+	defer atomic.AddInt32(&f.pending, -1)
+	select {
+	case f.settingsC <- settingsCommand{Settings: s, cmd: cmd}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-// SetEcoMode Sends the fridge state to the fridge
-func (f *Fridge) SetEcoMode(useEcoMode bool) {
-	log.Warnf("SetEcoMode: %v", useEcoMode)
-	s := f.GetStatusReport().Settings
-	if s.EcoMode != useEcoMode {
-		s.EcoMode = useEcoMode
-		f.settingsC <- s
+// SendTemp hands a celsius temperature setting to the bluetooth writer once
+// the arbiter lets cmd change the setpoint
+func (f *Fridge) SendTemp(ctx context.Context, cmd Command, celsius float64) error {
+	return f.admitTemp(ctx, tempCommand{celsius: celsius, cmd: cmd})
+}
+
+// SendTempSet is SendTemp for a setpoint already in the fridge's unit
+func (f *Fridge) SendTempSet(ctx context.Context, cmd Command, tempSet int8) error {
+	return f.admitTemp(ctx, tempCommand{tempSet: &tempSet, cmd: cmd})
+}
+
+func (f *Fridge) admitTemp(ctx context.Context, tc tempCommand) error {
+	release, err := f.arbiter.admit(tc.cmd, []string{"TempSet"}, func(ctx context.Context) error {
+		return f.admitTemp(ctx, tc)
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.sendTemp(ctx, tc); err != nil {
+		release()
+		return err
 	}
+	return nil
 }
 
-// SetLocked Sends the fridge state to the fridge
-func (f *Fridge) SetLocked(lockIt bool) {
-	log.Warnf("SetLocked: %v", lockIt)
-	s := f.GetStatusReport().Settings
-	if s.Locked != lockIt {
-		s.Locked = lockIt
-		f.settingsC <- s
+func (f *Fridge) sendTemp(ctx context.Context, tc tempCommand) error {
+	atomic.AddInt32(&f.pending, 1)
+	defer atomic.AddInt32(&f.pending, -1)
+	select {
+	case f.tempSettingsC <- tc:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// PendingCommands is how many commands are waiting on the bluetooth writer
+func (f *Fridge) PendingCommands() int {
+	return int(atomic.LoadInt32(&f.pending))
+}
+
+// UpdateSettings applies change to the current settings and sends them if
+// anything changed and the arbiter lets cmd change those settings
+func (f *Fridge) UpdateSettings(ctx context.Context, cmd Command, change func(*k25.Settings)) (k25.Settings, error) {
+	current := f.GetStatusReport().Settings
+	if current == initialFridgeSettings {
+		return current, errNoStatus
+	}
+	s := current
+	change(&s)
+	if s == current {
+		return s, nil
+	}
+	if s.CelsiusFahrenheitModeMenuE5 != current.CelsiusFahrenheitModeMenuE5 {
+		var err error
+		if s, err = followUnit(current, s); err != nil {
+			return s, err
+		}
+	}
+	if err := s.Validate(); err != nil {
+		return s, err
+	}
+	release, err := f.arbiter.admit(cmd, changedSettings(current, s), func(ctx context.Context) error {
+		_, err := f.UpdateSettings(ctx, cmd, change)
+		return err
+	})
+	if err != nil {
+		return s, err
+	}
+	if err := f.sendSettings(ctx, cmd, s); err != nil {
+		release()
+		return s, err
+	}
+	return s, nil
+}
+
+// setFlag changes one switch for cmd with the usual command timeout
+func (f *Fridge) setFlag(cmd Command, set func(*k25.Settings)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	_, err := f.UpdateSettings(ctx, cmd, set)
+	return err
+}
+
+// SetOn turns the fridge on or off
+func (f *Fridge) SetOn(cmd Command, turnOn bool) error {
+	return f.setFlag(cmd, func(s *k25.Settings) { s.On = turnOn })
+}
+
+// SetEcoMode turns eco mode on or off
+func (f *Fridge) SetEcoMode(cmd Command, useEcoMode bool) error {
+	return f.setFlag(cmd, func(s *k25.Settings) { s.EcoMode = useEcoMode })
+}
+
+// SetLocked locks or unlocks the keypad
+func (f *Fridge) SetLocked(cmd Command, lockIt bool) error {
+	return f.setFlag(cmd, func(s *k25.Settings) { s.Locked = lockIt })
+}
+
 // GetStatusReport gets the fridge state
 func (f *Fridge) GetStatusReport() k25.StatusReport {
 	f.mu.RLock()
@@ -151,6 +400,46 @@ func (f *Fridge) GetStatusReport() k25.StatusReport {
 	return f.status
 }
 
+// SetConnected records the bluetooth connection state
+func (f *Fridge) SetConnected(connected bool) {
+	f.mu.Lock()
+	prev := f.connected
+	f.connected = connected
+	if connected && !prev {
+		f.connectedAt = time.Now()
+	}
+	f.mu.Unlock()
+	if prev != connected {
+		log.WithFields(log.Fields{
+			"connected": connected,
+		}).Info("Fridge connection state changed")
+		f.hub.Publish(eventConnection, ConnectionChange{Connected: connected})
+	}
+}
+
+// Alert tells every event subscriber something needs attention
+func (f *Fridge) Alert(level, source, message string) {
+	log.WithFields(log.Fields{
+		"alert":  level,
+		"source": source,
+	}).Warnf("Alert: %s", message)
+	f.hub.Publish(eventAlert, Alert{Level: level, Source: source, Message: message})
+}
+
+// LastUpdate is when the last status report arrived, zero if none has
+func (f *Fridge) LastUpdate() time.Time {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.updated
+}
+
+// Connected reports whether the bluetooth client is talking to the fridge
+func (f *Fridge) Connected() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.connected
+}
+
 // CycleCompressor spins up compressor to defeat power bank auto-off
 func (f *Fridge) CycleCompressor(ctx context.Context, wg *sync.WaitGroup, onTime time.Duration) {
 	log.Info("Fridge quick compressor cycle")
@@ -175,9 +464,9 @@ Lerp:
 		}
 	}
 
-	if s.InputV1 > 13 {
+	if inputVoltage(s.Sensors) >= 14 {
 		// Voltage is high enough that we're not on a 12v regulated battery
-		f.Log().Info("Fridge input voltage over >=14v; skipping compressor cycle")
+		f.Log().Info("Fridge input voltage is 14v or more; skipping compressor cycle")
 		return
 	}
 
@@ -221,7 +510,6 @@ Lerp:
 			"temp set": s.TempSet,
 			"on":       s.On,
 		}).Debugf("Fridge going to cold setting")
-		// TODO see if there's a way to avoid this 30s window where things could get clobbered
 		// time after func turn off
 		log.WithFields(log.Fields{
 			"client": "CycleCompressor",
@@ -237,22 +525,19 @@ Lerp:
 				}).Trace("Calling done on main wait group")
 				wg.Done()
 			}()
-			s := f.GetStatusReport().Settings
-			s.On = prevSettings.On
-			if !s.On {
-				s.Locked = false
-			}
-			s.TempSet = prevSettings.TempSet
-			log.WithFields(log.Fields{
-				"client":   "CycleCompressor",
-				"temp set": s.TempSet,
-				"on":       s.On,
-			}).Debugf("Fridge going back to prev settings")
-			f.settingsC <- s
+			// Anything a person changed meanwhile holds the setting and wins
+			s, err := f.UpdateSettings(ctx, Command{Source: sourceKeepAlive}, func(s *k25.Settings) {
+				s.On = prevSettings.On
+				if !s.On {
+					s.Locked = false
+				}
+				s.TempSet = prevSettings.TempSet
+			})
 			log.WithFields(log.Fields{
 				"client":   "CycleCompressor",
 				"temp set": s.TempSet,
 				"on":       s.On,
+				"err":      err,
 			}).Debugf("Fridge went back to prev settings")
 		})
 
@@ -260,7 +545,15 @@ Lerp:
 		log.WithFields(log.Fields{
 			"client": "CycleCompressor",
 		}).Debug("sending cycle command")
-		f.settingsC <- s.Settings
+		cycle := s.Settings
+		if _, err := f.UpdateSettings(ctx, Command{Source: sourceKeepAlive}, func(s *k25.Settings) {
+			s.On, s.TempSet = cycle.On, cycle.TempSet
+		}); err != nil {
+			log.WithFields(log.Fields{
+				"client": "CycleCompressor",
+				"err":    err,
+			}).Info("Skipping compressor cycle")
+		}
 	}
 }
 
@@ -277,6 +570,11 @@ func main() {
 	minVideoBitrate = env.GetOrDefaultInt("CAM_MIN_VIDEO_BITRATE", *minVideoBitrateF)
 	camRotationDegrees = env.GetOrDefaultInt("CAM_ROTATION_DEGREES", *camRotationDegreesF)
 	multiStream = env.GetOrDefaultBool("CAM_MULTI_STREAM", *multiStreamF)
+	readyMaxAge = env.GetOrDefaultSecond("READY_MAX_AGE_SEC", *readyMaxAgeF)
+	staleAfter = env.GetOrDefaultSecond("STALE_AFTER_SEC", *staleAfterF)
+	if err := validStaleAfter(staleAfter); err != nil {
+		log.Fatal(err)
+	}
 
 	inputDevice = env.GetOrDefaultString("INPUT_DEVICE", *inputDeviceF)
 	inputFilename = env.GetOrDefaultString("INPUT_FILENAME", *inputFilenameF)
@@ -284,6 +582,186 @@ func main() {
 	h264Encoder = env.GetOrDefaultString("H264ENCODER", *h264EncoderF)
 	h264Decoder = env.GetOrDefaultString("H264DNECODER", *h264DecoderF)
 
+	battery := BatterySettings{
+		lowPercent: env.GetOrDefaultInt("BATTERY_LOW_PERCENT", *batteryLowPercentF),
+		ub17:       env.GetOrDefaultBool("BATTERY_UB17", *batteryUB17F),
+	}
+	if c := env.GetOrDefaultString("BATTERY_CURVE", *batteryCurveF); c != "none" && c != "" {
+		curve, err := parseBatteryCurve(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		battery.curve = curve
+	}
+	powerProfile, err := parsePowerProfile(env.GetOrDefaultString("POWER_PROFILE", *powerProfileF))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cutoffVolts, err := parseCutoffVolts(env.GetOrDefaultString("CUTOFF_VOLTS", *cutoffVoltsF))
+	if err != nil {
+		log.Fatal(err)
+	}
+	controlSettings := ControlSettings{
+		mode:        env.GetOrDefaultString("CONTROL_MODE", *controlModeF),
+		period:      env.GetOrDefaultSecond("CONTROL_PERIOD_SEC", *controlPeriodF),
+		minOff:      env.GetOrDefaultSecond("CONTROL_MIN_OFF_SEC", *controlMinOffF),
+		actuator:    env.GetOrDefaultString("CONTROL_ACTUATOR", *controlActuatorF),
+		probeMaxAge: env.GetOrDefaultSecond("CONTROL_PROBE_MAX_AGE_SEC", *controlProbeMaxAgeF),
+	}
+	if controlSettings.target, err = parseTemperature(env.GetOrDefaultString("CONTROL_TARGET", *controlTargetF), false); err != nil {
+		log.Fatal(err)
+	}
+	if controlSettings.band, err = parseTemperature(env.GetOrDefaultString("CONTROL_BAND", *controlBandF), true); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseControlGains(env.GetOrDefaultString("CONTROL_GAINS", *controlGainsF), &controlSettings); err != nil {
+		log.Fatal(err)
+	}
+	if err := controlSettings.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	lidSettings, err := parseLidSensitivity(env.GetOrDefaultString("LID_SENSITIVITY", *lidSensitivityF))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *hkResetPairingF {
+		removed, err := resetHKPairing(storagePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{
+			"client":  "HKClient",
+			"path":    storagePath,
+			"removed": removed,
+		}).Info("HomeKit pairing reset, remove the bridge from the Home app and pair again")
+		return
+	}
+	hkPin := env.GetOrDefaultString("HK_PIN", *hkPinF)
+	if _, err := hc.ValidatePin(hkPin); err != nil {
+		log.Fatal(err)
+	}
+	if hkPin == hkDefaultPin {
+		log.WithFields(log.Fields{"client": "HKClient"}).Warn("Using the default HomeKit PIN, set HK_PIN to your own")
+	}
+	hkSetupID := env.GetOrDefaultString("HK_SETUP_ID", *hkSetupIDF)
+	if hkSetupID == "" {
+		hkSetupID = macSuffix(addr)
+	}
+	if err := validSetupID(hkSetupID); hkSetupID != "" && err != nil {
+		log.Fatal(err)
+	}
+	hkIdentity := newHKIdentity(
+		addr,
+		env.GetOrDefaultString("HK_NAME", *hkNameF),
+		env.GetOrDefaultString("HK_MANUFACTURER", *hkManufacturerF),
+		env.GetOrDefaultString("HK_MODEL", *hkModelF),
+	)
+
+	auth, err := newAuth(
+		env.GetOrDefaultString("HTTP_READ_TOKENS", *httpReadTokensF),
+		env.GetOrDefaultString("HTTP_CONTROL_TOKENS", *httpControlTokensF),
+		env.GetOrDefaultString("HTTP_USERS", *httpUsersF),
+		env.GetOrDefaultBool("HTTP_ANONYMOUS_READ", *httpAnonymousReadF),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpSettings := HTTPSettings{
+		addr:       env.GetOrDefaultString("HTTP_ADDR", *httpAddrF),
+		auth:       auth,
+		writeRate:  float64(env.GetOrDefaultInt("HTTP_WRITE_RATE_PER_MIN", *httpWriteRateF)) / 60,
+		writeBurst: env.GetOrDefaultInt("HTTP_WRITE_BURST", *httpWriteBurstF),
+		tlsCert:    env.GetOrDefaultString("HTTP_TLS_CERT", *httpTLSCertF),
+		tlsKey:     env.GetOrDefaultString("HTTP_TLS_KEY", *httpTLSKeyF),
+		tlsSelf:    env.GetOrDefaultBool("HTTP_TLS_SELF_SIGNED", *httpTLSSelfSignedF),
+		tlsDir:     filepath.Join(storagePath, "tls"),
+
+		camSnapshotRate:     float64(env.GetOrDefaultInt("CAM_HTTP_SNAPSHOTS_PER_MIN", *camHTTPSnapshotRateF)) / 60,
+		camSnapshotBurst:    env.GetOrDefaultInt("CAM_HTTP_SNAPSHOT_BURST", *camHTTPSnapshotBurstF),
+		camStreamsPerClient: env.GetOrDefaultInt("CAM_HTTP_STREAMS_PER_CLIENT", *camHTTPStreamsF),
+	}
+
+	// fridgeID names the fridge to MQTT and gRPC clients
+	fridgeID := strings.ToLower(strings.ReplaceAll(addr, ":", ""))
+
+	snapshotSettings := SnapshotSettings{
+		dir:        filepath.Join(storagePath, "snapshots"),
+		timelapse:  env.GetOrDefaultSecond("SNAPSHOT_TIMELAPSE_SEC", *snapshotTimelapseF),
+		keepEvents: env.GetOrDefaultInt("SNAPSHOT_KEEP_EVENTS", *snapshotKeepEventsF),
+		keepFrames: env.GetOrDefaultInt("SNAPSHOT_KEEP_FRAMES", *snapshotKeepFramesF),
+		maxAge:     env.GetOrDefaultSecond("SNAPSHOT_MAX_AGE_SEC", *snapshotMaxAgeF),
+		alarmDelta: env.GetOrDefaultInt("SNAPSHOT_ALARM_DELTA", *snapshotAlarmDeltaF),
+	}
+
+	auditSettings := AuditSettings{
+		path:      env.GetOrDefaultString("AUDIT_FILE", *auditFileF),
+		maxBytes:  int64(env.GetOrDefaultInt("AUDIT_MAX_BYTES", *auditMaxBytesF)),
+		keep:      env.GetOrDefaultInt("AUDIT_KEEP", *auditKeepF),
+		ackWindow: auditAckWindow,
+	}
+	if auditSettings.path == "" {
+		auditSettings.path = filepath.Join(storagePath, "audit.log")
+	}
+
+	grpcSettings := GRPCSettings{
+		addr:       env.GetOrDefaultString("GRPC_ADDR", *grpcAddrF),
+		socket:     env.GetOrDefaultString("GRPC_SOCKET", *grpcSocketF),
+		fridgeID:   fridgeID,
+		fridgeAddr: addr,
+		auth:       auth,
+	}
+	if grpcSettings.addr != "" {
+		// Share the HTTP certificate, loaded here before JSONClient can race to create it
+		grpcSettings.tls, err = httpSettings.tlsConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	mqttSettings := MQTTSettings{
+		broker:          env.GetOrDefaultString("MQTT_BROKER", *mqttBrokerF),
+		clientID:        env.GetOrDefaultString("MQTT_CLIENT_ID", *mqttClientIDF),
+		username:        env.GetOrDefaultString("MQTT_USERNAME", *mqttUsernameF),
+		password:        env.GetOrDefaultString("MQTT_PASSWORD", *mqttPasswordF),
+		topicPrefix:     env.GetOrDefaultString("MQTT_TOPIC_PREFIX", *mqttTopicPrefixF),
+		discoveryPrefix: env.GetOrDefaultString("MQTT_DISCOVERY_PREFIX", *mqttDiscoveryPrefixF),
+		nodeID:          env.GetOrDefaultString("MQTT_NODE_ID", *mqttNodeIDF),
+		publishInterval: time.Second,
+	}
+	if mqttSettings.nodeID == "" {
+		mqttSettings.nodeID = fridgeID
+	}
+
+	exporters := []ExporterSettings{}
+	exporterDefaults := ExporterSettings{
+		node:           addr,
+		spoolDir:       filepath.Join(storagePath, "export"),
+		spoolMax:       env.GetOrDefaultInt("EXPORT_SPOOL_MAX_LINES", *exportSpoolMaxLinesF),
+		sampleInterval: env.GetOrDefaultSecond("EXPORT_INTERVAL_SEC", *exportIntervalF),
+		flushInterval:  env.GetOrDefaultSecond("EXPORT_FLUSH_INTERVAL_SEC", *exportFlushIntervalF),
+		batchSize:      env.GetOrDefaultInt("EXPORT_BATCH_SIZE", *exportBatchSizeF),
+	}
+	if u := env.GetOrDefaultString("INFLUX_URL", *influxURLF); u != "" {
+		e := exporterDefaults
+		e.format = exportInflux
+		e.url = u
+		e.token = env.GetOrDefaultString("INFLUX_TOKEN", *influxTokenF)
+		exporters = append(exporters, e)
+	}
+	if u := env.GetOrDefaultString("GRAPHITE_URL", *graphiteURLF); u != "" {
+		e := exporterDefaults
+		e.format = exportGraphite
+		e.url = u
+		e.prefix = env.GetOrDefaultString("GRAPHITE_PREFIX", *graphitePrefixF)
+		exporters = append(exporters, e)
+	}
+	for _, e := range exporters {
+		if err := e.Validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	log.WithFields(log.Fields{
 		"daemon timeout": timeout,
 		"pollrate":       pollrate,
@@ -331,18 +809,106 @@ func main() {
 	defer cancelHKClientContext()
 
 	// Data setup
+	audit, err := openAuditLog(auditSettings)
+	if err != nil {
+		log.WithFields(log.Fields{"client": "AuditLog", "err": err}).Error("Audit log is off")
+	}
+	defer audit.Close()
+	coolingSettings := CoolingSettings{
+		path:     filepath.Join(storagePath, "cooling.json"),
+		stall:    env.GetOrDefaultSecond("COOLING_STALL_SEC", *coolingStallF),
+		interval: env.GetOrDefaultSecond("COOLING_REPORT_SEC", *coolingReportF),
+	}
+	if err := coolingSettings.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	cooling, err := newCooling(coolingSettings)
+	if err != nil {
+		log.WithFields(log.Fields{"client": "Cooling", "err": err}).Error("Starting cooling baselines afresh")
+	}
 	fridge := Fridge{
 		inlet:             make(statusReportC),
 		tempSettingsC:     make(tempSettingsC),
 		settingsC:         make(settingsC),
 		cycleCompressorWg: &cycleCompressorWg,
+		hub:               newHub(),
+		history:           newHistory(historySize, historyInterval),
+		diag:              newDiagnostics(),
+		resubscribeC:      make(chan struct{}, 1),
+		arbiter: newArbiter(map[CommandPriority]time.Duration{
+			priorityManual: env.GetOrDefaultSecond("MANUAL_HOLD_SEC", *manualHoldF),
+			prioritySafety: env.GetOrDefaultSecond("SAFETY_HOLD_SEC", *safetyHoldF),
+		}),
+		audit:      audit,
+		compressor: newCompressor(powerProfile),
+		lid:        newLidDetector(lidSettings),
+		cooling:    cooling,
+		predictor:  newPredictor(cutoffVolts),
+		control:    newController(controlSettings),
 	}
 	// Collect updates into status
 	go func() { fridge.MonitorMu() }()
+	go fridge.WatchStale(ctx)
+	go fridge.WatchCooling(ctx)
+	go fridge.arbiter.Run(ctx)
+
+	// The camera is optional, it's shared by HomeKit and snapshots
+	var camera *Camera
+	if env.GetOrDefaultBool("CAM_ENABLED", *cameraF) {
+		info := hkIdentity.info(hkCameraID, "Camera")
+		info.FirmwareRevision = "0.0.9"
+		camera, err = newCamera(info, CameraSettings{
+			snapshotDir:      storagePath,
+			minVideoBitrate:  minVideoBitrate,
+			multiStream:      multiStream,
+			inputDevice:      inputDevice,
+			inputFilename:    inputFilename,
+			loopbackFilename: loopbackFilename,
+			h264Decoder:      h264Decoder,
+			h264Encoder:      h264Encoder,
+		}, fridge.diag)
+		if err != nil {
+			log.WithFields(log.Fields{"client": "Camera", "err": err}).Error("Camera setup failed, running without it")
+			fridge.diag.Error("camera", err)
+		} else {
+			go camera.Supervise(ctx)
+		}
+	} else {
+		fridge.diag.SetCamera(CameraState{})
+	}
+	if camera != nil {
+		fridge.camera = camera
+		fridge.snapshots, err = newSnapshotter(snapshotSettings, camera)
+		if err != nil {
+			log.WithFields(log.Fields{"client": "SnapshotClient", "err": err}).Error("Snapshots are off")
+		} else {
+			go SnapshotClient(ctx, &wg, &fridge, fridge.snapshots)
+		}
+	}
+
+	// User-defined automations
+	rulesPath := env.GetOrDefaultString("RULES_FILE", *rulesFileF)
+	if rulesPath == "" {
+		rulesPath = filepath.Join(storagePath, "rules.json")
+	}
+	rules, err := loadRules(rulesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rules) > 0 {
+		log.WithFields(log.Fields{
+			"client": "RulesClient",
+			"rules":  len(rules),
+		}).Infof("Loaded rules from %s", rulesPath)
+		fridge.rules = newRuleEngine(rules)
+		go RulesClient(ctx, &wg, &fridge, fridge.rules)
+	}
+
+	// Thermostat control, off until switched on by flag or over HTTP
+	go ControlClient(ctx, &wg, &fridge, fridge.control)
 
 	// Expose json client
-	// TODO get port from config
-	go JSONClient(JSONClientContext, &wg, "80", &fridge)
+	go JSONClient(JSONClientContext, &wg, httpSettings, &fridge)
 
 	// Listen for control-c subtask
 	go func() {
@@ -388,6 +954,7 @@ func main() {
 	go func() {
 		log.Debug("Launching client")
 		err := Client(clientContext, &wg, &fridge, adapterName, addr)
+		fridge.diag.Error("bluetooth", err)
 		if err == context.Canceled || err == context.DeadlineExceeded {
 			log.WithFields(log.Fields{
 				"client": "bluetooth",
@@ -410,15 +977,38 @@ func main() {
 	// Kick off homekit client
 	go HKClient(HKClientContext, &wg, &fridge, HKSettings{
 		storagePath,
-		minVideoBitrate,
-		multiStream,
-		inputDevice,
-		inputFilename,
-		loopbackFilename,
-		h264Decoder,
-		h264Encoder,
+		camera,
+		battery,
+		hkPin,
+		hkSetupID,
+		hkIdentity,
 	})
 
+	// Kick off gRPC server
+	if grpcSettings.addr != "" || grpcSettings.socket != "" {
+		GRPCClientContext, cancelGRPCClient := context.WithCancel(ctx)
+		defer cancelGRPCClient()
+		go GRPCClient(GRPCClientContext, &wg, &fridge, grpcSettings)
+	} else {
+		log.Info("grpc address and socket not set, gRPC is off")
+	}
+
+	// Kick off MQTT client
+	if mqttSettings.broker != "" {
+		MQTTClientContext, cancelMQTTClient := context.WithCancel(ctx)
+		defer cancelMQTTClient()
+		go MQTTClient(MQTTClientContext, &wg, &fridge, mqttSettings)
+	} else {
+		log.Info("mqtt broker not set, MQTT is off")
+	}
+
+	// Kick off push exporters
+	for _, e := range exporters {
+		exporterContext, cancelExporter := context.WithCancel(ctx)
+		defer cancelExporter()
+		go ExporterClient(exporterContext, &wg, &fridge, e)
+	}
+
 	// go CameraClient(cameraClientContext, &wg, cameraResultsC)
 
 	log.Trace("Main waiting...")
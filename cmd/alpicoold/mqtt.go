@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+// MQTTSettings avoids lots of args to MQTTClient
+type MQTTSettings struct {
+	broker          string // e.g. tcp://localhost:1883
+	clientID        string
+	username        string
+	password        string
+	topicPrefix     string // State and command topics live under here
+	discoveryPrefix string // Home Assistant discovery prefix
+	nodeID          string // Unique per fridge, used in discovery topics and ids
+	publishInterval time.Duration
+}
+
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+	mqttOn      = "ON"
+	mqttOff     = "OFF"
+	mqttQos     = 1
+)
+
+// Topic helpers
+
+func (s MQTTSettings) topic(parts ...string) string {
+	return strings.Join(append([]string{s.topicPrefix}, parts...), "/")
+}
+
+// daemonStatusTopic carries the last will, i.e. is the daemon alive
+func (s MQTTSettings) daemonStatusTopic() string { return s.topic("status") }
+
+// availabilityTopic follows the bluetooth connection to the fridge
+func (s MQTTSettings) availabilityTopic() string { return s.topic("availability") }
+
+func (s MQTTSettings) stateTopic(name string) string { return s.topic("state", name) }
+
+func (s MQTTSettings) commandTopic(name string) string { return s.topic("set", name) }
+
+func (s MQTTSettings) discoveryTopic(component, object string) string {
+	return strings.Join([]string{s.discoveryPrefix, component, s.nodeID, object, "config"}, "/")
+}
+
+func onOff(b bool) string {
+	if b {
+		return mqttOn
+	}
+	return mqttOff
+}
+
+// fridgeUnit is the temperature unit the fridge is currently using
+func fridgeUnit(s k25.Settings) string {
+	if s.CelsiusFahrenheitModeMenuE5 {
+		return "F"
+	}
+	return "C"
+}
+
+// mqttStateTopics maps each retained state topic name to its payload
+func mqttStateTopics(r k25.StatusReport) map[string]string {
+	mode := "off"
+	if r.On {
+		mode = "cool"
+	}
+	return map[string]string{
+		"temp":          strconv.Itoa(int(r.Temp)),
+		"temp_set":      strconv.Itoa(int(r.TempSet)),
+		"unit":          fridgeUnit(r.Settings),
+		"mode":          mode,
+		"on":            onOff(r.On),
+		"eco":           onOff(r.EcoMode),
+		"locked":        onOff(r.Locked),
+		"input_voltage": strconv.FormatFloat(inputVoltage(r.Sensors), 'f', 1, 64),
+		"ub17":          strconv.Itoa(int(r.UB17)),
+		"hlvl":          strconv.Itoa(int(r.HLvl)),
+		"e1":            strconv.Itoa(int(r.LowestTempSettingMenuE1)),
+		"e2":            strconv.Itoa(int(r.HighestTempSettingMenuE2)),
+		"e3":            strconv.Itoa(int(r.HysteresisMenuE3)),
+		"e4":            strconv.Itoa(int(r.SoftStartDelayMinMenuE4)),
+		"e6":            strconv.Itoa(int(r.TempCompGTEMinus6DegCelsiusMenuE6)),
+		"e7":            strconv.Itoa(int(r.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7)),
+		"e8":            strconv.Itoa(int(r.TempCompLTMinus12DegCelsiusMenuE8)),
+		"e9":            strconv.Itoa(int(r.TempCompShutdownMenuE9)),
+	}
+}
+
+// mqttDiscoveryPayloads builds the Home Assistant discovery configs, keyed by topic
+func mqttDiscoveryPayloads(s MQTTSettings, r k25.StatusReport) map[string]map[string]interface{} {
+	device := map[string]interface{}{
+		"identifiers":  []string{"alpicoold_" + s.nodeID},
+		"name":         "Alpicool " + s.nodeID,
+		"manufacturer": "Alpicool",
+		"model":        "WT-0001",
+	}
+	availability := []map[string]string{
+		{"topic": s.daemonStatusTopic()},
+		{"topic": s.availabilityTopic()},
+	}
+	base := func(object, name string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":              name,
+			"unique_id":         s.nodeID + "_" + object,
+			"device":            device,
+			"availability":      availability,
+			"availability_mode": "all",
+		}
+	}
+	unit := "°" + fridgeUnit(r.Settings)
+
+	payloads := map[string]map[string]interface{}{}
+
+	climate := base("fridge", "Fridge")
+	climate["modes"] = []string{"off", "cool"}
+	climate["mode_state_topic"] = s.stateTopic("mode")
+	climate["mode_command_topic"] = s.commandTopic("mode")
+	climate["current_temperature_topic"] = s.stateTopic("temp")
+	climate["temperature_state_topic"] = s.stateTopic("temp_set")
+	climate["temperature_command_topic"] = s.commandTopic("temperature")
+	climate["temperature_unit"] = fridgeUnit(r.Settings)
+	climate["precision"] = 1.0
+	climate["temp_step"] = 1
+	if r.Settings != initialFridgeSettings {
+		climate["min_temp"] = r.LowestTempSettingMenuE1
+		climate["max_temp"] = r.HighestTempSettingMenuE2
+	}
+	payloads[s.discoveryTopic("climate", "fridge")] = climate
+
+	temp := base("temp", "Temperature")
+	temp["state_topic"] = s.stateTopic("temp")
+	temp["device_class"] = "temperature"
+	temp["state_class"] = "measurement"
+	temp["unit_of_measurement"] = unit
+	payloads[s.discoveryTopic("sensor", "temp")] = temp
+
+	voltage := base("input_voltage", "Input voltage")
+	voltage["state_topic"] = s.stateTopic("input_voltage")
+	voltage["device_class"] = "voltage"
+	voltage["state_class"] = "measurement"
+	voltage["unit_of_measurement"] = "V"
+	payloads[s.discoveryTopic("sensor", "input_voltage")] = voltage
+
+	for _, sw := range []struct{ object, name string }{
+		{"on", "Power"},
+		{"eco", "Eco mode"},
+		{"locked", "Keypad lock"},
+	} {
+		p := base(sw.object, sw.name)
+		p["state_topic"] = s.stateTopic(sw.object)
+		p["command_topic"] = s.commandTopic(sw.object)
+		payloads[s.discoveryTopic("switch", sw.object)] = p
+	}
+
+	return payloads
+}
+
+// mqttPublisher tracks what has been published so only changes go out
+type mqttPublisher struct {
+	client    mqtt.Client
+	settings  MQTTSettings
+	mu        sync.Mutex
+	last      map[string]string
+	discovery string // unit and bounds the discovery payloads were built with
+}
+
+func (p *mqttPublisher) publish(topic, payload string) {
+	tok := p.client.Publish(topic, mqttQos, true, payload)
+	go func() {
+		tok.Wait()
+		if err := tok.Error(); err != nil {
+			log.WithFields(log.Fields{
+				"client": "MQTTClient",
+				"topic":  topic,
+				"err":    err,
+			}).Error("publish failed")
+		}
+	}()
+}
+
+// reset forgets what was published, e.g. after reconnecting to the broker
+func (p *mqttPublisher) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = map[string]string{}
+	p.discovery = ""
+}
+
+// update publishes availability, discovery and any changed state topics
+func (p *mqttPublisher) update(connected bool, r k25.StatusReport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last == nil {
+		p.last = map[string]string{}
+	}
+
+	available := mqttOffline
+	if connected {
+		available = mqttOnline
+	}
+	if p.last["availability"] != available {
+		p.publish(p.settings.availabilityTopic(), available)
+		p.last["availability"] = available
+	}
+
+	// Wait for a real status report before publishing state
+	if r.Settings == initialFridgeSettings {
+		return
+	}
+
+	discoveryKey := fmt.Sprintf("%s %d %d", fridgeUnit(r.Settings), r.LowestTempSettingMenuE1, r.HighestTempSettingMenuE2)
+	if p.settings.discoveryPrefix != "" && p.discovery != discoveryKey {
+		for topic, payload := range mqttDiscoveryPayloads(p.settings, r) {
+			b, err := json.Marshal(payload)
+			if err != nil {
+				log.WithFields(log.Fields{"client": "MQTTClient"}).Error(err)
+				continue
+			}
+			p.publish(topic, string(b))
+		}
+		p.discovery = discoveryKey
+	}
+
+	for name, payload := range mqttStateTopics(r) {
+		if p.last[name] == payload {
+			continue
+		}
+		p.publish(p.settings.stateTopic(name), payload)
+		p.last[name] = payload
+	}
+}
+
+// handleMQTTCommand routes a command topic payload to the fridge
+func handleMQTTCommand(fridge *Fridge, name, payload string) error {
+	payload = strings.TrimSpace(payload)
+	parseOnOff := func() (bool, error) {
+		switch strings.ToUpper(payload) {
+		case mqttOn, "TRUE", "1":
+			return true, nil
+		case mqttOff, "FALSE", "0":
+			return false, nil
+		}
+		return false, fmt.Errorf("Bad switch payload %q", payload)
+	}
+
+	switch name {
+	case "temperature":
+		t, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return fmt.Errorf("Bad temperature payload %q: %s", payload, err)
+		}
+		// Payloads use the fridge's units, the settings channel wants celsius
+		if fridge.GetStatusReport().CelsiusFahrenheitModeMenuE5 {
+			t = FtoC(t)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		return fridge.SendTemp(ctx, Command{Source: sourceMQTT}, t)
+	case "mode":
+		switch payload {
+		case "cool":
+			return fridge.SetOn(Command{Source: sourceMQTT}, true)
+		case "off":
+			return fridge.SetOn(Command{Source: sourceMQTT}, false)
+		default:
+			return fmt.Errorf("Bad mode payload %q", payload)
+		}
+	case "on":
+		b, err := parseOnOff()
+		if err != nil {
+			return err
+		}
+		return fridge.SetOn(Command{Source: sourceMQTT}, b)
+	case "eco":
+		b, err := parseOnOff()
+		if err != nil {
+			return err
+		}
+		return fridge.SetEcoMode(Command{Source: sourceMQTT}, b)
+	case "locked":
+		b, err := parseOnOff()
+		if err != nil {
+			return err
+		}
+		return fridge.SetLocked(Command{Source: sourceMQTT}, b)
+	case "probe":
+		t, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return fmt.Errorf("Bad probe payload %q: %s", payload, err)
+		}
+		// An external temperature for thermostat control, in the fridge's units
+		if fridge.GetStatusReport().CelsiusFahrenheitModeMenuE5 {
+			t = FtoC(t)
+		}
+		fridge.control.Probe(t, time.Now())
+		return nil
+	default:
+		return fmt.Errorf("Unknown command %q", name)
+	}
+}
+
+// MQTTClient publishes fridge state to an MQTT broker and takes commands from it
+func MQTTClient(ctx context.Context, wg *sync.WaitGroup, fridge *Fridge, settings MQTTSettings) {
+	log := log.WithFields(log.Fields{
+		"client": "MQTTClient",
+	})
+	wg.Add(1)
+	defer func() {
+		wg.Done()
+		log.Trace("Calling done on main wait group")
+	}()
+
+	if settings.publishInterval <= 0 {
+		settings.publishInterval = time.Second
+	}
+
+	pub := &mqttPublisher{settings: settings}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(settings.broker).
+		SetClientID(settings.clientID).
+		SetUsername(settings.username).
+		SetPassword(settings.password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(settings.daemonStatusTopic(), mqttOffline, mqttQos, true)
+
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Infof("Connected to broker %s", settings.broker)
+		pub.reset()
+		c.Publish(settings.daemonStatusTopic(), mqttQos, true, mqttOnline)
+
+		commands := settings.commandTopic("+")
+		tok := c.Subscribe(commands, mqttQos, func(_ mqtt.Client, m mqtt.Message) {
+			name, payload := m.Topic()[strings.LastIndex(m.Topic(), "/")+1:], string(m.Payload())
+			log.WithField("topic", m.Topic()).Debugf("Got command %q", payload)
+			// Commands wait on the fridge, which mustn't hold up paho's router
+			go func() {
+				if err := handleMQTTCommand(fridge, name, payload); err != nil {
+					log.Warn(err)
+				}
+			}()
+		})
+		go func() {
+			if tok.Wait(); tok.Error() != nil {
+				log.Errorf("Subscribe %s: %s", commands, tok.Error())
+			}
+		}()
+		pub.update(fridge.Connected() && !fridge.Stale(), fridge.GetStatusReport())
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Warnf("Lost broker connection: %s", err)
+	})
+
+	client := mqtt.NewClient(opts)
+	pub.client = client
+	log.Debugf("Connecting to %s", settings.broker)
+	client.Connect()
+
+	ticker := time.NewTicker(settings.publishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Trace("MQTTClient ctx canceled")
+			if client.IsConnected() {
+				tok := client.Publish(settings.daemonStatusTopic(), mqttQos, true, mqttOffline)
+				tok.WaitTimeout(time.Second)
+			}
+			client.Disconnect(250)
+			return
+		case <-ticker.C:
+			if client.IsConnectionOpen() {
+				pub.update(fridge.Connected() && !fridge.Stale(), fridge.GetStatusReport())
+			}
+		}
+	}
+}
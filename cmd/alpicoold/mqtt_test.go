@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	log "github.com/sirupsen/logrus"
+)
+
+// startTestBroker runs an embedded broker and returns its address
+func startTestBroker(t *testing.T) (*mochi.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server, addr
+}
+
+// topicRecorder keeps the latest payload seen per topic
+type topicRecorder struct {
+	mu       sync.Mutex
+	payloads map[string]string
+}
+
+func (r *topicRecorder) handler(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payloads[pk.TopicName] = string(pk.Payload)
+}
+
+func (r *topicRecorder) waitFor(t *testing.T, topic, payload string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		got, ok := r.payloads[topic]
+		r.mu.Unlock()
+		if ok && (payload == "" || got == payload) {
+			return got
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Never saw %s=%q, saw %v", topic, payload, r.payloads)
+	return ""
+}
+
+func TestMQTTClient(t *testing.T) {
+	log.SetLevel(log.WarnLevel)
+	server, addr := startTestBroker(t)
+
+	rec := &topicRecorder{payloads: map[string]string{}}
+	for i, filter := range []string{"alpicoold/#", "homeassistant/#"} {
+		if err := server.Subscribe(filter, i+1, rec.handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fridge := newTestFridge(testStatusReport)
+	fridge.SetConnected(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := sync.WaitGroup{}
+	done := make(chan struct{})
+	go func() {
+		MQTTClient(ctx, &wg, fridge, MQTTSettings{
+			broker:          fmt.Sprintf("tcp://%s", addr),
+			clientID:        "alpicoold-test",
+			topicPrefix:     "alpicoold",
+			discoveryPrefix: "homeassistant",
+			nodeID:          "d817d1f1b978",
+			publishInterval: 50 * time.Millisecond,
+		})
+		close(done)
+	}()
+
+	t.Run("state", func(t *testing.T) {
+		rec.waitFor(t, "alpicoold/status", mqttOnline)
+		rec.waitFor(t, "alpicoold/availability", mqttOnline)
+		rec.waitFor(t, "alpicoold/state/temp", "39")
+		rec.waitFor(t, "alpicoold/state/temp_set", "37")
+		rec.waitFor(t, "alpicoold/state/eco", mqttOn)
+		rec.waitFor(t, "alpicoold/state/input_voltage", "12.8")
+		rec.waitFor(t, "alpicoold/state/mode", "cool")
+	})
+
+	t.Run("discovery", func(t *testing.T) {
+		raw := rec.waitFor(t, "homeassistant/climate/d817d1f1b978/fridge/config", "")
+		var climate map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &climate); err != nil {
+			t.Fatal(err)
+		}
+		if climate["temperature_command_topic"] != "alpicoold/set/temperature" {
+			t.Fatalf("Bad command topic %v", climate["temperature_command_topic"])
+		}
+		if climate["temperature_unit"] != "F" {
+			t.Fatalf("Bad unit %v", climate["temperature_unit"])
+		}
+		if climate["min_temp"] != float64(-4) || climate["max_temp"] != float64(68) {
+			t.Fatalf("Bad bounds %v %v", climate["min_temp"], climate["max_temp"])
+		}
+		// Home Assistant drops devices routed via one it never saw
+		if device := climate["device"].(map[string]interface{}); device["via_device"] != nil {
+			t.Fatalf("Device points at an unpublished parent %v", device["via_device"])
+		}
+		rec.waitFor(t, "homeassistant/switch/d817d1f1b978/locked/config", "")
+		rec.waitFor(t, "homeassistant/sensor/d817d1f1b978/input_voltage/config", "")
+	})
+
+	t.Run("availability follows bluetooth", func(t *testing.T) {
+		fridge.SetConnected(false)
+		rec.waitFor(t, "alpicoold/availability", mqttOffline)
+		fridge.SetConnected(true)
+		rec.waitFor(t, "alpicoold/availability", mqttOnline)
+	})
+
+	t.Run("commands", func(t *testing.T) {
+		server.Publish("alpicoold/set/on", []byte(mqttOff), false, 0)
+		select {
+		case s := <-fridge.settingsC:
+			if s.On {
+				t.Fatal("Expected fridge to be turned off")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No settings command")
+		}
+
+		server.Publish("alpicoold/set/temperature", []byte("41"), false, 0)
+		select {
+		case c := <-fridge.tempSettingsC:
+			if math.Abs(c.celsius-5) > 0.001 {
+				t.Fatalf("Expected 5C, got %v", c.celsius)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No temperature command")
+		}
+	})
+
+	t.Run("a stuck command doesn't hold up the next", func(t *testing.T) {
+		// Nothing takes the power command, so it waits out its timeout
+		server.Publish("alpicoold/set/on", []byte(mqttOff), false, 0)
+		server.Publish("alpicoold/set/temperature", []byte("40"), false, 0)
+		select {
+		case <-fridge.tempSettingsC:
+		case <-time.After(commandTimeout / 2):
+			t.Fatal("Temperature command stuck behind the power command")
+		}
+	})
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MQTTClient did not stop")
+	}
+	rec.waitFor(t, "alpicoold/status", mqttOffline)
+}
+
+func TestHandleMQTTCommandErrors(t *testing.T) {
+	fridge := newTestFridge(testStatusReport)
+	for name, payload := range map[string]string{
+		"temperature": "cold",
+		"mode":        "heat",
+		"eco":         "maybe",
+		"defrost":     mqttOn,
+	} {
+		if err := handleMQTTCommand(fridge, name, payload); err == nil {
+			t.Fatalf("Expected error for %s=%q", name, payload)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// Custom HomeKit types for the predictions, in minutes
+const (
+	TypeFridgePredictions = "A1C00001-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeTimeToTarget      = "A1C000A0-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeTimeToTargetLow   = "A1C000A1-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeTimeToTargetHigh  = "A1C000A2-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeRuntime           = "A1C000B0-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeRuntimeLow        = "A1C000B1-4B25-4C0D-9E6F-0A1C00D0E500"
+	TypeRuntimeHigh       = "A1C000B2-4B25-4C0D-9E6F-0A1C00D0E500"
+)
+
+var (
+	// predictCoolWindow is how much of the current run the pull-down is fitted over
+	predictCoolWindow = 15 * time.Minute
+	// predictCoolMin is how much of a run is needed before trusting its trend
+	predictCoolMin = 5 * time.Minute
+	// predictBaselineSpread is the bounds either side of a learned rate
+	predictBaselineSpread = 0.3
+	// predictVoltWindow is how much resting voltage the drain is fitted over
+	predictVoltWindow = 3 * time.Hour
+	// predictVoltMin is how much resting voltage is needed for a drain trend
+	predictVoltMin = 30 * time.Minute
+)
+
+// CutoffVolts are the 12V input voltages the fridge turns off at for each
+// battery cutoff level (HLvl), from the Alpicool manual
+type CutoffVolts [3]float64
+
+// parseCutoffVolts reads level:volts pairs, e.g. h:11.3,m:10.1,l:9.6
+func parseCutoffVolts(s string) (CutoffVolts, error) {
+	c := CutoffVolts{}
+	seen := map[int]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return c, fmt.Errorf("Bad cutoff volts %q, want level:volts", pair)
+		}
+		v, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || v <= 0 {
+			return c, fmt.Errorf("Bad cutoff volts %q", parts[1])
+		}
+		level := strings.Index("hml", strings.ToLower(parts[0]))
+		if len(parts[0]) != 1 || level < 0 {
+			return c, fmt.Errorf("Unknown cutoff level %q, want h, m or l", parts[0])
+		}
+		c[level] = v
+		seen[level] = true
+	}
+	if len(seen) != 3 {
+		return c, fmt.Errorf("Cutoff volts need h, m and l")
+	}
+	return c, nil
+}
+
+// Estimate is a predicted duration with 95% bounds
+type Estimate struct {
+	Known       bool       `json:"known"`
+	Seconds     float64    `json:"seconds"`
+	LowSeconds  float64    `json:"lowSeconds"`
+	HighSeconds *float64   `json:"highSeconds,omitempty"` // missing when it might never happen
+	ETA         *time.Time `json:"eta,omitempty"`
+	Basis       string     `json:"basis,omitempty"`  // what the estimate rests on
+	Reason      string     `json:"reason,omitempty"` // why there's no estimate
+}
+
+// Prediction is how long until the fridge is cold and the battery is flat
+type Prediction struct {
+	TimeToTarget Estimate `json:"timeToTarget"`
+	Runtime      Estimate `json:"runtime"`      // until the input drops to the cutoff
+	CutoffVolts  float64  `json:"cutoffVolts"`  // for the fridge's HLvl
+	RestingVolts float64  `json:"restingVolts"` // fitted input voltage with the compressor resting
+	DrainPerHour float64  `json:"drainPerHour"` // volts an hour, negative while draining
+}
+
+// Predictor keeps the temperature of the current compressor run and the
+// resting input voltage to fit trends to. A nil Predictor predicts nothing.
+type Predictor struct {
+	mu      sync.Mutex
+	cutoffs CutoffVolts
+	report  k25.StatusReport
+	running bool
+	cooling []trendPoint // degrees C since the run started
+	resting []trendPoint // volts while the compressor rests
+	sag     float64      // input sag under the compressor, from the last run
+	last    time.Time
+}
+
+// trendPoint is one reading to fit a trend to
+type trendPoint struct {
+	at    time.Time
+	value float64
+}
+
+func newPredictor(cutoffs CutoffVolts) *Predictor {
+	return &Predictor{cutoffs: cutoffs}
+}
+
+// fitTrend is the least squares line through readings against hours since
+// at, with the standard error of its slope
+func fitTrend(readings []trendPoint, at time.Time) (value, slope, se float64) {
+	n := float64(len(readings))
+	var sx, sy float64
+	for _, r := range readings {
+		sx += r.at.Sub(at).Hours()
+		sy += r.value
+	}
+	mx, my := sx/n, sy/n
+	var sxx, sxy float64
+	for _, r := range readings {
+		dx := r.at.Sub(at).Hours() - mx
+		sxx += dx * dx
+		sxy += dx * (r.value - my)
+	}
+	if sxx == 0 {
+		return my, 0, math.Inf(1)
+	}
+	slope = sxy / sxx
+	var ssr float64
+	for _, r := range readings {
+		d := r.value - (my + slope*(r.at.Sub(at).Hours()-mx))
+		ssr += d * d
+	}
+	if n > 2 {
+		se = math.Sqrt(ssr / (n - 2) / sxx)
+	}
+	return my - slope*mx, slope, se
+}
+
+// Observe takes a status report and the compressor's inferred state
+func (p *Predictor) Observe(r k25.StatusReport, comp CompressorState, at time.Time) {
+	if p == nil || r.Settings == initialFridgeSettings {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	temp, _ := reportCelsius(r)
+	running := comp.Running && r.On
+	if running != p.running || r.TempSet != p.report.TempSet || r.CelsiusFahrenheitModeMenuE5 != p.report.CelsiusFahrenheitModeMenuE5 {
+		p.cooling = nil
+	}
+	if running {
+		p.cooling = append(p.cooling, trendPoint{at: at, value: temp})
+		if comp.VoltageSag > 0 {
+			p.sag = comp.VoltageSag
+		}
+	} else if r.On {
+		p.resting = append(p.resting, trendPoint{at: at, value: inputVoltage(r.Sensors)})
+	}
+	p.cooling = trimReadings(p.cooling, at, predictCoolWindow)
+	p.resting = trimReadings(p.resting, at, predictVoltWindow)
+	p.report, p.running, p.last = r, running, at
+}
+
+// trimReadings drops readings older than window
+func trimReadings(readings []trendPoint, at time.Time, window time.Duration) []trendPoint {
+	cut := 0
+	for cut < len(readings) && at.Sub(readings[cut].at) > window {
+		cut++
+	}
+	return readings[cut:]
+}
+
+// estimate turns a distance and a rate with its 95% bounds into durations
+func estimate(distance, rate, low, high float64, basis string, at time.Time) Estimate {
+	e := Estimate{Known: true, Basis: basis}
+	e.Seconds = distance / rate * 3600
+	e.LowSeconds = distance / high * 3600
+	if low > 0 {
+		s := math.Round(distance / low * 3600)
+		e.HighSeconds = &s
+	}
+	e.Seconds, e.LowSeconds = math.Round(e.Seconds), math.Round(e.LowSeconds)
+	eta := at.Add(time.Duration(e.Seconds) * time.Second)
+	e.ETA = &eta
+	return e
+}
+
+// Predict estimates as of at, falling back on a learned pull-down rate in
+// degrees C a minute when the current run is too short to fit
+func (p *Predictor) Predict(baseline float64, at time.Time) Prediction {
+	if p == nil {
+		return Prediction{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, r := Prediction{}, p.report
+	if p.last.IsZero() {
+		pr.TimeToTarget.Reason, pr.Runtime.Reason = "no status report yet", "no status report yet"
+		return pr
+	}
+	if !r.On {
+		pr.TimeToTarget.Reason, pr.Runtime.Reason = "fridge is off", "fridge is off"
+		return pr
+	}
+	temp, set := reportCelsius(r)
+	band := float64(r.HysteresisMenuE3)
+	if r.CelsiusFahrenheitModeMenuE5 {
+		band /= 1.8
+	}
+
+	// Time to target
+	n := len(p.cooling)
+	switch {
+	case temp <= set || (!p.running && temp < set+band):
+		pr.TimeToTarget = Estimate{Known: true, Basis: "at the setpoint"}
+		pr.TimeToTarget.ETA = &at
+	case p.running && n > 2 && p.cooling[n-1].at.Sub(p.cooling[0].at) >= predictCoolMin:
+		value, slope, se := fitTrend(p.cooling, at)
+		if slope >= 0 {
+			pr.TimeToTarget.Reason = "not cooling down"
+			break
+		}
+		// The fit can run past the setpoint before the rounded reading does
+		if value <= set {
+			pr.TimeToTarget = Estimate{Known: true, Basis: "at the setpoint"}
+			pr.TimeToTarget.ETA = &at
+			break
+		}
+		pr.TimeToTarget = estimate(value-set, -slope, -slope-2*se, -slope+2*se, "current run", at)
+	case baseline > 0:
+		rate := baseline * 60
+		pr.TimeToTarget = estimate(temp-set, rate, rate*(1-predictBaselineSpread), rate*(1+predictBaselineSpread), "learned pull-down rate", at)
+	default:
+		pr.TimeToTarget.Reason = "not enough cooling seen yet"
+	}
+
+	// Runtime, from the resting voltage, less the sag the compressor adds
+	pr.CutoffVolts = p.cutoffs[0]
+	if r.HLvl >= 0 && int(r.HLvl) < len(p.cutoffs) {
+		pr.CutoffVolts = p.cutoffs[r.HLvl]
+	}
+	if n := len(p.resting); n < 3 || p.resting[n-1].at.Sub(p.resting[0].at) < predictVoltMin {
+		pr.Runtime.Reason = "not enough resting voltage seen yet"
+		return pr
+	}
+	value, slope, se := fitTrend(p.resting, at)
+	pr.RestingVolts, pr.DrainPerHour = round2(value), round2(slope)
+	cutoff := pr.CutoffVolts + p.sag
+	switch {
+	case value <= cutoff:
+		pr.Runtime = Estimate{Known: true, Basis: "at the cutoff"}
+		pr.Runtime.ETA = &at
+	case slope >= 0:
+		pr.Runtime.Reason = "battery isn't draining"
+	default:
+		pr.Runtime = estimate(value-cutoff, -slope, -slope-2*se, -slope+2*se, "resting voltage trend", at)
+	}
+	return pr
+}
+
+// Baseline is the learned pull-down rate in degrees C a minute for the
+// conditions right now, 0 if there isn't one yet
+func (c *Cooling) Baseline() float64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.baselines[c.bucket()]; ok && b.Learned {
+		return b.Rate
+	}
+	return 0
+}
+
+// Predict estimates time to target and battery runtime right now
+func (f *Fridge) Predict() Prediction {
+	return f.predictor.Predict(f.cooling.Baseline(), time.Now())
+}
+
+func handlePredictions(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireStatus(w, f); !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, f.Predict())
+	}
+}
+
+// registerPredictions adds the predictions endpoint to mux
+func registerPredictions(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/predictions", methods(handlePredictions(f), http.MethodGet))
+}
+
+// hkPredictions is the "Fridge Predictions" service, in minutes with -1 for
+// unknown or unbounded
+type hkPredictions struct {
+	*service.Service
+	TimeToTarget, TimeToTargetLow, TimeToTargetHigh *characteristic.Float
+	Runtime, RuntimeLow, RuntimeHigh                *characteristic.Float
+}
+
+func newHKPredictions() *hkPredictions {
+	s := &hkPredictions{Service: service.New(TypeFridgePredictions)}
+	n := characteristic.NewName()
+	n.SetValue("Fridge Predictions")
+	s.AddCharacteristic(n.Characteristic)
+
+	minutes := func(typ, description string) *characteristic.Float {
+		c := characteristic.NewFloat(typ)
+		c.Format = characteristic.FormatFloat
+		c.Perms = characteristic.PermsRead()
+		c.Description = description
+		c.SetMinValue(-1)
+		c.SetMaxValue(1000000)
+		c.SetStepValue(1)
+		c.SetValue(-1)
+		s.AddCharacteristic(c.Characteristic)
+		return c
+	}
+	s.TimeToTarget = minutes(TypeTimeToTarget, "Minutes to target")
+	s.TimeToTargetLow = minutes(TypeTimeToTargetLow, "Minutes to target, at least")
+	s.TimeToTargetHigh = minutes(TypeTimeToTargetHigh, "Minutes to target, at most")
+	s.Runtime = minutes(TypeRuntime, "Battery minutes left")
+	s.RuntimeLow = minutes(TypeRuntimeLow, "Battery minutes left, at least")
+	s.RuntimeHigh = minutes(TypeRuntimeHigh, "Battery minutes left, at most")
+	return s
+}
+
+// set shows the prediction
+func (s *hkPredictions) set(p Prediction, push *hkPusher) {
+	minutes := func(e Estimate) (float64, float64, float64) {
+		if !e.Known {
+			return -1, -1, -1
+		}
+		high := -1.0
+		if e.HighSeconds != nil {
+			high = math.Round(*e.HighSeconds / 60)
+		}
+		return math.Round(e.Seconds / 60), math.Round(e.LowSeconds / 60), high
+	}
+	v, low, high := minutes(p.TimeToTarget)
+	push.Float("to target", v, s.TimeToTarget)
+	push.Float("to target low", low, s.TimeToTargetLow)
+	push.Float("to target high", high, s.TimeToTargetHigh)
+	v, low, high = minutes(p.Runtime)
+	push.Float("runtime", v, s.Runtime)
+	push.Float("runtime low", low, s.RuntimeLow)
+	push.Float("runtime high", high, s.RuntimeHigh)
+}
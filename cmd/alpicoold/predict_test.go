@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCutoffVolts(t *testing.T) {
+	c, err := parseCutoffVolts("h:11.3, M:10.1,l:9.6")
+	if err != nil || c != (CutoffVolts{11.3, 10.1, 9.6}) {
+		t.Fatalf("Bad cutoff volts %v %v", c, err)
+	}
+	for _, bad := range []string{"", "h:11.3,m:10.1", "h:11.3,m:10.1,l:x", "h:11.3,m:10.1,x:9", "hi:11.3,m:10.1,l:9.6"} {
+		if _, err := parseCutoffVolts(bad); err == nil {
+			t.Fatalf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestPredictTimeToTarget(t *testing.T) {
+	p := newPredictor(CutoffVolts{11.3, 10.1, 9.6})
+	at := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	r := testStatusReport // F, set 37
+	r.EcoMode = false
+	if e := p.Predict(0, at).TimeToTarget; e.Known || e.Reason != "no status report yet" {
+		t.Fatalf("Nothing to go on yet, got %+v", e)
+	}
+
+	// Warm drinks in, cooling 0.5°F a minute
+	running := CompressorState{Running: true, VoltageSag: 0.4}
+	feed := func(minutes int, from float64) {
+		for s := 0; s < minutes*60; s += 20 {
+			r.Temp = int8(math.Round(from - 0.5*float64(s)/60))
+			p.Observe(r, running, at)
+			at = at.Add(20 * time.Second)
+		}
+	}
+	feed(2, 50)
+	if e := p.Predict(0, at).TimeToTarget; e.Known || e.Reason != "not enough cooling seen yet" {
+		t.Fatalf("Too early to tell, got %+v", e)
+	}
+	// A learned rate of 0.25°C a minute fills in
+	e := p.Predict(0.25, at).TimeToTarget
+	if !e.Known || e.Basis != "learned pull-down rate" || e.HighSeconds == nil || e.LowSeconds >= e.Seconds || *e.HighSeconds <= e.Seconds {
+		t.Fatalf("Expected a learned estimate, got %+v", e)
+	}
+
+	feed(8, 49)
+	e = p.Predict(0.25, at).TimeToTarget
+	// 45°F is 8°F or 16 minutes from the setpoint
+	if !e.Known || e.Basis != "current run" || math.Abs(e.Seconds-16*60) > 120 {
+		t.Fatalf("Expected about 16 minutes, got %+v", e)
+	}
+	if e.HighSeconds == nil || e.LowSeconds > e.Seconds || *e.HighSeconds < e.Seconds || !e.ETA.Equal(at.Add(time.Duration(e.Seconds)*time.Second)) {
+		t.Fatalf("Bad bounds %+v", e)
+	}
+
+	// The fitted trend passes the setpoint before the rounded reading does
+	if e := p.Predict(0.25, at.Add(20*time.Minute)).TimeToTarget; !e.Known || e.Seconds != 0 || e.Basis != "at the setpoint" || !e.ETA.Equal(at.Add(20*time.Minute)) {
+		t.Fatalf("Expected the target reached, got %+v", e)
+	}
+
+	// Resting in the band is cold enough
+	r.Temp = 39
+	p.Observe(r, CompressorState{}, at)
+	if e := p.Predict(0.25, at).TimeToTarget; !e.Known || e.Seconds != 0 {
+		t.Fatalf("Expected the target reached, got %+v", e)
+	}
+	r.On = false
+	p.Observe(r, CompressorState{}, at)
+	if e := p.Predict(0.25, at).Runtime; e.Known || e.Reason != "fridge is off" {
+		t.Fatalf("Nothing to predict while off, got %+v", e)
+	}
+}
+
+func TestPredictRuntime(t *testing.T) {
+	p := newPredictor(CutoffVolts{11.3, 10.1, 9.6})
+	at := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	r := testStatusReport // HLvl 1 is M
+	r.Temp = 38
+
+	// Draining 0.1V an hour, sagging 0.4V whenever the compressor runs
+	feed := func(hours float64, from, perHour float64) {
+		for s := 0; s < int(hours*3600); s += 30 {
+			volts := from + perHour*float64(s)/3600
+			comp := CompressorState{}
+			if s%900 >= 600 {
+				comp = CompressorState{Running: true, VoltageSag: 0.4}
+				volts -= 0.4
+			}
+			r.InputV1, r.InputV2 = int8(volts), int8(math.Round((volts-math.Floor(volts))*10))
+			if r.InputV2 == 10 {
+				r.InputV1, r.InputV2 = r.InputV1+1, 0
+			}
+			p.Observe(r, comp, at)
+			at = at.Add(30 * time.Second)
+		}
+	}
+	feed(0.25, 12.6, -0.1)
+	if e := p.Predict(0, at).Runtime; e.Known || e.Reason != "not enough resting voltage seen yet" {
+		t.Fatalf("Too early to tell, got %+v", e)
+	}
+	feed(2.75, 12.6, -0.1)
+	pr := p.Predict(0, at)
+	// About 12.3V resting, 10.1V cutoff plus 0.4V sag, 18 hours at 0.1V an hour
+	e := pr.Runtime
+	if !e.Known || e.Basis != "resting voltage trend" || math.Abs(e.Seconds/3600-18) > 3 || pr.CutoffVolts != 10.1 {
+		t.Fatalf("Expected about 18 hours, got %+v %+v", e, pr)
+	}
+	if e.LowSeconds > e.Seconds || (e.HighSeconds != nil && *e.HighSeconds < e.Seconds) {
+		t.Fatalf("Bad bounds %+v", e)
+	}
+
+	// Charging
+	feed(3, 12.3, 0.2)
+	if e := p.Predict(0, at).Runtime; e.Known || e.Reason != "battery isn't draining" {
+		t.Fatalf("Expected no drain, got %+v", e)
+	}
+}
+
+func TestPredictionsHTTP(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	f.predictor = newPredictor(CutoffVolts{11.3, 10.1, 9.6})
+	f.predictor.Observe(testStatusReport, CompressorState{}, time.Now())
+	mux := http.NewServeMux()
+	registerPredictions(mux, f)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/predictions", nil))
+	var p Prediction
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != http.StatusOK || !p.TimeToTarget.Known || p.Runtime.Known || p.CutoffVolts != 10.1 {
+		t.Fatalf("Bad predictions %d %s %v", rec.Code, rec.Body, err)
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// rulesTick re-evaluates rules between reports so time conditions still fire
+	rulesTick = 30 * time.Second
+	// ruleDefaultCooldown is used when a rule doesn't set one
+	ruleDefaultCooldown = 10 * time.Minute
+	// ruleTrendWindow is how far back voltage and temperature trends look
+	ruleTrendWindow = 30 * time.Minute
+
+	errNoRules = errors.New("No rules loaded")
+)
+
+// ruleVarTypes are the variables conditions can use
+var ruleVarTypes = map[string]exprType{
+	"reported":    exprBool,   // a status report has arrived
+	"temp":        exprNumber, // in the fridge's unit
+	"tempSet":     exprNumber,
+	"fahrenheit":  exprBool,
+	"on":          exprBool,
+	"eco":         exprBool,
+	"locked":      exprBool,
+	"hLvl":        exprNumber,
+	"e1":          exprNumber,
+	"e2":          exprNumber,
+	"e3":          exprNumber,
+	"e4":          exprNumber,
+	"e6":          exprNumber,
+	"e7":          exprNumber,
+	"e8":          exprNumber,
+	"e9":          exprNumber,
+	"inputV":      exprNumber,
+	"inputVTrend": exprNumber, // volts per hour over ruleTrendWindow
+	"tempTrend":   exprNumber, // degrees per hour over ruleTrendWindow
+	"connected":   exprBool,
+	"stale":       exprBool,
+	"ageSec":      exprNumber, // seconds since the last report
+	"hour":        exprNumber, // local time
+	"minute":      exprNumber,
+	"weekday":     exprNumber, // 0 is Sunday
+}
+
+// ruleDuration reads "10m" style durations from the config file
+type ruleDuration time.Duration
+
+func (d *ruleDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Durations look like \"90s\" or \"10m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ruleDuration(parsed)
+	return nil
+}
+
+func (d ruleDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RuleAlert is an alert action
+type RuleAlert struct {
+	Level   string `json:"level"` // info, warn or error
+	Message string `json:"message"`
+}
+
+// RuleAction is one thing a rule does when it fires
+type RuleAction struct {
+	Settings map[string]json.RawMessage `json:"settings,omitempty"` // partial settings, like PATCH /settings
+	Alert    *RuleAlert                 `json:"alert,omitempty"`
+	Snapshot bool                       `json:"snapshot,omitempty"`
+}
+
+// Rule is one user-defined automation from the rules file
+type Rule struct {
+	Name     string       `json:"name"`
+	When     string       `json:"when"`
+	Priority int          `json:"priority"`        // higher wins conflicting settings
+	Class    string       `json:"class,omitempty"` // arbiter priority, schedule unless set
+	Cooldown ruleDuration `json:"cooldown"`        // 0 uses ruleDefaultCooldown
+	Disabled bool         `json:"disabled,omitempty"`
+	Actions  []RuleAction `json:"actions"`
+
+	expr   *Expr
+	source Source
+}
+
+// rulesFile is the layout of the rules config file
+type rulesFile struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// loadRules reads and checks path, a missing file means no rules
+func loadRules(path string) ([]*Rule, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseRules(b)
+}
+
+// parseRules decodes the rules file and compiles every condition
+func parseRules(b []byte) ([]*Rule, error) {
+	var file rulesFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("Bad rules file: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, r := range file.Rules {
+		if r == nil || r.Name == "" {
+			return nil, fmt.Errorf("Rule %d has no name", i+1)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("Rule %q is defined twice", r.Name)
+		}
+		seen[r.Name] = true
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("Rule %q: %w", r.Name, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+// compile checks the condition and actions
+func (r *Rule) compile() error {
+	expr, err := compileExpr(r.When, ruleVarTypes)
+	if err != nil {
+		return fmt.Errorf("when: %w", err)
+	}
+	if expr.root.typ != exprBool {
+		return fmt.Errorf("when must be true or false, not a number")
+	}
+	r.expr = expr
+	r.source = Source{Name: "rules/" + r.Name, Priority: prioritySchedule}
+	if r.Class != "" {
+		if r.source.Priority, err = parsePriority(r.Class); err != nil {
+			return fmt.Errorf("class: %w", err)
+		}
+	}
+	if r.Cooldown < 0 {
+		return errors.New("cooldown can't be negative")
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	for i, a := range r.Actions {
+		if len(a.Settings) == 0 && a.Alert == nil && !a.Snapshot {
+			return fmt.Errorf("action %d does nothing", i+1)
+		}
+		if len(a.Settings) > 0 {
+			if _, err := applySettingsPatch(k25.Settings{}, a.Settings); err != nil {
+				return fmt.Errorf("action %d: %w", i+1, err)
+			}
+		}
+		if a.Alert != nil {
+			switch a.Alert.Level {
+			case "":
+				a.Alert.Level = "info"
+			case "info", "warn", "error":
+			default:
+				return fmt.Errorf("action %d: alert level must be info, warn or error", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Rule) cooldown() time.Duration {
+	if r.Cooldown == 0 {
+		return ruleDefaultCooldown
+	}
+	return time.Duration(r.Cooldown)
+}
+
+// trend is the change per hour of value over samples, 0 without enough data
+func trend(samples []Sample, value func(Sample) float64) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	hours := last.Time.Sub(first.Time).Hours()
+	if hours < 5.0/60 {
+		return 0
+	}
+	return (value(last) - value(first)) / hours
+}
+
+// ruleVars collects everything a condition can look at
+func ruleVars(r k25.StatusReport, connected bool, fresh Freshness, samples []Sample, now time.Time) exprVars {
+	num := func(v float64) exprValue { return exprValue{num: v} }
+	flag := func(b bool) exprValue { return exprValue{b: b} }
+	s := r.Settings
+	return exprVars{
+		"reported":    flag(s != initialFridgeSettings),
+		"temp":        num(float64(r.Temp)),
+		"tempSet":     num(float64(s.TempSet)),
+		"fahrenheit":  flag(s.CelsiusFahrenheitModeMenuE5),
+		"on":          flag(s.On),
+		"eco":         flag(s.EcoMode),
+		"locked":      flag(s.Locked),
+		"hLvl":        num(float64(s.HLvl)),
+		"e1":          num(float64(s.LowestTempSettingMenuE1)),
+		"e2":          num(float64(s.HighestTempSettingMenuE2)),
+		"e3":          num(float64(s.HysteresisMenuE3)),
+		"e4":          num(float64(s.SoftStartDelayMinMenuE4)),
+		"e6":          num(float64(s.TempCompGTEMinus6DegCelsiusMenuE6)),
+		"e7":          num(float64(s.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7)),
+		"e8":          num(float64(s.TempCompLTMinus12DegCelsiusMenuE8)),
+		"e9":          num(float64(s.TempCompShutdownMenuE9)),
+		"inputV":      num(inputVoltage(r.Sensors)),
+		"inputVTrend": num(trend(samples, func(s Sample) float64 { return s.InputVoltage })),
+		"tempTrend":   num(trend(samples, func(s Sample) float64 { return float64(s.Temp) })),
+		"connected":   flag(connected),
+		"stale":       flag(fresh.Stale),
+		"ageSec":      num(fresh.AgeSeconds),
+		"hour":        num(float64(now.Hour())),
+		"minute":      num(float64(now.Minute())),
+		"weekday":     num(float64(now.Weekday())),
+	}
+}
+
+// RuleResult explains one rule against the current state
+type RuleResult struct {
+	Name       string                     `json:"name"`
+	Priority   int                        `json:"priority"`
+	Source     Source                     `json:"source"`
+	Matched    bool                       `json:"matched"`
+	Fire       bool                       `json:"fire"`
+	Reason     string                     `json:"reason"`
+	Explain    string                     `json:"explain"`
+	LastFired  *time.Time                 `json:"lastFired,omitempty"`
+	CooldownTo *time.Time                 `json:"cooldownUntil,omitempty"`
+	Actions    []RuleAction               `json:"actions"`
+	Overridden []string                   `json:"overridden,omitempty"` // settings a higher priority rule owns
+	Settings   map[string]json.RawMessage `json:"settings,omitempty"`   // what this rule would send
+	Blocked    string                     `json:"blocked,omitempty"`    // an arbiter hold in the way
+}
+
+// RuleEvaluation is every rule's result, highest priority first
+type RuleEvaluation struct {
+	Time     time.Time                  `json:"time"`
+	Vars     map[string]interface{}     `json:"vars"`
+	Results  []RuleResult               `json:"results"`
+	Settings map[string]json.RawMessage `json:"settings,omitempty"` // the combined change firing rules would make
+}
+
+// RuleEngine holds the loaded rules and when each last fired
+type RuleEngine struct {
+	mu    sync.Mutex
+	rules []*Rule // highest priority first, file order for ties
+	fired map[string]time.Time
+}
+
+func newRuleEngine(rules []*Rule) *RuleEngine {
+	sorted := append([]*Rule{}, rules...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+	return &RuleEngine{rules: sorted, fired: map[string]time.Time{}}
+}
+
+// evaluate works out which rules fire against vars at now, without acting
+func (e *RuleEngine) evaluate(vars exprVars, now time.Time) RuleEvaluation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := RuleEvaluation{Time: now, Vars: map[string]interface{}{}, Results: []RuleResult{}}
+	for name, t := range ruleVarTypes {
+		if t == exprBool {
+			out.Vars[name] = vars[name].b
+		} else {
+			out.Vars[name] = vars[name].num
+		}
+	}
+
+	owner := map[string]string{}
+	for _, r := range e.rules {
+		res := RuleResult{Name: r.Name, Priority: r.Priority, Source: r.source, Actions: r.Actions, Explain: r.expr.Explain(vars)}
+		if last, ok := e.fired[r.Name]; ok {
+			until := last.Add(r.cooldown())
+			res.LastFired = &last
+			if now.Before(until) {
+				res.CooldownTo = &until
+			}
+		}
+		res.Matched = r.expr.Eval(vars)
+		switch {
+		case r.Disabled:
+			res.Reason = "disabled"
+		case !res.Matched:
+			res.Reason = "condition is false"
+		case res.CooldownTo != nil:
+			res.Reason = "cooling down until " + res.CooldownTo.Format(time.RFC3339)
+		case !vars["reported"].b:
+			// Until the fridge reports, every reading is a zero value
+			res.Reason = "waiting for the first status report"
+		default:
+			res.Fire = true
+			res.Reason = "would fire"
+		}
+		if res.Fire {
+			for _, a := range r.Actions {
+				for field, v := range a.Settings {
+					if o, taken := owner[field]; taken && o != r.Name {
+						res.Overridden = append(res.Overridden, field+" by "+o)
+						continue
+					}
+					owner[field] = r.Name
+					if out.Settings == nil {
+						out.Settings = map[string]json.RawMessage{}
+					}
+					if res.Settings == nil {
+						res.Settings = map[string]json.RawMessage{}
+					}
+					out.Settings[field] = v
+					res.Settings[field] = v
+				}
+			}
+			sort.Strings(res.Overridden)
+		}
+		out.Results = append(out.Results, res)
+	}
+	return out
+}
+
+// markFired starts the cooldown of every rule that fired in ev
+func (e *RuleEngine) markFired(ev RuleEvaluation) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, res := range ev.Results {
+		if res.Fire {
+			e.fired[res.Name] = ev.Time
+		}
+	}
+}
+
+// Rules lists the loaded rules, highest priority first
+func (e *RuleEngine) Rules() []*Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Rule{}, e.rules...)
+}
+
+// currentRuleVars reads the fridge's state for the rules
+func (f *Fridge) currentRuleVars(now time.Time) exprVars {
+	return ruleVars(f.GetStatusReport(), f.Connected(), f.Freshness(), f.history.Since(now.Add(-ruleTrendWindow)), now)
+}
+
+// runRules evaluates the rules and carries out the ones that fire
+func (f *Fridge) runRules(ctx context.Context, e *RuleEngine, now time.Time) RuleEvaluation {
+	ev := e.evaluate(f.currentRuleVars(now), now)
+	e.markFired(ev)
+
+	for _, res := range ev.Results {
+		if !res.Fire {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"client": "RulesClient",
+			"rule":   res.Name,
+		}).Info("Rule fired")
+		for _, a := range res.Actions {
+			if a.Alert != nil {
+				f.Alert(a.Alert.Level, "rules/"+res.Name, a.Alert.Message)
+			}
+			if a.Snapshot {
+				if f.snapshots == nil {
+					log.WithFields(log.Fields{"client": "RulesClient", "rule": res.Name}).Warn("Snapshot action without a camera")
+					continue
+				}
+				go func(name string) {
+					if _, err := f.snapshots.Capture(snapshotRule); err != nil {
+						log.WithFields(log.Fields{"client": "RulesClient", "rule": name, "err": err}).Warn("Snapshot failed")
+					}
+				}(res.Name)
+			}
+		}
+	}
+
+	// Each rule sends its own settings so the arbiter sees who asked
+	for _, res := range ev.Results {
+		if !res.Fire || len(res.Settings) == 0 {
+			continue
+		}
+		var patchErr error
+		cctx, cancel := context.WithTimeout(ctx, commandTimeout)
+		_, err := f.UpdateSettings(cctx, Command{Source: res.Source}, func(s *k25.Settings) {
+			next, err := applySettingsPatch(*s, res.Settings)
+			if err != nil {
+				patchErr = err
+				return
+			}
+			*s = next
+		})
+		cancel()
+		if patchErr != nil {
+			err = patchErr
+		}
+		log := log.WithFields(log.Fields{
+			"client": "RulesClient",
+			"rule":   res.Name,
+			"err":    err,
+		})
+		var conflict *ConflictError
+		switch {
+		case errors.As(err, &conflict):
+			log.Info("Rule settings held off")
+		case err != nil:
+			log.Warn("Rule settings change failed")
+			f.diag.Error("rules", err)
+		}
+	}
+	return ev
+}
+
+// explainHolds notes firing rules whose settings an arbiter hold would turn away
+func (f *Fridge) explainHolds(ev *RuleEvaluation) {
+	current := f.GetStatusReport().Settings
+	for i, res := range ev.Results {
+		if !res.Fire || len(res.Settings) == 0 {
+			continue
+		}
+		next, err := applySettingsPatch(current, res.Settings)
+		if err != nil {
+			continue
+		}
+		if err := f.arbiter.Check(Command{Source: res.Source}, changedSettings(current, next)); err != nil {
+			ev.Results[i].Blocked = err.Error()
+		}
+	}
+}
+
+// RulesClient evaluates rules on every fridge event and every rulesTick
+func RulesClient(ctx context.Context, wg *sync.WaitGroup, f *Fridge, e *RuleEngine) {
+	wg.Add(1)
+	defer func() {
+		log.WithFields(log.Fields{
+			"client": "RulesClient",
+		}).Trace("Calling done on main wait group")
+		wg.Done()
+	}()
+	sub := f.hub.Subscribe(16)
+	defer sub.Close()
+	ticker := time.NewTicker(rulesTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			f.runRules(ctx, e, now)
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			switch ev.Kind {
+			case eventStatus, eventConnection, eventStale:
+				f.runRules(ctx, e, ev.Time)
+			}
+		}
+	}
+}
+
+func handleRules(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.rules == nil {
+			writeError(w, http.StatusNotFound, errNoRules)
+			return
+		}
+		writeJSON(w, http.StatusOK, f.rules.Rules())
+	}
+}
+
+// handleRulesDryRun explains which rules would fire right now, without
+// firing them. GET uses the loaded rules, POST tries a rules file in the body.
+func handleRulesDryRun(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := f.rules
+		if r.Method == http.MethodPost {
+			var file json.RawMessage
+			if err := decodeBody(w, r, &file); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			rules, err := parseRules(file)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			e = newRuleEngine(rules)
+		}
+		if e == nil {
+			writeError(w, http.StatusNotFound, errNoRules)
+			return
+		}
+		now := time.Now()
+		ev := e.evaluate(f.currentRuleVars(now), now)
+		f.explainHolds(&ev)
+		writeJSON(w, http.StatusOK, ev)
+	}
+}
+
+// registerRules adds the rules endpoints to mux
+func registerRules(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/rules", methods(handleRules(f), http.MethodGet))
+	mux.HandleFunc("/rules/dry-run", methods(handleRulesDryRun(f), http.MethodGet, http.MethodPost))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+const testRules = `{"rules": [
+	{"name": "low-battery", "when": "inputV < 13 && on", "priority": 10, "cooldown": "1m",
+	 "actions": [{"settings": {"EcoMode": true, "HLvl": 0}}, {"alert": {"level": "warn", "message": "Battery low"}}]},
+	{"name": "night", "when": "hour >= 0", "priority": 1,
+	 "actions": [{"settings": {"EcoMode": false, "Locked": true}}]},
+	{"name": "off", "when": "!on", "actions": [{"alert": {"message": "Fridge is off"}}]},
+	{"name": "later", "when": "true", "disabled": true, "actions": [{"snapshot": true}]}
+]}`
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 || rules[2].Actions[0].Alert.Level != "info" || rules[2].cooldown() != ruleDefaultCooldown {
+		t.Fatalf("Bad rules %+v", rules)
+	}
+
+	for _, bad := range []string{
+		`{"rules": [{"when": "on", "actions": [{"snapshot": true}]}]}`,
+		`{"rules": [{"name": "a", "when": "on", "actions": [{"snapshot": true}]}, {"name": "a", "when": "on", "actions": [{"snapshot": true}]}]}`,
+		`{"rules": [{"name": "a", "when": "inputV", "actions": [{"snapshot": true}]}]}`,
+		`{"rules": [{"name": "a", "when": "volts < 3", "actions": [{"snapshot": true}]}]}`,
+		`{"rules": [{"name": "a", "when": "on", "actions": []}]}`,
+		`{"rules": [{"name": "a", "when": "on", "actions": [{}]}]}`,
+		`{"rules": [{"name": "a", "when": "on", "actions": [{"settings": {"Nope": 1}}]}]}`,
+		`{"rules": [{"name": "a", "when": "on", "actions": [{"alert": {"level": "loud"}}]}]}`,
+		`{"rules": [{"name": "a", "when": "on", "cooldown": "soon", "actions": [{"snapshot": true}]}]}`,
+	} {
+		if _, err := parseRules([]byte(bad)); err == nil {
+			t.Fatalf("Expected an error for %s", bad)
+		}
+	}
+}
+
+func TestRuleEvaluate(t *testing.T) {
+	rules, err := parseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newRuleEngine(rules)
+	now := time.Date(2026, 10, 19, 22, 0, 0, 0, time.Local)
+	vars := ruleVars(testStatusReport, true, Freshness{}, nil, now)
+
+	ev := e.evaluate(vars, now)
+	byName := map[string]RuleResult{}
+	for _, r := range ev.Results {
+		byName[r.Name] = r
+	}
+	if ev.Results[0].Name != "low-battery" {
+		t.Fatalf("Highest priority should come first, got %s", ev.Results[0].Name)
+	}
+	if !byName["low-battery"].Fire || !byName["night"].Fire || byName["off"].Fire || byName["later"].Fire {
+		t.Fatalf("Wrong rules fire %+v", ev.Results)
+	}
+	if byName["later"].Reason != "disabled" || byName["off"].Reason != "condition is false" {
+		t.Fatalf("Bad reasons %+v", ev.Results)
+	}
+	if o := byName["night"].Overridden; len(o) != 1 || o[0] != "EcoMode by low-battery" {
+		t.Fatalf("Expected EcoMode overridden, got %v", o)
+	}
+	if string(ev.Settings["EcoMode"]) != "true" || string(ev.Settings["Locked"]) != "true" || string(ev.Settings["HLvl"]) != "0" {
+		t.Fatalf("Bad combined settings %s", ev.Settings)
+	}
+
+	// Cooldowns
+	e.markFired(ev)
+	ev = e.evaluate(vars, now.Add(30*time.Second))
+	if ev.Results[0].Fire || !strings.HasPrefix(ev.Results[0].Reason, "cooling down") {
+		t.Fatalf("Expected low-battery cooling down, got %+v", ev.Results[0])
+	}
+	if ev = e.evaluate(vars, now.Add(time.Minute)); !ev.Results[0].Fire {
+		t.Fatal("Cooldown should be over")
+	}
+
+	// Trends
+	start := now.Add(-time.Hour)
+	samples := []Sample{{Time: start, InputVoltage: 13, Temp: 40}, {Time: now, InputVoltage: 12.5, Temp: 38}}
+	vars = ruleVars(testStatusReport, true, Freshness{}, samples, now)
+	if vars["inputVTrend"].num != -0.5 || vars["tempTrend"].num != -2 {
+		t.Fatalf("Bad trends %v %v", vars["inputVTrend"], vars["tempTrend"])
+	}
+}
+
+func TestRunRules(t *testing.T) {
+	rules, err := parseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newRuleEngine(rules)
+	f := newTestFridge(testStatusReport)
+	sub := f.hub.Subscribe(8)
+	defer sub.Close()
+
+	// Each rule sends its own change, highest priority first
+	sent := make(chan k25.Settings, 2)
+	go func() {
+		sent <- (<-f.settingsC).Settings
+		sent <- (<-f.settingsC).Settings
+	}()
+	f.runRules(context.Background(), e, time.Now())
+
+	if s := <-sent; !s.EcoMode || s.Locked || s.HLvl != 0 || !s.On {
+		t.Fatalf("Bad settings from low-battery %+v", s)
+	}
+	if s := <-sent; !s.EcoMode || !s.Locked || s.HLvl != 1 {
+		t.Fatalf("Bad settings from night %+v", s)
+	}
+	alert := (<-sub.C).Data.(Alert)
+	if alert.Source != "rules/low-battery" || alert.Level != "warn" {
+		t.Fatalf("Bad alert %+v", alert)
+	}
+
+	// Nothing fires again inside the cooldown, so nothing is sent
+	ev := f.runRules(context.Background(), e, time.Now())
+	if ev.Results[0].Fire || len(sub.C) != 0 {
+		t.Fatal("Rule fired during its cooldown")
+	}
+
+	// Zero values before the first report don't fire anything
+	rules, err = parseRules([]byte(`{"rules": [{"name": "flat", "when": "inputV < 11.8", "actions": [{"alert": {"level": "warn", "message": "flat"}}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = newTestFridge(k25.StatusReport{Settings: initialFridgeSettings})
+	e = newRuleEngine(rules)
+	ev = f.runRules(context.Background(), e, time.Now())
+	if res := ev.Results[0]; res.Fire || !res.Matched || res.Reason != "waiting for the first status report" {
+		t.Fatalf("Rule ran before the first report %+v", res)
+	}
+	if len(e.fired) != 0 {
+		t.Fatal("Rules marked fired before the first report")
+	}
+}
+
+func TestRulesDryRun(t *testing.T) {
+	rules, _ := parseRules([]byte(testRules))
+	f := newTestFridge(testStatusReport)
+	mux := http.NewServeMux()
+	registerRules(mux, f)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rules/dry-run", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without rules, got %d", rec.Code)
+	}
+
+	f.rules = newRuleEngine(rules)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rules/dry-run", nil))
+	var ev RuleEvaluation
+	if err := json.Unmarshal(rec.Body.Bytes(), &ev); err != nil || len(ev.Results) != 4 || !ev.Results[0].Fire {
+		t.Fatalf("Bad dry run %s %v", rec.Body, err)
+	}
+	if ev.Vars["inputV"] != 12.8 || ev.Results[0].Explain == "" {
+		t.Fatalf("Dry run should explain itself %s", rec.Body)
+	}
+	if len(f.rules.fired) != 0 {
+		t.Fatal("Dry run fired rules")
+	}
+
+	// Try rules before saving them
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rules/dry-run", strings.NewReader(`{"rules": [{"name": "hot", "when": "temp > 40", "actions": [{"snapshot": true}]}]}`)))
+	if err := json.Unmarshal(rec.Body.Bytes(), &ev); err != nil || len(ev.Results) != 1 || ev.Results[0].Fire {
+		t.Fatalf("Bad posted dry run %s %v", rec.Body, err)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rules/dry-run", strings.NewReader(`{"rules": [{"name": "hot", "when": "temp >", "actions": [{"snapshot": true}]}]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad rule, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+	log "github.com/sirupsen/logrus"
+)
+
+// Snapshot kinds, also the suffix of each file name
+const (
+	snapshotAlarm     = "alarm"     // Temperature went too far over the setpoint
+	snapshotPower     = "power"     // Fridge turned on or off
+	snapshotLid       = "lid"       // The lid detector saw the lid open
+	snapshotTimelapse = "timelapse" // Regular interval frame
+	snapshotRule      = "rule"      // Asked for by a rule
+)
+
+var (
+	// snapshotCooldown stops one flapping trigger from filling the disk
+	snapshotCooldown = 5 * time.Minute
+	// snapshotWidth and snapshotHeight are the stored frame size
+	snapshotWidth, snapshotHeight uint = 1280, 720
+
+	snapshotTimeFormat = "20060102T150405.000Z"
+	snapshotName       = regexp.MustCompile(`^(\d{8}T\d{6}\.\d{3}Z)-([a-z]+)\.jpg$`)
+	errNoSnapshots     = errors.New("Snapshots are off, enable the camera")
+	errBadSnapshot     = errors.New("No such snapshot")
+)
+
+// FrameSource takes pictures, the camera in production and a fake in tests
+type FrameSource interface {
+	Snapshot(width, height uint) (*image.Image, error)
+}
+
+// SnapshotSettings avoids lots of args to SnapshotClient
+type SnapshotSettings struct {
+	dir        string
+	timelapse  time.Duration // 0 disables timelapse frames
+	keepEvents int           // newest event snapshots kept
+	keepFrames int           // newest timelapse frames kept
+	maxAge     time.Duration // 0 keeps snapshots until the count limits remove them
+	alarmDelta int           // degrees over the setpoint in the fridge's unit, 0 disables
+}
+
+// SnapshotInfo describes one stored picture
+type SnapshotInfo struct {
+	Name string    `json:"name"`
+	Kind string    `json:"kind"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+	URL  string    `json:"url"`
+}
+
+// Snapshotter stores frames from src under settings.dir
+type Snapshotter struct {
+	settings SnapshotSettings
+	src      FrameSource
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+func newSnapshotter(settings SnapshotSettings, src FrameSource) (*Snapshotter, error) {
+	if err := os.MkdirAll(settings.dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Snapshotter{settings: settings, src: src, now: time.Now}, nil
+}
+
+// Capture takes and stores a frame, then applies retention
+func (s *Snapshotter) Capture(kind string) (SnapshotInfo, error) {
+	img, err := s.src.Snapshot(snapshotWidth, snapshotHeight)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if img == nil || *img == nil {
+		return SnapshotInfo{}, errors.New("Camera returned no frame")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at := s.now().UTC()
+	name := fmt.Sprintf("%s-%s.jpg", at.Format(snapshotTimeFormat), kind)
+	path := filepath.Join(s.settings.dir, name)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	err = jpeg.Encode(file, *img, &jpeg.Options{Quality: 85})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return SnapshotInfo{}, err
+	}
+	s.prune()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return snapshotInfo(name, at, kind, info.Size()), nil
+}
+
+func snapshotInfo(name string, at time.Time, kind string, size int64) SnapshotInfo {
+	return SnapshotInfo{Name: name, Kind: kind, Time: at, Size: size, URL: "/snapshots/" + name}
+}
+
+// list is every stored snapshot, newest first
+func (s *Snapshotter) list() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.settings.dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []SnapshotInfo{}
+	for _, e := range entries {
+		m := snapshotName.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		at, err := time.Parse(snapshotTimeFormat, m[1])
+		if err != nil {
+			continue
+		}
+		var size int64
+		if info, err := e.Info(); err == nil {
+			size = info.Size()
+		}
+		out = append(out, snapshotInfo(e.Name(), at, m[2], size))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	return out, nil
+}
+
+// prune removes snapshots past the age limit and beyond the count limits.
+// Timelapse frames and event snapshots are counted separately so a busy
+// timelapse can't push out the interesting pictures.
+func (s *Snapshotter) prune() {
+	all, err := s.list()
+	if err != nil {
+		return
+	}
+	now := s.now()
+	events, frames := 0, 0
+	for _, snap := range all {
+		old := s.settings.maxAge > 0 && now.Sub(snap.Time) > s.settings.maxAge
+		if snap.Kind == snapshotTimelapse {
+			frames++
+			old = old || (s.settings.keepFrames > 0 && frames > s.settings.keepFrames)
+		} else {
+			events++
+			old = old || (s.settings.keepEvents > 0 && events > s.settings.keepEvents)
+		}
+		if old {
+			os.Remove(filepath.Join(s.settings.dir, snap.Name))
+		}
+	}
+}
+
+// List filters stored snapshots by kind and time, newest first
+func (s *Snapshotter) List(kind string, since time.Time, limit int) ([]SnapshotInfo, error) {
+	all, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	out := []SnapshotInfo{}
+	for _, snap := range all {
+		if (kind != "" && snap.Kind != kind) || snap.Time.Before(since) {
+			continue
+		}
+		out = append(out, snap)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// snapshotTrigger turns status reports into reasons to take a picture
+type snapshotTrigger struct {
+	settings SnapshotSettings
+	prev     *k25.StatusReport
+	alarm    bool
+}
+
+// observe returns the snapshot kinds r calls for
+func (t *snapshotTrigger) observe(r k25.StatusReport) []string {
+	if r.Settings == initialFridgeSettings {
+		return nil
+	}
+	kinds := []string{}
+	if t.prev != nil && t.prev.On != r.On {
+		kinds = append(kinds, snapshotPower)
+	}
+
+	if t.settings.alarmDelta > 0 {
+		over := r.On && int(r.Temp)-int(r.TempSet) >= t.settings.alarmDelta
+		if over && !t.alarm {
+			kinds = append(kinds, snapshotAlarm)
+		}
+		t.alarm = over
+	}
+
+	t.prev = &r
+	return kinds
+}
+
+// SnapshotClient captures pictures on fridge events and on the timelapse interval
+func SnapshotClient(ctx context.Context, wg *sync.WaitGroup, f *Fridge, s *Snapshotter) {
+	wg.Add(1)
+	defer func() {
+		log.WithFields(log.Fields{
+			"client": "SnapshotClient",
+		}).Trace("Calling done on main wait group")
+		wg.Done()
+	}()
+	sub := f.hub.Subscribe(16)
+	defer sub.Close()
+
+	var timelapse <-chan time.Time
+	if s.settings.timelapse > 0 {
+		ticker := time.NewTicker(s.settings.timelapse)
+		defer ticker.Stop()
+		timelapse = ticker.C
+	}
+
+	trigger := &snapshotTrigger{settings: s.settings}
+	last := map[string]time.Time{}
+	capture := func(kind string) {
+		now := s.now()
+		if kind != snapshotTimelapse && now.Sub(last[kind]) < snapshotCooldown {
+			return
+		}
+		last[kind] = now
+		snap, err := s.Capture(kind)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client": "SnapshotClient",
+				"kind":   kind,
+				"err":    err,
+			}).Warn("Snapshot failed")
+			f.diag.Error("snapshots", err)
+			return
+		}
+		log.WithFields(log.Fields{
+			"client": "SnapshotClient",
+			"kind":   kind,
+			"name":   snap.Name,
+		}).Debug("Snapshot taken")
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timelapse:
+			capture(snapshotTimelapse)
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			// Lid pictures follow the lid detector, like HomeKit's contact sensor
+			if lid, ok := e.Data.(LidState); e.Kind == eventLid && ok && lid.Open {
+				capture(snapshotLid)
+				continue
+			}
+			r, isStatus := e.Data.(k25.StatusReport)
+			if e.Kind != eventStatus || !isStatus {
+				continue
+			}
+			for _, kind := range trigger.observe(r) {
+				capture(kind)
+			}
+		}
+	}
+}
+
+func handleSnapshots(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.snapshots == nil {
+			writeError(w, http.StatusNotFound, errNoSnapshots)
+			return
+		}
+		q := r.URL.Query()
+		limit := 100
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, errors.New("limit must be a positive number"))
+				return
+			}
+			limit = n
+		}
+		since := time.Time{}
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, errors.New("since must be an RFC 3339 time"))
+				return
+			}
+			since = t
+		}
+		list, err := f.snapshots.List(q.Get("kind"), since, limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+func handleSnapshot(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.snapshots == nil {
+			writeError(w, http.StatusNotFound, errNoSnapshots)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/snapshots/")
+		if !snapshotName.MatchString(name) {
+			writeError(w, http.StatusNotFound, errBadSnapshot)
+			return
+		}
+		path := filepath.Join(f.snapshots.settings.dir, name)
+		if _, err := os.Stat(path); err != nil {
+			writeError(w, http.StatusNotFound, errBadSnapshot)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		http.ServeFile(w, r, path)
+	}
+}
+
+// registerSnapshots adds the snapshot browsing endpoints to mux
+func registerSnapshots(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/snapshots", methods(handleSnapshots(f), http.MethodGet))
+	mux.HandleFunc("/snapshots/", methods(handleSnapshot(f), http.MethodGet, http.MethodHead))
+}
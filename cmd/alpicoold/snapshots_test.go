@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFrames hands out plain grey frames instead of running ffmpeg
+type fakeFrames struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+}
+
+func (f *fakeFrames) Snapshot(width, height uint) (*image.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	gray := image.NewGray(image.Rect(0, 0, int(width), int(height)))
+	for i := range gray.Pix {
+		gray.Pix[i] = 128
+	}
+	img := image.Image(gray)
+	return &img, nil
+}
+
+func (f *fakeFrames) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func newTestSnapshotter(t *testing.T, settings SnapshotSettings) (*Snapshotter, *fakeFrames, *time.Time) {
+	t.Helper()
+	settings.dir = t.TempDir()
+	frames := &fakeFrames{}
+	s, err := newSnapshotter(settings, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, frames, &now
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	s, frames, now := newTestSnapshotter(t, SnapshotSettings{keepEvents: 2, keepFrames: 3, maxAge: time.Hour})
+
+	for i := 0; i < 5; i++ {
+		if _, err := s.Capture(snapshotTimelapse); err != nil {
+			t.Fatal(err)
+		}
+		*now = now.Add(time.Minute)
+	}
+	for _, kind := range []string{snapshotPower, snapshotAlarm, snapshotLid} {
+		if _, err := s.Capture(kind); err != nil {
+			t.Fatal(err)
+		}
+		*now = now.Add(time.Minute)
+	}
+
+	frameList, _ := s.List(snapshotTimelapse, time.Time{}, 0)
+	if len(frameList) != 3 {
+		t.Fatalf("Expected 3 timelapse frames, got %d", len(frameList))
+	}
+	events, _ := s.List("", time.Time{}, 0)
+	if len(events) != 5 || events[0].Kind != snapshotLid || events[1].Kind != snapshotAlarm {
+		t.Fatalf("Expected newest 2 events and 3 frames, got %+v", events)
+	}
+
+	// The image is a real JPEG
+	file, err := os.Open(s.settings.dir + "/" + events[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := jpeg.Decode(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything ages out
+	*now = now.Add(2 * time.Hour)
+	if _, err := s.Capture(snapshotPower); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := s.List("", time.Time{}, 0); len(all) != 1 {
+		t.Fatalf("Expected old snapshots gone, got %d", len(all))
+	}
+
+	frames.err = errors.New("no camera")
+	if _, err := s.Capture(snapshotPower); err == nil {
+		t.Fatal("Expected the frame error")
+	}
+}
+
+func TestSnapshotTrigger(t *testing.T) {
+	trigger := &snapshotTrigger{settings: SnapshotSettings{alarmDelta: 5}}
+	r := testStatusReport // on, set 37, temp 39
+	step := func(temp int8, on bool) []string {
+		r.Temp, r.On = temp, on
+		return trigger.observe(r)
+	}
+
+	// Warming isn't a picture until it trips the alarm
+	for temp := int8(38); temp <= 41; temp++ {
+		if kinds := step(temp, true); len(kinds) != 0 {
+			t.Fatalf("Unexpected %v at %d", kinds, temp)
+		}
+	}
+	if kinds := step(42, true); len(kinds) != 1 || kinds[0] != snapshotAlarm {
+		t.Fatalf("Expected alarm, got %v", kinds)
+	}
+	if kinds := step(42, true); len(kinds) != 0 {
+		t.Fatalf("Alarm should fire once, got %v", kinds)
+	}
+	if kinds := step(38, false); len(kinds) != 1 || kinds[0] != snapshotPower {
+		t.Fatalf("Expected power, got %v", kinds)
+	}
+}
+
+func TestSnapshotClient(t *testing.T) {
+	s, frames, _ := newTestSnapshotter(t, SnapshotSettings{keepEvents: 10, timelapse: 20 * time.Millisecond})
+	s.now = time.Now
+	fridge := newTestFridge(testStatusReport)
+	fridge.snapshots = s
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	done := make(chan struct{})
+	go func() {
+		SnapshotClient(ctx, &wg, fridge, s)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for frames.Calls() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	off := testStatusReport
+	fridge.hub.Publish(eventStatus, testStatusReport)
+	off.On = false
+	fridge.hub.Publish(eventStatus, off)
+
+	// Lid pictures come from the lid detector's events
+	since := time.Now()
+	fridge.hub.Publish(eventLid, LidState{Open: false, Since: &since})
+	fridge.hub.Publish(eventLid, LidState{Open: true, Since: &since})
+
+	var power, lid []SnapshotInfo
+	for (len(power) == 0 || len(lid) == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		power, _ = s.List(snapshotPower, time.Time{}, 0)
+		lid, _ = s.List(snapshotLid, time.Time{}, 0)
+	}
+	cancel()
+	<-done
+	if len(power) != 1 {
+		t.Fatal("No power snapshot")
+	}
+	if len(lid) != 1 {
+		t.Fatalf("Expected one lid snapshot for the opening, got %d", len(lid))
+	}
+
+	// Browse over HTTP
+	mux := http.NewServeMux()
+	registerSnapshots(mux, fridge)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/snapshots?kind=power", nil))
+	var list []SnapshotInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 1 {
+		t.Fatalf("Bad list %s %v", rec.Body, err)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, list[0].URL, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Bad image response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, path := range []string{"/snapshots/passwd", "/snapshots/20260101T000000.000Z-power.jpg"} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("Expected 404 for %s, got %d", path, rec.Code)
+		}
+	}
+
+	// No camera, no snapshots
+	rec = httptest.NewRecorder()
+	mux = http.NewServeMux()
+	registerSnapshots(mux, newTestFridge(testStatusReport))
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/snapshots", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without a camera, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// staleAfter is how old the last status report can get before nobody should trust it
+var staleAfter = 30 * time.Second
+
+// validStaleAfter rejects ages too short for WatchStale's ticker
+func validStaleAfter(d time.Duration) error {
+	if d < time.Second {
+		return errors.New("STALE_AFTER_SEC must be at least 1 second")
+	}
+	return nil
+}
+
+// StaleChange is the payload of a stale event
+type StaleChange struct {
+	Stale      bool      `json:"stale"`
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+// Freshness says how much to trust the status report
+type Freshness struct {
+	LastUpdate *time.Time `json:"lastUpdate"`
+	AgeSeconds float64    `json:"ageSeconds"`
+	Stale      bool       `json:"stale"`
+}
+
+// Age is how long ago the last status report arrived, zero if none has
+func (f *Fridge) Age() time.Duration {
+	last := f.LastUpdate()
+	if last.IsZero() {
+		return 0
+	}
+	return time.Since(last)
+}
+
+// Stale is true once reports have stopped arriving for longer than staleAfter,
+// or none has arrived that long after connecting
+func (f *Fridge) Stale() bool {
+	f.mu.RLock()
+	last, connected, since := f.updated, f.connected, f.connectedAt
+	f.mu.RUnlock()
+	if last.IsZero() {
+		return connected && time.Since(since) > staleAfter
+	}
+	return time.Since(last) > staleAfter
+}
+
+// Freshness snapshots the report age for API responses
+func (f *Fridge) Freshness() Freshness {
+	last := f.LastUpdate()
+	if last.IsZero() {
+		return Freshness{Stale: f.Stale()}
+	}
+	age := time.Since(last)
+	return Freshness{
+		LastUpdate: &last,
+		AgeSeconds: age.Seconds(),
+		Stale:      age > staleAfter,
+	}
+}
+
+// requestResubscribe asks the bluetooth client to re-ping and re-subscribe,
+// unless it already has a request waiting
+func (f *Fridge) requestResubscribe() {
+	select {
+	case f.resubscribeC <- struct{}{}:
+	default:
+	}
+}
+
+// markFresh is called for every status report and clears the stale state
+func (f *Fridge) markFresh() {
+	f.mu.Lock()
+	was := f.stale
+	f.stale = false
+	last := f.updated
+	f.mu.Unlock()
+	if was {
+		f.Alert("info", "staleness", "Status reports resumed")
+		f.hub.Publish(eventStale, StaleChange{Stale: false, LastUpdate: last})
+	}
+}
+
+// WatchStale notices when status reports stop, tells everyone and kicks the
+// bluetooth client every staleAfter until they come back
+func (f *Fridge) WatchStale(ctx context.Context) {
+	log := log.WithFields(log.Fields{"client": "StaleWatcher"})
+	ticker := time.NewTicker(staleAfter / 4)
+	defer ticker.Stop()
+	var lastKick time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !f.Stale() {
+				continue
+			}
+			f.mu.Lock()
+			was := f.stale
+			f.stale = true
+			last, since := f.updated, f.connectedAt
+			f.mu.Unlock()
+			if !was {
+				msg := fmt.Sprintf("No status report for %s", now.Sub(last).Round(time.Second))
+				if last.IsZero() {
+					msg = fmt.Sprintf("No status report %s after connecting", now.Sub(since).Round(time.Second))
+				}
+				f.Alert("warn", "staleness", msg)
+				f.hub.Publish(eventStale, StaleChange{Stale: true, LastUpdate: last})
+			}
+			if now.Sub(lastKick) >= staleAfter {
+				log.Warn("Status reports are stale, asking bluetooth client to re-subscribe")
+				lastKick = now
+				f.requestResubscribe()
+			}
+		}
+	}
+}
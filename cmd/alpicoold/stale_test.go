@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchStale(t *testing.T) {
+	prev := staleAfter
+	staleAfter = 100 * time.Millisecond
+	defer func() { staleAfter = prev }()
+
+	f := newTestFridge(testStatusReport)
+	sub := f.hub.Subscribe(10)
+	defer sub.Close()
+	if f.Stale() {
+		t.Fatal("No report yet shouldn't be stale")
+	}
+
+	f.mu.Lock()
+	f.updated = time.Now().Add(-time.Second)
+	f.mu.Unlock()
+	if !f.Stale() || !f.Freshness().Stale {
+		t.Fatal("Old report should be stale")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.WatchStale(ctx)
+
+	select {
+	case <-f.resubscribeC:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stale watcher didn't ask for a re-subscribe")
+	}
+	// Keeps kicking while stale
+	select {
+	case <-f.resubscribeC:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stale watcher didn't retry")
+	}
+
+	// A new report clears it
+	go f.MonitorMu()
+	f.inlet <- testStatusReport
+	if f.Stale() {
+		t.Fatal("Fresh report should clear stale")
+	}
+
+	var changes []bool
+	alerts := 0
+	timeout := time.After(2 * time.Second)
+	for len(changes) < 2 {
+		select {
+		case e := <-sub.C:
+			switch e.Kind {
+			case eventStale:
+				changes = append(changes, e.Data.(StaleChange).Stale)
+			case eventAlert:
+				alerts++
+			}
+		case <-timeout:
+			t.Fatalf("Expected stale then fresh events, got %v", changes)
+		}
+	}
+	if !changes[0] || changes[1] || alerts != 2 {
+		t.Fatalf("Expected stale then fresh with an alert each, got %v and %d alerts", changes, alerts)
+	}
+}
+
+func TestStaleWithoutFirstReport(t *testing.T) {
+	prev := staleAfter
+	staleAfter = 100 * time.Millisecond
+	defer func() { staleAfter = prev }()
+
+	f := newTestFridge(testStatusReport)
+	f.SetConnected(true)
+	if f.Stale() {
+		t.Fatal("Just connected shouldn't be stale")
+	}
+	f.mu.Lock()
+	f.connectedAt = time.Now().Add(-time.Second)
+	f.mu.Unlock()
+	if !f.Stale() || !f.Freshness().Stale {
+		t.Fatal("Connected without a report should go stale")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.WatchStale(ctx)
+	select {
+	case <-f.resubscribeC:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stale watcher didn't ask for a re-subscribe")
+	}
+
+	f.SetConnected(false)
+	if f.Stale() {
+		t.Fatal("Disconnected without a report isn't stale")
+	}
+}
+
+func TestValidStaleAfter(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second, 3} {
+		if validStaleAfter(d) == nil {
+			t.Fatalf("Expected %s rejected", d)
+		}
+	}
+	if err := validStaleAfter(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFreshnessHTTP(t *testing.T) {
+	f := newTestFridge(testStatusReport)
+	f.mu.Lock()
+	f.updated = time.Now().Add(-time.Hour)
+	f.mu.Unlock()
+	srv := newTestAPI(f)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-Fridge-Stale") != "true" || res.Header.Get("Last-Modified") == "" {
+		t.Fatalf("Missing freshness headers %v", res.Header)
+	}
+
+	_, body := doRequest(t, http.MethodGet, srv.URL+"/sensors", "")
+	if body["stale"] != true || body["ageSeconds"].(float64) < 3600 {
+		t.Fatalf("Bad sensors freshness %v", body)
+	}
+
+	w := httptest.NewRecorder()
+	handleConnection(f)(w, httptest.NewRequest(http.MethodGet, "/connection", nil))
+	if !strings.Contains(w.Body.String(), `"stale":true`) {
+		t.Fatalf("Bad connection body %s", w.Body)
+	}
+}
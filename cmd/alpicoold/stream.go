@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	// streamHeartbeat keeps idle streams and the proxies in front of them alive
+	streamHeartbeat = 15 * time.Second
+	// streamWriteTimeout disconnects clients that stop reading
+	streamWriteTimeout = 10 * time.Second
+	// streamBuffer is how many events a slow client can fall behind before losing some
+	streamBuffer = 64
+)
+
+// splitParam splits a comma separated query parameter
+func splitParam(r *http.Request, name string) []string {
+	out := []string{}
+	for _, v := range strings.Split(r.URL.Query().Get(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// streamFilter reads ?kinds=status,alert&fields=Temp,TempSet
+func streamFilter(r *http.Request) eventFilter {
+	return newEventFilter(splitParam(r, "kinds"), splitParam(r, "fields"))
+}
+
+// handleSSE streams events as Server-Sent Events
+func handleSSE(f *Fridge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.WithFields(log.Fields{
+			"client": "JSONClient",
+			"stream": "sse",
+			"remote": r.RemoteAddr,
+		})
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming unsupported"))
+			return
+		}
+		rc := http.NewResponseController(w)
+		filter := streamFilter(r)
+
+		sub := f.hub.Subscribe(streamBuffer)
+		defer sub.Close()
+
+		w.Header().Set(contentType, "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", 2000)
+		flusher.Flush()
+		log.Debug("stream open")
+
+		write := func(format string, args ...interface{}) error {
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if _, err := fmt.Fprintf(w, format, args...); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		dropped := 0
+		for {
+			select {
+			case <-r.Context().Done():
+				log.Debug("stream closed by client")
+				return
+			case <-heartbeat.C:
+				if err := write(": heartbeat\n\n"); err != nil {
+					log.Debugf("stream write: %s", err)
+					return
+				}
+			case e, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if d := sub.Dropped(); d != dropped {
+					if err := write("event: dropped\ndata: %d\n\n", d-dropped); err != nil {
+						return
+					}
+					dropped = d
+				}
+				e, ok = filter.apply(e)
+				if !ok {
+					continue
+				}
+				b, err := json.Marshal(e)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+				if err := write("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Kind, b); err != nil {
+					log.Debugf("stream write: %s", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// heartbeatEvent is sent to idle websocket clients
+type heartbeatEvent struct {
+	Kind    string    `json:"kind"`
+	Time    time.Time `json:"time"`
+	Dropped int       `json:"dropped"`
+}
+
+// checkWebSocketOrigin turns away browser pages from other sites, which would
+// otherwise ride along on the user's credentials. Clients that send no Origin
+// aren't browsers and go through.
+func checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != r.Host {
+		return fmt.Errorf("Origin %s doesn't match host %s", origin.Host, r.Host)
+	}
+	config.Origin = origin
+	return nil
+}
+
+// handleWebSocket streams the same events as JSON websocket messages
+func handleWebSocket(f *Fridge) http.Handler {
+	return websocket.Server{Handshake: checkWebSocketOrigin, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		r := ws.Request()
+		log := log.WithFields(log.Fields{
+			"client": "JSONClient",
+			"stream": "websocket",
+			"remote": r.RemoteAddr,
+		})
+		filter := streamFilter(r)
+
+		sub := f.hub.Subscribe(streamBuffer)
+		defer sub.Close()
+		log.Debug("stream open")
+
+		// Nothing is expected from the client, reading just notices it leaving
+		gone := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(gone)
+		}()
+
+		send := func(v interface{}) error {
+			ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			return websocket.JSON.Send(ws, v)
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-gone:
+				log.Debug("stream closed by client")
+				return
+			case now := <-heartbeat.C:
+				if err := send(heartbeatEvent{Kind: "heartbeat", Time: now, Dropped: sub.Dropped()}); err != nil {
+					log.Debugf("stream write: %s", err)
+					return
+				}
+			case e, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if e, ok = filter.apply(e); !ok {
+					continue
+				}
+				if err := send(e); err != nil {
+					log.Debugf("stream write: %s", err)
+					return
+				}
+			}
+		}
+	}}
+}
+
+// registerStreams adds the live event endpoints to mux
+func registerStreams(mux *http.ServeMux, f *Fridge) {
+	mux.HandleFunc("/events", methods(handleSSE(f), http.MethodGet))
+	mux.Handle("/ws", handleWebSocket(f))
+}
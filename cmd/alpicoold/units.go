@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+// convertSettingsUnit switches the fridge's E5 unit and moves every
+// temperature field with it. E1, E2 and the setpoint are temperatures, E3 and
+// E6 to E9 are differences so they only scale.
+func convertSettingsUnit(s k25.Settings, fahrenheit bool) (k25.Settings, error) {
+	if s.CelsiusFahrenheitModeMenuE5 == fahrenheit {
+		return s, nil
+	}
+	toUnit, scale := FtoC, 5.0/9
+	if fahrenheit {
+		toUnit, scale = CtoF, 9.0/5
+	}
+
+	var err error
+	temp := func(name string, v int8) int8 {
+		out, e := toInt8(name, toUnit(float64(v)))
+		if e != nil && err == nil {
+			err = e
+		}
+		return out
+	}
+	delta := func(name string, v int8) int8 {
+		out, e := toInt8(name, float64(v)*scale)
+		if e != nil && err == nil {
+			err = e
+		}
+		// Keep small offsets from rounding away to nothing
+		if out == 0 && v != 0 {
+			out = int8(math.Copysign(1, float64(v)))
+		}
+		return out
+	}
+
+	c := s
+	c.CelsiusFahrenheitModeMenuE5 = fahrenheit
+	c.TempSet = temp("setpoint", s.TempSet)
+	c.LowestTempSettingMenuE1 = temp("E1", s.LowestTempSettingMenuE1)
+	c.HighestTempSettingMenuE2 = temp("E2", s.HighestTempSettingMenuE2)
+	c.HysteresisMenuE3 = delta("E3", s.HysteresisMenuE3)
+	c.TempCompGTEMinus6DegCelsiusMenuE6 = delta("E6", s.TempCompGTEMinus6DegCelsiusMenuE6)
+	c.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7 = delta("E7", s.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7)
+	c.TempCompLTMinus12DegCelsiusMenuE8 = delta("E8", s.TempCompLTMinus12DegCelsiusMenuE8)
+	c.TempCompShutdownMenuE9 = delta("E9", s.TempCompShutdownMenuE9)
+	if err != nil {
+		return s, err
+	}
+	if err := c.Validate(); err != nil {
+		return s, err
+	}
+	return c, nil
+}
+
+func toInt8(name string, v float64) (int8, error) {
+	r := math.Round(v)
+	if r < math.MinInt8 || r > math.MaxInt8 {
+		return 0, fmt.Errorf("%s would be %v, which the fridge can't store", name, r)
+	}
+	return int8(r), nil
+}
+
+// followUnit moves the temperatures a change left alone into the unit it
+// switched E5 to, so flipping E5 by itself keeps the fridge where it was.
+// Temperatures the change set itself are taken to be in the new unit.
+func followUnit(current, s k25.Settings) (k25.Settings, error) {
+	converted, err := convertSettingsUnit(current, s.CelsiusFahrenheitModeMenuE5)
+	if err != nil {
+		return s, err
+	}
+	follow := func(field *int8, was, now int8) {
+		if *field == was {
+			*field = now
+		}
+	}
+	follow(&s.TempSet, current.TempSet, converted.TempSet)
+	follow(&s.LowestTempSettingMenuE1, current.LowestTempSettingMenuE1, converted.LowestTempSettingMenuE1)
+	follow(&s.HighestTempSettingMenuE2, current.HighestTempSettingMenuE2, converted.HighestTempSettingMenuE2)
+	follow(&s.HysteresisMenuE3, current.HysteresisMenuE3, converted.HysteresisMenuE3)
+	follow(&s.TempCompGTEMinus6DegCelsiusMenuE6, current.TempCompGTEMinus6DegCelsiusMenuE6, converted.TempCompGTEMinus6DegCelsiusMenuE6)
+	follow(&s.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7, current.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7, converted.TempCompGTEMinus12DegCelsiusLTMinus6DegCelsiusMenuE7)
+	follow(&s.TempCompLTMinus12DegCelsiusMenuE8, current.TempCompLTMinus12DegCelsiusMenuE8, converted.TempCompLTMinus12DegCelsiusMenuE8)
+	follow(&s.TempCompShutdownMenuE9, current.TempCompShutdownMenuE9, converted.TempCompShutdownMenuE9)
+	return s, nil
+}
+
+// SetUnit switches the fridge between celsius and fahrenheit
+func (f *Fridge) SetUnit(ctx context.Context, cmd Command, fahrenheit bool) (k25.Settings, error) {
+	return f.UpdateSettings(ctx, cmd, func(u *k25.Settings) { u.CelsiusFahrenheitModeMenuE5 = fahrenheit })
+}
+
+// hkTempBounds is the setpoint range and step HomeKit should offer, in
+// celsius since that's all HomeKit speaks. In fahrenheit mode the step is
+// fine enough for the Home app to land on every whole degree F.
+func hkTempBounds(s k25.Settings) (min, max, step float64) {
+	min, max, step = float64(s.LowestTempSettingMenuE1), float64(s.HighestTempSettingMenuE2), 1
+	if s.CelsiusFahrenheitModeMenuE5 {
+		min, max, step = FtoC(min), FtoC(max), 0.1
+	}
+	return math.Floor(min*10) / 10, math.Ceil(max*10) / 10, step
+}
+
+// hkDisplayUnits is TemperatureDisplayUnits for the fridge's unit, 0=C, 1=F
+func hkDisplayUnits(s k25.Settings) int {
+	if s.CelsiusFahrenheitModeMenuE5 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/johnelliott/alpicoold/pkg/k25"
+)
+
+func TestConvertSettingsUnit(t *testing.T) {
+	f := testStatusReport.Settings
+	f.TempCompGTEMinus6DegCelsiusMenuE6 = -3
+	f.TempCompShutdownMenuE9 = 1
+
+	c, err := convertSettingsUnit(f, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CelsiusFahrenheitModeMenuE5 {
+		t.Fatal("Still in fahrenheit")
+	}
+	if c.LowestTempSettingMenuE1 != -20 || c.HighestTempSettingMenuE2 != 20 || c.TempSet != 3 {
+		t.Fatalf("Bad temperatures %+v", c)
+	}
+	if c.HysteresisMenuE3 != 2 || c.TempCompGTEMinus6DegCelsiusMenuE6 != -2 || c.TempCompShutdownMenuE9 != 1 {
+		t.Fatalf("Bad offsets %+v", c)
+	}
+	if c.On != f.On || c.EcoMode != f.EcoMode || c.HLvl != f.HLvl {
+		t.Fatalf("Non temperature fields changed %+v", c)
+	}
+
+	back, err := convertSettingsUnit(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.LowestTempSettingMenuE1 != -4 || back.HighestTempSettingMenuE2 != 68 || back.TempSet != 37 {
+		t.Fatalf("Bad round trip %+v", back)
+	}
+
+	if same, err := convertSettingsUnit(f, true); err != nil || same != f {
+		t.Fatalf("Converting to the current unit changed settings %+v %v", same, err)
+	}
+
+	hot := c
+	hot.HighestTempSettingMenuE2 = 60
+	if _, err := convertSettingsUnit(hot, true); err == nil {
+		t.Fatal("Expected 140F to be rejected")
+	}
+}
+
+func TestHKTempBounds(t *testing.T) {
+	min, max, step := hkTempBounds(testStatusReport.Settings)
+	if min != -20 || max != 20 || step != 0.1 {
+		t.Fatalf("Bad fahrenheit bounds %v %v %v", min, max, step)
+	}
+	if hkDisplayUnits(testStatusReport.Settings) != 1 {
+		t.Fatal("Expected fahrenheit display units")
+	}
+
+	c, _ := convertSettingsUnit(testStatusReport.Settings, false)
+	min, max, step = hkTempBounds(c)
+	if min != -20 || max != 20 || step != 1 {
+		t.Fatalf("Bad celsius bounds %v %v %v", min, max, step)
+	}
+	if hkDisplayUnits(c) != 0 {
+		t.Fatal("Expected celsius display units")
+	}
+}
+
+func TestSetUnit(t *testing.T) {
+	fridge := newTestFridge(k25.StatusReport{})
+	if _, err := fridge.SetUnit(context.Background(), Command{Source: sourceHTTP}, false); err != errNoStatus {
+		t.Fatalf("Expected errNoStatus, got %v", err)
+	}
+
+	fridge = newTestFridge(testStatusReport)
+	go fridge.SetUnit(context.Background(), Command{Source: sourceHTTP}, false)
+	select {
+	case s := <-fridge.settingsC:
+		if s.CelsiusFahrenheitModeMenuE5 || s.TempSet != 3 {
+			t.Fatalf("Bad settings sent %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No settings command")
+	}
+}
+
+func TestTempCommandSettings(t *testing.T) {
+	c, err := convertSettingsUnit(testStatusReport.Settings, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	celsius := testStatusReport
+	celsius.Settings = c // C, E1 -20, E2 20
+
+	for _, test := range []struct {
+		report k25.StatusReport
+		in     float64 // degrees C
+		want   int8
+	}{
+		{celsius, 4, 4},
+		{celsius, 3.6, 4},
+		{celsius, -25, -20},
+		{celsius, 30, 20},
+		{testStatusReport, 4, 39},
+		{testStatusReport, -30, -4},
+		{testStatusReport, 25, 68},
+	} {
+		// Through SendTemp the way every source reaches the writer
+		f := newTestFridge(test.report)
+		go f.SendTemp(context.Background(), Command{Source: sourceHTTP}, test.in)
+		var tc tempCommand
+		select {
+		case tc = <-f.tempSettingsC:
+		case <-time.After(time.Second):
+			t.Fatal("Nothing sent to the writer")
+		}
+		after := tc.settings(test.report)
+		if after.TempSet != test.want {
+			t.Fatalf("%g°C with E5 %v: got %d, want %d", test.in, test.report.CelsiusFahrenheitModeMenuE5, after.TempSet, test.want)
+		}
+		if after.CelsiusFahrenheitModeMenuE5 != test.report.CelsiusFahrenheitModeMenuE5 || after.On != test.report.On {
+			t.Fatalf("Only the setpoint should change, got %+v", after)
+		}
+	}
+}
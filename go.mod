@@ -1,12 +1,39 @@
 module github.com/johnelliott/alpicoold
 
-go 1.16
+go 1.23
 
 require (
 	github.com/brutella/hc v1.2.4
 	github.com/brutella/hkcam v0.0.9
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/go-acme/lego v2.7.2+incompatible
-	github.com/godbus/dbus/v5 v5.0.3
+	github.com/godbus/dbus/v5 v5.0.4
+	github.com/mdp/qrterminal/v3 v3.2.0
+	github.com/mochi-mqtt/server/v2 v2.6.6
 	github.com/muka/go-bluetooth v0.0.0-20210508070623-03c23c62f181
-	github.com/sirupsen/logrus v1.8.1
+	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/net v0.26.0
+	google.golang.org/grpc v1.66.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/brutella/dnssd v1.2.0 // indirect
+	github.com/fatih/structs v1.1.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/miekg/dns v1.1.4 // indirect
+	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
+	github.com/radovskyb/watcher v1.0.6 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	github.com/tadglines/go-pkgs v0.0.0-20140924210655-1f86682992f1 // indirect
+	github.com/xiam/to v0.0.0-20191116183551-8328998fc0ed // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/term v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240604185151-ef581f913117 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	rsc.io/qr v0.2.0 // indirect
 )
@@ -0,0 +1,201 @@
+package export
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPoint = Point{
+	Measurement: "fridge",
+	Tags:        map[string]string{"node": "d8:17 d1", "unit": "F"},
+	Fields: map[string]interface{}{
+		"temp":          int8(39),
+		"input_voltage": 12.8,
+		"on":            true,
+		"mode":          `co"ol`,
+	},
+	Time: time.Unix(1600000000, 0),
+}
+
+func TestLineProtocol(t *testing.T) {
+	result, err := LineProtocol(testPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `fridge,node=d8:17\ d1,unit=F input_voltage=12.8,mode="co\"ol",on=true,temp=39i 1600000000000000000`
+	if result != expected {
+		t.Fatalf("Fail:\n%v\n%v", result, expected)
+	}
+
+	t.Run("nanoseconds", func(t *testing.T) {
+		// InfluxDB reads timestamps as nanoseconds unless told otherwise
+		p := testPoint
+		p.Time = time.Date(2026, 10, 19, 12, 0, 0, 5, time.UTC)
+		result, _ := LineProtocol(p)
+		if !strings.HasSuffix(result, " 1792411200000000005") {
+			t.Fatalf("Expected a nanosecond timestamp, got %s", result)
+		}
+	})
+
+	t.Run("no fields", func(t *testing.T) {
+		if _, err := LineProtocol(Point{Measurement: "fridge"}); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+}
+
+func TestGraphite(t *testing.T) {
+	result := strings.Join(Graphite("alpicoold", testPoint), "\n")
+	expected := strings.Join([]string{
+		"alpicoold.fridge.d8_17_d1.F.input_voltage 12.8 1600000000",
+		"alpicoold.fridge.d8_17_d1.F.on 1 1600000000",
+		"alpicoold.fridge.d8_17_d1.F.temp 39 1600000000",
+	}, "\n")
+	if result != expected {
+		t.Fatalf("Fail:\n%v\n%v", result, expected)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append("a 1", "b 2", "c 3"); err != nil {
+		t.Fatal(err)
+	}
+	p := s.Pending(2)
+	if len(p) != 2 || p[0].Line != "a 1" || p[1].Line != "b 2" {
+		t.Fatalf("Bad pending %v", p)
+	}
+	if err := s.Ack(p[1].Seq); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("replay after reopen skips acked lines", func(t *testing.T) {
+		s, err := OpenSpool(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := s.Pending(0)
+		if len(p) != 1 || p[0].Line != "c 3" || p[0].Seq != 3 {
+			t.Fatalf("Bad pending after reopen %v", p)
+		}
+		if err := s.Append("d 4"); err != nil {
+			t.Fatal(err)
+		}
+		if p := s.Pending(0); p[len(p)-1].Seq != 4 {
+			t.Fatalf("Sequence numbers must keep climbing, got %v", p)
+		}
+	})
+
+	t.Run("full spool drops oldest", func(t *testing.T) {
+		s, err := OpenSpool(t.TempDir(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Append("a", "b", "c")
+		p := s.Pending(0)
+		if len(p) != 2 || p[0].Line != "b" || s.Dropped() != 1 {
+			t.Fatalf("Bad pending %v dropped %d", p, s.Dropped())
+		}
+	})
+
+	t.Run("rejects newlines", func(t *testing.T) {
+		if err := s.Append("a\nb"); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+}
+
+func TestSenders(t *testing.T) {
+	t.Run("http", func(t *testing.T) {
+		var body, auth string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+			auth = r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		s, err := NewSender(srv.URL+"/api/v2/write?bucket=fridge", "secret", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Send([]string{"a 1", "b 2"}); err != nil {
+			t.Fatal(err)
+		}
+		if body != "a 1\nb 2\n" || auth != "Token secret" {
+			t.Fatalf("Bad request %q %q", body, auth)
+		}
+	})
+
+	t.Run("http error status", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", http.StatusBadRequest)
+		}))
+		defer srv.Close()
+		s, _ := NewSender(srv.URL, "", time.Second)
+		if err := s.Send([]string{"a 1"}); !errors.Is(err, ErrRejected) {
+			t.Fatalf("Expected a rejected batch, got %v", err)
+		}
+	})
+
+	t.Run("http retryable status", func(t *testing.T) {
+		for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "later", code)
+			}))
+			s, _ := NewSender(srv.URL, "", time.Second)
+			if err := s.Send([]string{"a 1"}); err == nil || errors.Is(err, ErrRejected) {
+				t.Fatalf("%d: expected a retryable error, got %v", code, err)
+			}
+			srv.Close()
+		}
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		got := make(chan string)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			b := make([]byte, 64)
+			n, _ := c.Read(b)
+			got <- string(b[:n])
+		}()
+
+		s, err := NewSender("tcp://"+l.Addr().String(), "", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := s.Send([]string{"a.b 1 1600000000"}); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-got; r != "a.b 1 1600000000\n" {
+			t.Fatalf("Bad payload %q", r)
+		}
+	})
+
+	t.Run("bad scheme", func(t *testing.T) {
+		if _, err := NewSender("ftp://example.com", "", time.Second); err == nil {
+			t.Fatal("Expected error")
+		}
+	})
+}
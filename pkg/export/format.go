@@ -0,0 +1,153 @@
+// Package export formats fridge telemetry for push based time series databases
+// and buffers it on disk while the network is away.
+package export
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is a single timestamped sample, e.g. one status report
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{} // float64, int64, int, int8, bool or string
+	Time        time.Time
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedTagKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxValue formats a field value, ok is false for unsupported types
+func influxValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case int:
+		return strconv.Itoa(v) + "i", true
+	case int8:
+		return strconv.Itoa(int(v)) + "i", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+// LineProtocol formats a point as an InfluxDB line with nanosecond
+// precision, which InfluxDB assumes when a write doesn't say
+func LineProtocol(p Point) (string, error) {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.Measurement))
+	for _, k := range sortedTagKeys(p.Tags) {
+		if p.Tags[k] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", tagEscaper.Replace(k), tagEscaper.Replace(p.Tags[k]))
+	}
+
+	fields := 0
+	for _, k := range sortedKeys(p.Fields) {
+		v, ok := influxValue(p.Fields[k])
+		if !ok {
+			return "", fmt.Errorf("Unsupported field type %T for %s", p.Fields[k], k)
+		}
+		if fields == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", tagEscaper.Replace(k), v)
+		fields++
+	}
+	if fields == 0 {
+		return "", fmt.Errorf("Point %s has no fields", p.Measurement)
+	}
+	fmt.Fprintf(&b, " %d", p.Time.UnixNano())
+	return b.String(), nil
+}
+
+// graphiteValue formats numeric and boolean values, strings can't be graphed
+func graphiteValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case int:
+		return strconv.Itoa(v), true
+	case int8:
+		return strconv.Itoa(int(v)), true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
+
+// graphiteSafe keeps metric path segments from growing extra dots or spaces
+func graphiteSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '/', ':':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Graphite formats a point as plaintext protocol lines, one per field. The
+// metric path is prefix.measurement.<tag values...>.field
+func Graphite(prefix string, p Point) []string {
+	path := []string{}
+	if prefix != "" {
+		path = append(path, prefix)
+	}
+	path = append(path, graphiteSafe(p.Measurement))
+	for _, k := range sortedTagKeys(p.Tags) {
+		if p.Tags[k] == "" {
+			continue
+		}
+		path = append(path, graphiteSafe(p.Tags[k]))
+	}
+	base := strings.Join(path, ".")
+
+	lines := []string{}
+	for _, k := range sortedKeys(p.Fields) {
+		v, ok := graphiteValue(p.Fields[k])
+		if !ok {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s.%s %s %d", base, graphiteSafe(k), v, p.Time.Unix()))
+	}
+	return lines
+}
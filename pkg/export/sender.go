@@ -0,0 +1,137 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrRejected wraps a send the far end will never accept, like a bad token
+// or a field type conflict, so retrying the batch is pointless
+var ErrRejected = errors.New("Batch rejected")
+
+// Sender ships a batch of wire lines somewhere
+type Sender interface {
+	Send(lines []string) error
+	Close() error
+}
+
+// NewSender picks a transport from the url scheme: http(s) posts batches,
+// e.g. to an InfluxDB write endpoint, udp and tcp write plain lines
+func NewSender(rawurl, token string, timeout time.Duration) (Sender, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpSender{
+			url:    rawurl,
+			token:  token,
+			client: &http.Client{Timeout: timeout},
+		}, nil
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("Missing host in %s", rawurl)
+		}
+		return &streamSender{network: u.Scheme, addr: u.Host, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("Unsupported export url scheme %q", u.Scheme)
+}
+
+type httpSender struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpSender) Send(lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequest(http.MethodPost, s.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		err := fmt.Errorf("Export POST %s: %s %s", s.url, res.Status, bytes.TrimSpace(msg))
+		// Other 4xx mean the batch itself is bad, 408 and 429 are worth a retry
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+			return fmt.Errorf("%w: %s", ErrRejected, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *httpSender) Close() error { return nil }
+
+// maxDatagram keeps udp batches under a typical MTU
+const maxDatagram = 1400
+
+// streamSender dials lazily and redials after any write error
+type streamSender struct {
+	network string
+	addr    string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+func (s *streamSender) Send(lines []string) error {
+	if s.conn == nil {
+		c, err := net.DialTimeout(s.network, s.addr, s.timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+	}
+
+	// udp gets one datagram per chunk, tcp just streams
+	chunks := [][]byte{}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if s.network == "udp" && buf.Len() > 0 && buf.Len()+len(line)+1 > maxDatagram {
+			chunks = append(chunks, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	chunks = append(chunks, buf.Bytes())
+
+	for _, chunk := range chunks {
+		if s.timeout > 0 {
+			s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		}
+		if _, err := s.conn.Write(chunk); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *streamSender) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,220 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Entry is a spooled wire line and its sequence number
+type Entry struct {
+	Seq  uint64
+	Line string
+}
+
+// Spool is an on disk FIFO of wire lines waiting to be sent. Lines are
+// appended to a data file and the highest sent sequence number is kept in an
+// ack file, so a restart replays only what never made it out.
+type Spool struct {
+	mu         sync.Mutex
+	dataPath   string
+	ackPath    string
+	maxEntries int
+	next       uint64
+	acked      uint64
+	entries    []Entry // unacked entries, oldest first
+	stale      int     // acked lines still in the data file
+	dropped    int
+}
+
+// OpenSpool loads or creates a spool in dir, keeping at most maxEntries
+// unsent lines before dropping the oldest
+func OpenSpool(dir string, maxEntries int) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dataPath:   filepath.Join(dir, "spool.log"),
+		ackPath:    filepath.Join(dir, "spool.ack"),
+		maxEntries: maxEntries,
+		next:       1,
+	}
+
+	if b, err := ioutil.ReadFile(s.ackPath); err == nil {
+		s.acked, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad spool ack file: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if s.acked >= s.next {
+		s.next = s.acked + 1
+	}
+
+	f, err := os.Open(s.dataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f != nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), " ", 2)
+			if len(parts) != 2 {
+				// Torn write at the tail from a crash
+				continue
+			}
+			seq, err := strconv.ParseUint(parts[0], 10, 64)
+			if err != nil {
+				continue
+			}
+			if seq >= s.next {
+				s.next = seq + 1
+			}
+			if seq <= s.acked {
+				continue
+			}
+			s.entries = append(s.entries, Entry{Seq: seq, Line: parts[1]})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	s.trim()
+	return s, s.rewrite()
+}
+
+// trim drops the oldest entries over the limit, caller holds the lock
+func (s *Spool) trim() {
+	if s.maxEntries <= 0 || len(s.entries) <= s.maxEntries {
+		return
+	}
+	over := len(s.entries) - s.maxEntries
+	s.acked = s.entries[over-1].Seq
+	s.entries = s.entries[over:]
+	s.dropped += over
+}
+
+// writeAck persists the acked sequence number, caller holds the lock
+func (s *Spool) writeAck() error {
+	tmp := s.ackPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(s.acked, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.ackPath)
+}
+
+// rewrite compacts the data file down to the unacked entries, caller holds the lock
+func (s *Spool) rewrite() error {
+	tmp := s.dataPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range s.entries {
+		fmt.Fprintf(w, "%d %s\n", e.Seq, e.Line)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.writeAck(); err != nil {
+		return err
+	}
+	s.stale = 0
+	return os.Rename(tmp, s.dataPath)
+}
+
+// Append spools lines for sending
+func (s *Spool) Append(lines ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.dataPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		if strings.ContainsAny(line, "\r\n") {
+			f.Close()
+			return fmt.Errorf("Spool lines can't contain newlines: %q", line)
+		}
+		e := Entry{Seq: s.next, Line: line}
+		s.next++
+		fmt.Fprintf(w, "%d %s\n", e.Seq, e.Line)
+		s.entries = append(s.entries, e)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if s.maxEntries > 0 && len(s.entries) > s.maxEntries {
+		s.trim()
+		return s.rewrite()
+	}
+	return nil
+}
+
+// Pending returns up to n of the oldest unsent entries
+func (s *Spool) Pending(n int) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n <= 0 || n > len(s.entries) {
+		n = len(s.entries)
+	}
+	out := make([]Entry, n)
+	copy(out, s.entries[:n])
+	return out
+}
+
+// Ack marks everything up to and including seq as sent so it's never replayed
+func (s *Spool) Ack(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq <= s.acked {
+		return nil
+	}
+	i := 0
+	for i < len(s.entries) && s.entries[i].Seq <= seq {
+		i++
+	}
+	s.entries = s.entries[i:]
+	s.acked = seq
+	s.stale += i
+
+	// Compact once the data file is mostly sent lines
+	if len(s.entries) == 0 || s.stale > len(s.entries) {
+		return s.rewrite()
+	}
+	return s.writeAck()
+}
+
+// Len is the number of unsent entries
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Dropped counts entries thrown away because the spool was full
+func (s *Spool) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
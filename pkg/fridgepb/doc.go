@@ -0,0 +1,4 @@
+// Package fridgepb is the gRPC control and telemetry API, generated from fridge.proto
+package fridgepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative fridge.proto
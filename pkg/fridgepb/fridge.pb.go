@@ -0,0 +1,954 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: fridge.proto
+
+package fridgepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	fieldmaskpb "google.golang.org/protobuf/types/known/fieldmaskpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type TemperatureUnit int32
+
+const (
+	TemperatureUnit_TEMPERATURE_UNIT_UNSPECIFIED TemperatureUnit = 0
+	TemperatureUnit_TEMPERATURE_UNIT_CELSIUS     TemperatureUnit = 1
+	TemperatureUnit_TEMPERATURE_UNIT_FAHRENHEIT  TemperatureUnit = 2
+)
+
+// Enum value maps for TemperatureUnit.
+var (
+	TemperatureUnit_name = map[int32]string{
+		0: "TEMPERATURE_UNIT_UNSPECIFIED",
+		1: "TEMPERATURE_UNIT_CELSIUS",
+		2: "TEMPERATURE_UNIT_FAHRENHEIT",
+	}
+	TemperatureUnit_value = map[string]int32{
+		"TEMPERATURE_UNIT_UNSPECIFIED": 0,
+		"TEMPERATURE_UNIT_CELSIUS":     1,
+		"TEMPERATURE_UNIT_FAHRENHEIT":  2,
+	}
+)
+
+func (x TemperatureUnit) Enum() *TemperatureUnit {
+	p := new(TemperatureUnit)
+	*p = x
+	return p
+}
+
+func (x TemperatureUnit) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TemperatureUnit) Descriptor() protoreflect.EnumDescriptor {
+	return file_fridge_proto_enumTypes[0].Descriptor()
+}
+
+func (TemperatureUnit) Type() protoreflect.EnumType {
+	return &file_fridge_proto_enumTypes[0]
+}
+
+func (x TemperatureUnit) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use TemperatureUnit.Descriptor instead.
+func (TemperatureUnit) EnumDescriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{0}
+}
+
+// Settings mirrors k25.Settings. Temperatures are in the fridge's units, see
+// celsius_fahrenheit_mode_menu_e5.
+type Settings struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Locked  bool                   `protobuf:"varint,1,opt,name=locked,proto3" json:"locked,omitempty"`
+	On      bool                   `protobuf:"varint,2,opt,name=on,proto3" json:"on,omitempty"`
+	EcoMode bool                   `protobuf:"varint,3,opt,name=eco_mode,json=ecoMode,proto3" json:"eco_mode,omitempty"`
+	// Input voltage cutoff level, 0 H, 1 M, 2 L
+	HLvl                     int32 `protobuf:"varint,4,opt,name=h_lvl,json=hLvl,proto3" json:"h_lvl,omitempty"`
+	TempSet                  int32 `protobuf:"varint,5,opt,name=temp_set,json=tempSet,proto3" json:"temp_set,omitempty"`
+	HighestTempSettingMenuE2 int32 `protobuf:"varint,6,opt,name=highest_temp_setting_menu_e2,json=highestTempSettingMenuE2,proto3" json:"highest_temp_setting_menu_e2,omitempty"`
+	LowestTempSettingMenuE1  int32 `protobuf:"varint,7,opt,name=lowest_temp_setting_menu_e1,json=lowestTempSettingMenuE1,proto3" json:"lowest_temp_setting_menu_e1,omitempty"`
+	HysteresisMenuE3         int32 `protobuf:"varint,8,opt,name=hysteresis_menu_e3,json=hysteresisMenuE3,proto3" json:"hysteresis_menu_e3,omitempty"`
+	SoftStartDelayMinMenuE4  int32 `protobuf:"varint,9,opt,name=soft_start_delay_min_menu_e4,json=softStartDelayMinMenuE4,proto3" json:"soft_start_delay_min_menu_e4,omitempty"`
+	// True when the fridge is in Fahrenheit mode
+	CelsiusFahrenheitModeMenuE5                          bool  `protobuf:"varint,10,opt,name=celsius_fahrenheit_mode_menu_e5,json=celsiusFahrenheitModeMenuE5,proto3" json:"celsius_fahrenheit_mode_menu_e5,omitempty"`
+	TempCompGteMinus6DegCelsiusMenuE6                    int32 `protobuf:"varint,11,opt,name=temp_comp_gte_minus6_deg_celsius_menu_e6,json=tempCompGteMinus6DegCelsiusMenuE6,proto3" json:"temp_comp_gte_minus6_deg_celsius_menu_e6,omitempty"`
+	TempCompGteMinus12DegCelsiusLtMinus6DegCelsiusMenuE7 int32 `protobuf:"varint,12,opt,name=temp_comp_gte_minus12_deg_celsius_lt_minus6_deg_celsius_menu_e7,json=tempCompGteMinus12DegCelsiusLtMinus6DegCelsiusMenuE7,proto3" json:"temp_comp_gte_minus12_deg_celsius_lt_minus6_deg_celsius_menu_e7,omitempty"`
+	TempCompLtMinus12DegCelsiusMenuE8                    int32 `protobuf:"varint,13,opt,name=temp_comp_lt_minus12_deg_celsius_menu_e8,json=tempCompLtMinus12DegCelsiusMenuE8,proto3" json:"temp_comp_lt_minus12_deg_celsius_menu_e8,omitempty"`
+	TempCompShutdownMenuE9                               int32 `protobuf:"varint,14,opt,name=temp_comp_shutdown_menu_e9,json=tempCompShutdownMenuE9,proto3" json:"temp_comp_shutdown_menu_e9,omitempty"`
+	unknownFields                                        protoimpl.UnknownFields
+	sizeCache                                            protoimpl.SizeCache
+}
+
+func (x *Settings) Reset() {
+	*x = Settings{}
+	mi := &file_fridge_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Settings) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Settings) ProtoMessage() {}
+
+func (x *Settings) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Settings.ProtoReflect.Descriptor instead.
+func (*Settings) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Settings) GetLocked() bool {
+	if x != nil {
+		return x.Locked
+	}
+	return false
+}
+
+func (x *Settings) GetOn() bool {
+	if x != nil {
+		return x.On
+	}
+	return false
+}
+
+func (x *Settings) GetEcoMode() bool {
+	if x != nil {
+		return x.EcoMode
+	}
+	return false
+}
+
+func (x *Settings) GetHLvl() int32 {
+	if x != nil {
+		return x.HLvl
+	}
+	return 0
+}
+
+func (x *Settings) GetTempSet() int32 {
+	if x != nil {
+		return x.TempSet
+	}
+	return 0
+}
+
+func (x *Settings) GetHighestTempSettingMenuE2() int32 {
+	if x != nil {
+		return x.HighestTempSettingMenuE2
+	}
+	return 0
+}
+
+func (x *Settings) GetLowestTempSettingMenuE1() int32 {
+	if x != nil {
+		return x.LowestTempSettingMenuE1
+	}
+	return 0
+}
+
+func (x *Settings) GetHysteresisMenuE3() int32 {
+	if x != nil {
+		return x.HysteresisMenuE3
+	}
+	return 0
+}
+
+func (x *Settings) GetSoftStartDelayMinMenuE4() int32 {
+	if x != nil {
+		return x.SoftStartDelayMinMenuE4
+	}
+	return 0
+}
+
+func (x *Settings) GetCelsiusFahrenheitModeMenuE5() bool {
+	if x != nil {
+		return x.CelsiusFahrenheitModeMenuE5
+	}
+	return false
+}
+
+func (x *Settings) GetTempCompGteMinus6DegCelsiusMenuE6() int32 {
+	if x != nil {
+		return x.TempCompGteMinus6DegCelsiusMenuE6
+	}
+	return 0
+}
+
+func (x *Settings) GetTempCompGteMinus12DegCelsiusLtMinus6DegCelsiusMenuE7() int32 {
+	if x != nil {
+		return x.TempCompGteMinus12DegCelsiusLtMinus6DegCelsiusMenuE7
+	}
+	return 0
+}
+
+func (x *Settings) GetTempCompLtMinus12DegCelsiusMenuE8() int32 {
+	if x != nil {
+		return x.TempCompLtMinus12DegCelsiusMenuE8
+	}
+	return 0
+}
+
+func (x *Settings) GetTempCompShutdownMenuE9() int32 {
+	if x != nil {
+		return x.TempCompShutdownMenuE9
+	}
+	return 0
+}
+
+// Sensors mirrors k25.Sensors.
+type Sensors struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Temp    int32                  `protobuf:"varint,1,opt,name=temp,proto3" json:"temp,omitempty"`
+	Ub17    int32                  `protobuf:"varint,2,opt,name=ub17,proto3" json:"ub17,omitempty"`
+	InputV1 int32                  `protobuf:"varint,3,opt,name=input_v1,json=inputV1,proto3" json:"input_v1,omitempty"`
+	InputV2 int32                  `protobuf:"varint,4,opt,name=input_v2,json=inputV2,proto3" json:"input_v2,omitempty"`
+	// input_v1 and input_v2 combined
+	InputVoltage  float64 `protobuf:"fixed64,5,opt,name=input_voltage,json=inputVoltage,proto3" json:"input_voltage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Sensors) Reset() {
+	*x = Sensors{}
+	mi := &file_fridge_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Sensors) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Sensors) ProtoMessage() {}
+
+func (x *Sensors) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Sensors.ProtoReflect.Descriptor instead.
+func (*Sensors) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Sensors) GetTemp() int32 {
+	if x != nil {
+		return x.Temp
+	}
+	return 0
+}
+
+func (x *Sensors) GetUb17() int32 {
+	if x != nil {
+		return x.Ub17
+	}
+	return 0
+}
+
+func (x *Sensors) GetInputV1() int32 {
+	if x != nil {
+		return x.InputV1
+	}
+	return 0
+}
+
+func (x *Sensors) GetInputV2() int32 {
+	if x != nil {
+		return x.InputV2
+	}
+	return 0
+}
+
+func (x *Sensors) GetInputVoltage() float64 {
+	if x != nil {
+		return x.InputVoltage
+	}
+	return 0
+}
+
+type Status struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	FridgeId  string                 `protobuf:"bytes,1,opt,name=fridge_id,json=fridgeId,proto3" json:"fridge_id,omitempty"`
+	Connected bool                   `protobuf:"varint,2,opt,name=connected,proto3" json:"connected,omitempty"`
+	Unit      TemperatureUnit        `protobuf:"varint,3,opt,name=unit,proto3,enum=alpicoold.v1.TemperatureUnit" json:"unit,omitempty"`
+	Settings  *Settings              `protobuf:"bytes,4,opt,name=settings,proto3" json:"settings,omitempty"`
+	Sensors   *Sensors               `protobuf:"bytes,5,opt,name=sensors,proto3" json:"sensors,omitempty"`
+	// When the fridge last sent a status report
+	LastUpdate *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=last_update,json=lastUpdate,proto3" json:"last_update,omitempty"`
+	// True once reports have stopped for longer than the daemon's stale_after
+	Stale         bool `protobuf:"varint,7,opt,name=stale,proto3" json:"stale,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Status) Reset() {
+	*x = Status{}
+	mi := &file_fridge_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Status) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Status) ProtoMessage() {}
+
+func (x *Status) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Status.ProtoReflect.Descriptor instead.
+func (*Status) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Status) GetFridgeId() string {
+	if x != nil {
+		return x.FridgeId
+	}
+	return ""
+}
+
+func (x *Status) GetConnected() bool {
+	if x != nil {
+		return x.Connected
+	}
+	return false
+}
+
+func (x *Status) GetUnit() TemperatureUnit {
+	if x != nil {
+		return x.Unit
+	}
+	return TemperatureUnit_TEMPERATURE_UNIT_UNSPECIFIED
+}
+
+func (x *Status) GetSettings() *Settings {
+	if x != nil {
+		return x.Settings
+	}
+	return nil
+}
+
+func (x *Status) GetSensors() *Sensors {
+	if x != nil {
+		return x.Sensors
+	}
+	return nil
+}
+
+func (x *Status) GetLastUpdate() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastUpdate
+	}
+	return nil
+}
+
+func (x *Status) GetStale() bool {
+	if x != nil {
+		return x.Stale
+	}
+	return false
+}
+
+type FridgeInfo struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	FridgeId string                 `protobuf:"bytes,1,opt,name=fridge_id,json=fridgeId,proto3" json:"fridge_id,omitempty"`
+	// Bluetooth address
+	Address       string `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
+	Connected     bool   `protobuf:"varint,3,opt,name=connected,proto3" json:"connected,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FridgeInfo) Reset() {
+	*x = FridgeInfo{}
+	mi := &file_fridge_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FridgeInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FridgeInfo) ProtoMessage() {}
+
+func (x *FridgeInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FridgeInfo.ProtoReflect.Descriptor instead.
+func (*FridgeInfo) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *FridgeInfo) GetFridgeId() string {
+	if x != nil {
+		return x.FridgeId
+	}
+	return ""
+}
+
+func (x *FridgeInfo) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *FridgeInfo) GetConnected() bool {
+	if x != nil {
+		return x.Connected
+	}
+	return false
+}
+
+type ListFridgesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListFridgesRequest) Reset() {
+	*x = ListFridgesRequest{}
+	mi := &file_fridge_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListFridgesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListFridgesRequest) ProtoMessage() {}
+
+func (x *ListFridgesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListFridgesRequest.ProtoReflect.Descriptor instead.
+func (*ListFridgesRequest) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{4}
+}
+
+type ListFridgesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Fridges       []*FridgeInfo          `protobuf:"bytes,1,rep,name=fridges,proto3" json:"fridges,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListFridgesResponse) Reset() {
+	*x = ListFridgesResponse{}
+	mi := &file_fridge_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListFridgesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListFridgesResponse) ProtoMessage() {}
+
+func (x *ListFridgesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListFridgesResponse.ProtoReflect.Descriptor instead.
+func (*ListFridgesResponse) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ListFridgesResponse) GetFridges() []*FridgeInfo {
+	if x != nil {
+		return x.Fridges
+	}
+	return nil
+}
+
+// Requests take an optional fridge_id, empty means the daemon's only fridge.
+type GetStatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FridgeId      string                 `protobuf:"bytes,1,opt,name=fridge_id,json=fridgeId,proto3" json:"fridge_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatusRequest) Reset() {
+	*x = GetStatusRequest{}
+	mi := &file_fridge_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatusRequest) ProtoMessage() {}
+
+func (x *GetStatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatusRequest.ProtoReflect.Descriptor instead.
+func (*GetStatusRequest) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *GetStatusRequest) GetFridgeId() string {
+	if x != nil {
+		return x.FridgeId
+	}
+	return ""
+}
+
+type WatchStatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FridgeId      string                 `protobuf:"bytes,1,opt,name=fridge_id,json=fridgeId,proto3" json:"fridge_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchStatusRequest) Reset() {
+	*x = WatchStatusRequest{}
+	mi := &file_fridge_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchStatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchStatusRequest) ProtoMessage() {}
+
+func (x *WatchStatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchStatusRequest.ProtoReflect.Descriptor instead.
+func (*WatchStatusRequest) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *WatchStatusRequest) GetFridgeId() string {
+	if x != nil {
+		return x.FridgeId
+	}
+	return ""
+}
+
+type UpdateSettingsRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	FridgeId string                 `protobuf:"bytes,1,opt,name=fridge_id,json=fridgeId,proto3" json:"fridge_id,omitempty"`
+	Settings *Settings              `protobuf:"bytes,2,opt,name=settings,proto3" json:"settings,omitempty"`
+	// Settings fields to change, e.g. "on" or "temp_set". Required.
+	UpdateMask    *fieldmaskpb.FieldMask `protobuf:"bytes,3,opt,name=update_mask,json=updateMask,proto3" json:"update_mask,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateSettingsRequest) Reset() {
+	*x = UpdateSettingsRequest{}
+	mi := &file_fridge_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateSettingsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateSettingsRequest) ProtoMessage() {}
+
+func (x *UpdateSettingsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateSettingsRequest.ProtoReflect.Descriptor instead.
+func (*UpdateSettingsRequest) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *UpdateSettingsRequest) GetFridgeId() string {
+	if x != nil {
+		return x.FridgeId
+	}
+	return ""
+}
+
+func (x *UpdateSettingsRequest) GetSettings() *Settings {
+	if x != nil {
+		return x.Settings
+	}
+	return nil
+}
+
+func (x *UpdateSettingsRequest) GetUpdateMask() *fieldmaskpb.FieldMask {
+	if x != nil {
+		return x.UpdateMask
+	}
+	return nil
+}
+
+type SetTemperatureRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FridgeId      string                 `protobuf:"bytes,1,opt,name=fridge_id,json=fridgeId,proto3" json:"fridge_id,omitempty"`
+	Value         float64                `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	Unit          TemperatureUnit        `protobuf:"varint,3,opt,name=unit,proto3,enum=alpicoold.v1.TemperatureUnit" json:"unit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetTemperatureRequest) Reset() {
+	*x = SetTemperatureRequest{}
+	mi := &file_fridge_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetTemperatureRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetTemperatureRequest) ProtoMessage() {}
+
+func (x *SetTemperatureRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetTemperatureRequest.ProtoReflect.Descriptor instead.
+func (*SetTemperatureRequest) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *SetTemperatureRequest) GetFridgeId() string {
+	if x != nil {
+		return x.FridgeId
+	}
+	return ""
+}
+
+func (x *SetTemperatureRequest) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *SetTemperatureRequest) GetUnit() TemperatureUnit {
+	if x != nil {
+		return x.Unit
+	}
+	return TemperatureUnit_TEMPERATURE_UNIT_UNSPECIFIED
+}
+
+// SetTemperatureResponse is the setpoint as sent, in the fridge's units.
+type SetTemperatureResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Value         float64                `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Unit          TemperatureUnit        `protobuf:"varint,2,opt,name=unit,proto3,enum=alpicoold.v1.TemperatureUnit" json:"unit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetTemperatureResponse) Reset() {
+	*x = SetTemperatureResponse{}
+	mi := &file_fridge_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetTemperatureResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetTemperatureResponse) ProtoMessage() {}
+
+func (x *SetTemperatureResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_fridge_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetTemperatureResponse.ProtoReflect.Descriptor instead.
+func (*SetTemperatureResponse) Descriptor() ([]byte, []int) {
+	return file_fridge_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *SetTemperatureResponse) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *SetTemperatureResponse) GetUnit() TemperatureUnit {
+	if x != nil {
+		return x.Unit
+	}
+	return TemperatureUnit_TEMPERATURE_UNIT_UNSPECIFIED
+}
+
+var File_fridge_proto protoreflect.FileDescriptor
+
+const file_fridge_proto_rawDesc = "" +
+	"\n" +
+	"\ffridge.proto\x12\falpicoold.v1\x1a google/protobuf/field_mask.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\x93\x06\n" +
+	"\bSettings\x12\x16\n" +
+	"\x06locked\x18\x01 \x01(\bR\x06locked\x12\x0e\n" +
+	"\x02on\x18\x02 \x01(\bR\x02on\x12\x19\n" +
+	"\beco_mode\x18\x03 \x01(\bR\aecoMode\x12\x13\n" +
+	"\x05h_lvl\x18\x04 \x01(\x05R\x04hLvl\x12\x19\n" +
+	"\btemp_set\x18\x05 \x01(\x05R\atempSet\x12>\n" +
+	"\x1chighest_temp_setting_menu_e2\x18\x06 \x01(\x05R\x18highestTempSettingMenuE2\x12<\n" +
+	"\x1blowest_temp_setting_menu_e1\x18\a \x01(\x05R\x17lowestTempSettingMenuE1\x12,\n" +
+	"\x12hysteresis_menu_e3\x18\b \x01(\x05R\x10hysteresisMenuE3\x12=\n" +
+	"\x1csoft_start_delay_min_menu_e4\x18\t \x01(\x05R\x17softStartDelayMinMenuE4\x12D\n" +
+	"\x1fcelsius_fahrenheit_mode_menu_e5\x18\n" +
+	" \x01(\bR\x1bcelsiusFahrenheitModeMenuE5\x12S\n" +
+	"(temp_comp_gte_minus6_deg_celsius_menu_e6\x18\v \x01(\x05R!tempCompGteMinus6DegCelsiusMenuE6\x12}\n" +
+	"?temp_comp_gte_minus12_deg_celsius_lt_minus6_deg_celsius_menu_e7\x18\f \x01(\x05R4tempCompGteMinus12DegCelsiusLtMinus6DegCelsiusMenuE7\x12S\n" +
+	"(temp_comp_lt_minus12_deg_celsius_menu_e8\x18\r \x01(\x05R!tempCompLtMinus12DegCelsiusMenuE8\x12:\n" +
+	"\x1atemp_comp_shutdown_menu_e9\x18\x0e \x01(\x05R\x16tempCompShutdownMenuE9\"\x8c\x01\n" +
+	"\aSensors\x12\x12\n" +
+	"\x04temp\x18\x01 \x01(\x05R\x04temp\x12\x12\n" +
+	"\x04ub17\x18\x02 \x01(\x05R\x04ub17\x12\x19\n" +
+	"\binput_v1\x18\x03 \x01(\x05R\ainputV1\x12\x19\n" +
+	"\binput_v2\x18\x04 \x01(\x05R\ainputV2\x12#\n" +
+	"\rinput_voltage\x18\x05 \x01(\x01R\finputVoltage\"\xae\x02\n" +
+	"\x06Status\x12\x1b\n" +
+	"\tfridge_id\x18\x01 \x01(\tR\bfridgeId\x12\x1c\n" +
+	"\tconnected\x18\x02 \x01(\bR\tconnected\x121\n" +
+	"\x04unit\x18\x03 \x01(\x0e2\x1d.alpicoold.v1.TemperatureUnitR\x04unit\x122\n" +
+	"\bsettings\x18\x04 \x01(\v2\x16.alpicoold.v1.SettingsR\bsettings\x12/\n" +
+	"\asensors\x18\x05 \x01(\v2\x15.alpicoold.v1.SensorsR\asensors\x12;\n" +
+	"\vlast_update\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"lastUpdate\x12\x14\n" +
+	"\x05stale\x18\a \x01(\bR\x05stale\"a\n" +
+	"\n" +
+	"FridgeInfo\x12\x1b\n" +
+	"\tfridge_id\x18\x01 \x01(\tR\bfridgeId\x12\x18\n" +
+	"\aaddress\x18\x02 \x01(\tR\aaddress\x12\x1c\n" +
+	"\tconnected\x18\x03 \x01(\bR\tconnected\"\x14\n" +
+	"\x12ListFridgesRequest\"I\n" +
+	"\x13ListFridgesResponse\x122\n" +
+	"\afridges\x18\x01 \x03(\v2\x18.alpicoold.v1.FridgeInfoR\afridges\"/\n" +
+	"\x10GetStatusRequest\x12\x1b\n" +
+	"\tfridge_id\x18\x01 \x01(\tR\bfridgeId\"1\n" +
+	"\x12WatchStatusRequest\x12\x1b\n" +
+	"\tfridge_id\x18\x01 \x01(\tR\bfridgeId\"\xa5\x01\n" +
+	"\x15UpdateSettingsRequest\x12\x1b\n" +
+	"\tfridge_id\x18\x01 \x01(\tR\bfridgeId\x122\n" +
+	"\bsettings\x18\x02 \x01(\v2\x16.alpicoold.v1.SettingsR\bsettings\x12;\n" +
+	"\vupdate_mask\x18\x03 \x01(\v2\x1a.google.protobuf.FieldMaskR\n" +
+	"updateMask\"}\n" +
+	"\x15SetTemperatureRequest\x12\x1b\n" +
+	"\tfridge_id\x18\x01 \x01(\tR\bfridgeId\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value\x121\n" +
+	"\x04unit\x18\x03 \x01(\x0e2\x1d.alpicoold.v1.TemperatureUnitR\x04unit\"a\n" +
+	"\x16SetTemperatureResponse\x12\x14\n" +
+	"\x05value\x18\x01 \x01(\x01R\x05value\x121\n" +
+	"\x04unit\x18\x02 \x01(\x0e2\x1d.alpicoold.v1.TemperatureUnitR\x04unit*r\n" +
+	"\x0fTemperatureUnit\x12 \n" +
+	"\x1cTEMPERATURE_UNIT_UNSPECIFIED\x10\x00\x12\x1c\n" +
+	"\x18TEMPERATURE_UNIT_CELSIUS\x10\x01\x12\x1f\n" +
+	"\x1bTEMPERATURE_UNIT_FAHRENHEIT\x10\x022\x94\x03\n" +
+	"\x06Fridge\x12R\n" +
+	"\vListFridges\x12 .alpicoold.v1.ListFridgesRequest\x1a!.alpicoold.v1.ListFridgesResponse\x12A\n" +
+	"\tGetStatus\x12\x1e.alpicoold.v1.GetStatusRequest\x1a\x14.alpicoold.v1.Status\x12G\n" +
+	"\vWatchStatus\x12 .alpicoold.v1.WatchStatusRequest\x1a\x14.alpicoold.v1.Status0\x01\x12M\n" +
+	"\x0eUpdateSettings\x12#.alpicoold.v1.UpdateSettingsRequest\x1a\x16.alpicoold.v1.Settings\x12[\n" +
+	"\x0eSetTemperature\x12#.alpicoold.v1.SetTemperatureRequest\x1a$.alpicoold.v1.SetTemperatureResponseB/Z-github.com/johnelliott/alpicoold/pkg/fridgepbb\x06proto3"
+
+var (
+	file_fridge_proto_rawDescOnce sync.Once
+	file_fridge_proto_rawDescData []byte
+)
+
+func file_fridge_proto_rawDescGZIP() []byte {
+	file_fridge_proto_rawDescOnce.Do(func() {
+		file_fridge_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_fridge_proto_rawDesc), len(file_fridge_proto_rawDesc)))
+	})
+	return file_fridge_proto_rawDescData
+}
+
+var file_fridge_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_fridge_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_fridge_proto_goTypes = []any{
+	(TemperatureUnit)(0),           // 0: alpicoold.v1.TemperatureUnit
+	(*Settings)(nil),               // 1: alpicoold.v1.Settings
+	(*Sensors)(nil),                // 2: alpicoold.v1.Sensors
+	(*Status)(nil),                 // 3: alpicoold.v1.Status
+	(*FridgeInfo)(nil),             // 4: alpicoold.v1.FridgeInfo
+	(*ListFridgesRequest)(nil),     // 5: alpicoold.v1.ListFridgesRequest
+	(*ListFridgesResponse)(nil),    // 6: alpicoold.v1.ListFridgesResponse
+	(*GetStatusRequest)(nil),       // 7: alpicoold.v1.GetStatusRequest
+	(*WatchStatusRequest)(nil),     // 8: alpicoold.v1.WatchStatusRequest
+	(*UpdateSettingsRequest)(nil),  // 9: alpicoold.v1.UpdateSettingsRequest
+	(*SetTemperatureRequest)(nil),  // 10: alpicoold.v1.SetTemperatureRequest
+	(*SetTemperatureResponse)(nil), // 11: alpicoold.v1.SetTemperatureResponse
+	(*timestamppb.Timestamp)(nil),  // 12: google.protobuf.Timestamp
+	(*fieldmaskpb.FieldMask)(nil),  // 13: google.protobuf.FieldMask
+}
+var file_fridge_proto_depIdxs = []int32{
+	0,  // 0: alpicoold.v1.Status.unit:type_name -> alpicoold.v1.TemperatureUnit
+	1,  // 1: alpicoold.v1.Status.settings:type_name -> alpicoold.v1.Settings
+	2,  // 2: alpicoold.v1.Status.sensors:type_name -> alpicoold.v1.Sensors
+	12, // 3: alpicoold.v1.Status.last_update:type_name -> google.protobuf.Timestamp
+	4,  // 4: alpicoold.v1.ListFridgesResponse.fridges:type_name -> alpicoold.v1.FridgeInfo
+	1,  // 5: alpicoold.v1.UpdateSettingsRequest.settings:type_name -> alpicoold.v1.Settings
+	13, // 6: alpicoold.v1.UpdateSettingsRequest.update_mask:type_name -> google.protobuf.FieldMask
+	0,  // 7: alpicoold.v1.SetTemperatureRequest.unit:type_name -> alpicoold.v1.TemperatureUnit
+	0,  // 8: alpicoold.v1.SetTemperatureResponse.unit:type_name -> alpicoold.v1.TemperatureUnit
+	5,  // 9: alpicoold.v1.Fridge.ListFridges:input_type -> alpicoold.v1.ListFridgesRequest
+	7,  // 10: alpicoold.v1.Fridge.GetStatus:input_type -> alpicoold.v1.GetStatusRequest
+	8,  // 11: alpicoold.v1.Fridge.WatchStatus:input_type -> alpicoold.v1.WatchStatusRequest
+	9,  // 12: alpicoold.v1.Fridge.UpdateSettings:input_type -> alpicoold.v1.UpdateSettingsRequest
+	10, // 13: alpicoold.v1.Fridge.SetTemperature:input_type -> alpicoold.v1.SetTemperatureRequest
+	6,  // 14: alpicoold.v1.Fridge.ListFridges:output_type -> alpicoold.v1.ListFridgesResponse
+	3,  // 15: alpicoold.v1.Fridge.GetStatus:output_type -> alpicoold.v1.Status
+	3,  // 16: alpicoold.v1.Fridge.WatchStatus:output_type -> alpicoold.v1.Status
+	1,  // 17: alpicoold.v1.Fridge.UpdateSettings:output_type -> alpicoold.v1.Settings
+	11, // 18: alpicoold.v1.Fridge.SetTemperature:output_type -> alpicoold.v1.SetTemperatureResponse
+	14, // [14:19] is the sub-list for method output_type
+	9,  // [9:14] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_fridge_proto_init() }
+func file_fridge_proto_init() {
+	if File_fridge_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_fridge_proto_rawDesc), len(file_fridge_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_fridge_proto_goTypes,
+		DependencyIndexes: file_fridge_proto_depIdxs,
+		EnumInfos:         file_fridge_proto_enumTypes,
+		MessageInfos:      file_fridge_proto_msgTypes,
+	}.Build()
+	File_fridge_proto = out.File
+	file_fridge_proto_goTypes = nil
+	file_fridge_proto_depIdxs = nil
+}
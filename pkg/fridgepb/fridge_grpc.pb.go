@@ -0,0 +1,291 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.1
+// - protoc             (unknown)
+// source: fridge.proto
+
+package fridgepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Fridge_ListFridges_FullMethodName    = "/alpicoold.v1.Fridge/ListFridges"
+	Fridge_GetStatus_FullMethodName      = "/alpicoold.v1.Fridge/GetStatus"
+	Fridge_WatchStatus_FullMethodName    = "/alpicoold.v1.Fridge/WatchStatus"
+	Fridge_UpdateSettings_FullMethodName = "/alpicoold.v1.Fridge/UpdateSettings"
+	Fridge_SetTemperature_FullMethodName = "/alpicoold.v1.Fridge/SetTemperature"
+)
+
+// FridgeClient is the client API for Fridge service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Fridge controls and watches the fridges a daemon is connected to.
+type FridgeClient interface {
+	// ListFridges lists the fridges this daemon talks to.
+	ListFridges(ctx context.Context, in *ListFridgesRequest, opts ...grpc.CallOption) (*ListFridgesResponse, error)
+	// GetStatus returns the latest status report.
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error)
+	// WatchStatus sends the current status, then every new status report.
+	WatchStatus(ctx context.Context, in *WatchStatusRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Status], error)
+	// UpdateSettings changes the settings named in update_mask.
+	UpdateSettings(ctx context.Context, in *UpdateSettingsRequest, opts ...grpc.CallOption) (*Settings, error)
+	// SetTemperature sets the thermostat, converting units as needed.
+	SetTemperature(ctx context.Context, in *SetTemperatureRequest, opts ...grpc.CallOption) (*SetTemperatureResponse, error)
+}
+
+type fridgeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFridgeClient(cc grpc.ClientConnInterface) FridgeClient {
+	return &fridgeClient{cc}
+}
+
+func (c *fridgeClient) ListFridges(ctx context.Context, in *ListFridgesRequest, opts ...grpc.CallOption) (*ListFridgesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListFridgesResponse)
+	err := c.cc.Invoke(ctx, Fridge_ListFridges_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fridgeClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Status)
+	err := c.cc.Invoke(ctx, Fridge_GetStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fridgeClient) WatchStatus(ctx context.Context, in *WatchStatusRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Status], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Fridge_ServiceDesc.Streams[0], Fridge_WatchStatus_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchStatusRequest, Status]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Fridge_WatchStatusClient = grpc.ServerStreamingClient[Status]
+
+func (c *fridgeClient) UpdateSettings(ctx context.Context, in *UpdateSettingsRequest, opts ...grpc.CallOption) (*Settings, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Settings)
+	err := c.cc.Invoke(ctx, Fridge_UpdateSettings_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fridgeClient) SetTemperature(ctx context.Context, in *SetTemperatureRequest, opts ...grpc.CallOption) (*SetTemperatureResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SetTemperatureResponse)
+	err := c.cc.Invoke(ctx, Fridge_SetTemperature_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FridgeServer is the server API for Fridge service.
+// All implementations must embed UnimplementedFridgeServer
+// for forward compatibility.
+//
+// Fridge controls and watches the fridges a daemon is connected to.
+type FridgeServer interface {
+	// ListFridges lists the fridges this daemon talks to.
+	ListFridges(context.Context, *ListFridgesRequest) (*ListFridgesResponse, error)
+	// GetStatus returns the latest status report.
+	GetStatus(context.Context, *GetStatusRequest) (*Status, error)
+	// WatchStatus sends the current status, then every new status report.
+	WatchStatus(*WatchStatusRequest, grpc.ServerStreamingServer[Status]) error
+	// UpdateSettings changes the settings named in update_mask.
+	UpdateSettings(context.Context, *UpdateSettingsRequest) (*Settings, error)
+	// SetTemperature sets the thermostat, converting units as needed.
+	SetTemperature(context.Context, *SetTemperatureRequest) (*SetTemperatureResponse, error)
+	mustEmbedUnimplementedFridgeServer()
+}
+
+// UnimplementedFridgeServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFridgeServer struct{}
+
+func (UnimplementedFridgeServer) ListFridges(context.Context, *ListFridgesRequest) (*ListFridgesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListFridges not implemented")
+}
+func (UnimplementedFridgeServer) GetStatus(context.Context, *GetStatusRequest) (*Status, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedFridgeServer) WatchStatus(*WatchStatusRequest, grpc.ServerStreamingServer[Status]) error {
+	return status.Error(codes.Unimplemented, "method WatchStatus not implemented")
+}
+func (UnimplementedFridgeServer) UpdateSettings(context.Context, *UpdateSettingsRequest) (*Settings, error) {
+	return nil, status.Error(codes.Unimplemented, "method UpdateSettings not implemented")
+}
+func (UnimplementedFridgeServer) SetTemperature(context.Context, *SetTemperatureRequest) (*SetTemperatureResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method SetTemperature not implemented")
+}
+func (UnimplementedFridgeServer) mustEmbedUnimplementedFridgeServer() {}
+func (UnimplementedFridgeServer) testEmbeddedByValue()                {}
+
+// UnsafeFridgeServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FridgeServer will
+// result in compilation errors.
+type UnsafeFridgeServer interface {
+	mustEmbedUnimplementedFridgeServer()
+}
+
+func RegisterFridgeServer(s grpc.ServiceRegistrar, srv FridgeServer) {
+	// If the following call panics, it indicates UnimplementedFridgeServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Fridge_ServiceDesc, srv)
+}
+
+func _Fridge_ListFridges_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFridgesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FridgeServer).ListFridges(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Fridge_ListFridges_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FridgeServer).ListFridges(ctx, req.(*ListFridgesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Fridge_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FridgeServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Fridge_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FridgeServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Fridge_WatchStatus_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchStatusRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FridgeServer).WatchStatus(m, &grpc.GenericServerStream[WatchStatusRequest, Status]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Fridge_WatchStatusServer = grpc.ServerStreamingServer[Status]
+
+func _Fridge_UpdateSettings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateSettingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FridgeServer).UpdateSettings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Fridge_UpdateSettings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FridgeServer).UpdateSettings(ctx, req.(*UpdateSettingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Fridge_SetTemperature_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetTemperatureRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FridgeServer).SetTemperature(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Fridge_SetTemperature_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FridgeServer).SetTemperature(ctx, req.(*SetTemperatureRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Fridge_ServiceDesc is the grpc.ServiceDesc for Fridge service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Fridge_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "alpicoold.v1.Fridge",
+	HandlerType: (*FridgeServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListFridges",
+			Handler:    _Fridge_ListFridges_Handler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    _Fridge_GetStatus_Handler,
+		},
+		{
+			MethodName: "UpdateSettings",
+			Handler:    _Fridge_UpdateSettings_Handler,
+		},
+		{
+			MethodName: "SetTemperature",
+			Handler:    _Fridge_SetTemperature_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchStatus",
+			Handler:       _Fridge_WatchStatus_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "fridge.proto",
+}
@@ -25,8 +25,8 @@ type Settings struct {
 	EcoMode                     bool // Power efficient mode
 	HLvl                        int8 // Input voltage cutoff level H/M/L
 	TempSet                     int8 // Desired temperature (thermostat)
-	HighestTempSettingMenuE2    int8 // E2: Thermostat setting lower bound
-	LowestTempSettingMenuE1     int8 // E1: Thermostat setting upper bound
+	HighestTempSettingMenuE2    int8 // E2: Thermostat setting upper bound
+	LowestTempSettingMenuE1     int8 // E1: Thermostat setting lower bound
 	HysteresisMenuE3            int8 // E3: Hysteresis i.e. Temp return setting
 	SoftStartDelayMinMenuE4     int8 // E4: Soft on start delay in minutes
 	CelsiusFahrenheitModeMenuE5 bool // E5  Celsius or Fahrenheit mode for fridge
@@ -39,6 +39,23 @@ type Settings struct {
 	TempCompShutdownMenuE9                               int8 // E9: Shutdown? Perhaps a lower bound?
 }
 
+// Validate checks settings make sense before sending them to the fridge
+func (s Settings) Validate() error {
+	if s.LowestTempSettingMenuE1 > s.HighestTempSettingMenuE2 {
+		return fmt.Errorf("Temp minimum > maximum")
+	}
+	if s.TempSet > s.HighestTempSettingMenuE2 {
+		return fmt.Errorf("Temp setting > maximum")
+	}
+	if s.TempSet < s.LowestTempSettingMenuE1 {
+		return fmt.Errorf("Temp setting < minimum")
+	}
+	if s.HLvl < 0 || s.HLvl > 2 {
+		return fmt.Errorf("Voltage cutoff level must be 0 (H), 1 (M) or 2 (L)")
+	}
+	return nil
+}
+
 // PingCommand requests notifications, and is static, so it needs no associated code
 // Command code 1
 var PingCommand = []byte{0xfe, 0xfe, 0x3, 0x1, 0x2, 0x0} // Get back notification state
@@ -260,13 +277,7 @@ func (c *SetStateCommand) Valid() error {
 	if c.Checksum != c.CRC() {
 		return fmt.Errorf("CRC does not validate")
 	}
-	if c.TempSet > c.HighestTempSettingMenuE2 {
-		return fmt.Errorf("Temp setting > maximum")
-	}
-	if c.TempSet < c.LowestTempSettingMenuE1 {
-		return fmt.Errorf("Temp setting < minimum")
-	}
-	return nil
+	return c.Settings.Validate()
 }
 
 // MarshalBinary serializes a state set command
@@ -87,8 +87,8 @@ func TestSetTempCommand(t *testing.T) {
 				EcoMode:                           true,
 				HLvl:                              1,
 				TempSet:                           67,
-				LowestTempSettingMenuE1:           68,
-				HighestTempSettingMenuE2:          -4,
+				LowestTempSettingMenuE1:           -4,
+				HighestTempSettingMenuE2:          68,
 				HysteresisMenuE3:                  4,
 				SoftStartDelayMinMenuE4:           0,
 				CelsiusFahrenheitModeMenuE5:       true,
@@ -117,8 +117,8 @@ func TestSetTempCommand(t *testing.T) {
 				EcoMode:                           true,
 				HLvl:                              1,
 				TempSet:                           0x43,
-				LowestTempSettingMenuE1:           0x44,
-				HighestTempSettingMenuE2:          -4,
+				LowestTempSettingMenuE1:           -4,
+				HighestTempSettingMenuE2:          0x44,
 				HysteresisMenuE3:                  0x04,
 				SoftStartDelayMinMenuE4:           0x00,
 				CelsiusFahrenheitModeMenuE5:       true,
@@ -155,8 +155,8 @@ func TestSetStateCommand(t *testing.T) {
 			EcoMode:                           true,
 			HLvl:                              1,
 			TempSet:                           0x43,
-			LowestTempSettingMenuE1:           0x44,
-			HighestTempSettingMenuE2:          -4,
+			LowestTempSettingMenuE1:           -4,
+			HighestTempSettingMenuE2:          0x44,
 			HysteresisMenuE3:                  0x04,
 			SoftStartDelayMinMenuE4:           0x00,
 			CelsiusFahrenheitModeMenuE5:       true,